@@ -0,0 +1,127 @@
+// Tracing the access decisions for one code, for when someone asks "why
+// exactly was I denied at 22:05". The log only has the outcome; with a
+// trace, each check AuthUser() makes for the code is recorded with the
+// values it looked at, e.g.
+//
+//	curl -d code-hash=<hash from the users file> http://localhost:<httpport>/api/trace
+//
+// (or code=<code>; POST, so that it doesn't end up in access logs). The
+// steps are logged and the last few traces shown at GET /api/trace. Off by
+// default, and only ever for one code, so the log isn't flooded.
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const accessTraceSize = 20
+
+type AccessTraceStep struct {
+	Step   string `json:"step"` // suspended, validity, hours, ...
+	Passed bool   `json:"passed"`
+	Values string `json:"values"` // What it looked at.
+}
+
+// The steps of one decision.
+type AccessTrace struct {
+	Time    time.Time         `json:"time"`
+	Target  Target            `json:"target"`
+	Steps   []AccessTraceStep `json:"steps"`
+	Granted bool              `json:"granted"`
+	Reason  string            `json:"reason"`
+}
+
+// Record a step. Fine to call on a nil trace, for codes not traced.
+func (t *AccessTrace) Step(step string, passed bool, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, AccessTraceStep{
+		Step:   step,
+		Passed: passed,
+		Values: fmt.Sprintf(format, args...),
+	})
+}
+
+// The step that denied access; nil if all passed.
+func (t *AccessTrace) Decisive() *AccessTraceStep {
+	for i := range t.Steps {
+		if !t.Steps[i].Passed {
+			return &t.Steps[i]
+		}
+	}
+	return nil
+}
+
+type AccessTracer struct {
+	lock     sync.Mutex
+	codeHash string        // Traced code; empty for none.
+	traces   []AccessTrace // Last accessTraceSize, oldest first.
+}
+
+func NewAccessTracer() *AccessTracer {
+	return &AccessTracer{}
+}
+
+// Trace decisions for the code with the given hash, as in the users file
+// (see hashAuthCode()); empty to stop. Earlier traces are dropped.
+func (t *AccessTracer) Trace(codeHash string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.codeHash = codeHash
+	t.traces = nil
+}
+
+func (t *AccessTracer) CodeHash() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.codeHash
+}
+
+// A trace for a decision about the code, or nil if it isn't traced. Fine
+// to call on a nil AccessTracer.
+func (t *AccessTracer) start(code string, target Target, now time.Time) *AccessTrace {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.codeHash == "" || hashAuthCode(code) != t.codeHash {
+		return nil
+	}
+	return &AccessTrace{Time: now, Target: target}
+}
+
+// Log the trace with its decision and keep it.
+func (t *AccessTracer) finish(trace *AccessTrace, decision AuthDecision) {
+	if trace == nil {
+		return
+	}
+	trace.Granted = decision.Granted
+	trace.Reason = decision.Reason.String()
+	for _, step := range trace.Steps {
+		result := "passed"
+		if !step.Passed {
+			result = "FAILED"
+		}
+		log.Printf("Trace %s: %s %s (%s)", trace.Target, step.Step, result, step.Values)
+	}
+	log.Printf("Trace %s: granted=%t reason=%s", trace.Target, trace.Granted, trace.Reason)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.traces = append(t.traces, *trace)
+	if len(t.traces) > accessTraceSize {
+		t.traces = t.traces[len(t.traces)-accessTraceSize:]
+	}
+}
+
+// The last traces, oldest first.
+func (t *AccessTracer) Traces() []AccessTrace {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]AccessTrace{}, t.traces...)
+}
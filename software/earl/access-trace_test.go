@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTraceShowsDecisiveStep(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "trace-tests")
+	mockClock := &MockClock{now: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth.tracer = NewAccessTracer()
+	u := User{Name: "Jon Doe", ContactInfo: "jon@nb", UserLevel: LevelUser}
+	u.SetAuthCode("user123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	mockClock.now = mockClock.now.Add(time.Minute)
+
+	auth.AuthUser("user123", TargetUpstairs)
+	ExpectTrue(t, len(auth.tracer.Traces()) == 0, "Not traced by default")
+
+	auth.tracer.Trace(hashAuthCode("user123"))
+	auth.AuthUser("root123", TargetUpstairs)
+	ExpectTrue(t, len(auth.tracer.Traces()) == 0, "Only the traced code")
+
+	auth.AuthUser("user123", TargetUpstairs)
+	mockClock.now = time.Date(2024, 5, 1, 22, 5, 0, 0, time.UTC)
+	auth.AuthUser("user123", TargetUpstairs)
+	traces := auth.tracer.Traces()
+	if len(traces) != 2 {
+		t.Fatalf("Expected 2 traces, got %d", len(traces))
+	}
+	ExpectTrue(t, traces[0].Granted && traces[0].Decisive() == nil, "Granted at 13:00")
+
+	denied := traces[1]
+	ExpectTrue(t, !denied.Granted && denied.Reason == "outside-daytime", "Denied at 22:05")
+	step := denied.Decisive()
+	if step == nil || step.Step != "hours" {
+		t.Fatalf("Expected hours to be decisive, got %v", denied.Steps)
+	}
+	ExpectTrue(t, strings.Contains(step.Values, "11:00..22:00") &&
+		strings.Contains(step.Values, "now=22:05"), "Values: "+step.Values)
+	for _, step := range denied.Steps[:len(denied.Steps)-1] {
+		ExpectTrue(t, step.Passed, "Earlier steps passed: "+step.Step)
+	}
+
+	auth.tracer.Trace("")
+	auth.AuthUser("user123", TargetUpstairs)
+	ExpectTrue(t, len(auth.tracer.Traces()) == 0, "Stopped")
+}
+
+func TestTraceApi(t *testing.T) {
+	tracer := NewAccessTracer()
+	api := &ApiServer{tracer: tracer}
+	post := func(form url.Values) JsonTrace {
+		req := httptest.NewRequest("POST", "/api/trace",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, req)
+		var result JsonTrace
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return result
+	}
+	ExpectTrue(t, post(url.Values{"code": {"ABCD1234"}}).Tracing, "Tracing")
+	ExpectTrue(t, tracer.CodeHash() == hashAuthCode("abcd1234"), "Normalized card")
+	ExpectTrue(t, post(url.Values{"code-hash": {"0123abcd"}}).Tracing, "By hash")
+	ExpectTrue(t, tracer.CodeHash() == "0123abcd", "Hash as given")
+	ExpectFalse(t, post(url.Values{}).Tracing, "Stopped")
+}
@@ -5,13 +5,33 @@
 // appropriate (by sending events to the subsytems that do that).
 // Also user-feedback with LEDs and feedback tones.
 // Each entrance has its own independent instance running.
+//
+// A terminal can control more than one door (e.g. an inner and an outer
+// gate). The user gets whichever of these they may access; if that is more
+// than one, they choose with a single digit on the keypad, or '#' for all.
+//
+// For high-security rooms, a card alone can be made to not open the door:
+// after a valid swipe, the user has to press '#' within a few seconds to
+// enter (confirmRFID). So a card brushing past the reader, or relayed from
+// far away, doesn't open it.
+//
+// If the RFID reader fails, members can still get in with keypad fallback:
+// the number printed on their card is typed on the keypad (see
+// authorizeKeypadAsCard()). Card numbers are easy to guess, so after a few
+// unknown keypad codes they are not accepted for a while.
+//
+// While the terminal is in maintenance (see maintenance.go), RFID and
+// keypad are ignored and no door is opened.
 package main
 
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,95 +39,257 @@ type AccessHandler struct {
 	backends *Backends
 	clock    Clock
 
-	t Terminal // Our terminal we can do operations on
+	// Configuration
+	target          Target        // Ours. Empty: the terminal's name.
+	strikeDuration  time.Duration // How long to open door. 0: default.
+	welcomeDuration time.Duration // How long to show welcome on grant.
+	expiryWarning   time.Duration // Show time left if expiring within.
+	keypadTimeout   time.Duration // Discard partial keypad input after.
+	proppedReminder time.Duration // Remind while propped open. 0: don't.
+	feedback        FeedbackProfile
+	doors           []Target // Doors we open. Empty: just the terminal's.
+	keypadFallback  bool     // Keypad codes may be card numbers.
+	outsideHours    string   // OutsideHours* policy. Empty: default.
+	cardOverlap     string   // CardOverlap* policy. Empty: default.
+	confirmRFID     bool     // Cards need '#' on the keypad to open.
+
+	t       Terminal     // Our terminal we can do operations on
+	display DisplayState // Restored on reconnect.
+
+	// What to do once access is granted. Default: open the door.
+	grantAction func(user *User, target Target)
 
 	// Current state
-	currentCode        string    // PIN typed so far on keypad
-	lastKeypressTime   time.Time // Last touch of key to reset
-	currentRFID        string    // Current RFID we received
-	nextRFIDActionTime time.Time // Time we have seen the current RFID
+	currentCode      string         // PIN typed so far on keypad
+	lastKeypressTime time.Time      // Last touch of key to reset
+	rfidDebouncer    *RFIDDebouncer // Act only once on a card held.
 
 	colorShown   bool
 	colorOffTime time.Time
+
+	messageShown   bool
+	messageOffTime time.Time
+
+	// The user last granted is let in on grace; the welcome asks them
+	// to renew.
+	renewalDue bool
+
+	// Door propped open; reminding until it is closed.
+	doorPropped      bool
+	nextPropReminder time.Time
+
+	// While the user chooses between several doors.
+	selectableDoors      []Target
+	selectingUser        *User
+	doorSelectionEndTime time.Time
+
+	// After a swipe, while waiting for '#' to open (see confirmRFID).
+	confirmingUser *User
+	confirmDoor    Target
+	confirmEndTime time.Time
+
+	// Recent unknown keypad codes, to throttle keypad fallback.
+	keypadFailures []time.Time
 }
 
 const (
-	kRFIDRepeatDebounce = 300 * time.Millisecond // RFID is repeated. Pace down.
-	kKeypadTimeout      = 30 * time.Second       // Timeout: user stopped typing
+	kRFIDRemovedGap       = 1 * time.Second  // RFID not repeated: removed.
+	kKeypadTimeout        = 30 * time.Second // Timeout: user stopped typing
+	kWelcomeTime          = 2 * time.Second  // Green light and welcome message
+	kDoorSelectionTimeout = 15 * time.Second // Time to choose door.
+	kConfirmTimeout       = 3 * time.Second  // Time to confirm a swipe.
+	kExpiryWarning        = 7 * 24 * time.Hour
+	kKeypadCardAttempts   = 5                // Unknown keypad codes within
+	kKeypadCardWindow     = 10 * time.Minute // this stop card numbers.
+)
+
+// What to do when a known user shows up outside their hours.
+const (
+	// Ring the doorbell with their name, so whoever is in the space can
+	// let them in. The default.
+	OutsideHoursDoorbell = "doorbell"
+
+	// Just deny, like any other denial. For spaces where nobody should be
+	// bothered at night.
+	OutsideHoursDeny = "deny"
+)
+
+// What to do with a second card presented while the first is still held.
+const (
+	// Stay with the first card let in until it is removed; ignore others
+	// meanwhile. The default.
+	CardOverlapFirst = "first"
+
+	// Act on each card as it comes, as readers that never see two cards
+	// at once might prefer.
+	CardOverlapEach = "each"
 )
 
+func validCardOverlapPolicy(policy string) error {
+	switch policy {
+	case "", CardOverlapFirst, CardOverlapEach:
+		return nil
+	}
+	return fmt.Errorf("unknown card-overlap policy '%s'; one of '%s', '%s'",
+		policy, CardOverlapFirst, CardOverlapEach)
+}
+
+func validOutsideHoursPolicy(policy string) error {
+	switch policy {
+	case "", OutsideHoursDoorbell, OutsideHoursDeny:
+		return nil
+	}
+	return fmt.Errorf("unknown outside-hours policy '%s'; one of '%s', '%s'",
+		policy, OutsideHoursDoorbell, OutsideHoursDeny)
+}
+
 func NewAccessHandler(backends *Backends) *AccessHandler {
-	return &AccessHandler{
-		backends: backends,
-		clock:    RealClock{}}
+	h := &AccessHandler{
+		backends:        backends,
+		clock:           RealClock{},
+		keypadTimeout:   kKeypadTimeout,
+		welcomeDuration: kWelcomeTime,
+		expiryWarning:   kExpiryWarning,
+		feedback:        DefaultFeedbackProfile(),
+		rfidDebouncer:   NewRFIDDebouncer(kRFIDRemovedGap),
+	}
+	h.grantAction = h.openDoor
+	return h
 }
 
 func (h *AccessHandler) Init(t Terminal) {
-	h.t = t
+	h.display.Attach(t)
+	h.t = &h.display
+	if h.inMaintenance() {
+		h.showMaintenance()
+	}
 }
 func (h *AccessHandler) HandleShutdown() {}
 
+// The admins are told (see handleSerialDevice); nothing to show at the
+// door.
+func (h *AccessHandler) HandlePowerStatus(ok bool) {}
+
 func (h *AccessHandler) HandleKeypress(b byte) {
+	if key, ok := StandardKeypad.Key(b); ok {
+		h.HandleKey(key)
+	}
+}
+
+func (h *AccessHandler) HandleKey(key Key) {
+	if h.inMaintenance() {
+		return
+	}
 	h.lastKeypressTime = h.clock.Now()
-	switch b {
-	case '#':
+	if h.confirmingUser != nil {
+		h.confirmEntry(key)
+		return
+	}
+	if len(h.selectableDoors) > 0 {
+		h.selectDoor(key)
+		return
+	}
+	switch key.Type {
+	case KeyEnter:
+		// Only check complete codes: a code can be the prefix of
+		// another (see hasMinimalCodeRequirements()).
 		if h.currentCode != "" {
 			h.checkAccess(h.currentCode, "keypad")
 			h.currentCode = ""
 		} else {
 			// As long as we don't have a 4x4 keypad, we
 			// use the single '#' to be the doorbell.
+			h.giveFeedback(FeedbackDoorbell)
 			h.backends.appEventBus.Post(&AppEvent{
 				Ev:     AppDoorbellTriggerEvent,
-				Target: Target(h.t.GetTerminalName()),
+				Target: h.ourTarget(),
 				Source: h.t.GetTerminalName(),
-				Msg:    "doorbell",
+				Value:  DoorbellButton,
 			})
 		}
-	case '*':
+	case KeyClear:
 		h.currentCode = "" // reset
-	default:
-		h.currentCode += string(b)
+	case KeyDigit:
+		h.currentCode += string(key.Digit)
 	}
 }
 
 func (h *AccessHandler) HandleRFID(rfid string) {
-	// The reader might send IDs faster than we can checkAccess()
-	// which is problematic, as checkAccess() blocks the event thread.
-	// If we get the same ID again, ignore until nextRFIDActionTime
-	if rfid == h.currentRFID && h.clock.Now().Before(h.nextRFIDActionTime) {
+	if h.inMaintenance() {
+		return
+	}
+	rfid = NormalizeRFID(rfid)
+	// The reader repeats the ID as long as the card is held. Only act
+	// once, otherwise we'd open the door multiple times and also block
+	// the event thread with repeated checkAccess().
+	if !h.rfidDebouncer.ShouldHandle(rfid, h.clock.Now()) {
 		return
 	}
 
-	h.checkAccess(rfid, "RFID")
-	h.currentRFID = rfid
-	h.nextRFIDActionTime = h.clock.Now().Add(kRFIDRepeatDebounce)
+	if h.checkAccess(rfid, "RFID") && h.cardOverlap != CardOverlapEach {
+		h.rfidDebouncer.Hold(rfid, h.clock.Now())
+	}
 }
 
 func (h *AccessHandler) HandleAppEvent(event *AppEvent) {
 	switch event.Ev {
 	case AppOpenRequest:
-		// This happens either because we triggered it ourselves,
-		// or has been triggered elsewhere, e.g. someone triggered
-		// the gate-buzzer button - in that case, we also show green
-		// on the respective terminal, making it a round experience.
-		if event.Target == Target(h.t.GetTerminalName()) {
-			h.setColorForTime("G", 2000*time.Millisecond)
+		// If triggered elsewhere, e.g. someone triggered the
+		// gate-buzzer button, we also show green on the respective
+		// terminal, making it a round experience. If we triggered it
+		// ourselves, we already show the welcome.
+		if h.isOurDoor(event.Target) &&
+			event.Source != h.t.GetTerminalName() {
+			h.giveFeedback(FeedbackRemoteOpen)
+		}
+	case AppMaintenanceChanged:
+		if event.Target != h.ourTarget() {
+			break
+		}
+		if event.Value != 0 {
+			h.showMaintenance()
+		} else {
+			h.t.WriteLCDLines([]string{"", ""})
+		}
+	case AppDoorPropped:
+		if h.isOurDoor(event.Target) {
+			h.doorPropped = event.Value != 0
+			h.nextPropReminder = h.clock.Now() // Right away.
+		}
+	case AppDoorSensorEvent:
+		if h.isOurDoor(event.Target) && event.Value == 0 {
+			h.doorPropped = false // Closed; no need to wait for the all-clear.
 		}
 	}
 }
 
 func (h *AccessHandler) HandleTick() {
 	now := h.clock.Now()
+	if len(h.selectableDoors) > 0 && now.After(h.doorSelectionEndTime) {
+		h.endDoorSelection()
+		h.giveFeedback(FeedbackTimeout)
+	}
+	if h.confirmingUser != nil && now.After(h.confirmEndTime) {
+		h.endConfirmation()
+		h.giveFeedback(FeedbackTimeout)
+	}
 	// Keypad got a partial code, but never finished with '#'
-	if now.Sub(h.lastKeypressTime) > kKeypadTimeout && h.currentCode != "" {
+	if now.Sub(h.lastKeypressTime) > h.keypadTimeout && h.currentCode != "" {
 		h.currentCode = ""
-		h.t.BuzzSpeaker("L", 500) // indicate timeout
+		h.giveFeedback(FeedbackTimeout)
 	}
 	if h.colorShown && now.After(h.colorOffTime) {
-		h.t.ShowColor("")
+		h.t.ShowColor(ColorOff)
 		h.colorShown = false
 	}
+	if h.messageShown && now.After(h.messageOffTime) {
+		h.t.WriteLCDLines([]string{"", ""})
+		h.messageShown = false
+	}
+	if h.doorPropped && h.proppedReminder > 0 && !now.Before(h.nextPropReminder) {
+		h.giveFeedback(FeedbackPropped)
+		h.nextPropReminder = now.Add(h.proppedReminder)
+	}
 }
 
 // Hashing a value in a way that we can't recover the content of the value,
@@ -124,28 +306,91 @@ func (h *AccessHandler) setColorForTime(color string, duration time.Duration) {
 	h.colorOffTime = h.clock.Now().Add(duration)
 }
 
-func (h *AccessHandler) checkAccess(code string, fyi_origin string) {
+// Show color and play tone configured for the event.
+func (h *AccessHandler) giveFeedback(event FeedbackEvent) {
+	h.feedbackColor(event, 0)
+	h.feedbackTone(event)
+}
+
+// Show the color for the event. If the profile doesn't say for how long,
+// show it for defaultDuration.
+func (h *AccessHandler) feedbackColor(event FeedbackEvent, defaultDuration time.Duration) {
+	feedback := h.feedback[event]
+	if feedback.Color == "" {
+		return
+	}
+	duration := time.Duration(feedback.ColorDuration)
+	if duration == 0 {
+		duration = defaultDuration
+	}
+	h.setColorForTime(feedback.Color, duration)
+}
+
+func (h *AccessHandler) feedbackTone(event FeedbackEvent) {
+	feedback := h.feedback[event]
+	if feedback.Tone != "" {
+		h.t.BuzzSpeaker(feedback.Tone, time.Duration(feedback.ToneDuration))
+	}
+}
+
+// Show a message on the LCD (if the terminal has one) for a while.
+func (h *AccessHandler) showMessageForTime(line0, line1 string, duration time.Duration) {
+	h.t.WriteLCDLines([]string{line0, line1})
+	h.messageShown = true
+	h.messageOffTime = h.clock.Now().Add(duration)
+}
+
+// Returns true if access was granted.
+func (h *AccessHandler) checkAccess(code string, fyi_origin string) bool {
 	// Don't bother with too short codes. In particular, don't buzz
 	// or flash lights to not to seem overly interactive.
 	if !hasMinimalCodeRequirements(code) {
-		return
+		return false
 	}
-	target := Target(h.t.GetTerminalName())
-	user := h.backends.authenticator.FindUser(code)
-	auth_result, msg := h.backends.authenticator.AuthUser(code, target)
-	if user != nil && auth_result == AuthOk {
-		h.t.BuzzSpeaker("H", 500)
-		// Be sparse, don't log user, but keep track of level.
-		log.Printf("%s: granted. %s Type=%s",
-			target, fyi_origin, user.UserLevel)
+	target := h.ourTarget()
+	decision, doors := h.authorizeDoors(code)
+	if !decision.Granted && decision.Reason == ReasonUnknownCode &&
+		fyi_origin == "keypad" && h.keypadFallback {
+		if h.keypadCardThrottled() {
+			log.Printf("%s: too many unknown keypad codes, no card numbers for now",
+				target)
+		} else if cardDecision, cardDoors, ok := h.authorizeKeypadAsCard(code); ok {
+			decision, doors = cardDecision, cardDoors
+			fyi_origin = "keypad-card"
+		}
+		if decision.Reason == ReasonUnknownCode {
+			h.keypadFailures = append(h.keypadFailures, h.clock.Now())
+		}
+	}
+	h.backends.recentAccess.Record(target, code, fyi_origin, decision)
+	user := decision.User
+	if decision.Duress {
+		// Whoever is forcing them is watching: the terminal must
+		// behave exactly as for the regular code.
+		h.raiseDuress(user, target)
+	}
+	h.renewalDue = decision.RenewalDue
+	if decision.RenewalDue {
 		h.backends.appEventBus.Post(&AppEvent{
-			Ev:     AppOpenRequest,
+			Ev:     AppRenewalDue,
 			Target: target,
 			Source: h.t.GetTerminalName(),
-			Msg:    "Opening for " + string(user.UserLevel),
+			Msg:    user.Name,
 		})
-		// Note, this will automatically trigger the green LED as
-		// we subsequently receive the AppOpenRequest ourselves.
+	}
+	if decision.Granted {
+		h.feedbackTone(FeedbackGranted)
+		// Be sparse, don't log user, but keep track of level.
+		log.Printf("%s: granted. %s Type=%s",
+			target, fyi_origin, user.UserLevel)
+		switch {
+		case len(doors) == 1 && h.confirmRFID && fyi_origin == "RFID":
+			h.startConfirmation(user, doors[0])
+		case len(doors) == 1:
+			h.admit(user, doors)
+		default:
+			h.startDoorSelection(user, doors)
+		}
 	} else {
 		// This is either an invalid RFID (or used outside the
 		// validity), or a PIN-code, which is not valid for user
@@ -155,23 +400,286 @@ func (h *AccessHandler) checkAccess(code string, fyi_origin string) {
 		// to create a reverse table), but can see patterns when the
 		// same thing happens multiple times.
 		log.Printf("%s: denied. %s | %s (%s)",
-			target, msg, fyi_origin, scrubLogValue(code))
-		if auth_result == AuthFail {
-			h.setColorForTime("R", 500*time.Millisecond)
-		} else {
-			// Show blue (='nighttime') for authentication that is
-			// just failing due to be outside daytime (or expired).
-			// Better than otherwise confusing 'red' feeback.
-			h.setColorForTime("B", 1000*time.Millisecond)
-			// Trigger doorbell artificially. Usually if
-			// someone is in the space, they might open the door.
-			h.backends.appEventBus.Post(&AppEvent{
-				Ev:     AppDoorbellTriggerEvent,
-				Target: target,
-				Source: h.t.GetTerminalName(),
-				Msg:    user.Name + " nightbell.",
-			})
+			target, decision.Detail, fyi_origin, scrubLogValue(code))
+		// Others might want to know if someone keeps trying.
+		h.backends.appEventBus.Post(&AppEvent{
+			Ev:     AppAccessDenied,
+			Target: target,
+			Source: h.t.GetTerminalName(),
+			Msg:    decision.Reason.String(),
+			Value:  int(decision.Reason),
+		})
+		// Let the user know why, instead of just blinking at them.
+		h.showMessageForTime("Access denied",
+			decision.Reason.DisplayMessage(), 2000*time.Millisecond)
+		switch decision.Reason {
+		case ReasonOutsideDaytime:
+			h.giveFeedback(FeedbackLocked)
+			if h.outsideHours != OutsideHoursDeny {
+				h.ringForUser(user, target, DoorbellOutsideHours)
+			}
+		case ReasonExpired:
+			h.giveFeedback(FeedbackLocked)
+			h.ringForUser(user, target, DoorbellExpired)
+		case ReasonUnknownCode:
+			h.giveFeedback(FeedbackUnknown)
+		default:
+			h.giveFeedback(FeedbackDenied)
+		}
+	}
+	return decision.Granted
+}
+
+// Silently alert the admins that someone is forced to open the door.
+func (h *AccessHandler) raiseDuress(user *User, target Target) {
+	log.Printf("%s: DURESS code of '%s' used", target, user.Name)
+	h.backends.appEventBus.Post(&AppEvent{
+		Ev:     AppDuress,
+		Target: target,
+		Source: h.t.GetTerminalName(),
+		Msg:    user.Name,
+	})
+}
+
+// Trigger doorbell artificially for a known user that can't get in.
+// Usually if someone is in the space, they might open the door; tell them
+// who is waiting.
+func (h *AccessHandler) ringForUser(user *User, target Target, why int) {
+	doorbell := &AppEvent{
+		Ev:     AppDoorbellTriggerEvent,
+		Target: target,
+		Source: h.t.GetTerminalName(),
+		Value:  why,
+	}
+	if user != nil {
+		doorbell.Msg = user.Name
+	}
+	h.backends.appEventBus.Post(doorbell)
+}
+
+// The target as configured, or as the terminal's name says; the name in
+// the normalized form the schedules, levels and pins are configured with.
+func (h *AccessHandler) ourTarget() Target {
+	if h.target == "" {
+		target, _ := TargetForTerminalName(h.t.GetTerminalName())
+		return target
+	}
+	return h.target
+}
+
+func (h *AccessHandler) inMaintenance() bool {
+	return h.backends.maintenance.Active(h.ourTarget())
+}
+
+// Drop whatever was going on; the screen stays until maintenance ends.
+func (h *AccessHandler) showMaintenance() {
+	h.currentCode = ""
+	h.selectableDoors = nil
+	h.selectingUser = nil
+	h.confirmingUser = nil
+	h.messageShown = false
+	h.colorShown = false
+	h.t.ShowColor(ColorOff)
+	h.t.WriteLCDLines([]string{"Out of service", "Maintenance"})
+}
+
+// The doors this terminal opens.
+func (h *AccessHandler) ourDoors() []Target {
+	if len(h.doors) == 0 {
+		return []Target{h.ourTarget()}
+	}
+	return h.doors
+}
+
+func (h *AccessHandler) isOurDoor(target Target) bool {
+	for _, door := range h.ourDoors() {
+		if door == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask for access at each of our doors. Returns the decision and the doors
+// granted. If none is, the decision is the denial for the first door.
+// Only checks: the access is recorded by admit() once a door opens.
+func (h *AccessHandler) authorizeDoors(code string) (AuthDecision, []Target) {
+	var result AuthDecision
+	var granted []Target
+	for i, door := range h.ourDoors() {
+		decision := h.backends.authenticator.CheckCode(code, door)
+		if decision.Granted {
+			if len(granted) == 0 {
+				result = decision
+			}
+			granted = append(granted, door)
+		} else if i == 0 {
+			result = decision
+		}
+	}
+	return result, granted
+}
+
+// Keypad fallback: with a broken reader, members can type the number of
+// their card instead. Only works for cards of our own facilities, as these
+// are enrolled by card number (see wiegand.go); short numbers are typed
+// with leading zeros. Returns ok=false if the code isn't a member's card
+// number.
+func (h *AccessHandler) authorizeKeypadAsCard(code string) (AuthDecision, []Target, bool) {
+	card, err := strconv.Atoi(code)
+	if err != nil || card < 0 {
+		return AuthDecision{}, nil, false
+	}
+	cardCode := facilityScopedCode(card)
+	// Printed on the card, so weaker than a PIN: members only.
+	check := h.backends.authenticator.CheckCode(cardCode, h.ourDoors()[0])
+	if check.User == nil || check.User.UserLevel != LevelMember {
+		return AuthDecision{}, nil, false
+	}
+	decision, doors := h.authorizeDoors(cardCode)
+	return decision, doors, true
+}
+
+// Whether there were too many unknown keypad codes lately to still accept
+// card numbers, which are much easier to guess than PINs.
+func (h *AccessHandler) keypadCardThrottled() bool {
+	now := h.clock.Now()
+	recent := []time.Time{}
+	for _, t := range h.keypadFailures {
+		if now.Sub(t) < kKeypadCardWindow {
+			recent = append(recent, t)
 		}
-		h.t.BuzzSpeaker("L", 200)
 	}
+	h.keypadFailures = recent
+	return len(recent) >= kKeypadCardAttempts
+}
+
+// The user gets in through the given doors, as decided by
+// authorizeDoors(). The access is recorded once (last access, daily
+// entries), however many doors open.
+func (h *AccessHandler) admit(user *User, doors []Target) {
+	for _, door := range doors {
+		h.grantAction(user, door)
+	}
+	h.backends.authenticator.RecordAccess(user, doors[0])
+}
+
+func (h *AccessHandler) startDoorSelection(user *User, doors []Target) {
+	h.selectableDoors = doors
+	h.selectingUser = user
+	h.doorSelectionEndTime = h.clock.Now().Add(kDoorSelectionTimeout)
+	var choices []string
+	for i, door := range doors {
+		choices = append(choices, fmt.Sprintf("%d:%s", i+1, door))
+	}
+	h.showMessageForTime("Select door, # all", strings.Join(choices, " "),
+		kDoorSelectionTimeout)
+}
+
+// Keypress while selecting: a door number, '#' for all, or '*' to cancel.
+func (h *AccessHandler) selectDoor(key Key) {
+	doors, user := h.selectableDoors, h.selectingUser
+	switch {
+	case key.Type == KeyClear:
+		h.endDoorSelection()
+	case key.Type == KeyEnter:
+		h.endDoorSelection()
+		h.admit(user, doors)
+	case key.Digit >= '1' && int(key.Digit-'1') < len(doors):
+		h.endDoorSelection()
+		h.admit(user, doors[key.Digit-'1':key.Digit-'1'+1])
+	default:
+		h.giveFeedback(FeedbackDenied)
+	}
+}
+
+func (h *AccessHandler) endDoorSelection() {
+	h.selectableDoors = nil
+	h.selectingUser = nil
+	h.t.WriteLCDLines([]string{"", ""})
+	h.messageShown = false
+}
+
+// A valid card was shown; the door only opens once the user presses '#'.
+// Choosing between several doors already needs the keypad, so this is only
+// for a single door.
+func (h *AccessHandler) startConfirmation(user *User, door Target) {
+	h.confirmingUser = user
+	h.confirmDoor = door
+	h.confirmEndTime = h.clock.Now().Add(kConfirmTimeout)
+	h.showMessageForTime("Press # to enter", "", kConfirmTimeout)
+}
+
+// Keypress while waiting for confirmation: '#' opens, anything else
+// cancels.
+func (h *AccessHandler) confirmEntry(key Key) {
+	user, door := h.confirmingUser, h.confirmDoor
+	h.endConfirmation()
+	if key.Type == KeyEnter {
+		h.admit(user, []Target{door})
+	}
+}
+
+func (h *AccessHandler) endConfirmation() {
+	h.confirmingUser = nil
+	h.t.WriteLCDLines([]string{"", ""})
+	h.messageShown = false
+}
+
+// After access is granted, we show a welcome on the terminal for
+// welcomeDuration and, independently, open the door for strikeDuration. Both
+// are switched off again by the GPIO actions or HandleTick(), so we never
+// block here.
+func (h *AccessHandler) openDoor(user *User, target Target) {
+	if h.inMaintenance() {
+		log.Printf("%s: in maintenance, not opening %s",
+			h.t.GetTerminalName(), target)
+		return
+	}
+	h.showWelcome(user)
+	h.backends.occupancy.RecordEntry(target, user)
+	openRequest := &AppEvent{
+		Ev:     AppOpenRequest,
+		Target: target,
+		Source: h.t.GetTerminalName(),
+		Msg:    "Opening for " + string(user.UserLevel),
+	}
+	if h.strikeDuration > 0 {
+		openRequest.Timeout = h.clock.Now().Add(h.strikeDuration)
+	}
+	h.backends.appEventBus.Post(openRequest)
+}
+
+func (h *AccessHandler) showWelcome(user *User) {
+	h.feedbackColor(FeedbackGranted, h.welcomeDuration)
+	name := ""
+	if user.Name != "" && user.Name[0] != '<' { // Not auto-generated.
+		name = user.Name
+	}
+	welcome := "Welcome"
+	now := h.clock.Now()
+	if h.backends.location != nil {
+		now = now.In(h.backends.location)
+	}
+	remaining, expires := user.RemainingValidity(now)
+	switch {
+	case h.renewalDue:
+		welcome = "Please renew"
+	case expires && remaining > 0 && remaining < h.expiryWarning:
+		welcome = "Welcome, " + formatTimeLeft(remaining)
+	}
+	h.showMessageForTime(welcome, name, h.welcomeDuration)
+}
+
+// A reminder for users who need to renew soon, e.g. "3 days left".
+func formatTimeLeft(remaining time.Duration) string {
+	days := int(remaining / (24 * time.Hour))
+	switch {
+	case days > 1:
+		return fmt.Sprintf("%d days left", days)
+	case days == 1:
+		return "1 day left"
+	}
+	hours := int((remaining + time.Hour - 1) / time.Hour)
+	return fmt.Sprintf("%dh left", hours)
 }
@@ -1,106 +1,11 @@
 package main
 
 import (
-	"strings"
+	"fmt"
 	"testing"
 	"time"
 )
 
-type ACKey struct {
-	code   string
-	target Target
-}
-
-// Implements Athenticator interface.
-type MockAuthenticator struct {
-	allow map[ACKey]AuthResult
-}
-
-func NewMockAuthenticator() *MockAuthenticator {
-	return &MockAuthenticator{
-		allow: make(map[ACKey]AuthResult)}
-}
-
-func (a *MockAuthenticator) AuthUser(code string, target Target) (AuthResult, string) {
-	result, ok := a.allow[ACKey{code, target}]
-	if !ok {
-		return AuthFail, "User does not exist"
-	}
-	if result == AuthOk {
-		return AuthOk, ""
-	}
-	return result, "MockAuthenticator says: some failure occured"
-}
-
-func (a *MockAuthenticator) AddNewUser(authentication_user string, user User) (bool, string) {
-	return false, ""
-}
-func (a *MockAuthenticator) FindUser(code string) *User {
-	// Return dummy user as accesshandler likes to independently find it.
-	return &User{
-		UserLevel: "member",
-	}
-}
-func (a *MockAuthenticator) UpdateUser(auth_code string, user_code string, updater_fun ModifyFun) (bool, string) {
-	return false, ""
-}
-
-func (a *MockAuthenticator) DeleteUser(auth_code string, user_code string) (bool, string) {
-	return false, ""
-}
-
-type Buzz struct {
-	toneCode string
-	duration time.Duration
-}
-
-// Implements Terminal interface.
-type MockTerminal struct {
-	t      *testing.T
-	colors string
-	buzzes []Buzz
-	lcd    [2]string
-}
-
-func NewMockTerminal(t *testing.T) *MockTerminal {
-	ret := &MockTerminal{t: t}
-	return ret
-}
-
-func (term *MockTerminal) GetTerminalName() string {
-	return "mock"
-}
-
-func (term *MockTerminal) ShowColor(colors string) {
-	term.colors = term.colors + colors
-}
-
-func (term *MockTerminal) BuzzSpeaker(toneCode string, duration time.Duration) {
-	term.buzzes = append(term.buzzes, Buzz{toneCode, duration})
-}
-
-func (term *MockTerminal) WriteLCD(row int, text string) {
-	term.lcd[row] = text
-}
-
-func (term *MockTerminal) expectColor(color string) {
-	if !strings.Contains(term.colors, color) {
-		term.t.Errorf("Expecting color '%v', but seeing colors '%v'", color, term.colors)
-	}
-}
-
-func (term *MockTerminal) expectBuzz(buzz Buzz) {
-	if len(term.buzzes) == 0 {
-		term.t.Errorf("Expecting buzz %v but heard nothing", buzz)
-		return
-	}
-	curBuzz := term.buzzes[0]
-	term.buzzes = term.buzzes[1:]
-	if curBuzz != buzz {
-		term.t.Errorf("Expecting buzz %v but heard buzz %v", buzz, curBuzz)
-	}
-}
-
 type TestFixture struct {
 	tester             *testing.T
 	mockauth           *MockAuthenticator
@@ -110,6 +15,7 @@ type TestFixture struct {
 	mockbackends       *Backends
 
 	handlerUnderTest *AccessHandler
+	appEventHandler  TerminalEventHandler // Receiving app events.
 }
 
 func NewTestFixture(t *testing.T) *TestFixture {
@@ -140,6 +46,7 @@ func NewTestFixture(t *testing.T) *TestFixture {
 		expectEventChannel: expectEventChannel,
 		mockbackends:       backends,
 		handlerUnderTest:   testHandler,
+		appEventHandler:    testHandler,
 	}
 }
 
@@ -149,14 +56,16 @@ func (f *TestFixture) FlushAllAppEvents() {
 		select {
 		// Events accumulated for the term: give it to handle
 		case event := <-f.termEventChannel:
-			f.handlerUnderTest.HandleAppEvent(event)
-		case <-time.After(0):
+			f.appEventHandler.HandleAppEvent(event)
+		default:
 			return // done.
 		}
 	}
 }
 
-func (f *TestFixture) ExpectEvent(ev AppEventType, target Target) {
+// Expect the given event and return it for further inspection. Returns nil
+// if it didn't arrive.
+func (f *TestFixture) ExpectEvent(ev AppEventType, target Target) *AppEvent {
 	f.FlushAllAppEvents()
 	select {
 	case event := <-f.expectEventChannel:
@@ -164,10 +73,12 @@ func (f *TestFixture) ExpectEvent(ev AppEventType, target Target) {
 			f.tester.Errorf("Expecting event %s:%s, but got %s:%s\n",
 				ev, target, event.Ev, event.Target)
 		}
+		return event
 	case <-time.After(50 * time.Millisecond):
 		f.tester.Errorf("Expecting event %s:%s, but nothing in queue\n",
 			ev, target)
 	}
+	return nil
 }
 
 func (f *TestFixture) ExpectNoMoreEvents() {
@@ -176,12 +87,12 @@ func (f *TestFixture) ExpectNoMoreEvents() {
 	case event := <-f.expectEventChannel:
 		f.tester.Errorf("Didn't expect event but got %s:%s\n",
 			event.Ev, event.Target)
-	case <-time.After(0):
+	default:
 		// Good.
 	}
 }
 
-func PressKeys(h *AccessHandler, keys string) {
+func PressKeys(h TerminalEventHandler, keys string) {
 	for _, key := range keys {
 		h.HandleKeypress(byte(key))
 	}
@@ -189,40 +100,212 @@ func PressKeys(h *AccessHandler, keys string) {
 
 func TestValidAccessCode(t *testing.T) {
 	testFixture := NewTestFixture(t)
-	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthOk
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
 	PressKeys(testFixture.handlerUnderTest, "123456#")
 	testFixture.FlushAllAppEvents()
 
-	testFixture.mockterm.expectBuzz(Buzz{"H", 500})
+	testFixture.mockterm.expectBuzz(Buzz{"H", 500 * time.Millisecond})
 	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
 	// The AppOpenRequest also set the green color.
 	testFixture.mockterm.expectColor("G")
 	testFixture.ExpectNoMoreEvents()
 }
 
+func TestValidAccessCodeOpensDoor(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	actions := NewRecordingActions()
+	actions.Listen(testFixture.mockbackends.appEventBus, nil)
+	testFixture.handlerUnderTest.strikeDuration = 3 * time.Second
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+
+	call := actions.WaitForCall("open", Target("mock"), time.Second)
+	if call == nil {
+		t.Fatalf("Door not opened; actions were %v", actions.Calls())
+	}
+	ExpectTrue(t, call.Duration > 2*time.Second && call.Duration <= 3*time.Second,
+		"Open for strike duration")
+	PressKeys(testFixture.handlerUnderTest, "#")
+	ExpectTrue(t, actions.WaitForCall("ring", Target("mock"), time.Second) != nil,
+		"Doorbell rang")
+	ExpectTrue(t, len(actions.Calls()) == 2, "Nothing else happened")
+}
+
 func TestInvalidAccessCode(t *testing.T) {
 	testFixture := NewTestFixture(t)
-	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthOk
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
 	PressKeys(testFixture.handlerUnderTest, "654321#")
 	testFixture.FlushAllAppEvents()
 
 	testFixture.mockterm.expectColor("R")
-	testFixture.mockterm.expectBuzz(Buzz{"L", 200})
+	testFixture.mockterm.expectBuzz(Buzz{"L", 200 * time.Millisecond})
+	event := testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	if event != nil && event.Msg != ReasonUnknownCode.String() {
+		t.Errorf("Expected denial reason, got %s", event.Msg)
+	}
 	testFixture.ExpectNoMoreEvents()
 }
 
 func TestExpiredAccessCode(t *testing.T) {
 	testFixture := NewTestFixture(t)
-	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthExpired
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonExpired
 	PressKeys(testFixture.handlerUnderTest, "123456#")
 	testFixture.FlushAllAppEvents()
 
 	testFixture.mockterm.expectColor("B") // 'nighttime'
-	testFixture.mockterm.expectBuzz(Buzz{"L", 200})
+	testFixture.mockterm.expectBuzz(Buzz{"L", 200 * time.Millisecond})
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.ExpectEvent(AppDoorbellTriggerEvent, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestWelcomeShowsTimeLeft(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testFixture.handlerUnderTest.clock = &MockClock{now: now}
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	user := &User{Name: "Jon Doe", ContactInfo: "jon@example.org",
+		UserLevel: LevelUser}
+	testFixture.mockauth.users["123456"] = user
+	for _, c := range []struct {
+		validFor time.Duration // 0: doesn't expire.
+		welcome  string
+	}{
+		{0, "Welcome"},
+		{kExpiryWarning + time.Hour, "Welcome"},
+		{kExpiryWarning, "Welcome"},
+		{kExpiryWarning - time.Second, "Welcome, 6 days left"},
+		{36 * time.Hour, "Welcome, 1 day left"},
+		{5*time.Hour - time.Minute, "Welcome, 5h left"},
+	} {
+		user.ValidTo = time.Time{}
+		if c.validFor > 0 {
+			user.ValidTo = now.Add(c.validFor)
+		}
+		PressKeys(testFixture.handlerUnderTest, "123456#")
+		testFixture.mockterm.expectLCD(0, c.welcome)
+		testFixture.mockterm.expectLCD(1, "Jon Doe")
+	}
+
+	// Configured not to show.
+	testFixture.handlerUnderTest.expiryWarning = -1
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.mockterm.expectLCD(0, "Welcome")
+}
+
+func TestRenewalDueWelcome(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testFixture.handlerUnderTest.clock = &MockClock{now: now}
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	testFixture.mockauth.users["123456"] = &User{Name: "Jon Doe",
+		ContactInfo: "jon@example.org", UserLevel: LevelMember,
+		ValidTo: now.Add(-24 * time.Hour)}
+	testFixture.mockauth.renewalDue["123456"] = true
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.mockterm.expectLCD(0, "Please renew")
+	testFixture.mockterm.expectLCD(1, "Jon Doe")
+	event := testFixture.ExpectEvent(AppRenewalDue, Target("mock"))
+	if event != nil && event.Msg != "Jon Doe" {
+		t.Errorf("Expected renewal reminder for Jon Doe, got '%s'", event.Msg)
+	}
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestOutsideHoursRingsWithName(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOutsideDaytime
+	testFixture.mockauth.users["123456"] = &User{
+		Name:      "Jon Doe",
+		UserLevel: LevelUser,
+	}
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	event := testFixture.ExpectEvent(AppDoorbellTriggerEvent, Target("mock"))
+	if event != nil && (event.Value != DoorbellOutsideHours || event.Msg != "Jon Doe") {
+		t.Errorf("Expected doorbell for Jon Doe, got %d:%s", event.Value, event.Msg)
+	}
+
+	// A plain doorbell button press is distinguishable.
+	PressKeys(testFixture.handlerUnderTest, "#")
+	event = testFixture.ExpectEvent(AppDoorbellTriggerEvent, Target("mock"))
+	if event != nil && (event.Value != DoorbellButton || event.Msg != "") {
+		t.Errorf("Expected doorbell button, got %d:%s", event.Value, event.Msg)
+	}
+}
+
+func TestOutsideHoursDenyPolicy(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.handlerUnderTest.outsideHours = OutsideHoursDeny
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOutsideDaytime
+	testFixture.mockauth.allow[ACKey{"654321", Target("mock")}] = ReasonExpired
+	testFixture.mockauth.users["123456"] = &User{
+		Name:      "Jon Doe",
+		UserLevel: LevelUser,
+	}
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.mockterm.expectLCD(1, "Outside daytime")
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	// Expired users still ring; only the hours are a policy matter.
+	PressKeys(testFixture.handlerUnderTest, "654321#")
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
 	testFixture.ExpectEvent(AppDoorbellTriggerEvent, Target("mock"))
 	testFixture.ExpectNoMoreEvents()
 }
 
+func TestDuressCodeLooksLikeRegularCode(t *testing.T) {
+	user := &User{Name: "Jon Doe", UserLevel: LevelMember}
+	regular := NewTestFixture(t)
+	regular.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	regular.mockauth.users["123456"] = user
+	PressKeys(regular.handlerUnderTest, "123456#")
+	regular.ExpectEvent(AppOpenRequest, Target("mock"))
+	regular.ExpectNoMoreEvents()
+
+	duress := NewTestFixture(t)
+	duress.mockauth.allow[ACKey{"654321", Target("mock")}] = ReasonOK
+	duress.mockauth.users["654321"] = user
+	duress.mockauth.duress["654321"] = true
+	PressKeys(duress.handlerUnderTest, "654321#")
+	event := duress.ExpectEvent(AppDuress, Target("mock"))
+	if event != nil && event.Msg != "Jon Doe" {
+		t.Errorf("Expected duress of Jon Doe, got '%s'", event.Msg)
+	}
+	duress.ExpectEvent(AppOpenRequest, Target("mock"))
+	duress.ExpectNoMoreEvents()
+
+	// Whoever watches can't tell the difference.
+	want := fmt.Sprint(regular.mockterm.calls, regular.mockterm.buzzes)
+	got := fmt.Sprint(duress.mockterm.calls, duress.mockterm.buzzes)
+	if got != want {
+		t.Errorf("Terminal differs for duress code:\n%s\nvs. regular\n%s",
+			got, want)
+	}
+}
+
+func TestDenyReasonOnLCD(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOutsideDaytime
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+
+	testFixture.mockterm.expectLCD(0, "Access denied")
+	testFixture.mockterm.expectLCD(1, "Outside daytime")
+
+	PressKeys(testFixture.handlerUnderTest, "654321#")
+	testFixture.mockterm.expectLCD(1, "Unknown code")
+
+	// Message vanishes after a while.
+	mockClock.now = mockClock.now.Add(10 * time.Second)
+	testFixture.handlerUnderTest.HandleTick()
+	testFixture.mockterm.expectLCD(0, "")
+	testFixture.mockterm.expectLCD(1, "")
+}
+
 func TestKeypadDoorbell(t *testing.T) {
 	testFixture := NewTestFixture(t)
 	// Just a single '#' should ring the bell.
@@ -235,7 +318,7 @@ func TestKeypadDoorbell(t *testing.T) {
 
 func TestKeypadTimeout(t *testing.T) {
 	testFixture := NewTestFixture(t)
-	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthOk
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
 	mockClock := &MockClock{}
 	testFixture.handlerUnderTest.clock = mockClock
 
@@ -244,13 +327,13 @@ func TestKeypadTimeout(t *testing.T) {
 	testFixture.handlerUnderTest.HandleTick()
 	testFixture.FlushAllAppEvents()
 
-	testFixture.mockterm.expectBuzz(Buzz{"L", 500}) // timeout buzz
+	testFixture.mockterm.expectBuzz(Buzz{"L", 500 * time.Millisecond}) // timeout buzz
 	testFixture.ExpectNoMoreEvents()
 }
 
 func TestRFIDDebounce(t *testing.T) {
 	testFixture := NewTestFixture(t)
-	testFixture.mockauth.allow[ACKey{"rfid-123", Target("mock")}] = AuthOk
+	testFixture.mockauth.allow[ACKey{"rfid-123", Target("mock")}] = ReasonOK
 	mockClock := &MockClock{}
 	testFixture.handlerUnderTest.clock = mockClock
 
@@ -269,5 +352,379 @@ func TestRFIDDebounce(t *testing.T) {
 	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
 }
 
+func TestRFIDCaseInsensitive(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"abcd1234", Target("mock")}] = ReasonOK
+	testFixture.handlerUnderTest.HandleRFID("ABCD1234")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+}
+
+func TestHeldRFIDOpensOnce(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"rfid-123", Target("mock")}] = ReasonOK
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+
+	// Card held in front of the reader: repeatedly reported.
+	for i := 0; i < 10; i++ {
+		testFixture.handlerUnderTest.HandleRFID("rfid-123")
+		mockClock.now = mockClock.now.Add(200 * time.Millisecond)
+	}
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	// Removed and presented again.
+	mockClock.now = mockClock.now.Add(kRFIDRemovedGap)
+	testFixture.handlerUnderTest.HandleRFID("rfid-123")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+}
+
+func TestInterleavedCardsActOnFirst(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"rfid-first", Target("mock")}] = ReasonOK
+	testFixture.mockauth.allow[ACKey{"rfid-other", Target("mock")}] = ReasonOK
+	testFixture.mockauth.users["rfid-first"] = &User{Name: "First", UserLevel: LevelMember}
+	testFixture.mockauth.users["rfid-other"] = &User{Name: "Other", UserLevel: LevelMember}
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+
+	// Both held to the reader, reported interleaved.
+	for i := 0; i < 10; i++ {
+		testFixture.handlerUnderTest.HandleRFID("rfid-first")
+		testFixture.handlerUnderTest.HandleRFID("rfid-other")
+		mockClock.now = mockClock.now.Add(200 * time.Millisecond)
+	}
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+	testFixture.mockterm.expectLCD(1, "First")
+
+	// Once the first is removed, the other is acted on.
+	mockClock.now = mockClock.now.Add(kRFIDRemovedGap)
+	testFixture.handlerUnderTest.HandleRFID("rfid-other")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.mockterm.expectLCD(1, "Other")
+}
+
+func TestDeniedCardDoesNotHoldReader(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"rfid-other", Target("mock")}] = ReasonOK
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+
+	testFixture.handlerUnderTest.HandleRFID("rfid-unknown")
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.handlerUnderTest.HandleRFID("rfid-other")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	// Now the valid card holds the reader.
+	testFixture.handlerUnderTest.HandleRFID("rfid-unknown")
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestCardOverlapEach(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.handlerUnderTest.cardOverlap = CardOverlapEach
+	testFixture.mockauth.allow[ACKey{"rfid-first", Target("mock")}] = ReasonOK
+	testFixture.mockauth.allow[ACKey{"rfid-other", Target("mock")}] = ReasonOK
+	testFixture.handlerUnderTest.clock = &MockClock{}
+
+	testFixture.handlerUnderTest.HandleRFID("rfid-first")
+	testFixture.handlerUnderTest.HandleRFID("rfid-other")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestConfirmRFIDWithinWindow(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.handlerUnderTest.confirmRFID = true
+	testFixture.mockauth.allow[ACKey{"rfid-123", Target("mock")}] = ReasonOK
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+
+	testFixture.handlerUnderTest.HandleRFID("rfid-123")
+	testFixture.mockterm.expectLCD(0, "Press # to enter")
+	testFixture.ExpectNoMoreEvents()
+
+	mockClock.now = mockClock.now.Add(kConfirmTimeout / 2)
+	testFixture.handlerUnderTest.HandleTick()
+	PressKeys(testFixture.handlerUnderTest, "#")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents() // Not taken as doorbell.
+
+	// Typed codes are confirmed by their '#' already.
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+}
+
+func TestConfirmRFIDTimeout(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.handlerUnderTest.confirmRFID = true
+	testFixture.mockauth.allow[ACKey{"rfid-123", Target("mock")}] = ReasonOK
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+
+	testFixture.handlerUnderTest.HandleRFID("rfid-123")
+	mockClock.now = mockClock.now.Add(kConfirmTimeout + time.Second)
+	testFixture.handlerUnderTest.HandleTick()
+	testFixture.mockterm.expectLCD(0, "")
+
+	// Too late: '#' is just the doorbell again.
+	PressKeys(testFixture.handlerUnderTest, "#")
+	testFixture.ExpectEvent(AppDoorbellTriggerEvent, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestAccessRecordedOncePerEntry(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	handler := testFixture.handlerUnderTest
+	handler.confirmRFID = true
+	auth := testFixture.mockauth
+	auth.allow[ACKey{"rfid-123", Target("mock")}] = ReasonOK
+	mockClock := &MockClock{now: time.Now()}
+	handler.clock = mockClock
+
+	// Not confirmed: nobody got in.
+	handler.HandleRFID("rfid-123")
+	PressKeys(handler, "*")
+	ExpectTrue(t, len(auth.accesses) == 0, "No access without '#'")
+	mockClock.now = mockClock.now.Add(kRFIDRemovedGap + time.Second)
+	handler.HandleTick()
+	handler.HandleRFID("rfid-123")
+	PressKeys(handler, "#")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	ExpectTrue(t, len(auth.accesses) == 1, "Access on '#'")
+
+	// Both doors at once are one entry.
+	inner, outer := Target("inner-gate"), Target("outer-gate")
+	handler.doors = []Target{inner, outer}
+	auth.allow[ACKey{"111111", inner}] = ReasonOK
+	auth.allow[ACKey{"111111", outer}] = ReasonOK
+	PressKeys(handler, "111111#")
+	ExpectTrue(t, len(auth.accesses) == 1, "Nothing recorded while selecting")
+	PressKeys(handler, "#")
+	testFixture.ExpectEvent(AppOpenRequest, inner)
+	testFixture.ExpectEvent(AppOpenRequest, outer)
+	ExpectTrue(t, len(auth.accesses) == 2, "One more access")
+}
+
+func TestTerminalNameNormalizedToTarget(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockterm.name = "  GATE"
+	testFixture.mockauth.allow[ACKey{"123456", TargetDownstairs}] = ReasonOK
+
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.ExpectEvent(AppOpenRequest, TargetDownstairs)
+	PressKeys(testFixture.handlerUnderTest, "#")
+	testFixture.ExpectEvent(AppDoorbellTriggerEvent, TargetDownstairs)
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestConfiguredTargetOverridesName(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockterm.name = "door-v2"
+	configureAccessHandler(testFixture.handlerUnderTest, TargetUpstairs,
+		TerminalConfig{})
+	testFixture.mockauth.allow[ACKey{"123456", TargetUpstairs}] = ReasonOK
+
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.ExpectEvent(AppOpenRequest, TargetUpstairs)
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestGrantSequence(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	testFixture.mockauth.users["123456"] = &User{
+		Name:      "Jon Doe",
+		UserLevel: LevelMember,
+	}
+	mockClock := &MockClock{}
+	handler := testFixture.handlerUnderTest
+	handler.clock = mockClock
+	handler.strikeDuration = 1 * time.Second
+	handler.welcomeDuration = 5 * time.Second
+
+	PressKeys(handler, "123456#")
+	ExpectTrue(t, testFixture.mockterm.currentColor == "G", "Green on grant")
+	testFixture.mockterm.expectLCD(0, "Welcome")
+	testFixture.mockterm.expectLCD(1, "Jon Doe")
+	event := testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	if event != nil && !event.Timeout.Equal(mockClock.now.Add(time.Second)) {
+		t.Errorf("Expected strike until %v, got %v",
+			mockClock.now.Add(time.Second), event.Timeout)
+	}
+
+	// Strike is done, but welcome is still shown.
+	mockClock.now = mockClock.now.Add(2 * time.Second)
+	handler.HandleTick()
+	ExpectTrue(t, testFixture.mockterm.currentColor == "G", "Still green")
+	testFixture.mockterm.expectLCD(0, "Welcome")
+
+	// Back to idle.
+	mockClock.now = mockClock.now.Add(4 * time.Second)
+	handler.HandleTick()
+	ExpectTrue(t, testFixture.mockterm.currentColor == "", "Light off")
+	testFixture.mockterm.expectLCD(0, "")
+	testFixture.mockterm.expectCallSequence("buzz:H", "color:G",
+		"lcd0:Welcome", "color:", "lcd0:")
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestCustomFeedbackProfile(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	handler := testFixture.handlerUnderTest
+	handler.feedback = DefaultFeedbackProfile().WithOverrides(FeedbackProfile{
+		FeedbackUnknown: {Color: "RB", ColorDuration: Duration(3 * time.Second),
+			Tone: "L", ToneDuration: Duration(2 * time.Second)},
+		FeedbackGranted: {Color: "G", Tone: "H",
+			ToneDuration: Duration(100 * time.Millisecond)},
+	})
+
+	PressKeys(handler, "654321#")
+	testFixture.mockterm.expectColor("RB")
+	testFixture.mockterm.expectBuzz(Buzz{"L", 2 * time.Second})
+
+	PressKeys(handler, "123456#")
+	testFixture.mockterm.expectColor("G")
+	testFixture.mockterm.expectBuzz(Buzz{"H", 100 * time.Millisecond})
+}
+
+func TestTwoDoorTerminal(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	handler := testFixture.handlerUnderTest
+	inner, outer := Target("inner-gate"), Target("outer-gate")
+	handler.doors = []Target{inner, outer}
+	auth := testFixture.mockauth
+	auth.allow[ACKey{"111111", inner}] = ReasonOK
+	auth.allow[ACKey{"111111", outer}] = ReasonOK
+	auth.allow[ACKey{"222222", inner}] = ReasonWrongTarget
+	auth.allow[ACKey{"222222", outer}] = ReasonOK
+	auth.allow[ACKey{"333333", inner}] = ReasonExpired
+	auth.allow[ACKey{"333333", outer}] = ReasonExpired
+
+	// Only one door permitted: opens that right away.
+	PressKeys(handler, "222222#")
+	testFixture.ExpectEvent(AppOpenRequest, outer)
+	testFixture.ExpectNoMoreEvents()
+
+	// Both permitted: the user chooses.
+	PressKeys(handler, "111111#")
+	testFixture.ExpectNoMoreEvents()
+	testFixture.mockterm.expectLCD(0, "Select door, # all")
+	PressKeys(handler, "3") // Not a door.
+	testFixture.ExpectNoMoreEvents()
+	PressKeys(handler, "2")
+	testFixture.ExpectEvent(AppOpenRequest, outer)
+	testFixture.ExpectNoMoreEvents()
+
+	PressKeys(handler, "111111##")
+	testFixture.ExpectEvent(AppOpenRequest, inner)
+	testFixture.ExpectEvent(AppOpenRequest, outer)
+	testFixture.ExpectNoMoreEvents()
+
+	// Selection times out.
+	mockClock := &MockClock{now: time.Now()}
+	handler.clock = mockClock
+	PressKeys(handler, "111111#")
+	mockClock.now = mockClock.now.Add(kDoorSelectionTimeout + time.Second)
+	handler.HandleTick()
+	PressKeys(handler, "1")
+	testFixture.ExpectNoMoreEvents()
+	handler.currentCode = ""
+
+	// Denied everywhere: the reason of the first door.
+	PressKeys(handler, "333333#")
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.ExpectEvent(AppDoorbellTriggerEvent, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestPrefixCodeNeedsSubmit(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"12345", Target("mock")}] = ReasonOK
+	PressKeys(testFixture.handlerUnderTest, "12345")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectNoMoreEvents() // Not before '#'
+
+	// Typing on to a longer code is a different code.
+	PressKeys(testFixture.handlerUnderTest, "6#")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	PressKeys(testFixture.handlerUnderTest, "12345#")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestKeypadFallbackForCards(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	handler := testFixture.handlerUnderTest
+	auth := testFixture.mockauth
+	// Cards of our facilities are enrolled by card number.
+	auth.allow[ACKey{":12345", Target("mock")}] = ReasonOK
+	auth.users[":12345"] = &User{Name: "Member", UserLevel: LevelMember}
+	auth.allow[ACKey{":777", Target("mock")}] = ReasonOK
+	auth.users[":777"] = &User{Name: "Member", UserLevel: LevelMember}
+	auth.allow[ACKey{":54321", Target("mock")}] = ReasonOK
+	auth.users[":54321"] = &User{Name: "User", UserLevel: LevelUser}
+
+	// Not enabled: the card number is no PIN.
+	PressKeys(handler, "12345#")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	handler.keypadFallback = true
+	PressKeys(handler, "12345#")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	// Short card numbers with leading zeros.
+	PressKeys(handler, "00777#")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	// Only members.
+	PressKeys(handler, "54321#")
+	testFixture.FlushAllAppEvents()
+	testFixture.ExpectEvent(AppAccessDenied, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestKeypadFallbackThrottled(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	handler := testFixture.handlerUnderTest
+	handler.keypadFallback = true
+	mockClock := &MockClock{now: time.Now()}
+	handler.clock = mockClock
+	auth := testFixture.mockauth
+	auth.allow[ACKey{":12345", Target("mock")}] = ReasonOK
+	auth.users[":12345"] = &User{Name: "Member", UserLevel: LevelMember}
+	auth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+
+	// Someone guessing card numbers.
+	for i := 0; i < kKeypadCardAttempts; i++ {
+		PressKeys(handler, fmt.Sprintf("%d#", 20000+i))
+	}
+	testFixture.FlushAllAppEvents()
+	PressKeys(handler, "12345#")
+	testFixture.FlushAllAppEvents()
+	ExpectTrue(t, len(auth.accesses) == 0, "Card number not accepted")
+
+	// PINs still work.
+	PressKeys(handler, "123456#")
+	ExpectTrue(t, len(auth.accesses) == 1, "PIN accepted")
+
+	mockClock.now = mockClock.now.Add(kKeypadCardWindow)
+	PressKeys(handler, "12345#")
+	ExpectTrue(t, len(auth.accesses) == 2, "Card number accepted again")
+}
+
 // test ideas:
 //  - too short code: don't buzz
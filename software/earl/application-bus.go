@@ -26,23 +26,44 @@ type AppEventType string
 
 const (
 	// Entrance handling events.
-	AppDoorbellTriggerEvent = AppEventType("trigger-bell") // Doorbell triggered for target
-	AppDoorSensorEvent      = AppEventType("door-sensor")  // Target door opened/closed
-	AppOpenRequest          = AppEventType("open")         // Request to open door for target.
-	AppHushBellRequest      = AppEventType("hush-bell")    // Request to snooze bell until given timeout
+	AppDoorbellTriggerEvent = AppEventType("trigger-bell")  // Doorbell triggered for target
+	AppDoorSensorEvent      = AppEventType("door-sensor")   // Target door opened/closed
+	AppOpenRequest          = AppEventType("open")          // Request to open door for target (optional: until Timeout)
+	AppCloseRequest         = AppEventType("close")         // Request to close door opened until a later Timeout
+	AppHushBellRequest      = AppEventType("hush-bell")     // Request to snooze bell until given timeout
+	AppEnableFloorRequest   = AppEventType("enable-floor")  // Request to enable elevator floor Value (or AllFloors)
+	AppAccessDenied         = AppEventType("access-denied") // Code denied at target. Msg: ReasonCode
+	AppDuress               = AppEventType("duress")        // Duress code used at target. Msg: user name
+	AppRenewalDue           = AppEventType("renewal-due")   // Expired user let in on grace at target. Msg: user name
+	AppDoorForced           = AppEventType("door-forced")   // Target door opened without access granted
+	AppDoorPropped          = AppEventType("door-propped")  // Value: 1 door open too long, 0 closed again
 
 	// User management events.
 	AppUserAdded        = AppEventType("user-added")
 	AppUserUpdated      = AppEventType("user-updated")
 	AppUserDeleted      = AppEventType("user-deleted")
 	AppUserFileReloaded = AppEventType("user-file-reloaded")
+	AppUserFileAlert    = AppEventType("user-file-alert") // Msg: problem with file; empty once resolved.
+	AppLockdownChanged  = AppEventType("lockdown")        // Msg: new LockdownMode, also as Value
 
 	// terminal/lifetime handling
 	AppEarlStarted        = AppEventType("earl-started")
+	AppConfigReloaded     = AppEventType("config-reloaded") // On SIGHUP, see reload.go
 	AppTerminalConnect    = AppEventType("terminal-connect")
 	AppTerminalDisconnect = AppEventType("terminal-disconnect")
+	AppTerminalPower      = AppEventType("terminal-power") // Value: 1 ok, 0 on battery
+	AppMaintenanceChanged = AppEventType("maintenance")    // Value: 1 in maintenance, 0 back in service
 
-	applicationBusInternalFlush = AppEventType("internal-flush")
+	// Self-test of outputs, see selftest.go
+	AppSelfTestStep    = AppEventType("selftest-step")    // Msg: output just tested
+	AppSelfTestConfirm = AppEventType("selftest-confirm") // Msg: output; Value: SelfTestWorked/Failed
+)
+
+// Value of AppDoorbellTriggerEvent: what made the doorbell ring.
+const (
+	DoorbellButton       = 0 // Someone pressed the doorbell button.
+	DoorbellOutsideHours = 1 // Known user outside their hours. Msg: name.
+	DoorbellExpired      = 2 // Known user with expired code. Msg: name.
 )
 
 // We keep it simple and somewhat un-typed: an event is identified by an
@@ -84,17 +105,17 @@ func (b *ApplicationBus) Post(event *AppEvent) {
 	}
 	b.syncedOperations <- func() {
 		for channel, _ := range b.receivers {
-			if event.Ev != applicationBusInternalFlush {
-				channel <- event
-			}
+			channel <- event
 		}
 	}
 }
 
 func (b *ApplicationBus) Flush() {
-	// Since we have a syncedOperations channel of length 1, this will
-	// make sure that we wait until the previous operation is through.
-	b.Post(&AppEvent{Ev: applicationBusInternalFlush})
+	// Operations are executed in sequence, so once this one ran, all
+	// previously posted events have been delivered.
+	done := make(chan bool)
+	b.syncedOperations <- func() { close(done) }
+	<-done
 }
 
 func (b *ApplicationBus) Subscribe(channel AppEventChannel) {
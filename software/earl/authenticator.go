@@ -15,27 +15,141 @@ package main
 //   in independent of time.
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/csv"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-type AuthResult int
+const (
+	guestCodeDigits = 6 // Length of generated guest PINs.
+
+	// Lookups check if the users file changed at most this often.
+	defaultFileCheckInterval = time.Second
+)
+
+const (
+	HolidayHiatusBegin = 1482278400 // 2016-12-21 UTC
+	HolidayHiatusEnd   = 1483747200 // 2017-01-07 UTC
+)
+
+// The reason for an AuthUser() decision, so that callers can branch on it
+// (or tell the user what went wrong) without parsing the human-readable
+// detail message meant for logs.
+type ReasonCode int
 
 const (
-	AuthFail             = AuthResult(0) // Not authorized.
-	AuthExpired          = AuthResult(1)
-	AuthOkButOutsideTime = AuthResult(2) // User ok; time-of-day limit.
-	AuthOk               = AuthResult(42)
-	HolidayHiatusBegin   = 1482278400 // 2016-12-21 UTC
-	HolidayHiatusEnd     = 1483747200 // 2017-01-07 UTC
+	ReasonOK             = ReasonCode(iota)
+	ReasonUnknownCode    // No user for code (or code not valid at all).
+	ReasonExpired        // Code not valid yet or expired.
+	ReasonOutsideDaytime // User ok, but outside their time of day.
+	ReasonHiatus         // User is on hiatus.
+	ReasonWrongTarget    // User ok, but not allowed at this target.
+	ReasonLockdown       // User ok, but the space is in lockdown.
+	ReasonSuspended      // User is suspended, whatever their level.
+	ReasonDailyLimit     // User used up their entries or time today.
+	ReasonBackendDown    // Can't tell: remote authenticator unreachable.
 )
 
+func (r ReasonCode) String() string {
+	switch r {
+	case ReasonOK:
+		return "ok"
+	case ReasonUnknownCode:
+		return "unknown-code"
+	case ReasonExpired:
+		return "expired"
+	case ReasonOutsideDaytime:
+		return "outside-daytime"
+	case ReasonHiatus:
+		return "hiatus"
+	case ReasonWrongTarget:
+		return "wrong-target"
+	case ReasonLockdown:
+		return "lockdown"
+	case ReasonSuspended:
+		return "suspended"
+	case ReasonDailyLimit:
+		return "daily-limit"
+	case ReasonBackendDown:
+		return "backend-down"
+	}
+	return fmt.Sprintf("reason-%d", int(r))
+}
+
+// The ReasonCode for its String(), e.g. as sent by a remote authenticator.
+func ParseReasonCode(name string) (ReasonCode, bool) {
+	for r := ReasonOK; r <= ReasonBackendDown; r++ {
+		if r.String() == name {
+			return r, true
+		}
+	}
+	return ReasonUnknownCode, false
+}
+
+// Short message suitable to be shown to the user on the LCD (fits
+// maxLCDCols).
+func (r ReasonCode) DisplayMessage() string {
+	switch r {
+	case ReasonOK:
+		return ""
+	case ReasonUnknownCode:
+		return "Unknown code"
+	case ReasonExpired:
+		return "Code expired"
+	case ReasonOutsideDaytime:
+		return "Outside daytime"
+	case ReasonHiatus:
+		return "On hiatus"
+	case ReasonWrongTarget:
+		return "Not valid here"
+	case ReasonLockdown:
+		return "Lockdown"
+	case ReasonSuspended:
+		return "Suspended"
+	case ReasonDailyLimit:
+		return "Daily limit"
+	case ReasonBackendDown:
+		return "Try again later"
+	}
+	return "Access denied"
+}
+
+// Result of AuthUser()
+type AuthDecision struct {
+	Granted bool
+	Reason  ReasonCode
+	Detail  string // Human readable, good for logs.
+
+	// The code was one of the user's DuressCodes: someone is forcing
+	// them. Otherwise decided like their regular code.
+	Duress bool
+
+	// Copy of the user the code belongs to, also if access is denied.
+	// nil if the code is unknown.
+	User *User
+
+	// Granted, but only in the grace period after ValidTo: the user
+	// should renew.
+	RenewalDue bool
+}
+
+func authGranted() AuthDecision {
+	return AuthDecision{Granted: true, Reason: ReasonOK}
+}
+
+func authDenied(reason ReasonCode, detail string) AuthDecision {
+	return AuthDecision{Granted: false, Reason: reason, Detail: detail}
+}
+
 // Modify a user pointer. Returns 'true' if the changes should be written back.
 type ModifyFun func(user *User) bool
 
@@ -45,11 +159,22 @@ type Authenticator interface {
 	FindUser(plain_code string) *User
 
 	// Given a code (RFID or PIN), does it exist and is the user allowed
-	// to access "target" ?
-	AuthUser(code string, target Target) (AuthResult, string)
+	// to access "target" ? The decision contains the user found, so
+	// no separate FindUser() is needed.
+	AuthUser(code string, target Target) AuthDecision
+
+	// Same decision as AuthUser(), but not an access attempt and without
+	// side effects: for diagnostics, or to decide before anyone actually
+	// gets in.
+	CheckCode(code string, target Target) AuthDecision
+
+	// The user, as decided with CheckCode(), got in at target: record the
+	// access (last access, daily entries) without deciding again.
+	RecordAccess(user *User, target Target)
 
 	// Given a valid authentication code of some member (PIN or RFID), add
-	/// the new user object. Updates the file.
+	/// the new user object. Updates the file. The member needs to be
+	// allowed to add users of its level, see CanLevelAddLevel().
 	AddNewUser(authentication_code string, user User) (bool, string)
 
 	// Given a valid authentication code of some member, find user by code
@@ -61,6 +186,29 @@ type Authenticator interface {
 	// Given a valid authentication code of some member, delete user
 	// associated with user_code.
 	DeleteUser(authentication_code string, user_code string) (bool, string)
+
+	// Given a valid authentication code of a member, suspend or
+	// unsuspend the user associated with user_code. Suspended users keep
+	// their record, but are denied access.
+	SetSuspended(authentication_code string, user_code string, suspended bool) (bool, string)
+
+	// Given a valid authentication code of some member, create a
+	// temporary guest user with a random PIN, valid for "duration" from
+	// now at the given target (or everywhere if empty). Returns the PIN.
+	CreateGuestCode(authentication_code string, duration time.Duration, target Target) (string, error)
+
+	// True while there is no member yet, so nobody could add users. The
+	// first member can then be added with ProvisionMember().
+	NeedsProvisioning() bool
+
+	// Add the first member, given the one-time provisioning token if
+	// one is required. Refused once there is a member.
+	ProvisionMember(token string, user User) (bool, string)
+
+	// Returns a problem with the backing store, e.g. the file became
+	// unreadable, or nil if all is good. Users keep being served from
+	// what was last read successfully.
+	StoreError() error
 }
 
 type FileBasedAuthenticator struct {
@@ -68,31 +216,109 @@ type FileBasedAuthenticator struct {
 	fileTimestamp time.Time  // modification timestamp.
 	fileLock      sync.Mutex // File writing
 
+	// Looking at the file costs system calls, so lookups only do it
+	// every fileCheckInterval. Protected by fileLock.
+	fileCheckInterval time.Duration
+	lastFileCheck     time.Time
+
+	// The columns of the file are in the order we write them, so
+	// appending works. Not so if someone rearranged them.
+	fileAppendable bool
+
 	// List of users and various indexes needed to look-up. Never use
 	// directly, use the ...UserSyncronized() methods.
+	// Looking up a code is O(1): the indexes are keyed by the hashed
+	// code, built once when reading the file and maintained on each
+	// change, so lookups stay fast with thousands of users.
 	// For modifications, we employ an optimistic concurrency control:
 	// on change operations we determine if we are still in the same
 	// revision when we looked up the item to change.
-	userLock   sync.Mutex       // Mutex to protect following data structures
-	userList   []*User          // Sequence of users
-	user2index map[*User]int    // user-pointer to index in userList
-	code2user  map[string]*User // access-code to user
-	revision   int              // counter for optimistic locking.
+	userLock    sync.Mutex       // Mutex to protect following data structures
+	userList    []*User          // Sequence of users
+	user2index  map[*User]int    // user-pointer to index in userList
+	code2user   map[string]*User // access-code to user
+	duress2user map[string]*User // duress-code to user
+	revision    int              // counter for optimistic locking.
+	storeError  error            // Problem reading the file, if any.
+
+	// Comment lines in the file before userList[i], or at the end at
+	// len(userList); written back, so that notes added by hand survive.
+	comments map[int][]string
+
+	// The lines of users as they were read, written back as they are
+	// until the user changes. Changes replace the *User, so they're not
+	// found here anymore; those changing a user in place need to delete
+	// it. Only if the columns are in write order.
+	rawLines map[*User]string
+
+	// LastAccess of some user changed since the file was written.
+	lastAccessDirty bool
 
 	eventBus *ApplicationBus
-	clock    Clock // Our source of time. Useful for simulated clock in tests
+	clock    Clock     // Our source of time. Useful for simulated clock in tests
+	lockdown *Lockdown // Optional. If set, consulted in AuthUser()
+
+	// Timezone the daytime hours of users are in, and in which days
+	// start and end. If nil, the clock's own (which is local for the
+	// RealClock).
+	location *time.Location
+
+	// Held while deciding, so that Reload() swaps the following and the
+	// users in between decisions, never during one.
+	policyLock sync.RWMutex
+
+	// Open hours per target. Targets not in here are open all day.
+	schedules map[Target]TargetSchedule
+
+	// How long users are still let in after their ValidTo; 0 for not at
+	// all. See User.InRenewalGrace()
+	renewalGrace time.Duration
+
+	// Traces the decisions for one code, if asked to. See access-trace.go
+	tracer *AccessTracer
+
+	// Today's usage of users with daily limits (see daily-limit.go).
+	// Protected by userLock.
+	dailyUsage map[string]*dailyUsage
+
+	// Users are managed elsewhere and synced to the file (see
+	// replica.go); never modify it.
+	readOnly bool
+
+	// Needed to add the first member, unless provisionWithoutToken; made
+	// when needed. See provisioning.go. Protected by userLock.
+	provisionWithoutToken bool
+	provisionToken        string
 }
 
 func NewFileBasedAuthenticator(userFilename string,
 	bus *ApplicationBus) *FileBasedAuthenticator {
+	return newFileBasedAuthenticator(userFilename, bus, false)
+}
+
+// Authenticator of a replica: reads the users file, but refuses any
+// change to the users.
+func NewReadOnlyFileBasedAuthenticator(userFilename string,
+	bus *ApplicationBus) *FileBasedAuthenticator {
+	return newFileBasedAuthenticator(userFilename, bus, true)
+}
+
+func newFileBasedAuthenticator(userFilename string,
+	bus *ApplicationBus, readOnly bool) *FileBasedAuthenticator {
 	a := &FileBasedAuthenticator{
 		userFilename: userFilename,
 		userList:     make([]*User, 0, 10),
 		user2index:   make(map[*User]int),
 		code2user:    make(map[string]*User),
+		duress2user:  make(map[string]*User),
+		comments:     make(map[int][]string),
+		rawLines:     make(map[*User]string),
 		revision:     0,
 		eventBus:     bus,
 		clock:        RealClock{},
+		readOnly:     readOnly,
+
+		fileCheckInterval: defaultFileCheckInterval,
 	}
 
 	if !a.readDatabase() {
@@ -102,14 +328,23 @@ func NewFileBasedAuthenticator(userFilename string,
 }
 
 func (a *FileBasedAuthenticator) FindUser(plain_code string) *User {
+	a.reloadIfStale()
 	user := a.findUserSynchronized(plain_code, nil)
 	if user == nil {
 		return nil
 	}
-	retval := *user // Copy, so that caller does not mess with state.
+	retval := a.copyUserSynchronized(user) // Caller can't mess with state.
 	return &retval
 }
 
+// A copy of the user as stored. Taken under the userLock, as accesses
+// update the stored user (see recordAccessRequiresLock()).
+func (a *FileBasedAuthenticator) copyUserSynchronized(user *User) User {
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	return *user
+}
+
 // Iterate through users. The users are a copy, you can't modify them.
 func (a *FileBasedAuthenticator) IterateUsers(callback func(user User)) {
 	for _, user := range a.userList {
@@ -118,30 +353,179 @@ func (a *FileBasedAuthenticator) IterateUsers(callback func(user User)) {
 }
 
 // Check if access for a given code is granted to a given Target
-func (a *FileBasedAuthenticator) AuthUser(code string, target Target) (AuthResult, string) {
+func (a *FileBasedAuthenticator) AuthUser(code string, target Target) AuthDecision {
+	decision, user := a.decide(code, target)
+	if decision.Granted {
+		a.userLock.Lock()
+		a.recordAccessRequiresLock(user)
+		a.userLock.Unlock()
+	}
+	return decision
+}
+
+func (a *FileBasedAuthenticator) RecordAccess(user *User, target Target) {
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	for _, code := range user.Codes {
+		if stored := a.code2user[code]; stored != nil {
+			a.recordAccessRequiresLock(stored)
+			return
+		}
+	}
+	// Removed in the meantime; nothing to remember.
+}
+
+func (a *FileBasedAuthenticator) CheckCode(code string, target Target) AuthDecision {
+	decision, _ := a.decide(code, target)
+	return decision
+}
+
+// The decision shared by AuthUser() and CheckCode(), and the user as
+// stored (nil if unknown). Anything that should only happen on an actual
+// access attempt belongs in AuthUser().
+func (a *FileBasedAuthenticator) decide(code string, target Target) (AuthDecision, *User) {
 	if !hasMinimalCodeRequirements(code) {
-		return AuthFail, "Auth failed: too short code."
+		return authDenied(ReasonUnknownCode, "Auth failed: too short code."), nil
 	}
-	user := a.findUserSynchronized(code, nil)
+	a.policyLock.RLock()
+	defer a.policyLock.RUnlock()
+	trace := a.tracer.start(code, target, a.localNow())
+	user, duress := a.findUserForAccessSynchronized(code)
 	if user == nil {
-		return AuthFail, "No user for code"
+		trace.Step("user", false, "no user for code")
+		decision := authDenied(ReasonUnknownCode, "No user for code")
+		a.tracer.finish(trace, decision)
+		return decision, nil
+	}
+	trace.Step("user", true, "name=%s level=%s duress=%t",
+		user.Name, user.UserLevel, duress)
+	userCopy := a.copyUserSynchronized(user) // Caller can't mess with state.
+	decision := a.authKnownUser(&userCopy, target, trace)
+	decision.User = &userCopy
+	decision.Duress = duress
+	a.tracer.finish(trace, decision)
+	return decision, user
+}
+
+// Remember when the user last got in. This is only in memory: rewriting
+// the file on every access would be costly, so it is written with the next
+// FlushLastAccess(). Also counts towards the user's daily limit.
+func (a *FileBasedAuthenticator) recordAccessRequiresLock(user *User) {
+	user.LastAccess = a.clock.Now()
+	delete(a.rawLines, user)
+	a.lastAccessDirty = true
+	a.countDailyEntryRequiresLock(user)
+}
+
+// Write the last access times recorded since the last flush to the file.
+// Call from time to time and on shutdown.
+func (a *FileBasedAuthenticator) FlushLastAccess() (bool, string) {
+	if a.readOnly {
+		return true, "" // Only kept in memory.
+	}
+	a.reloadIfChanged() // Don't overwrite manual edits.
+	a.userLock.Lock()
+	if a.storeError != nil {
+		a.userLock.Unlock()
+		return false, a.storeError.Error()
+	}
+	dirty := a.lastAccessDirty
+	a.lastAccessDirty = false
+	a.userLock.Unlock()
+	if !dirty {
+		return true, ""
+	}
+	ok, msg := a.writeDatabase()
+	if !ok {
+		a.userLock.Lock()
+		a.lastAccessDirty = true // Try again next time.
+		a.userLock.Unlock()
+	}
+	return ok, msg
+}
+
+// The trace records each check; nil if the code isn't traced.
+func (a *FileBasedAuthenticator) authKnownUser(user *User, target Target,
+	trace *AccessTrace) AuthDecision {
+	trace.Step("suspended", !user.Suspended, "suspended=%t", user.Suspended)
+	if user.Suspended {
+		return authDenied(ReasonSuspended,
+			fmt.Sprintf("User suspended '%s <%s>'", user.Name, user.ContactInfo))
 	}
 	// In case of Hiatus users, be a bit more specific with logging: this
 	// might be someone stolen a token of some person on leave or attempt
 	// of a blocked user to get access.
+	trace.Step("hiatus", user.UserLevel != LevelHiatus, "level=%s", user.UserLevel)
 	if user.UserLevel == LevelHiatus {
-		return AuthFail, fmt.Sprintf("User on hiatus '%s <%s>'", user.Name, user.ContactInfo)
+		return authDenied(ReasonHiatus,
+			fmt.Sprintf("User on hiatus '%s <%s>'", user.Name, user.ContactInfo))
+	}
+	// Note, users without contact info expire some time after they
+	// have been registered (see User.ExpiryDate()), not only at ValidTo.
+	now := a.localNow()
+	inValidity := user.InValidityPeriod(now)
+	renewalDue := !inValidity && user.InRenewalGrace(now, a.renewalGrace)
+	trace.Step("validity", inValidity || renewalDue,
+		"now=%s valid-from=%s expires=%s renewal-due=%t",
+		traceTime(now), traceTime(user.ValidFrom),
+		traceTime(user.ExpiryDate(now)), renewalDue)
+	if !inValidity && !renewalDue {
+		return authDenied(ReasonExpired, "Code not valid yet/expired")
+	}
+	mayAccess := user.MayAccessTarget(target)
+	trace.Step("target", mayAccess, "target=%s allowed=%v", target, user.AllowedTargets)
+	if !mayAccess {
+		return authDenied(ReasonWrongTarget,
+			fmt.Sprintf("User not allowed at '%s'", target))
 	}
-	if !user.InValidityPeriod(a.clock.Now()) {
-		return AuthExpired, "Code not valid yet/expired"
+	lockdownAllows := a.lockdown.Allows(user.UserLevel)
+	trace.Step("lockdown", lockdownAllows, "mode=%s level=%s",
+		a.lockdown.Mode(), user.UserLevel)
+	if !lockdownAllows {
+		return authDenied(ReasonLockdown,
+			fmt.Sprintf("Lockdown (%s)", a.lockdown.Mode()))
 	}
-	return a.userHasAccess(user, target)
+	decision := a.levelHasAccess(user)
+	from, to := user.AccessHours()
+	trace.Step("hours", decision.Granted, "level=%s hours=%d:00..%d:00 now=%s",
+		user.UserLevel, from, to, now.Format("15:04"))
+	if !decision.Granted {
+		return decision
+	}
+	decision = a.schedules[target].Check(user, now.Hour())
+	trace.Step("schedule", decision.Granted, "target=%s hour=%d %s",
+		target, now.Hour(), decision.Detail)
+	if !decision.Granted {
+		return decision
+	}
+	decision = a.checkDailyLimit(user)
+	trace.Step("daily-limit", decision.Granted, "entries=%d budget=%v %s",
+		user.DailyEntries, user.DailyBudget, decision.Detail)
+	decision.RenewalDue = renewalDue && decision.Granted
+	return decision
+}
+
+// Times in traces; "-" for none.
+func traceTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
 }
 
 func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
+	if a.readOnly {
+		return false, errReplicaReadOnly.Error()
+	}
 	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
 		return false, auth_msg
 	}
+	canAddLevel := func(actor Level) bool {
+		return CanLevelAddLevel(actor, user.UserLevel)
+	}
+	if auth_ok, _ := a.verifyOpAllowed(authentication_code, canAddLevel); !auth_ok {
+		return false, fmt.Sprintf("Not authorized to add %s.", user.UserLevel)
+	}
 
 	// We remember the sponsor who added the user.
 	user.Sponsors = []string{hashAuthCode(authentication_code)}
@@ -149,6 +533,13 @@ func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user Use
 	if user.ValidFrom.IsZero() {
 		user.ValidFrom = a.clock.Now()
 	}
+	user.RegisteredAt = a.clock.Now()
+	user.ContactInfo = NormalizeContactInfo(user.ContactInfo)
+	if user.ContactInfo != "" {
+		if err := ValidateContactInfo(user.ContactInfo); err != nil {
+			log.Printf("Adding user '%s' anyway: %v", user.Name, err)
+		}
+	}
 	// Are the codes used unique ?
 	if !a.addUserSynchronized(&user) {
 		return false, "Duplicate codes while adding user"
@@ -159,8 +550,69 @@ func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user Use
 	return a.appendDatabaseSingleEntry(&user)
 }
 
+func (a *FileBasedAuthenticator) CreateGuestCode(authentication_code string,
+	duration time.Duration, target Target) (string, error) {
+	if a.readOnly {
+		return "", errReplicaReadOnly
+	}
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return "", errors.New(auth_msg)
+	}
+	sponsor := a.FindUser(authentication_code)
+	now := a.clock.Now()
+	// A random code might collide with an existing one; just retry.
+	for attempt := 0; attempt < 10; attempt++ {
+		code, err := randomGuestCode()
+		if err != nil {
+			return "", err
+		}
+		guest := &User{
+			Name:         "<guest " + now.Format("0102-1504") + ">",
+			UserLevel:    LevelGuest,
+			Sponsors:     []string{hashAuthCode(authentication_code)},
+			ValidFrom:    now,
+			ValidTo:      now.Add(duration),
+			RegisteredAt: now,
+			Comment:      "guest of " + sponsor.Name,
+		}
+		if target != "" {
+			guest.AllowedTargets = []Target{target}
+		}
+		guest.SetAuthCode(code)
+		if !a.addUserSynchronized(guest) {
+			continue
+		}
+		a.postUserEvent(AppUserAdded, guest)
+		if ok, msg := a.appendDatabaseSingleEntry(guest); !ok {
+			return "", errors.New(msg)
+		}
+		return code, nil
+	}
+	return "", errors.New("Couldn't find unused guest code")
+}
+
+// A PIN that can be typed on the keypad.
+func randomGuestCode() (string, error) {
+	return randomDigits(guestCodeDigits)
+}
+
+func randomDigits(digits int) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < digits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	value, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, value), nil
+}
+
 func (a *FileBasedAuthenticator) UpdateUser(authentication_code string,
 	user_code string, updater_fun ModifyFun) (bool, string) {
+	if a.readOnly {
+		return false, errReplicaReadOnly.Error()
+	}
 	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelModify); !auth_ok {
 		return false, auth_msg
 	}
@@ -188,6 +640,9 @@ func (a *FileBasedAuthenticator) UpdateUser(authentication_code string,
 
 func (a *FileBasedAuthenticator) DeleteUser(
 	authentication_code string, user_code string) (bool, string) {
+	if a.readOnly {
+		return false, errReplicaReadOnly.Error()
+	}
 	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
 		return false, auth_msg
 	}
@@ -203,16 +658,42 @@ func (a *FileBasedAuthenticator) DeleteUser(
 	return a.writeDatabase()
 }
 
+func (a *FileBasedAuthenticator) SetSuspended(authentication_code string,
+	user_code string, suspended bool) (bool, string) {
+	if a.readOnly {
+		return false, errReplicaReadOnly.Error()
+	}
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelSuspend); !auth_ok {
+		return false, auth_msg
+	}
+
+	var previous_revision int
+	orig_user := a.findUserSynchronized(user_code, &previous_revision)
+	if orig_user == nil {
+		return false, "No user for code."
+	}
+	modification_copy := *orig_user
+	modification_copy.Suspended = suspended
+	if !a.replaceUserSynchronized(previous_revision, orig_user, &modification_copy) {
+		return false, "Changed while editing."
+	}
+
+	a.postUserEvent(AppUserUpdated, &modification_copy)
+
+	return a.writeDatabase()
+}
+
 // Given a test function for the user level, test if operation is allowed
 func (a *FileBasedAuthenticator) verifyOpAllowed(auth_code string, isOpAllowed func(Level) bool) (bool, string) {
+	a.reloadIfChanged() // Changes need to be based on the latest file.
 	authMember := a.findUserSynchronized(auth_code, nil)
 	if authMember == nil {
 		return false, "Couldn't find member with authentication code."
 	}
-	if !isOpAllowed(authMember.UserLevel) {
+	if !isOpAllowed(authMember.UserLevel) || authMember.Suspended {
 		return false, "User not authorized."
 	}
-	if !authMember.InValidityPeriod(a.clock.Now()) {
+	if !authMember.InValidityPeriod(a.localNow()) {
 		return false, "Auth-Member expired."
 	}
 	return true, ""
@@ -222,17 +703,35 @@ func (a *FileBasedAuthenticator) verifyOpAllowed(auth_code string, isOpAllowed f
 // should modify while holdling a lock.
 // If you want to use the returned object to call a modification operation:
 // If revision is non-nil, fills in the current revision.
+// Doesn't look at the file; call reloadIfChanged() or reloadIfStale()
+// first.
 func (a *FileBasedAuthenticator) findUserSynchronized(plain_code string, rev *int) *User {
-	a.reloadIfChanged()
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
-	user, _ := a.code2user[hashAuthCode(plain_code)]
+	var user *User
+	for _, code := range rfidLookupCodes(plain_code) {
+		if user = a.code2user[hashAuthCode(code)]; user != nil {
+			break
+		}
+	}
 	if rev != nil {
 		*rev = a.revision
 	}
 	return user
 }
 
+// Like findUserSynchronized(), but also finds users by their duress
+// codes, which are only good to get in, not to administer anything.
+func (a *FileBasedAuthenticator) findUserForAccessSynchronized(plain_code string) (user *User, duress bool) {
+	a.reloadIfStale()
+	if user = a.findUserSynchronized(plain_code, nil); user != nil {
+		return user, false
+	}
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	return a.duress2user[hashAuthCode(plain_code)], true
+}
+
 // Add user.
 // Makes sure the data structure is synchronized.
 func (a *FileBasedAuthenticator) addUserSynchronized(user *User) bool {
@@ -271,10 +770,12 @@ func (a *FileBasedAuthenticator) addUserAtPosRequiresLock(user *User, at_index i
 	// ASSERT: a.userLock already locked.
 	// First verify that there is no code in there that is already used by
 	// someone else.
-	for _, code := range user.Codes {
-		if a.code2user[code] != nil {
-			log.Printf("Ignoring multiple used code '%s'", code)
-			return false // Existing user with that code
+	for _, codes := range [][]string{user.Codes, user.DuressCodes} {
+		for _, code := range codes {
+			if a.code2user[code] != nil || a.duress2user[code] != nil {
+				log.Printf("Ignoring multiple used code '%s'", code)
+				return false // Existing user with that code
+			}
 		}
 	}
 	// Then ok to add.
@@ -292,6 +793,9 @@ func (a *FileBasedAuthenticator) addUserAtPosRequiresLock(user *User, at_index i
 	for _, code := range user.Codes {
 		a.code2user[code] = user
 	}
+	for _, code := range user.DuressCodes {
+		a.duress2user[code] = user
+	}
 	return true
 }
 
@@ -308,13 +812,17 @@ func (a *FileBasedAuthenticator) deleteUserRequiresLock(user *User) int {
 	for _, code := range user.Codes {
 		delete(a.code2user, code)
 	}
+	for _, code := range user.DuressCodes {
+		delete(a.duress2user, code)
+	}
+	delete(a.rawLines, user)
 	return pos
 }
 
 //
 // Read the user CSV file
 //
-// It is name, level, code[,code...]
+// See user.go for the format.
 func (a *FileBasedAuthenticator) readDatabase() bool {
 	if a.userFilename == "" {
 		log.Println("RFID-user file not provided")
@@ -325,36 +833,85 @@ func (a *FileBasedAuthenticator) readDatabase() bool {
 		log.Println("Could not read RFID user-file", err)
 		return false
 	}
+	defer f.Close()
 
-	fileinfo, _ := os.Stat(a.userFilename)
-	a.fileTimestamp = fileinfo.ModTime()
+	a.fileTimestamp = a.clock.Now() // In case we can't stat.
+	if fileinfo, err := os.Stat(a.userFilename); err == nil {
+		a.fileTimestamp = fileinfo.ModTime()
+	}
 
-	reader := csv.NewReader(f)
-	reader.FieldsPerRecord = -1 //variable length fields
+	reader := NewUserCSVReader(f)
 
 	counts := make(map[Level]int)
 	expired_counts := make(map[Level]int)
 	total := 0
+	purged := 0
+	unregistered := 0
 	log.Printf("Reading %s", a.userFilename)
+	var comments []string // Not placed yet.
 	for {
-		user, done := NewUserFromCSV(reader)
+		user, done := reader.Next()
+		comments = append(comments, reader.Comments()...)
 		if done {
 			break
 		}
 		if user == nil {
 			continue // e.g. due to comment or short line
 		}
-		a.addUserSynchronized(user)
+		// Guests are only around for a short while; no need to
+		// keep them after they expired. One without an end (added by
+		// hand) stays.
+		if now := a.localNow(); user.UserLevel == LevelGuest &&
+			!user.ValidTo.IsZero() && user.ExpiryDate(now).Before(now) {
+			purged++
+			continue
+		}
+		// Older files don't have the registration time. Before, the
+		// ValidFrom was set at creation; if not even that, the best
+		// guess we have is the file modification time.
+		keepRaw := reader.InWriteOrder()
+		if user.RegisteredAt.IsZero() {
+			user.RegisteredAt = user.ValidFrom
+			if user.RegisteredAt.IsZero() {
+				user.RegisteredAt = a.fileTimestamp
+				unregistered++
+				keepRaw = false // Write down the guess.
+			}
+		}
+		if a.addUserSynchronized(user) {
+			if len(comments) > 0 {
+				a.comments[len(a.userList)-1] = comments
+				comments = nil
+			}
+			if keepRaw {
+				a.rawLines[user] = reader.Raw()
+			}
+		}
 		total++
 		counts[user.UserLevel]++
-		if !user.InValidityPeriod(a.clock.Now()) {
+		if !user.InValidityPeriod(a.localNow()) {
 			expired_counts[user.UserLevel]++
 		}
 	}
-	log.Printf("Read %d users from %s", total, a.userFilename)
+	if len(comments) > 0 {
+		a.comments[len(a.userList)] = comments
+	}
+	a.fileAppendable = reader.InWriteOrder()
+	log.Printf("Read %d users from %s (schema %d)", total, a.userFilename,
+		reader.Schema())
 	for level, count := range counts {
 		log.Printf("%14s %4d (%3d good, %3d expired)", level, count, count-expired_counts[level], expired_counts[level])
 	}
+	if unregistered > 0 {
+		log.Printf("%d users without registration time; assuming %s",
+			unregistered, a.fileTimestamp.Format("2006-01-02 15:04"))
+	}
+	if purged > 0 && !a.readOnly {
+		log.Printf("Purging %d expired guests from %s", purged, a.userFilename)
+		if ok, msg := a.writeDatabase(); !ok {
+			log.Printf("Couldn't write %s: %s", a.userFilename, msg)
+		}
+	}
 	return true
 }
 
@@ -363,11 +920,20 @@ func (a *FileBasedAuthenticator) readDatabase() bool {
 func (a *FileBasedAuthenticator) reloadIfChanged() {
 	a.fileLock.Lock()
 	defer a.fileLock.Unlock()
+	a.lastFileCheck = a.clock.Now()
 	fileinfo, err := os.Stat(a.userFilename)
+	if err == nil {
+		// Permission changes don't change the modification time.
+		err = checkReadable(a.userFilename)
+	}
 	if err != nil {
-		return // well, ok then.
+		// If we'd just re-read the file now (or after a restart),
+		// nobody would get in. Keep what we have, but make noise.
+		a.setStoreError(err)
+		return
 	}
 	if a.fileTimestamp == fileinfo.ModTime() {
+		a.setStoreError(nil)
 		return // nothing to do.
 	}
 	msg := fmt.Sprintf("Refreshing changed %s (%s -> %s)\n",
@@ -380,17 +946,35 @@ func (a *FileBasedAuthenticator) reloadIfChanged() {
 	// a new authenticator and steal the result.
 	// If we allow to modify users in-memory, we need to make
 	// sure that we don't replace contents while that is happening.
-	newAuth := NewFileBasedAuthenticator(a.userFilename, a.eventBus)
+	newAuth := newFileBasedAuthenticator(a.userFilename, a.eventBus, a.readOnly)
 	if newAuth == nil {
+		a.setStoreError(fmt.Errorf("couldn't read changed %s", a.userFilename))
 		return
 	}
+	a.setStoreError(nil)
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
+	// Access times not flushed yet are only in our memory.
+	for _, user := range a.userList {
+		if user == nil || user.LastAccess.IsZero() {
+			continue
+		}
+		for _, code := range user.Codes {
+			if fresh := newAuth.code2user[code]; fresh != nil &&
+				fresh.LastAccess.Before(user.LastAccess) {
+				fresh.LastAccess = user.LastAccess
+				delete(newAuth.rawLines, fresh)
+			}
+		}
+	}
 	// Steal all the fields :)
 	a.fileTimestamp = newAuth.fileTimestamp
 	a.userList = newAuth.userList
 	a.user2index = newAuth.user2index
 	a.code2user = newAuth.code2user
+	a.duress2user = newAuth.duress2user
+	a.comments = newAuth.comments
+	a.rawLines = newAuth.rawLines
 	a.eventBus.Post(&AppEvent{
 		Ev:     AppUserFileReloaded,
 		Source: "authenticator",
@@ -398,6 +982,121 @@ func (a *FileBasedAuthenticator) reloadIfChanged() {
 	})
 }
 
+// Take the schedules and renewal grace of a reloaded config, and re-read
+// the users file even if it looks unchanged. See reload.go
+func (a *FileBasedAuthenticator) Reload(schedules map[Target]TargetSchedule,
+	renewalGrace time.Duration) {
+	a.policyLock.Lock()
+	defer a.policyLock.Unlock()
+	a.schedules = schedules
+	a.renewalGrace = renewalGrace
+	a.fileLock.Lock()
+	a.fileTimestamp = time.Time{}
+	a.fileLock.Unlock()
+	a.reloadIfChanged()
+}
+
+// Like reloadIfChanged(), but only if we haven't looked at the file for
+// the fileCheckInterval. For lookups, which happen several times a second
+// while a card is held to a reader.
+func (a *FileBasedAuthenticator) reloadIfStale() {
+	a.fileLock.Lock()
+	elapsed := a.clock.Now().Sub(a.lastFileCheck)
+	a.fileLock.Unlock()
+	// Also if the clock was set back.
+	stale := elapsed >= a.fileCheckInterval || elapsed < 0
+	if stale {
+		a.reloadIfChanged()
+	}
+}
+
+func (a *FileBasedAuthenticator) StoreError() error {
+	a.reloadIfChanged() // Checks the file.
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	return a.storeError
+}
+
+// Remember the current problem with the file (nil if none). Changes are
+// logged and announced as AppUserFileAlert, so that someone can fix the
+// file before the next restart locks everyone out.
+func (a *FileBasedAuthenticator) setStoreError(err error) {
+	a.userLock.Lock()
+	previous := a.storeError
+	a.storeError = err
+	userCount := len(a.userList)
+	a.userLock.Unlock()
+
+	logger := &Logger{}
+	switch {
+	case previous == nil && err != nil:
+		logger.Errorf("ALERT: Problem with user file: %v. "+
+			"Keep serving %d users from memory; a restart now "+
+			"would lock out everyone.", err, userCount)
+		a.eventBus.Post(&AppEvent{
+			Ev:     AppUserFileAlert,
+			Source: "authenticator",
+			Msg:    err.Error(),
+		})
+	case previous != nil && err == nil:
+		logger.Infof("User file %s is fine again", a.userFilename)
+		a.eventBus.Post(&AppEvent{
+			Ev:     AppUserFileAlert,
+			Source: "authenticator",
+		})
+	}
+}
+
+func checkReadable(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// All users in the format of the file, e.g. for replicas.
+func (a *FileBasedAuthenticator) ExportCSV(out io.Writer) error {
+	a.reloadIfChanged()
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	return a.writeCSV(out)
+}
+
+// Write header, users and comments; the users file. Users that didn't
+// change keep their line, so that rewriting after a change only changes
+// the lines of the users affected.
+func (a *FileBasedAuthenticator) writeCSV(out io.Writer) error {
+	writer := csv.NewWriter(out)
+	WriteUserCSVHeader(writer)
+	writeLine := func(line string) {
+		writer.Flush() // Goes in as it is, not as CSV.
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		io.WriteString(out, line)
+	}
+	writeComments := func(comments []string) {
+		for _, comment := range comments {
+			writeLine(comment)
+		}
+	}
+	for i, user := range a.userList {
+		writeComments(a.comments[i])
+		if user == nil {
+			continue
+		}
+		if raw, ok := a.rawLines[user]; ok {
+			writeLine(raw)
+		} else {
+			user.WriteCSV(writer)
+		}
+	}
+	writeComments(a.comments[len(a.userList)])
+	writer.Flush()
+	return writer.Error()
+}
+
 // Full dump of database.
 func (a *FileBasedAuthenticator) writeDatabase() (bool, string) {
 	// First, dump out the database to a temporary file and
@@ -411,6 +1110,7 @@ func (a *FileBasedAuthenticator) writeDatabase() (bool, string) {
 	a.fileLock.Lock()
 	defer a.fileLock.Unlock()
 	os.Rename(tmpFilename, a.userFilename)
+	a.fileAppendable = true
 
 	fileinfo, _ := os.Stat(a.userFilename)
 	a.fileTimestamp = fileinfo.ModTime()
@@ -421,6 +1121,9 @@ func (a *FileBasedAuthenticator) writeDatabase() (bool, string) {
 // Like write database, but just append a single user. In that case, a file
 // append is sufficient.
 func (a *FileBasedAuthenticator) appendDatabaseSingleEntry(user *User) (bool, string) {
+	if !a.fileAppendable {
+		return a.writeDatabase()
+	}
 	// Just append the user to the file which is sufficient for AddNewUser()
 	a.fileLock.Lock()
 	defer a.fileLock.Unlock()
@@ -447,22 +1150,16 @@ func (a *FileBasedAuthenticator) writeTempCSV(filename string) (bool, string) {
 		return false, err.Error()
 	}
 	defer f.Close()
-	writer := csv.NewWriter(f)
-	for _, user := range a.userList {
-		if user != nil {
-			user.WriteCSV(writer)
-		}
-	}
-	writer.Flush()
-	/* writer.Error() does not exist in older go versions :(
-	if writer.Error() != nil {
-		log.Println(writer.Error())
-		return false, writer.Error()
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	if err := a.writeCSV(f); err != nil {
+		return false, err.Error()
 	}
-	*/
 	return true, ""
 }
 
+const authCodeSalt = "MakeThisALittleBitLongerToChewOnEarlFoo"
+
 // We hash the authentication codes, as we don't need/want knowledge
 // of actual IDs just to be able to verify.
 //
@@ -475,62 +1172,112 @@ func (a *FileBasedAuthenticator) writeTempCSV(filename string) (bool, string) {
 // So we merely protect against accidentally revealing a PIN or card-ID and
 // their lengths while browsing the file. A weak MD5 is more than enough for
 // this use-case.
+//
+// Called on every lookup, so it avoids allocating more than the result.
 func hashAuthCode(plain string) string {
-	hashgen := md5.New()
-	io.WriteString(hashgen, "MakeThisALittleBitLongerToChewOnEarlFoo"+plain)
-	return hex.EncodeToString(hashgen.Sum(nil))
+	sum := md5.Sum([]byte(authCodeSalt + plain))
+	var encoded [2 * md5.Size]byte
+	hex.Encode(encoded[:], sum[:])
+	return string(encoded[:])
+}
+
+// RFID card IDs are hex strings. Our firmware sends them in lowercase, but
+// other readers might use uppercase, so we normalize to lowercase to have the
+// same card match everywhere. Leading zeros are kept: they are part of the
+// fixed-length card ID.
+// Wiegand "<facility>:<card>" IDs are brought into canonical decimal form.
+// Only for RFID codes; keypad PINs are used as-is.
+func NormalizeRFID(rfid string) string {
+	rfid = strings.ToLower(strings.TrimSpace(rfid))
+	if facility, card, ok := ParseWiegand(rfid); ok {
+		return formatWiegand(facility, card)
+	}
+	return rfid
 }
 
 // Verify that code is long enough (and possibly other syntactical things, such
 // as not all the same digits and such)
+//
+// A code may be a prefix of another one, e.g. "12345" and "123456": codes
+// typed on a keypad are only ever checked once submitted with '#', so
+// there is no ambiguity. (We couldn't reject prefixes anyway, as we only
+// know the hashes of the codes.) Don't add a handler that checks codes
+// as they are typed.
 func hasMinimalCodeRequirements(code string) bool {
 	// 32Bit Mifare are 8 characters hex, this is more to impose a minimum
-	// 'strength' of a pin.
+	// 'strength' of a pin. Wiegand IDs can be short, but can't be typed.
+	if _, _, ok := ParseWiegand(code); ok {
+		return true
+	}
 	return len(code) >= 5
 }
 
-func (a *FileBasedAuthenticator) userHasAccess(user *User, target Target) (AuthResult, string) {
+// Access as given by the user's level, the same at every target.
+func (a *FileBasedAuthenticator) levelHasAccess(user *User) AuthDecision {
 	// TODO: we need a concept of an 'open' space, i.e. a responsible user
 	// opens the space to be accessible by the public, so that other users
 	// can come in even outside 'their' times. Right now only dummy - never
 	// open.
 	space_open_to_public := false
 
+	// The hours of a level are the same at every target. That includes
+	// the elevator: it is the way up for whoever was let in at the gate,
+	// so by default it mirrors the doors, and after hours it is only for
+	// those with all-hour access. Targets can be closed further with
+	// their schedule (see schedule.go). Which floors someone may select
+	// is up to their AllowedFloors (see ElevatorHandler).
+	//
+	// Hours are compared on the wall clock of our location, so across
+	// daylight saving changes the space still opens and closes at the
+	// same time of day as printed on the door.
 	hour_from, hour_to := user.AccessHours()
-	current_hour := a.clock.Now().Hour()
+	current_hour := a.localNow().Hour()
 	isday := space_open_to_public ||
 		(current_hour >= hour_from && current_hour < hour_to)
 	switch user.UserLevel {
 	case LevelMember:
-		return AuthOk, "" // Members always have access.
+		return authGranted() // Members always have access.
 
 	case LevelPhilanthropist: // Philanthropists also have all-hour access
-		return AuthOk, ""
+		return authGranted()
 
 	case LevelFulltimeUser:
 		if !isday {
-			return AuthOkButOutsideTime,
+			return authDenied(ReasonOutsideDaytime,
 				fmt.Sprintf("Fulltime user outside %d:00..%d:00",
-					hour_from, hour_to)
+					hour_from, hour_to))
 		}
-		return AuthOk, ""
+		return authGranted()
 
 	case LevelUser:
 		if !isday {
-			return AuthOkButOutsideTime,
+			return authDenied(ReasonOutsideDaytime,
 				fmt.Sprintf("Regular user outside %d:00..%d:00",
-					hour_from, hour_to)
+					hour_from, hour_to))
 		}
 		now := a.clock.Now().Unix()
 		if now >= HolidayHiatusBegin && now <= HolidayHiatusEnd {
-			return AuthOkButOutsideTime, "Regular user during holiday hiatus period"
+			return authDenied(ReasonOutsideDaytime,
+				"Regular user during holiday hiatus period")
 		}
-		return AuthOk, ""
+		return authGranted()
+
+	case LevelGuest: // Guests are limited by their validity period.
+		return authGranted()
 
 	case LevelHiatus:
-		return AuthFail, "On Hiatus"
+		return authDenied(ReasonHiatus, "On Hiatus")
+	}
+	return authDenied(ReasonUnknownCode, "")
+}
+
+// The current time in the location of our schedule and days.
+func (a *FileBasedAuthenticator) localNow() time.Time {
+	now := a.clock.Now()
+	if a.location != nil {
+		now = now.In(a.location)
 	}
-	return AuthFail, ""
+	return now
 }
 
 func (a *FileBasedAuthenticator) postUserEvent(ev AppEventType, user *User) {
@@ -539,6 +1286,6 @@ func (a *FileBasedAuthenticator) postUserEvent(ev AppEventType, user *User) {
 		Source: "authenticator",
 		Msg:    "user:" + user.Name,
 		// 'Timeout' of the user is when token expires
-		Timeout: user.ExpiryDate(time.Now()),
+		Timeout: user.ExpiryDate(a.localNow()),
 	})
 }
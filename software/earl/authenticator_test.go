@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/csv"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -27,29 +29,19 @@ func ExpectFalse(t *testing.T, condition bool, message string) {
 	}
 }
 
-func ExpectResult(t *testing.T, auth AuthResult, msg string,
-	expected_auth AuthResult, expected_re string, fail_prefix string) {
-	matcher := regexp.MustCompile(expected_re)
-	matches := matcher.MatchString(msg)
-	if !matches {
-		t.Errorf("%s: Expected '%s' to match '%s'",
-			fail_prefix, msg, expected_re)
+func ExpectAuthResult(t *testing.T, auth Authenticator,
+	code string, target Target, expected ReasonCode) {
+	decision := auth.AuthUser(code, target)
+	if decision.Reason != expected {
+		t.Errorf("%s,%s: Expected %s, got %s (%s)", code, target,
+			expected, decision.Reason, decision.Detail)
 	}
-	if auth != expected_auth {
-		t.Errorf("%s: Expected %d, got %d", fail_prefix, expected_auth, auth)
+	if decision.Granted != (expected == ReasonOK) {
+		t.Errorf("%s,%s: Unexpected granted=%t for %s", code, target,
+			decision.Granted, decision.Reason)
 	}
 }
 
-// Looks like I can't pass output of multiple return function as parameter-tuple.
-// So doing this manually here.
-func ExpectAuthResult(t *testing.T, auth Authenticator,
-	code string, target Target,
-	expected_auth AuthResult, expected_re string) {
-	auth_result, msg := auth.AuthUser(code, target)
-	ExpectResult(t, auth_result, msg, expected_auth, expected_re,
-		code+","+string(target))
-}
-
 // Strip message from bool/string tuple and just return the bool
 func eatmsg(ok bool, msg string) bool {
 	if msg != "" {
@@ -145,6 +137,7 @@ func TestAddUser(t *testing.T) {
 
 	// A Philanthropist however, can add a new user.
 	u.Name = "Philanthropist adding"
+	u.UserLevel = LevelUser
 	u.SetAuthCode("fromphil")
 	ExpectTrue(t, eatmsg(auth.AddNewUser("phil123", u)),
 		"Philanthropist adding new user")
@@ -158,6 +151,40 @@ func TestAddUser(t *testing.T) {
 	ExpectTrue(t, auth.FindUser("expired123") != nil, "Finding expired123")
 }
 
+func TestAddUserLevelRules(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-add-level")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	add := func(actor string, name string, level Level) bool {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: level}
+		u.SetAuthCode(name + "123")
+		ok, _ := auth.AddNewUser(actor, u)
+		return ok
+	}
+	ExpectTrue(t, add("root123", "phil", LevelPhilanthropist), "Member adds philanthropist")
+	ExpectTrue(t, add("root123", "user", LevelUser), "Member adds user")
+	ExpectTrue(t, add("root123", "other", LevelMember), "Member adds member")
+
+	ExpectFalse(t, add("phil123", "member", LevelMember),
+		"Philanthropist can't add member")
+	ExpectFalse(t, add("phil123", "philtoo", LevelPhilanthropist),
+		"Philanthropist can't add their own level")
+	ExpectFalse(t, add("phil123", "odd", Level("admin")),
+		"Nor anything we don't know")
+	ExpectTrue(t, add("phil123", "fulltime", LevelFulltimeUser),
+		"Philanthropist adds fulltime user")
+	ExpectTrue(t, add("phil123", "guest", LevelGuest), "Philanthropist adds guest")
+
+	ExpectFalse(t, add("user123", "sneaky", LevelMember), "User can't add member")
+	ExpectFalse(t, add("user123", "friend", LevelUser), "User can't add anyone")
+	ExpectTrue(t, auth.FindUser("member123") == nil, "Not added")
+
+	_, msg := auth.AddNewUser("phil123", User{Name: "x", UserLevel: LevelMember})
+	ExpectTrue(t, msg == "Not authorized to add member.", "Tells why: "+msg)
+}
+
 func TestUpdateUser(t *testing.T) {
 	authFile, _ := ioutil.TempFile("", "test-update-user")
 	auth := CreateSimpleFileAuth(authFile, RealClock{})
@@ -317,67 +344,133 @@ func TestTimeLimits(t *testing.T) {
 	u.SetAuthCode("user_nocontact")
 	auth.AddNewUser("root123", u)
 
+	// User with contact info that is just blank.
+	u = User{
+		Name:        "Blank User",
+		ContactInfo: "  ",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user_blankcontact")
+	auth.AddNewUser("root123", u)
+
+	// The elevator has the same rules as the doors.
+	expectEverywhere := func(code string, expected ReasonCode) {
+		for _, target := range []Target{TargetDownstairs, TargetUpstairs, TargetElevator} {
+			ExpectAuthResult(t, auth, code, target, expected)
+		}
+	}
+
 	mockClock.now = nightTime_3h
-	ExpectAuthResult(t, auth, "member123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
-	ExpectAuthResult(t, auth, "member_nocontact", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	expectEverywhere("member123", ReasonOK)
+	expectEverywhere("philanthropist123", ReasonOK)
+	expectEverywhere("fulltimeuser123", ReasonOutsideDaytime)
+	expectEverywhere("user123", ReasonOutsideDaytime)
+	expectEverywhere("member_nocontact", ReasonOK)
+	expectEverywhere("user_nocontact", ReasonOutsideDaytime)
 
 	mockClock.now = earlyMorning_7h
-	ExpectAuthResult(t, auth, "member123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
-	ExpectAuthResult(t, auth, "member_nocontact", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	expectEverywhere("member123", ReasonOK)
+	expectEverywhere("philanthropist123", ReasonOK)
+	expectEverywhere("fulltimeuser123", ReasonOK)
+	expectEverywhere("user123", ReasonOutsideDaytime)
+	expectEverywhere("member_nocontact", ReasonOK)
+	expectEverywhere("user_nocontact", ReasonOutsideDaytime)
 
 	mockClock.now = hackerDaytime_13h
-	ExpectAuthResult(t, auth, "member123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "hiatus123", TargetUpstairs,
-		AuthFail, "hiatus")
-	ExpectAuthResult(t, auth, "member_nocontact", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs, AuthOk, "")
+	expectEverywhere("member123", ReasonOK)
+	expectEverywhere("philanthropist123", ReasonOK)
+	expectEverywhere("fulltimeuser123", ReasonOK)
+	expectEverywhere("user123", ReasonOK)
+	expectEverywhere("hiatus123", ReasonHiatus)
+	expectEverywhere("member_nocontact", ReasonOK)
+	expectEverywhere("user_nocontact", ReasonOK)
 
 	mockClock.now = closingTime_22h // should behave similar to earlyMorning
-	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "member123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
-	ExpectAuthResult(t, auth, "member_nocontact", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	expectEverywhere("philanthropist123", ReasonOK)
+	expectEverywhere("member123", ReasonOK)
+	expectEverywhere("fulltimeuser123", ReasonOK)
+	expectEverywhere("user123", ReasonOutsideDaytime)
+	expectEverywhere("member_nocontact", ReasonOK)
+	expectEverywhere("user_nocontact", ReasonOutsideDaytime)
 
 	mockClock.now = lateStayUsers_23h // members, philanthropists, and fulltimeusers left
-	ExpectAuthResult(t, auth, "member123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
-	ExpectAuthResult(t, auth, "member_nocontact", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	expectEverywhere("member123", ReasonOK)
+	expectEverywhere("philanthropist123", ReasonOK)
+	expectEverywhere("fulltimeuser123", ReasonOK)
+	expectEverywhere("user123", ReasonOutsideDaytime)
+	expectEverywhere("member_nocontact", ReasonOK)
+	expectEverywhere("user_nocontact", ReasonOutsideDaytime)
 
 	// Automatic expiry of entries that don't have contact info
 	mockClock.now = anonExpiry_30d
-	ExpectAuthResult(t, auth, "member123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
-	ExpectAuthResult(t, auth, "member_nocontact", TargetUpstairs,
-		AuthExpired, "Code not valid yet/expired")
-	ExpectAuthResult(t, auth, "user_nocontact", TargetUpstairs,
-		AuthExpired, "Code not valid yet/expired")
+	expectEverywhere("member123", ReasonOK)
+	expectEverywhere("philanthropist123", ReasonOK)
+	expectEverywhere("fulltimeuser123", ReasonOK)
+	expectEverywhere("user123", ReasonOK)
+	expectEverywhere("member_nocontact", ReasonExpired)
+	expectEverywhere("user_nocontact", ReasonExpired)
+	expectEverywhere("user_blankcontact", ReasonExpired)
+}
+
+func TestTargetSchedules(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "schedule-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	// Gate as before, quieter hours upstairs, members-only elevator at
+	// night, and a workshop that is closed at night even for members.
+	auth.(*FileBasedAuthenticator).schedules = map[Target]TargetSchedule{
+		TargetUpstairs: {From: 12, To: 20},
+		TargetElevator: {From: 7, To: 22, AfterHours: AfterHoursMembers},
+		"workshop":     {From: 9, To: 18, AfterHours: AfterHoursNobody},
+	}
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some Member",
+		ContactInfo: "member@noisebridge.net",
+		UserLevel:   LevelMember}
+	u.SetAuthCode("member123")
+	auth.AddNewUser("root123", u)
+
+	u = User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+
+	u = User{
+		Name:        "Some Fulltime User",
+		ContactInfo: "ftuser@noisebridge.net",
+		UserLevel:   LevelFulltimeUser}
+	u.SetAuthCode("fulltimeuser123")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = someMidnight.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "member123", TargetUpstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "member123", TargetElevator, ReasonOK)
+	ExpectAuthResult(t, auth, "member123", "workshop", ReasonOutsideDaytime)
+
+	mockClock.now = someMidnight.Add(11 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
+	ExpectAuthResult(t, auth, "user123", TargetElevator, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", "workshop", ReasonOK)
+
+	mockClock.now = someMidnight.Add(13 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOK)
+
+	// The level's hours still apply within the open hours of a target.
+	mockClock.now = someMidnight.Add(23 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetElevator, ReasonOutsideDaytime)
+	ExpectAuthResult(t, auth, "member123", TargetElevator, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonOutsideDaytime)
 }
 
 func TestHolidayTimeLimits(t *testing.T) {
@@ -407,22 +500,919 @@ func TestHolidayTimeLimits(t *testing.T) {
 	auth.AddNewUser("root123", u)
 
 	mockClock.now = nightTime_3h
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
 
 	mockClock.now = earlyMorning_7h
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
 
 	mockClock.now = hackerDaytime_13h
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "holiday")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
 
 	mockClock.now = closingTime_22h // should behave similar to earlyMorning
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
 
 	mockClock.now = lateStayUsers_23h
-	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
-		AuthOkButOutsideTime, "outside")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
+}
+
+func TestDaylightSavingTimeLimits(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("No timezone database: ", err)
+	}
+	authFile, _ := ioutil.TempFile("", "dst-timing-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	auth.(*FileBasedAuthenticator).location = location
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	// The clock is in UTC, as the RealClock would be on a server
+	// configured that way; the schedule needs to be in local time.
+	at := func(utc string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", utc)
+		return result
+	}
+
+	mockClock.now = at("2024-03-01 12:00")
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+	u = User{
+		Name:        "Some Fulltime User",
+		ContactInfo: "ftuser@noisebridge.net",
+		UserLevel:   LevelFulltimeUser}
+	u.SetAuthCode("fulltimeuser123")
+	auth.AddNewUser("root123", u)
+
+	// Spring forward: 2024-03-10 02:00 PST becomes 03:00 PDT.
+	mockClock.now = at("2024-03-10 09:59") // 01:59 PST
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-03-10 10:00") // 03:00 PDT
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-03-10 13:59") // 06:59 PDT
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-03-10 14:00") // 07:00 PDT
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-03-10 17:59") // 10:59 PDT
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-03-10 18:00") // 11:00 PDT
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-03-11 04:59") // 21:59 PDT
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-03-11 05:00") // 22:00 PDT
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
+
+	// Fall back: 2024-11-03 02:00 PDT becomes 01:00 PST. The hour
+	// from 01:00 happens twice; it is night both times.
+	mockClock.now = at("2024-11-03 08:30") // 01:30 PDT
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-11-03 09:30") // 01:30 PST
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-11-03 14:59") // 06:59 PST
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-11-03 15:00") // 07:00 PST
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-11-03 18:59") // 10:59 PST
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
+	mockClock.now = at("2024-11-03 19:00") // 11:00 PST
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-11-04 05:59") // 21:59 PST
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-11-04 06:00") // 22:00 PST
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, ReasonOutsideDaytime)
+}
+
+func TestAllowedTargetsAndFloors(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-allowed-targets")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	u := User{
+		Name:           "Elevator only",
+		ContactInfo:    "e@nb",
+		UserLevel:      LevelMember,
+		AllowedTargets: []Target{TargetElevator},
+		AllowedFloors:  []int{2, 3}}
+	u.SetAuthCode("lift123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	// Restrictions survive writing and re-reading the file.
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectAuthResult(t, auth, "lift123", TargetElevator, ReasonOK)
+	ExpectAuthResult(t, auth, "lift123", TargetDownstairs, ReasonWrongTarget)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+
+	found := auth.FindUser("lift123")
+	ExpectTrue(t, found.MayAccessFloor(3), "Floor 3 allowed")
+	ExpectFalse(t, found.MayAccessFloor(4), "Floor 4 not allowed")
+	ExpectTrue(t, auth.FindUser("root123").MayAccessFloor(4),
+		"No restriction: all floors")
+}
+
+func TestGuestCode(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-guest-code")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	// Guest from 5 hours ago, valid for 4 hours: already expired.
+	mockClock.now = time.Now().Add(-5 * time.Hour)
+	_, err := auth.CreateGuestCode("non-existent member", 4*time.Hour, "")
+	ExpectTrue(t, err != nil, "Only members can create guests")
+	oldGuest, err := auth.CreateGuestCode("root123", 4*time.Hour, "")
+	ExpectTrue(t, err == nil, "Create guest code")
+	ExpectTrue(t, len(oldGuest) == guestCodeDigits, "Guest code length")
+	mockClock.now = mockClock.now.Add(time.Minute)
+	ExpectAuthResult(t, auth, oldGuest, TargetUpstairs, ReasonOK)
+	mockClock.now = mockClock.now.Add(4 * time.Hour)
+	ExpectAuthResult(t, auth, oldGuest, TargetUpstairs, ReasonExpired)
+
+	// A current guest, only valid at the gate.
+	mockClock.now = time.Now()
+	guest, err := auth.CreateGuestCode("root123", 4*time.Hour, TargetDownstairs)
+	ExpectTrue(t, err == nil, "Create guest code")
+	ExpectTrue(t, guest != oldGuest, "Guest codes are different")
+	mockClock.now = mockClock.now.Add(time.Minute)
+	ExpectAuthResult(t, auth, guest, TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, guest, TargetUpstairs, ReasonWrongTarget)
+
+	// Expired guests are purged when reading the file.
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, auth.FindUser(oldGuest) == nil, "Expired guest purged")
+	ExpectTrue(t, auth.FindUser(guest) != nil, "Current guest still there")
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, auth.FindUser(oldGuest) == nil, "Purge written to file")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Root still there")
+}
+
+func TestGuestWithoutEndNotPurged(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "test-guest-no-end")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	guest := User{
+		Name:        "Guest",
+		ContactInfo: "guest@nb",
+		UserLevel:   LevelGuest,
+		ValidFrom:   time.Now().Add(-time.Hour),
+	}
+	guest.SetAuthCode("guest123")
+	writer := csv.NewWriter(authFile)
+	guest.WriteCSV(writer)
+	writer.Flush()
+	authFile.Close()
+
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, auth.FindUser("guest123") != nil, "Guest without end kept")
+}
+
+func TestAnonymousValidityPeriod(t *testing.T) {
+	defer func() {
+		ValidityPeriodAnonymousCards = DefaultValidityPeriodAnonymousCards
+	}()
+	registered, _ := time.Parse("2006-01-02", "2014-10-10")
+	u := User{
+		UserLevel:    LevelUser,
+		ValidFrom:    registered.Add(-365 * 24 * time.Hour),
+		RegisteredAt: registered}
+
+	// Expiry is measured from registration, not ValidFrom.
+	ExpectTrue(t, u.InValidityPeriod(registered.Add(29*24*time.Hour)),
+		"Valid within 30 days")
+	ExpectFalse(t, u.InValidityPeriod(registered.Add(31*24*time.Hour)),
+		"Expired after 30 days")
+
+	ValidityPeriodAnonymousCards = 7 * 24 * time.Hour
+	ExpectFalse(t, u.InValidityPeriod(registered.Add(8*24*time.Hour)),
+		"Expired after configured 7 days")
+
+	u.ContactInfo = "user@noisebridge.net"
+	u.Name = "Some User"
+	ExpectTrue(t, u.InValidityPeriod(registered.Add(31*24*time.Hour)),
+		"Users with contact info don't expire")
+}
+
+func TestRegistrationTimeSurvivesReload(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "registration-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	registered, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = registered
+	u := User{UserLevel: LevelMember}
+	u.SetAuthCode("anonymous123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	// Expiry is still based on the registration after re-reading.
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	reloaded.clock = mockClock
+	found := reloaded.FindUser("anonymous123")
+	ExpectTrue(t, found.RegisteredAt.Equal(registered), "Registration time read")
+	mockClock.now = registered.Add(29 * 24 * time.Hour)
+	ExpectAuthResult(t, reloaded, "anonymous123", TargetUpstairs, ReasonOK)
+	mockClock.now = registered.Add(31 * 24 * time.Hour)
+	ExpectAuthResult(t, reloaded, "anonymous123", TargetUpstairs, ReasonExpired)
+}
+
+func TestAuthUserReturnsUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "auth-user-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	decision := auth.AuthUser("root123", TargetDownstairs)
+	ExpectTrue(t, decision.Granted, "root granted")
+	ExpectTrue(t, decision.User != nil && decision.User.Name == "root",
+		"Granted decision has user")
+
+	// Modifying the returned user doesn't change the database.
+	decision.User.UserLevel = LevelHiatus
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+
+	u := User{Name: "Night owl", ContactInfo: "owl@nb", UserLevel: LevelUser}
+	u.SetAuthCode("owl12345")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	mockClock.now = mockClock.now.Add(time.Minute) // Still around midnight.
+	decision = auth.AuthUser("owl12345", TargetDownstairs)
+	ExpectTrue(t, decision.Reason == ReasonOutsideDaytime, "Outside daytime")
+	ExpectTrue(t, decision.User != nil && decision.User.Name == "Night owl",
+		"Denied decision still has user")
+
+	decision = auth.AuthUser("unknown123", TargetDownstairs)
+	ExpectTrue(t, decision.Reason == ReasonUnknownCode, "Unknown code")
+	ExpectTrue(t, decision.User == nil, "No user for unknown code")
+}
+
+func TestCheckCodeMatchesAuthUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "check-code-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	u := User{Name: "Some User", ContactInfo: "u@nb", UserLevel: LevelUser,
+		AllowedTargets: []Target{TargetUpstairs}}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+
+	for _, hour := range []int{3, 13} {
+		mockClock.now = time.Date(2014, 10, 10, hour, 0, 0, 0, time.UTC)
+		for _, code := range []string{"user123", "root123", "nobody123", "x"} {
+			for _, target := range []Target{TargetUpstairs, TargetDownstairs} {
+				checked := auth.CheckCode(code, target)
+				authed := auth.AuthUser(code, target)
+				if checked.Granted != authed.Granted ||
+					checked.Reason != authed.Reason {
+					t.Errorf("%s,%s at %d:00: CheckCode %s, AuthUser %s",
+						code, target, hour, checked.Reason, authed.Reason)
+				}
+			}
+		}
+	}
+	ExpectTrue(t, auth.CheckCode("user123", TargetUpstairs).User.Name == "Some User",
+		"User in decision")
+}
+
+func TestCommentSurvivesReload(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "comment-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	u := User{Name: "Extra Card", ContactInfo: "extra@nb", UserLevel: LevelUser}
+	u.Comment = "For Jane, \"spare\" card; lost the other one" // Stress-test CSV
+	u.SetAuthCode("extra123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	guest, err := auth.CreateGuestCode("root123", time.Hour, "")
+	ExpectTrue(t, err == nil, "Creating guest code")
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("extra123").Comment == u.Comment,
+		"Comment read back")
+	ExpectTrue(t, reloaded.FindUser(guest).Comment == "guest of root",
+		"Guest code notes sponsor")
+	ExpectTrue(t, reloaded.FindUser("root123").Comment == "",
+		"No comment for users without")
+}
+
+func TestCommentLinesSurviveRewrite(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "comment-line-tests")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	writer := csv.NewWriter(authFile)
+	writeUser := func(name string, level Level) {
+		user := User{Name: name, ContactInfo: name + "@nb", UserLevel: level}
+		user.SetAuthCode(name + "123")
+		user.WriteCSV(writer)
+		writer.Flush()
+	}
+	authFile.WriteString("# Members,of,the,board\n")
+	writeUser("root", LevelMember)
+	authFile.WriteString("# Don't \"forget\": keys are in the box\n")
+	writeUser("alice", LevelUser)
+	authFile.WriteString("  # Former members below\n")
+	writeUser("bob", LevelUser)
+	authFile.WriteString("# End of list\n")
+	authFile.Close()
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, auth.FindUser("alice123") != nil, "Read past quotes in comment")
+
+	u := User{Name: "carol", ContactInfo: "carol@nb", UserLevel: LevelUser}
+	u.SetAuthCode("carol123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "bob123")), "Deleting user")
+
+	// Rewritten with header; comments where they were.
+	content, _ := ioutil.ReadFile(authFile.Name())
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	ExpectTrue(t, strings.HasPrefix(lines[0], userCSVSchemaMarker), "Rewritten")
+	var found []string
+	for _, line := range lines[2:] {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			line = strings.Split(line, ",")[0] // Just the name.
+		}
+		found = append(found, line)
+	}
+	expected := []string{"# Members,of,the,board", "root",
+		"# Don't \"forget\": keys are in the box", "alice",
+		"  # Former members below", "# End of list", "carol"}
+	ExpectTrue(t, strings.Join(found, "|") == strings.Join(expected, "|"),
+		"Comments kept in place: "+strings.Join(found, "|"))
+
+	// And read back the same.
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("carol123") != nil, "New user read back")
+	ExpectTrue(t, eatmsg(reloaded.DeleteUser("root123", "carol123")), "Rewriting again")
+	rewritten, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Count(string(rewritten), "#") == strings.Count(string(content), "#"),
+		"Comments survive another rewrite")
+}
+
+func TestUntouchedLinesSurviveRewrite(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "untouched-line-tests")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	// Written by hand, or by older versions: fewer columns, other quoting.
+	original := []string{
+		"# Board",
+		"root,root@nb,member,,2020-01-01 10:00,," + hashAuthCode("root123"),
+		"# Regulars",
+		`"zoe",zoe@nb,user,,2020-01-01 10:00,,` + hashAuthCode("zoe123") + `,,,,"likes ""tea"""`,
+		"bob,bob@nb,user,,2020-01-01 10:00,," + hashAuthCode("bob123"),
+		"amy,amy@nb,user,,2020-01-01 10:00,," + hashAuthCode("amy123"),
+	}
+	authFile.WriteString(strings.Join(original, "\n") + "\n")
+	authFile.Close()
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+
+	u := User{Name: "carl", ContactInfo: "carl@nb", UserLevel: LevelUser}
+	u.SetAuthCode("carl123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	ExpectTrue(t, eatmsg(auth.SetSuspended("root123", "amy123", true)), "Changing user")
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "bob123")), "Deleting user")
+
+	content, _ := ioutil.ReadFile(authFile.Name())
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	ExpectTrue(t, len(lines) == 2+6, "Header, four old lines, amy and carl")
+	ExpectTrue(t, strings.Join(lines[2:6], "\n") == strings.Join(original[0:4], "\n"),
+		"Untouched lines and comments as they were:\n"+strings.Join(lines[2:6], "\n"))
+	ExpectTrue(t, strings.HasPrefix(lines[6], "amy,") &&
+		strings.Contains(lines[6], "suspended"), "Changed user in place: "+lines[6])
+	ExpectTrue(t, strings.HasPrefix(lines[7], "carl,"), "Added user at the end")
+
+	// Accessing changes the line, once flushed.
+	auth.AuthUser("root123", TargetUpstairs)
+	ExpectTrue(t, eatmsg(auth.FlushLastAccess()), "Flushing")
+	content, _ = ioutil.ReadFile(authFile.Name())
+	lines = strings.Split(strings.TrimSpace(string(content)), "\n")
+	ExpectTrue(t, lines[3] != original[1], "Last access written")
+	ExpectTrue(t, lines[5] == original[3], "Others still untouched")
+}
+
+func TestPrefixCodes(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "prefix-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	// Codes are submitted with '#', so one can be the prefix of another.
+	u := User{Name: "Short", ContactInfo: "s@nb", UserLevel: LevelMember}
+	u.SetAuthCode("12345")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding short code")
+	u = User{Name: "Long", ContactInfo: "l@nb", UserLevel: LevelMember}
+	u.SetAuthCode("123456")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding longer code")
+	u = User{Name: "Root prefix", ContactInfo: "r@nb", UserLevel: LevelMember}
+	u.SetAuthCode("root1")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding prefix code")
+
+	ExpectTrue(t, auth.FindUser("12345").Name == "Short", "Short code")
+	ExpectTrue(t, auth.FindUser("123456").Name == "Long", "Longer code")
+	ExpectTrue(t, auth.FindUser("root1").Name == "Root prefix", "Prefix code")
+	ExpectTrue(t, auth.FindUser("root123").Name == "root", "Root unchanged")
+	ExpectTrue(t, auth.FindUser("1234567") == nil, "Longer yet is unknown")
+}
+
+func TestWrittenFileHasHeader(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "header-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	// Adding appends to the headerless file ...
+	u := User{Name: "Some User", ContactInfo: "u@nb", UserLevel: LevelUser}
+	u.SetAuthCode("user123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	// ... while rewriting the file adds the header.
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "user123", func(user *User) bool {
+		user.Comment = "updated"
+		return true
+	})), "Updating user")
+
+	content, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.HasPrefix(string(content), "# earl-users schema 2\n#name,"),
+		"Schema marker and header")
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("user123").Comment == "updated", "Read back")
+	ExpectTrue(t, reloaded.FindUser("root123") != nil, "Root still there")
+}
+
+func TestAddingToRearrangedFile(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "rearranged-tests")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	root := User{Name: "root", ContactInfo: "root@nb"}
+	root.SetAuthCode("root123")
+	authFile.WriteString("#codes,level,name,contact-info\n" +
+		root.Codes[0] + ",member,root,root@nb\n")
+	authFile.Close()
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Root read by column name")
+
+	// Appending in our column order would garble it; needs a rewrite.
+	u := User{Name: "Some User", ContactInfo: "u@nb", UserLevel: LevelUser}
+	u.SetAuthCode("user123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("user123") != nil, "New user read back")
+	ExpectTrue(t, reloaded.FindUser("root123") != nil, "Root still there")
+}
+
+// Run with -race: accesses update the stored user.
+func TestConcurrentAccess(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "concurrent-access-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				auth.AuthUser("root123", TargetUpstairs)
+				auth.FindUser("root123")
+			}
+		}()
+	}
+	wg.Wait()
+	ExpectFalse(t, auth.FindUser("root123").LastAccess.IsZero(), "Recorded")
+}
+
+func TestLastAccessSurvivesFlush(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "last-access-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock.now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	u := User{Name: "Some Member", ContactInfo: "m@nb", UserLevel: LevelMember}
+	u.SetAuthCode("member123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	mockClock.now = mockClock.now.Add(time.Hour)
+	auth.CheckCode("member123", TargetUpstairs)
+	ExpectTrue(t, auth.FindUser("member123").LastAccess.IsZero(),
+		"Checking is not an access")
+	ExpectAuthResult(t, auth, "member123", TargetUpstairs, ReasonOK)
+	ExpectTrue(t, auth.FindUser("member123").LastAccess.Equal(mockClock.now),
+		"Access recorded")
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("member123").LastAccess.IsZero(),
+		"Not written on each access")
+	ExpectTrue(t, eatmsg(auth.FlushLastAccess()), "Flushing")
+	reloaded = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("member123").LastAccess.Equal(mockClock.now),
+		"Written on flush")
+	ExpectTrue(t, reloaded.FindUser("root123").LastAccess.IsZero(),
+		"Others untouched")
+
+	// Decided first, recorded once the door opens.
+	mockClock.now = mockClock.now.Add(time.Hour)
+	decision := auth.CheckCode("member123", TargetUpstairs)
+	auth.RecordAccess(decision.User, TargetUpstairs)
+	ExpectTrue(t, auth.FindUser("member123").LastAccess.Equal(mockClock.now),
+		"Recorded access")
+
+	// Access times not flushed yet survive a reload of the edited file.
+	mockClock.now = mockClock.now.Add(time.Hour)
+	ExpectAuthResult(t, auth, "member123", TargetUpstairs, ReasonOK)
+	accessed := mockClock.now
+	edited := time.Now().Add(time.Minute)
+	os.Chtimes(authFile.Name(), edited, edited)
+	mockClock.now = mockClock.now.Add(defaultFileCheckInterval)
+	ExpectTrue(t, auth.FindUser("member123").LastAccess.Equal(accessed),
+		"Kept across reload")
+	ExpectTrue(t, auth.fileTimestamp.Equal(edited), "File was reloaded")
+}
+
+func TestDailyLimits(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "daily-limit-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock.now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	u := User{Name: "Trial Entries", ContactInfo: "e@nb",
+		UserLevel: LevelMember, DailyEntries: 2}
+	u.SetAuthCode("entries123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	u = User{Name: "Trial Budget", ContactInfo: "b@nb",
+		UserLevel: LevelMember, DailyBudget: 3 * time.Hour}
+	u.SetAuthCode("budget123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	mockClock.now = mockClock.now.Add(time.Minute)
+	ExpectAuthResult(t, auth, "entries123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "entries123", TargetUpstairs, ReasonOK)
+	ExpectTrue(t, auth.CheckCode("entries123", TargetUpstairs).Reason ==
+		ReasonDailyLimit, "Checking tells the limit")
+	ExpectAuthResult(t, auth, "entries123", TargetDownstairs, ReasonDailyLimit)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+
+	ExpectAuthResult(t, auth, "budget123", TargetDownstairs, ReasonOK)
+	mockClock.now = mockClock.now.Add(2 * time.Hour)
+	ExpectAuthResult(t, auth, "budget123", TargetDownstairs, ReasonOK)
+	mockClock.now = mockClock.now.Add(time.Hour)
+	ExpectAuthResult(t, auth, "budget123", TargetDownstairs, ReasonDailyLimit)
+
+	// Usage is kept when the file is reloaded ...
+	mockClock.now = time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	edited := time.Now().Add(time.Minute)
+	os.Chtimes(authFile.Name(), edited, edited)
+	ExpectAuthResult(t, auth, "entries123", TargetDownstairs, ReasonDailyLimit)
+	ExpectTrue(t, auth.fileTimestamp.Equal(edited), "File was reloaded")
+
+	// ... and starts over after midnight.
+	mockClock.now = time.Date(2024, 5, 2, 0, 1, 0, 0, time.UTC)
+	ExpectAuthResult(t, auth, "entries123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "budget123", TargetDownstairs, ReasonOK)
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	user := reloaded.FindUser("budget123")
+	ExpectTrue(t, user.DailyBudget == 3*time.Hour && user.DailyEntries == 0,
+		"Budget survives reload")
+	ExpectTrue(t, reloaded.FindUser("entries123").DailyEntries == 2,
+		"Entries survive reload")
+}
+
+func TestLocalDaysSurviveReload(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("No timezone database: ", err)
+	}
+	authFile, _ := ioutil.TempFile("", "local-day-reload-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.location = location
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock.now = time.Date(2026, 10, 16, 12, 0, 0, 0, location)
+	validTo := startOfDayAfter(mockClock.now, 7) // 2026-10-23 00:00 PDT
+	u := User{Name: "Week", ContactInfo: "w@nb", UserLevel: LevelMember,
+		ValidFrom: mockClock.now, ValidTo: validTo}
+	u.SetAuthCode("week1234")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	reloaded.location = location
+	reloaded.clock = mockClock
+	ExpectTrue(t, reloaded.FindUser("week1234").ValidTo.Equal(validTo),
+		"Same end after reload: "+reloaded.FindUser("week1234").ValidTo.String())
+	mockClock.now = validTo.Add(-time.Minute)
+	ExpectAuthResult(t, reloaded, "week1234", TargetDownstairs, ReasonOK)
+}
+
+func TestLocalDayBoundaries(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("No timezone database: ", err)
+	}
+	authFile, _ := ioutil.TempFile("", "local-day-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.location = location
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	// The clock is in UTC; days are counted in Los Angeles.
+	at := func(utc string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", utc)
+		return result
+	}
+
+	mockClock.now = at("2024-03-02 04:00") // 2024-03-01 20:00 PST
+	u := User{Name: "Anonymous", UserLevel: LevelMember}
+	u.SetAuthCode("anonymous123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	u = User{Name: "Trial", ContactInfo: "t@nb", UserLevel: LevelMember,
+		DailyEntries: 1}
+	u.SetAuthCode("trial123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+
+	// 30 days from March 1st end at local midnight of March 31st, which
+	// is in PDT by then.
+	mockClock.now = at("2024-03-31 06:59")
+	ExpectAuthResult(t, auth, "anonymous123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-03-31 07:00")
+	ExpectAuthResult(t, auth, "anonymous123", TargetUpstairs, ReasonExpired)
+
+	// The daily limit starts over at local midnight, not midnight UTC.
+	mockClock.now = at("2024-05-01 16:30") // 09:30 PDT
+	ExpectAuthResult(t, auth, "trial123", TargetUpstairs, ReasonOK)
+	mockClock.now = at("2024-05-02 00:30") // 17:30 PDT
+	ExpectAuthResult(t, auth, "trial123", TargetUpstairs, ReasonDailyLimit)
+	mockClock.now = at("2024-05-02 06:59") // 23:59 PDT
+	ExpectAuthResult(t, auth, "trial123", TargetUpstairs, ReasonDailyLimit)
+	mockClock.now = at("2024-05-02 07:00") // 00:00 PDT
+	ExpectAuthResult(t, auth, "trial123", TargetUpstairs, ReasonOK)
+}
+
+func TestSuspendUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "suspend-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	u := User{Name: "Some Member", ContactInfo: "m@nb", UserLevel: LevelMember}
+	u.SetAuthCode("member123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding member")
+	u = User{Name: "Phil", ContactInfo: "p@nb", UserLevel: LevelPhilanthropist}
+	u.SetAuthCode("phil123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding philanthropist")
+	mockClock.now = mockClock.now.Add(time.Minute)
+
+	ExpectFalse(t, eatmsg(auth.SetSuspended("phil123", "member123", true)),
+		"Only members can suspend")
+	ExpectFalse(t, eatmsg(auth.SetSuspended("root123", "nobody123", true)),
+		"Unknown user")
+
+	ExpectTrue(t, eatmsg(auth.SetSuspended("root123", "member123", true)),
+		"Suspending")
+	ExpectAuthResult(t, auth, "member123", TargetUpstairs, ReasonSuspended)
+	ExpectFalse(t, eatmsg(auth.SetSuspended("member123", "root123", true)),
+		"Suspended members can't suspend others")
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	reloaded.clock = mockClock
+	user := reloaded.FindUser("member123")
+	ExpectTrue(t, user.Suspended, "Suspension persisted")
+	ExpectTrue(t, user.UserLevel == LevelMember, "Level kept")
+	ExpectAuthResult(t, reloaded, "member123", TargetUpstairs, ReasonSuspended)
+
+	ExpectTrue(t, eatmsg(auth.SetSuspended("root123", "member123", false)),
+		"Unsuspending")
+	ExpectAuthResult(t, auth, "member123", TargetUpstairs, ReasonOK)
+	reloaded = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	reloaded.clock = mockClock
+	ExpectAuthResult(t, reloaded, "member123", TargetUpstairs, ReasonOK)
+}
+
+func TestDuressCode(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "duress-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	u := User{Name: "Some Member", ContactInfo: "m@nb", UserLevel: LevelMember}
+	u.SetAuthCode("member123")
+	u.SetDuressCode("member911")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding member")
+
+	decision := auth.AuthUser("member123", TargetUpstairs)
+	ExpectTrue(t, decision.Granted && !decision.Duress, "Regular code")
+	decision = auth.AuthUser("member911", TargetUpstairs)
+	ExpectTrue(t, decision.Granted && decision.Duress, "Duress code")
+	ExpectTrue(t, decision.User != nil && decision.User.Name == "Some Member",
+		"Duress code has user")
+
+	// Only good to get in.
+	ExpectTrue(t, auth.FindUser("member911") == nil, "Not found by duress code")
+	n := User{Name: "Someone", ContactInfo: "s@nb", UserLevel: LevelUser}
+	n.SetAuthCode("someone123")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("member911", n)),
+		"Duress code can't add users")
+
+	// Codes can't be shared between regular and duress codes.
+	n.SetAuthCode("member911")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("root123", n)),
+		"Duress code in use")
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	reloaded.clock = mockClock
+	decision = reloaded.AuthUser("member911", TargetUpstairs)
+	ExpectTrue(t, decision.Granted && decision.Duress, "Duress code persisted")
+}
+
+func TestRenewalGrace(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "renewal-grace-tests")
+	mockClock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	u := User{Name: "Lapsed Member", ContactInfo: "l@nb", UserLevel: LevelMember,
+		ValidFrom: mockClock.now.Add(-365 * 24 * time.Hour),
+		ValidTo:   mockClock.now.Add(time.Hour)}
+	u.SetAuthCode("lapsed123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding member")
+
+	decision := auth.AuthUser("lapsed123", TargetUpstairs)
+	ExpectTrue(t, decision.Granted && !decision.RenewalDue, "Still valid")
+
+	mockClock.now = mockClock.now.Add(2 * time.Hour)
+	decision = auth.AuthUser("lapsed123", TargetUpstairs)
+	ExpectTrue(t, !decision.Granted && decision.Reason == ReasonExpired,
+		"No grace by default")
+
+	auth.renewalGrace = 7 * 24 * time.Hour
+	decision = auth.AuthUser("lapsed123", TargetUpstairs)
+	ExpectTrue(t, decision.Granted && decision.RenewalDue, "In grace, renewal due")
+	ExpectTrue(t, auth.CheckCode("lapsed123", TargetUpstairs).RenewalDue,
+		"Checking tells as well")
+
+	// Grace doesn't get around the other checks.
+	ExpectTrue(t, eatmsg(auth.SetSuspended("root123", "lapsed123", true)), "Suspending")
+	decision = auth.AuthUser("lapsed123", TargetUpstairs)
+	ExpectTrue(t, !decision.Granted && decision.Reason == ReasonSuspended,
+		"Suspended in grace")
+	ExpectTrue(t, eatmsg(auth.SetSuspended("root123", "lapsed123", false)), "Unsuspending")
+
+	mockClock.now = mockClock.now.Add(7 * 24 * time.Hour)
+	decision = auth.AuthUser("lapsed123", TargetUpstairs)
+	ExpectTrue(t, !decision.Granted && decision.Reason == ReasonExpired,
+		"Expired after grace")
+}
+
+func TestUnreadableUserFileKeepsUsers(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "unreadable-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	alerts := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(alerts)
+	expectAlert := func(expectProblem bool) {
+		auth.eventBus.Flush()
+		select {
+		case event := <-alerts:
+			ExpectTrue(t, event.Ev == AppUserFileAlert, "Alert event")
+			ExpectTrue(t, (event.Msg != "") == expectProblem, "Alert message")
+		default:
+			t.Error("Expected user file alert")
+		}
+	}
+	ExpectTrue(t, auth.StoreError() == nil, "Readable file is healthy")
+
+	// File goes away: keep serving from memory, but alert.
+	hidden := authFile.Name() + ".hidden"
+	os.Rename(authFile.Name(), hidden)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+	ExpectTrue(t, auth.StoreError() != nil, "Missing file is a problem")
+	expectAlert(true)
+	os.Rename(hidden, authFile.Name())
+	ExpectTrue(t, auth.StoreError() == nil, "File is back")
+	expectAlert(false)
+
+	if os.Geteuid() == 0 {
+		t.Log("Running as root; can't test permissions")
+		return
+	}
+	os.Chmod(authFile.Name(), 0)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+	ExpectTrue(t, auth.StoreError() != nil, "Unreadable file is a problem")
+	expectAlert(true)
+	os.Chmod(authFile.Name(), 0644)
+	ExpectTrue(t, auth.StoreError() == nil, "File readable again")
+	expectAlert(false)
+}
+
+func TestRFIDNormalization(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "rfid-case-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	u := User{Name: "Card User", ContactInfo: "card@nb", UserLevel: LevelMember}
+	u.SetRFIDCode("ABCD1234")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding card user")
+	ExpectAuthResult(t, auth, NormalizeRFID("abcd1234"), TargetUpstairs, ReasonOK)
+	ExpectAuthResult(t, auth, NormalizeRFID("AbCd1234"), TargetUpstairs, ReasonOK)
+	ExpectTrue(t, NormalizeRFID("00ab") == "00ab", "Leading zeros are kept")
+
+	// Keypad PINs are not touched.
+	u = User{Name: "PIN User", ContactInfo: "pin@nb", UserLevel: LevelMember}
+	u.SetAuthCode("12345")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding PIN user")
+	ExpectAuthResult(t, auth, "12345", TargetUpstairs, ReasonOK)
+}
+
+// A users file with many users, as a large space would have.
+func createLargeUserFile(users int) string {
+	authFile, _ := ioutil.TempFile("", "large-users")
+	writer := csv.NewWriter(authFile)
+	WriteUserCSVHeader(writer)
+	for i := 0; i < users; i++ {
+		user := User{
+			Name:        fmt.Sprintf("User %d", i),
+			ContactInfo: fmt.Sprintf("user%d@example.org", i),
+			UserLevel:   LevelFulltimeUser,
+			ValidFrom:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		user.SetAuthCode(fmt.Sprintf("%08x", i))
+		user.WriteCSV(writer)
+	}
+	writer.Flush()
+	authFile.Close()
+	return authFile.Name()
+}
+
+func benchmarkLookup(b *testing.B, lookup func(auth *FileBasedAuthenticator, code string)) {
+	const users = 10000
+	filename := createLargeUserFile(users)
+	defer syscall.Unlink(filename)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	auth := NewFileBasedAuthenticator(filename, NewApplicationBus())
+	codes := make([]string, 1024)
+	for i := range codes {
+		codes[i] = fmt.Sprintf("%08x", (i*7919)%users)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(auth, codes[i%len(codes)])
+	}
+}
+
+func BenchmarkFindUser(b *testing.B) {
+	benchmarkLookup(b, func(auth *FileBasedAuthenticator, code string) {
+		if auth.FindUser(code) == nil {
+			b.Fatalf("%s not found", code)
+		}
+	})
+}
+
+func BenchmarkFindUserUnknown(b *testing.B) {
+	benchmarkLookup(b, func(auth *FileBasedAuthenticator, code string) {
+		if auth.FindUser("x"+code) != nil {
+			b.Fatalf("x%s found", code)
+		}
+	})
+}
+
+func BenchmarkAuthUser(b *testing.B) {
+	benchmarkLookup(b, func(auth *FileBasedAuthenticator, code string) {
+		if d := auth.AuthUser(code, TargetUpstairs); !d.Granted {
+			b.Fatalf("%s not granted: %s", code, d.Detail)
+		}
+	})
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// How long to wait between attempts to reconnect a terminal. Configured
+// in the "reconnect" section of the config file, e.g.
+//
+//	"reconnect": { "initial": "500ms", "max": "2m", "multiplier": 1.5,
+//	               "jitter": 0.2 }
+type BackoffConfig struct {
+	Initial    Duration `json:"initial"`    // First wait. 0 for default.
+	Max        Duration `json:"max"`        // Longest wait. 0 for default.
+	Multiplier float64  `json:"multiplier"` // Growth per attempt. 0 for default.
+
+	// Randomize each wait by up to this fraction in either direction, so
+	// that terminals don't all reconnect in lockstep after a shared
+	// outage. 0 for none.
+	Jitter float64 `json:"jitter"`
+}
+
+func (c *BackoffConfig) Validate() error {
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		return fmt.Errorf("reconnect multiplier needs to be at least 1")
+	}
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return fmt.Errorf("reconnect jitter needs to be in [0..1)")
+	}
+	if c.Initial < 0 || c.Max < 0 {
+		return fmt.Errorf("reconnect times can't be negative")
+	}
+	if c.Initial > 0 && c.Max > 0 && c.Max < c.Initial {
+		return fmt.Errorf("reconnect max needs to be at least initial")
+	}
+	return nil
+}
+
+// Exponential backoff: each Next() wait is longer than the one before, up
+// to a maximum, until Reset().
+type Backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	random     func() float64 // In [0..1); replaceable in tests.
+
+	current time.Duration
+}
+
+func NewBackoff(config BackoffConfig) *Backoff {
+	b := &Backoff{
+		initial:    initialReconnectOnErrorTime,
+		max:        maxReconnectOnErrorTime,
+		multiplier: 2,
+		jitter:     config.Jitter,
+		random:     rand.Float64,
+	}
+	if config.Initial > 0 {
+		b.initial = time.Duration(config.Initial)
+	}
+	if config.Max > 0 {
+		b.max = time.Duration(config.Max)
+	}
+	if b.max < b.initial {
+		b.max = b.initial
+	}
+	if config.Multiplier > 0 {
+		b.multiplier = config.Multiplier
+	}
+	b.Reset()
+	return b
+}
+
+// The time to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	wait := b.current
+	b.current = time.Duration(float64(b.current) * b.multiplier)
+	if b.current > b.max {
+		b.current = b.max
+	}
+	if b.jitter > 0 {
+		wait = time.Duration(float64(wait) * (1 + b.jitter*(2*b.random()-1)))
+	}
+	return wait
+}
+
+// Start over with the initial wait, e.g. after a successful connect.
+func (b *Backoff) Reset() {
+	b.current = b.initial
+}
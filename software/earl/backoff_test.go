@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func expectWaits(t *testing.T, b *Backoff, expected ...time.Duration) {
+	for i, e := range expected {
+		if got := b.Next(); got != e {
+			t.Errorf("Wait %d: expected %s, got %s", i, e, got)
+		}
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := NewBackoff(BackoffConfig{})
+	expectWaits(t, b, 2*time.Second, 4*time.Second, 8*time.Second,
+		16*time.Second, 32*time.Second, 60*time.Second, 60*time.Second)
+	b.Reset()
+	expectWaits(t, b, 2*time.Second)
+}
+
+func TestBackoffConfigured(t *testing.T) {
+	b := NewBackoff(BackoffConfig{
+		Initial:    Duration(100 * time.Millisecond),
+		Max:        Duration(time.Second),
+		Multiplier: 3,
+	})
+	expectWaits(t, b, 100*time.Millisecond, 300*time.Millisecond,
+		900*time.Millisecond, time.Second)
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := NewBackoff(BackoffConfig{Jitter: 0.5})
+	random := 0.0
+	b.random = func() float64 { return random }
+	expectWaits(t, b, 1*time.Second) // Lowest: 2s - 50%
+	random = 0.5
+	expectWaits(t, b, 4*time.Second) // Middle: unchanged.
+	random = 0.999
+	if wait := b.Next(); wait <= 11*time.Second || wait >= 12*time.Second {
+		t.Errorf("Expected just below 12s, got %s", wait)
+	}
+}
+
+func TestBackoffConfigValidation(t *testing.T) {
+	ExpectTrue(t, (&BackoffConfig{}).Validate() == nil, "Defaults")
+	ExpectTrue(t, (&BackoffConfig{Multiplier: 1.5, Jitter: 0.2}).Validate() == nil,
+		"Valid multiplier and jitter")
+	ExpectFalse(t, (&BackoffConfig{Multiplier: 0.5}).Validate() == nil,
+		"Shrinking multiplier")
+	ExpectFalse(t, (&BackoffConfig{Jitter: 1}).Validate() == nil,
+		"Jitter too large")
+	ExpectFalse(t, (&BackoffConfig{
+		Initial: Duration(time.Minute), Max: Duration(time.Second),
+	}).Validate() == nil, "Max below initial")
+}
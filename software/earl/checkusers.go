@@ -0,0 +1,156 @@
+// Checking a users file before deploying it, without running the daemon:
+//
+//	earl check users.csv
+//
+// Reads the file like the authenticator does and reports entries it would
+// skip, users it would ignore because they share a code with someone
+// before them, and accounts that expired or expire soon. Exits non-zero
+// if there are errors.
+//
+// Codes that are a prefix of another one are fine (see
+// hasMinimalCodeRequirements()), and we couldn't find them anyway: the
+// file only has the hashes of the codes.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Accounts expiring within this time are worth a warning.
+const expirySoonWarning = 14 * 24 * time.Hour
+
+type UserFileReport struct {
+	Users    int      // Users the authenticator would use.
+	Errors   []string // The file doesn't work as intended.
+	Warnings []string // Worth a look.
+}
+
+func (r *UserFileReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *UserFileReport) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func CheckUserFile(in io.Reader, now time.Time) *UserFileReport {
+	report := &UserFileReport{}
+	reader := NewUserCSVReader(in)
+	codeOwner := make(map[string]string) // Code hash to who has it.
+	for {
+		user, done := reader.Next()
+		entry := reader.Line() // Entries are named by their line.
+		if err := reader.Err(); err != nil {
+			if done {
+				report.errorf("%v", err) // Tells the line.
+			} else {
+				report.errorf("entry %d: %v", entry, err)
+			}
+		}
+		if done {
+			break
+		}
+		if user == nil {
+			continue
+		}
+		who := fmt.Sprintf("entry %d (%s)", entry, user.Name)
+		if user.Name == "" {
+			who = fmt.Sprintf("entry %d", entry)
+		}
+		if checkUserCodes(report, user, who, codeOwner) {
+			report.Users++
+			checkUserExpiry(report, user, who, now)
+		}
+	}
+	return report
+}
+
+// Returns false if the authenticator would ignore the user.
+func checkUserCodes(report *UserFileReport, user *User, who string,
+	codeOwner map[string]string) bool {
+	for _, codes := range [][]string{user.Codes, user.DuressCodes} {
+		for _, code := range codes {
+			if code == "" {
+				continue
+			}
+			if owner, taken := codeOwner[code]; taken {
+				report.errorf("%s: shares a code with %s, so is ignored",
+					who, owner)
+				return false
+			}
+		}
+	}
+	for _, codes := range [][]string{user.Codes, user.DuressCodes} {
+		for _, code := range codes {
+			if code != "" {
+				codeOwner[code] = who
+			}
+		}
+	}
+	hasCode := false
+	for _, code := range user.Codes {
+		hasCode = hasCode || code != ""
+	}
+	if !hasCode {
+		report.errorf("%s: has no code", who)
+	}
+	return true
+}
+
+func checkUserExpiry(report *UserFileReport, user *User, who string, now time.Time) {
+	// Same as the authenticator: guests without an end stay.
+	if user.UserLevel == LevelGuest &&
+		!user.ValidTo.IsZero() && user.ExpiryDate(now).Before(now) {
+		report.warnf("%s: expired guest, removed on next start", who)
+		return
+	}
+	// Like the authenticator does for older files.
+	if user.RegisteredAt.IsZero() {
+		user.RegisteredAt = user.ValidFrom
+		if user.RegisteredAt.IsZero() {
+			user.RegisteredAt = now
+		}
+	}
+	expires := user.ExpiryDate(now)
+	switch {
+	case expires.IsZero():
+	case !expires.After(now):
+		report.warnf("%s: expired %s", who, expires.Format("2006-01-02 15:04"))
+	case expires.Sub(now) < expirySoonWarning:
+		report.warnf("%s: expires %s", who, expires.Format("2006-01-02 15:04"))
+	}
+}
+
+func (r *UserFileReport) Print(out io.Writer, filename string) {
+	for _, msg := range r.Errors {
+		fmt.Fprintf(out, "ERROR   %s\n", msg)
+	}
+	for _, msg := range r.Warnings {
+		fmt.Fprintf(out, "WARNING %s\n", msg)
+	}
+	fmt.Fprintf(out, "%s: %d users, %d errors, %d warnings\n",
+		filename, r.Users, len(r.Errors), len(r.Warnings))
+}
+
+// The "check" subcommand. Returns the exit code.
+func checkUserFileCommand(args []string, location *time.Location) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s check <users-file>\n", os.Args[0])
+		return 2
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+	report := CheckUserFile(f, time.Now().In(location))
+	report.Print(os.Stdout, args[0])
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
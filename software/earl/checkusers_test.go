@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckBrokenUserFile(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	report := CheckUserFile(strings.NewReader(`# Comment,with,multi,comma,foo,bar,x
+good,good@nb,member,,,,abc;def,,,2024-01-01 10:00
+short,short@nb
+badlevel,bad@nb,admin,,,,ghi
+badfloor,floor@nb,user,,,,jkl,,third
+twin,twin@nb,user,,,,def
+nocode,nocode@nb,user,,,,
+expired,,user,,,,mno,,,2024-01-01 10:00
+soon,soon@nb,user,,,2024-06-10 00:00,pqr,,,2024-01-01 10:00
+guest,,guest,,,2024-05-01 00:00,stu,,,2024-04-30 00:00
+`), now)
+
+	ExpectTrue(t, report.Users == 5, "Good, nocode, expired, soon and guest")
+	expectedErrors := []string{"entry 3: too few", "entry 4: invalid level",
+		"entry 5: invalid floor", "entry 6 (twin): shares a code with entry 2 (good)",
+		"entry 7 (nocode): has no code"}
+	if len(report.Errors) != len(expectedErrors) {
+		t.Fatalf("Expected errors %v, got %v", expectedErrors, report.Errors)
+	}
+	for i, expected := range expectedErrors {
+		ExpectTrue(t, strings.HasPrefix(report.Errors[i], expected), expected)
+	}
+	expectedWarnings := []string{"entry 8 (expired): expired",
+		"entry 9 (soon): expires", "entry 10 (guest): expired guest"}
+	if len(report.Warnings) != len(expectedWarnings) {
+		t.Fatalf("Expected warnings %v, got %v", expectedWarnings, report.Warnings)
+	}
+	for i, expected := range expectedWarnings {
+		ExpectTrue(t, strings.HasPrefix(report.Warnings[i], expected), expected)
+	}
+
+	var out bytes.Buffer
+	report.Print(&out, "users.csv")
+	ExpectTrue(t, strings.HasSuffix(out.String(),
+		"users.csv: 5 users, 5 errors, 3 warnings\n"), "Summary")
+}
+
+func TestCheckOpenEndedGuest(t *testing.T) {
+	report := CheckUserFile(strings.NewReader(
+		"guest,guest@nb,guest,,,,stu,,,2024-04-30 00:00\n"),
+		time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	ExpectTrue(t, report.Users == 1 && len(report.Errors) == 0, "Valid")
+	ExpectTrue(t, len(report.Warnings) == 0, "Guest without end stays")
+}
+
+func TestCheckUnparseableUserFile(t *testing.T) {
+	report := CheckUserFile(strings.NewReader(
+		"good,good@nb,member,,,,abc\n\"unterminated,x@nb,member,,,,def\n"),
+		time.Now())
+	ExpectTrue(t, report.Users == 1 && len(report.Errors) == 1,
+		"Parse error stops reading")
+}
@@ -0,0 +1,404 @@
+// Configuration file, given with -config. A JSON file that describes the
+// terminals to connect to and per-terminal settings, e.g.
+//
+//	{
+//	  "terminals": [
+//	    { "device": "/dev/ttyAMA0", "baud": 9600, "name": "gate",
+//	      "strike-duration": "3s", "welcome-duration": "5s",
+//	      "idle-timeout": "20s" },
+//	    { "device": "/dev/ttyUSB0", "target": "upstairs" }
+//	  ],
+//	  "elevator-floor-pins": { "1": 22, "2": 23 },
+//	  "door-pins": { "inner-gate": 24 },
+//	  "door-sensors": { "upstairs": { "pin": 5 } },
+//	  "feedback": { "denied": { "color": "R", "color-duration": "1s" } },
+//	  "schedules": { "upstairs": { "from": 9, "to": 22 } }
+//	}
+//
+// Terminals can also be given as <serial-device>[:baudrate] on the
+// commandline, which is a shortcut for a terminal with default settings.
+// For deployments where commandline arguments are awkward, e.g. in a
+// container, these (and the users file) can come from the environment
+// instead. The commandline always wins over the environment.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Terminals like on the commandline, separated by whitespace or comma.
+	EnvTerminals = "EARL_TERMINALS"
+
+	// Users file, like -users.
+	EnvUsers = "EARL_USERS"
+)
+
+// A time.Duration that is given as string in JSON, e.g. "2s" or "500ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration needs to be a string such as \"2s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type TerminalConfig struct {
+	Device string `json:"device"` // Path to the serial device.
+	Baud   int    `json:"baud"`   // Baudrate; 0 for defaultBaudrate.
+
+	// If set, the name the terminal is expected to report. A terminal
+	// reporting a different name is not accepted.
+	Name string `json:"name"`
+
+	// Explicitly choose the handler for this terminal instead of
+	// dispatching by the name the terminal reports. Useful for
+	// oddly named hardware.
+	Target Target `json:"target"`
+
+	// Doors this terminal opens, if it controls more than one, e.g. an
+	// inner and an outer gate. Default: just its target. On the control
+	// terminal, the doors that can be held open; default gate and
+	// upstairs.
+	Doors []Target `json:"doors"`
+
+	// Let members type their card number on the keypad, for when the
+	// RFID reader is broken. Throttled after repeated unknown codes. See
+	// accesshandler.go
+	KeypadFallback bool `json:"keypad-fallback"`
+
+	// A valid card only opens once '#' is pressed on the keypad within a
+	// few seconds, against accidental or relayed swipes. For high-security
+	// rooms. See accesshandler.go
+	ConfirmRFID bool `json:"confirm-rfid"`
+
+	// Longest a member may hold a door open from the control terminal,
+	// e.g. for deliveries. 0 for default.
+	HoldOpenMax Duration `json:"hold-open-max"`
+
+	// How long the control terminal waits for the next key or card while
+	// adding or renewing a user before giving up. 0 for default.
+	EnrollTimeout Duration `json:"enroll-timeout"`
+
+	// What to do with a known user outside their hours: "doorbell"
+	// (default) rings with their name, "deny" just denies.
+	OutsideHours string `json:"outside-hours"`
+
+	// A second card presented while the first is still held: "first"
+	// (default) ignores it until the card let in is removed, "each" acts
+	// on it. See rfid-debouncer.go
+	CardOverlap string `json:"card-overlap"`
+
+	// How long to keep the door strike open. 0 for default.
+	StrikeDuration Duration `json:"strike-duration"`
+
+	// How long to show the green light and welcome message after access
+	// is granted; independent of the strike. 0 for default.
+	WelcomeDuration Duration `json:"welcome-duration"`
+
+	// Users whose code expires within this time see how long it has left
+	// in the welcome message. 0 for default; negative to never show it.
+	ExpiryWarning Duration `json:"expiry-warning"`
+
+	// Time after which partial keypad input is discarded. 0 for default.
+	IdleTimeout Duration `json:"idle-timeout"`
+
+	// "swapped" for keypads that clear with '#' and enter with '*'.
+	// See keypad.go
+	Keypad string `json:"keypad"`
+
+	// For readers passing on the raw Wiegand frame as bits: "wiegand26"
+	// or "wiegand34". Frames failing the length or parity check are
+	// discarded. Empty (default): the terminal reports decoded IDs. See
+	// wiegand.go
+	RFIDFormat string `json:"rfid-format"`
+
+	// While a door of this terminal is propped open (see door-sensor.go),
+	// remind people every so often with the "propped" feedback. 0: don't.
+	ProppedReminder Duration `json:"propped-reminder"`
+
+	// Time an RFID card has to be absent from the reader before it is
+	// acted on again. 0 for default.
+	RFIDGap Duration `json:"rfid-gap"`
+
+	// If the terminal has been quiet for HeartbeatInterval, we ping it.
+	// If it doesn't answer within PingTimeout twice in a row, we
+	// reconnect. 0 for defaults.
+	HeartbeatInterval Duration `json:"heartbeat-interval"`
+	PingTimeout       Duration `json:"ping-timeout"`
+
+	// Number of responses not matching a request that are discarded
+	// while waiting for the right one, e.g. stale lines after noise on
+	// the line. Beyond that, we reconnect. 0 for default; negative to
+	// reconnect on the first.
+	SkipUnexpectedResponses int `json:"skip-unexpected-responses"`
+
+	// Least time between two commands to the terminal, for old firmware
+	// that drops a command sent right after another. 0: don't wait.
+	CommandGap Duration `json:"command-gap"`
+
+	// Longer tones are cut to this, so the buzzer can't get stuck
+	// blaring. 0 for default.
+	MaxToneDuration Duration `json:"max-tone-duration"`
+
+	// LED and tone feedback, overriding the Config's Feedback per event.
+	Feedback FeedbackProfile `json:"feedback"`
+
+	// How the terminal firmware ends lines: "lf" (default), "crlf" or
+	// "cr". See serial-framing.go
+	LineTerminator string `json:"line-terminator"`
+
+	// Number of events from the terminal to queue while the handler is
+	// busy. If exceeded, the oldest are dropped. 0 for default.
+	EventBufferSize int `json:"event-buffer-size"`
+
+	// Start in maintenance: connected, but not letting anyone in. Needs
+	// the name or target. See maintenance.go
+	Maintenance bool `json:"maintenance"`
+}
+
+type Config struct {
+	Terminals []TerminalConfig `json:"terminals"`
+
+	// GPIO pin that enables each elevator floor. Without it, the elevator
+	// terminal just opens the elevator.
+	ElevatorFloorPins map[int]int `json:"elevator-floor-pins"`
+
+	// GPIO pin of the strike of each door, in addition to (or replacing)
+	// the built-in ones for gate, upstairs and elevator.
+	DoorPins map[Target]int `json:"door-pins"`
+
+	// Reed contacts telling if a door is open. See door-sensor.go
+	DoorSensors map[Target]DoorSensorConfig `json:"door-sensors"`
+
+	// LED and tone feedback for all terminals, overriding the default
+	// per event. See feedback.go
+	Feedback FeedbackProfile `json:"feedback"`
+
+	// Where to send notifications about notable events. See notifier.go
+	Notifications NotificationConfig `json:"notifications"`
+
+	// Waiting between attempts to reconnect terminals. See backoff.go
+	Reconnect BackoffConfig `json:"reconnect"`
+
+	// How long people who entered count towards the occupancy shown in
+	// the status. 0 for default. See occupancy.go
+	OccupancyWindow Duration `json:"occupancy-window"`
+
+	// Access attempts per terminal shown in the status. 0 for default.
+	// See recent-access.go
+	RecentAccess int `json:"recent-access"`
+
+	// Users are still let in this long after their valid-to, with a
+	// reminder to renew. 0 (default): not at all.
+	RenewalGrace Duration `json:"renewal-grace"`
+
+	// Open hours of each target. See schedule.go
+	Schedules map[Target]TargetSchedule `json:"schedules"`
+
+	// Outputs to test at startup with -selftest. See selftest.go
+	SelfTest SelfTestConfig `json:"self-test"`
+
+	// If set, access is decided by an external system instead of the
+	// users file. See remote-auth.go
+	RemoteAuth *RemoteAuthConfig `json:"remote-auth"`
+
+	// If set, the users are synced from a primary and can't be changed
+	// here. See replica.go
+	Replica *ReplicaConfig `json:"replica"`
+
+	// Lets replicas with this token fetch the users from /api/users.
+	UsersExportToken string `json:"users-export-token"`
+
+	// Lets /api/check be used with this token, see http-api.go
+	CheckToken string `json:"check-token"`
+}
+
+// The target as far as it is known before the terminal connects and
+// tells its name; empty if neither target nor name are configured.
+func (c *TerminalConfig) ConfiguredTarget() Target {
+	if c.Target != "" {
+		target, _ := TargetForTerminalName(string(c.Target))
+		return target
+	}
+	if c.Name != "" {
+		target, _ := TargetForTerminalName(c.Name)
+		return target
+	}
+	return ""
+}
+
+// A "device:baud" pair as a string, as used to identify a device in logs.
+func (c *TerminalConfig) DeviceString() string {
+	return fmt.Sprintf("%s:%d", c.Device, c.Baud)
+}
+
+// Parse a <serial-device>[:baudrate] commandline argument.
+func ParseTerminalArg(arg string) (TerminalConfig, error) {
+	split := strings.Split(arg, ":")
+	result := TerminalConfig{Device: split[0], Baud: defaultBaudrate}
+	if len(split) > 1 {
+		var err error
+		if result.Baud, err = strconv.Atoi(split[1]); err != nil {
+			return result, fmt.Errorf("invalid baudrate in '%s'", arg)
+		}
+	}
+	return result, nil
+}
+
+// Add the terminals given on the commandline or, if there are none, in
+// the environment to those of the config file. A device can only be given
+// once.
+func AddTerminalArgs(config *Config, args []string, getenv func(string) string) error {
+	source := "commandline"
+	if len(args) == 0 {
+		args = strings.FieldsFunc(getenv(EnvTerminals), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		source = EnvTerminals
+	}
+	seen := make(map[string]bool)
+	for _, terminal := range config.Terminals {
+		seen[terminal.Device] = true
+	}
+	for _, arg := range args {
+		terminal, err := ParseTerminalArg(arg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		if seen[terminal.Device] {
+			return fmt.Errorf("%s: '%s' given twice", source, terminal.Device)
+		}
+		seen[terminal.Device] = true
+		terminal.Feedback = config.Feedback
+		config.Terminals = append(config.Terminals, terminal)
+	}
+	return nil
+}
+
+// The value of a flag or, if not given, of the environment variable.
+func FlagOrEnv(value string, name string, getenv func(string) string) string {
+	if value != "" {
+		return value
+	}
+	return getenv(name)
+}
+
+func ParseConfig(in io.Reader) (*Config, error) {
+	config := &Config{}
+	if err := json.NewDecoder(in).Decode(config); err != nil {
+		return nil, err
+	}
+	if err := config.Feedback.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Notifications.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Reconnect.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.SelfTest.Validate(); err != nil {
+		return nil, err
+	}
+	if config.RemoteAuth != nil {
+		if err := config.RemoteAuth.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Replica != nil {
+		if config.RemoteAuth != nil {
+			return nil, fmt.Errorf("replica: can't be used with remote-auth")
+		}
+		if err := config.Replica.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for target, sensor := range config.DoorSensors {
+		if err := sensor.Validate(); err != nil {
+			return nil, fmt.Errorf("door-sensor '%s': %v", target, err)
+		}
+	}
+	for target, schedule := range config.Schedules {
+		if err := schedule.Validate(); err != nil {
+			return nil, fmt.Errorf("schedule '%s': %v", target, err)
+		}
+	}
+	if config.OccupancyWindow < 0 {
+		return nil, fmt.Errorf("occupancy-window can't be negative")
+	}
+	if config.RecentAccess < 0 {
+		return nil, fmt.Errorf("recent-access can't be negative")
+	}
+	if config.RenewalGrace < 0 {
+		return nil, fmt.Errorf("renewal-grace can't be negative")
+	}
+	for i := range config.Terminals {
+		terminal := &config.Terminals[i]
+		if err := terminal.Feedback.Validate(); err != nil {
+			return nil, fmt.Errorf("terminal #%d: %v", i+1, err)
+		}
+		terminal.Feedback = config.Feedback.WithOverrides(terminal.Feedback)
+		if _, err := NewLineCodec(terminal.LineTerminator); err != nil {
+			return nil, fmt.Errorf("terminal #%d: %v", i+1, err)
+		}
+		if err := validOutsideHoursPolicy(terminal.OutsideHours); err != nil {
+			return nil, fmt.Errorf("terminal #%d: %v", i+1, err)
+		}
+		if err := validCardOverlapPolicy(terminal.CardOverlap); err != nil {
+			return nil, fmt.Errorf("terminal #%d: %v", i+1, err)
+		}
+		if terminal.EnrollTimeout < 0 {
+			return nil, fmt.Errorf("terminal #%d: enroll-timeout can't be negative", i+1)
+		}
+		if terminal.CommandGap < 0 {
+			return nil, fmt.Errorf("terminal #%d: command-gap can't be negative", i+1)
+		}
+		if terminal.MaxToneDuration < 0 {
+			return nil, fmt.Errorf("terminal #%d: max-tone-duration can't be negative", i+1)
+		}
+		if _, err := ParseKeypadLayout(terminal.Keypad); err != nil {
+			return nil, fmt.Errorf("terminal #%d: %v", i+1, err)
+		}
+		if _, err := ParseRFIDFormat(terminal.RFIDFormat); err != nil {
+			return nil, fmt.Errorf("terminal #%d: %v", i+1, err)
+		}
+		if terminal.Device == "" {
+			return nil, fmt.Errorf("terminal #%d: missing device", i+1)
+		}
+		if terminal.Maintenance && terminal.ConfiguredTarget() == "" {
+			return nil, fmt.Errorf("terminal #%d: maintenance needs name or target", i+1)
+		}
+		if terminal.Baud == 0 {
+			terminal.Baud = defaultBaudrate
+		}
+	}
+	return config, nil
+}
+
+func ReadConfigFile(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return config, nil
+}
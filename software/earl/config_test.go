@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`{
+  "terminals": [
+    { "device": "/dev/ttyAMA0", "baud": 19200, "name": "gate",
+      "strike-duration": "3s", "idle-timeout": "20s" },
+    { "device": "/dev/ttyUSB0", "target": "upstairs" }
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(config.Terminals) != 2 {
+		t.Fatalf("Expected 2 terminals, got %d", len(config.Terminals))
+	}
+	gate := config.Terminals[0]
+	ExpectTrue(t, gate.DeviceString() == "/dev/ttyAMA0:19200", "gate device")
+	ExpectTrue(t, gate.Name == "gate", "gate name")
+	ExpectTrue(t, time.Duration(gate.StrikeDuration) == 3*time.Second,
+		"strike duration")
+	ExpectTrue(t, time.Duration(gate.IdleTimeout) == 20*time.Second,
+		"idle timeout")
+
+	upstairs := config.Terminals[1]
+	ExpectTrue(t, upstairs.Baud == defaultBaudrate, "default baudrate")
+	ExpectTrue(t, upstairs.Target == TargetUpstairs, "explicit target")
+
+	_, err = ParseConfig(strings.NewReader(`{"terminals": [{"baud": 9600}]}`))
+	ExpectTrue(t, err != nil, "Missing device should be an error")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"terminals": [{"device": "x", "idle-timeout": 5}]}`))
+	ExpectTrue(t, err != nil, "Durations need to be strings")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"terminals": [{"device": "x", "line-terminator": "\\n"}]}`))
+	ExpectTrue(t, err != nil, "Line terminators are given by name")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"terminals": [{"device": "x", "outside-hours": "ignore"}]}`))
+	ExpectTrue(t, err != nil, "Unknown outside-hours policy")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"terminals": [{"device": "x", "card-overlap": "last"}]}`))
+	ExpectTrue(t, err != nil, "Unknown card-overlap policy")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"terminals": [{"device": "x", "maintenance": true}]}`))
+	ExpectTrue(t, err != nil, "Maintenance needs to know the target")
+
+	config, err = ParseConfig(strings.NewReader(
+		`{"terminals": [{"device": "x", "name": " Gate", "maintenance": true}]}`))
+	ExpectTrue(t, err == nil && config.Terminals[0].ConfiguredTarget() == TargetDownstairs,
+		"Maintenance by name")
+
+	config, err = ParseConfig(strings.NewReader(
+		`{"schedules": {"upstairs": {"from": 9, "to": 22}}}`))
+	ExpectTrue(t, err == nil && config.Schedules[TargetUpstairs].To == 22,
+		"Schedule parsed")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"schedules": {"upstairs": {"from": 22, "to": 9}}}`))
+	ExpectTrue(t, err != nil, "Open hours can't wrap around")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"schedules": {"upstairs": {"after-hours": "everyone"}}}`))
+	ExpectTrue(t, err != nil, "Unknown after-hours policy")
+}
+
+func TestTerminalsFromEnvironment(t *testing.T) {
+	env := map[string]string{
+		EnvTerminals: "/dev/ttyUSB0:19200, /dev/ttyUSB1\n",
+		EnvUsers:     "/data/users.csv",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	config := &Config{Terminals: []TerminalConfig{{Device: "/dev/ttyAMA0"}}}
+	ExpectTrue(t, AddTerminalArgs(config, nil, getenv) == nil, "Parse env")
+	ExpectTrue(t, len(config.Terminals) == 3, "Added to config file")
+	ExpectTrue(t, config.Terminals[1].Device == "/dev/ttyUSB0" &&
+		config.Terminals[1].Baud == 19200, "Baudrate from env")
+	ExpectTrue(t, config.Terminals[2].Baud == defaultBaudrate, "Default baud")
+
+	// The commandline wins.
+	config = &Config{}
+	ExpectTrue(t, AddTerminalArgs(config, []string{"/dev/ttyS0"}, getenv) == nil,
+		"Parse args")
+	ExpectTrue(t, len(config.Terminals) == 1 &&
+		config.Terminals[0].Device == "/dev/ttyS0", "Env ignored")
+
+	config = &Config{Terminals: []TerminalConfig{{Device: "/dev/ttyUSB1"}}}
+	ExpectTrue(t, AddTerminalArgs(config, nil, getenv) != nil,
+		"Device in config file and env")
+
+	env[EnvTerminals] = "/dev/ttyUSB0:fast"
+	ExpectTrue(t, AddTerminalArgs(&Config{}, nil, getenv) != nil, "Invalid baud")
+
+	ExpectTrue(t, FlagOrEnv("", EnvUsers, getenv) == "/data/users.csv",
+		"Users from env")
+	ExpectTrue(t, FlagOrEnv("users.csv", EnvUsers, getenv) == "users.csv",
+		"Flag wins")
+}
+
+func TestParseFeedbackConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`{
+  "feedback": {
+    "denied": { "color": "R", "color-duration": "2s",
+                "tone": "L", "tone-duration": "1s" }
+  },
+  "terminals": [
+    { "device": "/dev/ttyAMA0",
+      "feedback": { "granted": { "color": "G", "tone": "H" } } },
+    { "device": "/dev/ttyUSB0" }
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	denied := Feedback{Color: "R", ColorDuration: Duration(2 * time.Second),
+		Tone: "L", ToneDuration: Duration(time.Second)}
+	for _, terminal := range config.Terminals {
+		ExpectTrue(t, terminal.Feedback[FeedbackDenied] == denied,
+			"Global feedback applies to all terminals")
+	}
+	ExpectTrue(t, config.Terminals[0].Feedback[FeedbackGranted].Tone == "H",
+		"Terminal specific feedback")
+	_, hasGranted := config.Terminals[1].Feedback[FeedbackGranted]
+	ExpectFalse(t, hasGranted, "Only configured for first terminal")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"feedback": {"denied": {"color": "purple"}}}`))
+	ExpectTrue(t, err != nil, "Invalid color")
+	_, err = ParseConfig(strings.NewReader(
+		`{"feedback": {"party": {"color": "R"}}}`))
+	ExpectTrue(t, err != nil, "Unknown event")
+}
+
+func TestParseTerminalArg(t *testing.T) {
+	terminal, err := ParseTerminalArg("/dev/ttyUSB1:38400")
+	ExpectTrue(t, err == nil, "Valid arg")
+	ExpectTrue(t, terminal.Device == "/dev/ttyUSB1" && terminal.Baud == 38400,
+		"device and baud")
+
+	terminal, _ = ParseTerminalArg("/dev/ttyUSB1")
+	ExpectTrue(t, terminal.Baud == defaultBaudrate, "default baud")
+
+	_, err = ParseTerminalArg("/dev/ttyUSB1:fast")
+	ExpectTrue(t, err != nil, "Invalid baudrate")
+}
+
+func TestParseNotificationConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`{
+  "notifications": { "transport": "slack", "slack-webhook": "http://x",
+                     "failed-attempts": 3, "terminal-offline": "5m" }
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ExpectTrue(t, config.Notifications.FailedAttempts == 3, "failed attempts")
+	ExpectTrue(t, time.Duration(config.Notifications.TerminalOffline) == 5*time.Minute,
+		"terminal offline")
+
+	_, err = ParseConfig(strings.NewReader(
+		`{"notifications": {"transport": "slack"}}`))
+	ExpectTrue(t, err != nil, "Slack needs a webhook")
+	_, err = ParseConfig(strings.NewReader(
+		`{"notifications": {"transport": "pigeon"}}`))
+	ExpectTrue(t, err != nil, "Unknown transport")
+}
+
+func TestParseReconnectConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`{
+  "reconnect": { "initial": "500ms", "max": "2m", "multiplier": 1.5, "jitter": 0.2 }
+}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ExpectTrue(t, time.Duration(config.Reconnect.Initial) == 500*time.Millisecond,
+		"initial")
+	ExpectTrue(t, time.Duration(config.Reconnect.Max) == 2*time.Minute, "max")
+	ExpectTrue(t, config.Reconnect.Multiplier == 1.5, "multiplier")
+
+	_, err = ParseConfig(strings.NewReader(`{"reconnect": {"jitter": 2}}`))
+	ExpectTrue(t, err != nil, "Jitter out of range")
+}
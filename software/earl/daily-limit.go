@@ -0,0 +1,80 @@
+// Daily usage caps for trial or limited memberships: a number of entries
+// per day, and/or a time budget counted from the first entry of the day.
+// We don't see people leave, so a budget of 3h means the doors open for
+// them until 3h after they first came in that day.
+//
+// Usage is only counted in memory and starts over at local midnight (and
+// when earl restarts). It is independent of the hours a user may come in
+// (see User.AccessHours()).
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What a user with daily limits used so far on one day.
+type dailyUsage struct {
+	day        string // Local date, as "2006-01-02".
+	entries    int
+	firstEntry time.Time
+}
+
+func (user *User) HasDailyLimit() bool {
+	return user.DailyEntries > 0 || user.DailyBudget > 0
+}
+
+// Finds the usage of a user again after the file is reloaded, which
+// replaces all User pointers.
+func dailyUsageKey(user *User) string {
+	return strings.Join(user.Codes, ";")
+}
+
+// Usage of the user today; usage of an earlier day is dropped.
+// Requires userLock.
+func (a *FileBasedAuthenticator) todaysUsageRequiresLock(user *User) *dailyUsage {
+	today := a.localNow().Format("2006-01-02")
+	if a.dailyUsage == nil {
+		a.dailyUsage = make(map[string]*dailyUsage)
+	}
+	key := dailyUsageKey(user)
+	usage := a.dailyUsage[key]
+	if usage == nil || usage.day != today {
+		usage = &dailyUsage{day: today}
+		a.dailyUsage[key] = usage
+	}
+	return usage
+}
+
+func (a *FileBasedAuthenticator) checkDailyLimit(user *User) AuthDecision {
+	if !user.HasDailyLimit() {
+		return authGranted()
+	}
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	usage := a.todaysUsageRequiresLock(user)
+	if user.DailyEntries > 0 && usage.entries >= user.DailyEntries {
+		return authDenied(ReasonDailyLimit,
+			fmt.Sprintf("Daily limit of %d entries reached", user.DailyEntries))
+	}
+	if user.DailyBudget > 0 && usage.entries > 0 &&
+		a.clock.Now().Sub(usage.firstEntry) >= user.DailyBudget {
+		return authDenied(ReasonDailyLimit,
+			fmt.Sprintf("Daily limit of %v used up", user.DailyBudget))
+	}
+	return authGranted()
+}
+
+// Count an entry of the user. Every door opened counts, so coming in
+// through the gate and upstairs is two entries. Requires userLock.
+func (a *FileBasedAuthenticator) countDailyEntryRequiresLock(user *User) {
+	if !user.HasDailyLimit() {
+		return
+	}
+	usage := a.todaysUsageRequiresLock(user)
+	if usage.entries == 0 {
+		usage.firstEntry = a.clock.Now()
+	}
+	usage.entries++
+}
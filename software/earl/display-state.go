@@ -0,0 +1,61 @@
+// A terminal comes back blank after it reconnects. Handlers are kept
+// across reconnects, so they remember what they want the terminal to show
+// in a DisplayState and restore it in Init().
+package main
+
+import (
+	"time"
+)
+
+// Implements Terminal by forwarding to the currently connected terminal,
+// remembering the LED color and LCD content on the way.
+type DisplayState struct {
+	Terminal // The currently connected terminal.
+
+	color string
+	lcd   [maxLCDRows]string
+}
+
+// Switch to the newly connected terminal. If we had a terminal before,
+// this is a reconnect: show what was shown before.
+func (d *DisplayState) Attach(t Terminal) {
+	reconnect := d.Terminal != nil
+	d.Terminal = t
+	if !reconnect {
+		return
+	}
+	if d.color != ColorOff {
+		t.ShowColor(d.color)
+	}
+	for row, text := range d.lcd {
+		if text != "" {
+			t.WriteLCD(row, text)
+		}
+	}
+}
+
+func (d *DisplayState) ShowColor(colors string) {
+	d.color = colors
+	d.Terminal.ShowColor(colors)
+}
+
+func (d *DisplayState) WriteLCD(row int, text string) {
+	if row >= 0 && row < maxLCDRows {
+		d.lcd[row] = text
+	}
+	d.Terminal.WriteLCD(row, text)
+}
+
+// Not remembered: after a reconnect, it's too late to revert.
+func (d *DisplayState) WriteLCDTemporary(row int, text string, duration time.Duration) {
+	d.Terminal.WriteLCDTemporary(row, text, duration)
+}
+
+func (d *DisplayState) WriteLCDLines(lines []string) {
+	for row, text := range lines {
+		if row < maxLCDRows {
+			d.lcd[row] = text
+		}
+	}
+	d.Terminal.WriteLCDLines(lines)
+}
@@ -0,0 +1,183 @@
+// Door sensors.
+//
+// Energizing a strike only tells that we let someone in, not whether the
+// door actually opened or closed again. Doors with a reed contact wired to
+// a GPIO pin are watched by the DoorWatcher, configured in the config file:
+//
+//	"door-sensors": {
+//	  "upstairs": { "pin": 5, "alert-forced": true, "propped-time": "5m" }
+//	}
+//
+// It posts an AppDoorSensorEvent whenever a door opens or closes, and
+// raises an alert if a door
+//   - opens without anyone being let in, e.g. forced open or someone
+//     slipping in after the strike closed (only with "alert-forced": doors
+//     people open from the inside to leave would alert all the time), or
+//   - stays open longer than the propped-time after being let in, e.g.
+//     propped open with a chair.
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	doorSensorPollTime = 100 * time.Millisecond
+
+	// After the strike closes, it still takes a moment to push the door.
+	doorOpenGrace = 3 * time.Second
+
+	defaultDoorProppedTime = 2 * time.Minute
+)
+
+// Reed contact of a door.
+type DoorSensorConfig struct {
+	Pin int `json:"pin"` // GPIO pin; reads 1 when the door is open.
+
+	// Alert when the door opens without anyone being let in.
+	AlertForced bool `json:"alert-forced"`
+
+	// Alert when the door is open longer than this after being let in.
+	// 0 for the default, negative for never.
+	ProppedTime Duration `json:"propped-time"`
+}
+
+func (c *DoorSensorConfig) Validate() error {
+	if c.Pin <= 0 {
+		return fmt.Errorf("needs a GPIO pin")
+	}
+	return nil
+}
+
+// What we know about a door.
+type doorStatus struct {
+	config DoorSensorConfig
+	known  bool // Read the sensor at least once.
+	open   bool
+
+	openedAt     time.Time
+	grantedUntil time.Time // Strike open, plus doorOpenGrace.
+	proppedTold  bool
+}
+
+type DoorWatcher struct {
+	actions PhysicalActions
+	bus     *ApplicationBus
+	clock   Clock
+	doors   map[Target]*doorStatus
+}
+
+func NewDoorWatcher(actions PhysicalActions, bus *ApplicationBus,
+	sensors map[Target]DoorSensorConfig) *DoorWatcher {
+	w := &DoorWatcher{
+		actions: actions,
+		bus:     bus,
+		clock:   RealClock{},
+		doors:   make(map[Target]*doorStatus),
+	}
+	for target, config := range sensors {
+		if config.ProppedTime == 0 {
+			config.ProppedTime = Duration(defaultDoorProppedTime)
+		}
+		w.doors[target] = &doorStatus{config: config}
+	}
+	return w
+}
+
+// Watch the sensors, and the bus to know when someone is let in.
+func (w *DoorWatcher) EventLoop() {
+	appEvents := make(AppEventChannel, 10)
+	w.bus.Subscribe(appEvents)
+	ticker := time.NewTicker(doorSensorPollTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-appEvents:
+			w.HandleAppEvent(event)
+		case <-ticker.C:
+			w.CheckDoors()
+		}
+	}
+}
+
+// Remember until when opening a door is expected.
+func (w *DoorWatcher) HandleAppEvent(event *AppEvent) {
+	target, until := event.Target, event.Timeout
+	switch event.Ev {
+	case AppOpenRequest:
+		if until.IsZero() {
+			until = w.clock.Now().Add(defaultDoorOpenTime)
+		}
+	case AppEnableFloorRequest:
+		target = TargetElevator
+		until = w.clock.Now().Add(defaultFloorEnableTime)
+	case AppCloseRequest:
+		until = w.clock.Now()
+	default:
+		return
+	}
+	if door, ok := w.doors[target]; ok {
+		door.grantedUntil = until.Add(doorOpenGrace)
+	}
+}
+
+// Read the sensors and tell about what changed.
+func (w *DoorWatcher) CheckDoors() {
+	now := w.clock.Now()
+	for target, door := range w.doors {
+		open, known := w.actions.DoorState(target)
+		if !known {
+			continue
+		}
+		if !door.known || open != door.open {
+			w.doorChanged(target, door, open, now)
+		}
+		if door.open && !door.proppedTold && door.config.ProppedTime > 0 {
+			since := door.openedAt
+			if door.grantedUntil.After(since) {
+				since = door.grantedUntil // Held open on purpose.
+			}
+			if now.Sub(since) >= time.Duration(door.config.ProppedTime) {
+				door.proppedTold = true
+				log.Printf("Door %s propped open since %s", target,
+					door.openedAt.Format("15:04:05"))
+				w.post(AppDoorPropped, target, 1,
+					"Open since "+door.openedAt.Format("15:04"))
+			}
+		}
+	}
+}
+
+func (w *DoorWatcher) doorChanged(target Target, door *doorStatus, open bool, now time.Time) {
+	firstReading := !door.known
+	door.known, door.open = true, open
+	value := 0
+	if open {
+		value = 1
+		door.openedAt = now
+	}
+	w.post(AppDoorSensorEvent, target, value, "")
+	switch {
+	case open && !firstReading && now.After(door.grantedUntil):
+		log.Printf("Door %s opened without access granted", target)
+		if door.config.AlertForced {
+			w.post(AppDoorForced, target, 0, "Opened without access granted")
+		}
+	case !open && door.proppedTold:
+		door.proppedTold = false
+		log.Printf("Door %s closed again", target)
+		w.post(AppDoorPropped, target, 0, "Closed again")
+	}
+}
+
+func (w *DoorWatcher) post(ev AppEventType, target Target, value int, msg string) {
+	w.bus.Post(&AppEvent{
+		Ev:     ev,
+		Target: target,
+		Source: "door-sensor",
+		Msg:    msg,
+		Value:  value,
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type doorWatcherFixture struct {
+	actions *RecordingActions
+	bus     *ApplicationBus
+	events  AppEventChannel
+	clock   *MockClock
+	watcher *DoorWatcher
+}
+
+func newDoorWatcherFixture(sensors map[Target]DoorSensorConfig) *doorWatcherFixture {
+	f := &doorWatcherFixture{
+		actions: NewRecordingActions(),
+		bus:     NewApplicationBus(),
+		events:  make(AppEventChannel, 20),
+		clock:   &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	f.bus.Subscribe(f.events)
+	f.watcher = NewDoorWatcher(f.actions, f.bus, sensors)
+	f.watcher.clock = f.clock
+	return f
+}
+
+// Let time pass and check the doors, then return what was posted.
+func (f *doorWatcherFixture) check(after time.Duration) []string {
+	f.clock.now = f.clock.now.Add(after)
+	f.watcher.CheckDoors()
+	f.bus.Flush()
+	result := []string{}
+	for len(f.events) > 0 {
+		event := <-f.events
+		result = append(result, fmt.Sprintf("%s:%s:%d", event.Ev,
+			event.Target, event.Value))
+	}
+	return result
+}
+
+func TestDoorForcedOpen(t *testing.T) {
+	f := newDoorWatcherFixture(map[Target]DoorSensorConfig{
+		TargetUpstairs:   {Pin: 5, AlertForced: true},
+		TargetDownstairs: {Pin: 6}, // People leave through here.
+	})
+	f.actions.SetDoorOpen(TargetUpstairs, false)
+	f.actions.SetDoorOpen(TargetDownstairs, false)
+	ExpectTrue(t, len(f.check(0)) == 2, "Initial state posted")
+
+	// Let in: opening is expected.
+	f.watcher.HandleAppEvent(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs})
+	f.actions.SetDoorOpen(TargetUpstairs, true)
+	ExpectTrue(t, fmt.Sprint(f.check(time.Second)) == "[door-sensor:upstairs:1]",
+		"Opened after grant")
+	f.actions.SetDoorOpen(TargetUpstairs, false)
+	ExpectTrue(t, fmt.Sprint(f.check(2*time.Second)) == "[door-sensor:upstairs:0]",
+		"Closed")
+	ExpectTrue(t, len(f.check(time.Second)) == 0, "No change, nothing posted")
+
+	// After the strike closed.
+	f.actions.SetDoorOpen(TargetUpstairs, true)
+	ExpectTrue(t, fmt.Sprint(f.check(doorOpenGrace)) ==
+		"[door-sensor:upstairs:1 door-forced:upstairs:0]", "Forced open")
+	f.actions.SetDoorOpen(TargetDownstairs, true)
+	ExpectTrue(t, fmt.Sprint(f.check(time.Second)) == "[door-sensor:gate:1]",
+		"Only logged where people leave")
+}
+
+func TestDoorProppedOpen(t *testing.T) {
+	f := newDoorWatcherFixture(map[Target]DoorSensorConfig{
+		TargetUpstairs: {Pin: 5},
+	})
+	f.actions.SetDoorOpen(TargetUpstairs, false)
+	f.check(0)
+
+	f.watcher.HandleAppEvent(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs})
+	f.actions.SetDoorOpen(TargetUpstairs, true)
+	f.check(time.Second)
+	grantEnd := defaultDoorOpenTime + doorOpenGrace - time.Second
+	ExpectTrue(t, len(f.check(grantEnd+defaultDoorProppedTime-time.Second)) == 0,
+		"Not propped yet")
+	ExpectTrue(t, fmt.Sprint(f.check(time.Second)) == "[door-propped:upstairs:1]",
+		"Propped")
+	ExpectTrue(t, len(f.check(time.Minute)) == 0, "Told only once")
+	f.actions.SetDoorOpen(TargetUpstairs, false)
+	ExpectTrue(t, fmt.Sprint(f.check(time.Second)) ==
+		"[door-sensor:upstairs:0 door-propped:upstairs:0]", "Closed again")
+
+	// Held open on purpose: counts from the end of it.
+	f.watcher.HandleAppEvent(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs,
+		Timeout: f.clock.now.Add(10 * time.Minute)})
+	f.actions.SetDoorOpen(TargetUpstairs, true)
+	f.check(time.Second)
+	ExpectTrue(t, len(f.check(10*time.Minute)) == 0, "Held open")
+	ExpectTrue(t, fmt.Sprint(f.check(doorOpenGrace+defaultDoorProppedTime)) ==
+		"[door-propped:upstairs:1]", "Propped after holding open")
+}
+
+func TestDoorClosedInTime(t *testing.T) {
+	f := newDoorWatcherFixture(map[Target]DoorSensorConfig{
+		TargetUpstairs: {Pin: 5, ProppedTime: Duration(time.Minute)},
+	})
+	f.actions.SetDoorOpen(TargetUpstairs, false)
+	f.check(0)
+
+	f.watcher.HandleAppEvent(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs})
+	f.actions.SetDoorOpen(TargetUpstairs, true)
+	f.check(time.Second)
+	f.actions.SetDoorOpen(TargetUpstairs, false)
+	ExpectTrue(t, fmt.Sprint(f.check(50*time.Second)) == "[door-sensor:upstairs:0]",
+		"Closed before the propped-time")
+	ExpectTrue(t, len(f.check(time.Hour)) == 0, "No alert later")
+}
+
+func TestProppedDoorReminder(t *testing.T) {
+	f := NewTestFixture(t)
+	clock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	f.handlerUnderTest.clock = clock
+	f.handlerUnderTest.proppedReminder = 30 * time.Second
+	buzzes := func() int { return len(f.mockterm.buzzes) }
+
+	f.handlerUnderTest.HandleAppEvent(&AppEvent{Ev: AppDoorPropped,
+		Target: Target("other"), Value: 1})
+	f.handlerUnderTest.HandleTick()
+	ExpectTrue(t, buzzes() == 0, "Not our door")
+
+	f.handlerUnderTest.HandleAppEvent(&AppEvent{Ev: AppDoorPropped,
+		Target: Target("mock"), Value: 1})
+	f.handlerUnderTest.HandleTick()
+	ExpectTrue(t, buzzes() == 1, "Reminded right away")
+	f.mockterm.expectColor(ColorRed)
+	clock.now = clock.now.Add(20 * time.Second)
+	f.handlerUnderTest.HandleTick()
+	ExpectTrue(t, buzzes() == 1, "Not too often")
+	clock.now = clock.now.Add(10 * time.Second)
+	f.handlerUnderTest.HandleTick()
+	ExpectTrue(t, buzzes() == 2, "Reminded again")
+
+	// Closing the door ends it.
+	f.handlerUnderTest.HandleAppEvent(&AppEvent{Ev: AppDoorSensorEvent,
+		Target: Target("mock"), Value: 0})
+	clock.now = clock.now.Add(time.Minute)
+	f.handlerUnderTest.HandleTick()
+	ExpectTrue(t, buzzes() == 2, "Quiet once closed")
+}
@@ -0,0 +1,122 @@
+// ElevatorHandler.
+//
+// An AccessHandler for the terminal in front of the elevator. Instead of
+// just opening, it enables the floors the user is allowed to go to. If the
+// user has more than one floor to choose from, they select the floor with a
+// single digit on the keypad.
+// Users without any floor restriction get all floors enabled.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	kFloorSelectionTimeout = 15 * time.Second // Time to choose floor.
+)
+
+type ElevatorHandler struct {
+	*AccessHandler
+
+	selectableFloors      []int     // Non-empty while waiting for selection
+	floorSelectionEndTime time.Time // Give up selection after this.
+}
+
+func NewElevatorHandler(backends *Backends) *ElevatorHandler {
+	h := &ElevatorHandler{AccessHandler: NewAccessHandler(backends)}
+	h.grantAction = h.grantFloors
+	return h
+}
+
+func (h *ElevatorHandler) HandleKeypress(b byte) {
+	if key, ok := StandardKeypad.Key(b); ok {
+		h.HandleKey(key)
+	}
+}
+
+func (h *ElevatorHandler) HandleKey(key Key) {
+	if len(h.selectableFloors) == 0 {
+		h.AccessHandler.HandleKey(key)
+		return
+	}
+	h.lastKeypressTime = h.clock.Now()
+	switch key.Type {
+	case KeyClear:
+		h.endFloorSelection()
+	case KeyDigit:
+		floor := int(key.Digit - '0')
+		for _, allowed := range h.selectableFloors {
+			if allowed == floor {
+				h.enableFloor(floor)
+				h.endFloorSelection()
+				h.feedbackColor(FeedbackGranted, h.welcomeDuration)
+				return
+			}
+		}
+		h.giveFeedback(FeedbackDenied)
+	}
+}
+
+func (h *ElevatorHandler) HandleAppEvent(event *AppEvent) {
+	switch event.Ev {
+	case AppEnableFloorRequest:
+		// Show if triggered elsewhere; we know about our own.
+		if event.Target == h.ourTarget() &&
+			event.Source != h.t.GetTerminalName() {
+			h.giveFeedback(FeedbackRemoteOpen)
+		}
+	default:
+		h.AccessHandler.HandleAppEvent(event)
+	}
+}
+
+func (h *ElevatorHandler) HandleTick() {
+	if len(h.selectableFloors) > 0 && h.clock.Now().After(h.floorSelectionEndTime) {
+		h.endFloorSelection()
+		h.giveFeedback(FeedbackTimeout)
+	}
+	h.AccessHandler.HandleTick()
+}
+
+// Called by the AccessHandler once the user is granted access.
+func (h *ElevatorHandler) grantFloors(user *User, target Target) {
+	switch len(user.AllowedFloors) {
+	case 0:
+		h.showWelcome(user)
+		h.enableFloor(AllFloors)
+	case 1:
+		h.showWelcome(user)
+		h.enableFloor(user.AllowedFloors[0])
+	default:
+		h.selectableFloors = user.AllowedFloors
+		h.floorSelectionEndTime = h.clock.Now().Add(kFloorSelectionTimeout)
+		var floors []string
+		for _, floor := range user.AllowedFloors {
+			floors = append(floors, fmt.Sprintf("%d", floor))
+		}
+		h.showMessageForTime("Select floor", strings.Join(floors, ","),
+			kFloorSelectionTimeout)
+	}
+}
+
+func (h *ElevatorHandler) endFloorSelection() {
+	h.selectableFloors = nil
+	h.t.WriteLCDLines([]string{"", ""})
+	h.messageShown = false
+}
+
+func (h *ElevatorHandler) enableFloor(floor int) {
+	msg := "Enabling all floors"
+	if floor != AllFloors {
+		msg = fmt.Sprintf("Enabling floor %d", floor)
+	}
+	h.backends.appEventBus.Post(&AppEvent{
+		Ev:     AppEnableFloorRequest,
+		Target: h.ourTarget(),
+		Source: h.t.GetTerminalName(),
+		Msg:    msg,
+		Value:  floor,
+	})
+}
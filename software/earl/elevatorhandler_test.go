@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func NewElevatorTestFixture(t *testing.T) (*TestFixture, *ElevatorHandler) {
+	testFixture := NewTestFixture(t)
+	handler := NewElevatorHandler(testFixture.mockbackends)
+	handler.Init(testFixture.mockterm)
+	testFixture.appEventHandler = handler
+	return testFixture, handler
+}
+
+func (f *TestFixture) ExpectFloorEnabled(floor int) {
+	f.FlushAllAppEvents()
+	select {
+	case event := <-f.expectEventChannel:
+		if event.Ev != AppEnableFloorRequest || event.Value != floor {
+			f.tester.Errorf("Expecting floor %d enabled, but got %s:%d",
+				floor, event.Ev, event.Value)
+		}
+	case <-time.After(50 * time.Millisecond):
+		f.tester.Errorf("Expecting floor %d enabled, but nothing in queue",
+			floor)
+	}
+}
+
+func TestElevatorAllFloorsWithoutRestriction(t *testing.T) {
+	testFixture, handler := NewElevatorTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	PressKeys(handler, "123456#")
+
+	testFixture.ExpectFloorEnabled(AllFloors)
+	testFixture.mockterm.expectColor("G")
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestElevatorFloorSelection(t *testing.T) {
+	testFixture, handler := NewElevatorTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	testFixture.mockauth.users["123456"] = &User{
+		UserLevel:     LevelMember,
+		AllowedFloors: []int{2, 4},
+	}
+	PressKeys(handler, "123456#")
+	testFixture.mockterm.expectLCD(0, "Select floor")
+	testFixture.mockterm.expectLCD(1, "2,4")
+	testFixture.ExpectNoMoreEvents()
+
+	PressKeys(handler, "3") // Not allowed.
+	testFixture.mockterm.expectColor("R")
+	testFixture.ExpectNoMoreEvents()
+
+	PressKeys(handler, "4")
+	testFixture.ExpectFloorEnabled(4)
+	testFixture.ExpectNoMoreEvents()
+
+	// Selection is done, so keys are a new code again.
+	PressKeys(handler, "2")
+	testFixture.ExpectNoMoreEvents()
+}
+
+func TestElevatorFloorSelectionTimeout(t *testing.T) {
+	testFixture, handler := NewElevatorTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	testFixture.mockauth.users["123456"] = &User{
+		UserLevel:     LevelMember,
+		AllowedFloors: []int{2, 4},
+	}
+	mockClock := &MockClock{}
+	handler.clock = mockClock
+	PressKeys(handler, "123456#")
+
+	mockClock.now = mockClock.now.Add(60 * time.Second)
+	handler.HandleTick()
+	testFixture.mockterm.expectLCD(0, "")
+
+	PressKeys(handler, "2")
+	testFixture.ExpectNoMoreEvents()
+}
@@ -0,0 +1,550 @@
+// Fakes and mocks to test handlers and terminals without hardware.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ACKey struct {
+	code   string
+	target Target
+}
+
+// Implements Athenticator interface.
+type MockAuthenticator struct {
+	allow  map[ACKey]ReasonCode
+	users  map[string]*User // Users returned for code.
+	duress map[string]bool  // Codes that are duress codes.
+
+	renewalDue map[string]bool // Codes let in on grace.
+	accesses   []Target        // Recorded by AuthUser() or RecordAccess().
+}
+
+func NewMockAuthenticator() *MockAuthenticator {
+	return &MockAuthenticator{
+		allow:  make(map[ACKey]ReasonCode),
+		users:  make(map[string]*User),
+		duress: make(map[string]bool),
+
+		renewalDue: make(map[string]bool)}
+}
+
+func (a *MockAuthenticator) AuthUser(code string, target Target) AuthDecision {
+	decision := a.CheckCode(code, target)
+	if decision.Granted {
+		a.RecordAccess(decision.User, target)
+	}
+	return decision
+}
+
+func (a *MockAuthenticator) RecordAccess(user *User, target Target) {
+	a.accesses = append(a.accesses, target)
+}
+
+func (a *MockAuthenticator) CheckCode(code string, target Target) AuthDecision {
+	reason, ok := a.allow[ACKey{code, target}]
+	if !ok {
+		return authDenied(ReasonUnknownCode, "User does not exist")
+	}
+	decision := authDenied(reason, "MockAuthenticator says: some failure occured")
+	if reason == ReasonOK {
+		decision = authGranted()
+	}
+	decision.Duress = a.duress[code]
+	decision.RenewalDue = decision.Granted && a.renewalDue[code]
+	decision.User = a.FindUser(code)
+	if decision.User == nil {
+		decision.User = &User{UserLevel: LevelMember}
+	}
+	return decision
+}
+
+func (a *MockAuthenticator) AddNewUser(authentication_user string, user User) (bool, string) {
+	return false, ""
+}
+func (a *MockAuthenticator) FindUser(code string) *User {
+	return a.users[code]
+}
+func (a *MockAuthenticator) UpdateUser(auth_code string, user_code string, updater_fun ModifyFun) (bool, string) {
+	return false, ""
+}
+
+func (a *MockAuthenticator) DeleteUser(auth_code string, user_code string) (bool, string) {
+	return false, ""
+}
+
+func (a *MockAuthenticator) SetSuspended(auth_code string, user_code string, suspended bool) (bool, string) {
+	return false, ""
+}
+
+func (a *MockAuthenticator) StoreError() error {
+	return nil
+}
+
+func (a *MockAuthenticator) CreateGuestCode(auth_code string, duration time.Duration, target Target) (string, error) {
+	return "", nil
+}
+
+func (a *MockAuthenticator) NeedsProvisioning() bool {
+	return false
+}
+
+func (a *MockAuthenticator) ProvisionMember(token string, user User) (bool, string) {
+	return false, ""
+}
+
+type Buzz struct {
+	toneCode string
+	duration time.Duration
+}
+
+// Implements Terminal interface.
+type MockTerminal struct {
+	t            *testing.T
+	colors       string // All colors shown so far.
+	currentColor string
+	buzzes       []Buzz
+	lcd          [2]string
+	calls        []string // Log of all calls, e.g. "color:G" or "lcd0:Hi"
+	capabilities TerminalCapabilities
+	name         string // Reported name; "mock" if empty.
+}
+
+func NewMockTerminal(t *testing.T) *MockTerminal {
+	ret := &MockTerminal{t: t, capabilities: FullTerminalCapabilities()}
+	return ret
+}
+
+func (term *MockTerminal) Capabilities() TerminalCapabilities {
+	return term.capabilities
+}
+
+func (term *MockTerminal) GetTerminalName() string {
+	if term.name != "" {
+		return term.name
+	}
+	return "mock"
+}
+
+func (term *MockTerminal) ShowColor(colors string) {
+	term.colors = term.colors + colors
+	term.currentColor = colors
+	term.calls = append(term.calls, "color:"+colors)
+}
+
+func (term *MockTerminal) BuzzSpeaker(toneCode string, duration time.Duration) {
+	term.buzzes = append(term.buzzes, Buzz{toneCode, duration})
+	term.calls = append(term.calls, "buzz:"+toneCode)
+}
+
+// Shown like a regular write, but never reverted.
+func (term *MockTerminal) WriteLCDTemporary(row int, text string, duration time.Duration) {
+	term.WriteLCD(row, text)
+}
+
+// Recorded like the individual rows; tests care about what is shown.
+func (term *MockTerminal) WriteLCDLines(lines []string) {
+	for row, text := range lines {
+		term.WriteLCD(row, text)
+	}
+}
+
+func (term *MockTerminal) WriteLCD(row int, text string) {
+	term.lcd[row] = text
+	term.calls = append(term.calls, fmt.Sprintf("lcd%d:%s", row, text))
+}
+
+func (term *MockTerminal) expectColor(color string) {
+	if !strings.Contains(term.colors, color) {
+		term.t.Errorf("Expecting color '%v', but seeing colors '%v'", color, term.colors)
+	}
+}
+
+func (term *MockTerminal) expectLCD(row int, text string) {
+	if term.lcd[row] != text {
+		term.t.Errorf("Expecting LCD row %d '%s', but seeing '%s'",
+			row, text, term.lcd[row])
+	}
+}
+
+func (term *MockTerminal) expectBuzz(buzz Buzz) {
+	if len(term.buzzes) == 0 {
+		term.t.Errorf("Expecting buzz %v but heard nothing", buzz)
+		return
+	}
+	curBuzz := term.buzzes[0]
+	term.buzzes = term.buzzes[1:]
+	if curBuzz != buzz {
+		term.t.Errorf("Expecting buzz %v but heard buzz %v", buzz, curBuzz)
+	}
+}
+
+// Expect the given calls to have happened in this sequence (other calls
+// in-between are ok).
+func (term *MockTerminal) expectCallSequence(expected ...string) {
+	pos := 0
+	for _, call := range term.calls {
+		if pos < len(expected) && call == expected[pos] {
+			pos++
+		}
+	}
+	if pos < len(expected) {
+		term.t.Errorf("Expecting '%s' in sequence %v, but calls were %v",
+			expected[pos], expected, term.calls)
+	}
+}
+
+// A call to RecordingActions.
+type ActionCall struct {
+	When     time.Time
+	Action   string // "open", "close", "ring", "hush" or "floor"
+	Target   Target
+	Floor    int
+	Duration time.Duration // How long a door is opened.
+}
+
+// Implements PhysicalActions, recording the calls instead of touching
+// hardware. Actions come from the goroutine reading the ApplicationBus,
+// so all access is locked.
+type RecordingActions struct {
+	lock  sync.Mutex
+	calls []ActionCall
+	doors map[Target]bool // Doors with a sensor: open?
+}
+
+func NewRecordingActions() *RecordingActions {
+	return &RecordingActions{doors: make(map[Target]bool)}
+}
+
+// Simulate the door sensor.
+func (a *RecordingActions) SetDoorOpen(which Target, open bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.doors[which] = open
+}
+
+func (a *RecordingActions) DoorState(which Target) (open bool, known bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	open, known = a.doors[which]
+	return open, known
+}
+
+// Act on everything posted to the bus from now on.
+func (a *RecordingActions) Listen(bus *ApplicationBus, maintenance *Maintenance) {
+	appEvents := make(AppEventChannel, 10)
+	bus.Subscribe(appEvents)
+	go func() {
+		for event := range appEvents {
+			DispatchPhysicalAction(event, a, maintenance)
+		}
+	}()
+}
+
+func (a *RecordingActions) record(call ActionCall) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	call.When = time.Now()
+	a.calls = append(a.calls, call)
+}
+
+func (a *RecordingActions) OpenDoor(which Target, openTime time.Duration) {
+	a.record(ActionCall{Action: "open", Target: which, Duration: openTime})
+}
+func (a *RecordingActions) CloseDoor(which Target) {
+	a.record(ActionCall{Action: "close", Target: which})
+}
+func (a *RecordingActions) RingBell(which Target) {
+	a.record(ActionCall{Action: "ring", Target: which})
+}
+func (a *RecordingActions) HushBell(which Target, until time.Time) {
+	a.record(ActionCall{Action: "hush", Target: which})
+}
+func (a *RecordingActions) EnableFloor(floor int) {
+	a.record(ActionCall{Action: "floor", Floor: floor})
+}
+
+// All calls so far, in sequence.
+func (a *RecordingActions) Calls() []ActionCall {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]ActionCall{}, a.calls...)
+}
+
+// Wait until the action happened for the given target and return the
+// call. Returns nil on timeout.
+func (a *RecordingActions) WaitForCall(action string, target Target, timeout time.Duration) *ActionCall {
+	for end := time.Now().Add(timeout); time.Now().Before(end); {
+		for _, call := range a.Calls() {
+			if call.Action == action && call.Target == target {
+				return &call
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// A serial port with a fake terminal on the other end. Requests are answered
+// like the firmware would (it can also be told to stop answering), and
+// tests can inject keypresses and RFID reads as if coming from the terminal.
+type FakeSerialPort struct {
+	fromTerminal *io.PipeReader
+	terminalOut  *io.PipeWriter
+
+	lock     sync.Mutex
+	name     string        // Reported on 'n'ame request.
+	version  string        // Reported on 'v'ersion request. Empty: old firmware.
+	silent   bool          // Don't answer any requests.
+	lcdBatch bool          // Knows the 'W' command writing both LCD rows.
+	toneAck  time.Duration // Delay before acknowledging a 'T'one.
+	junk     int           // Stale lines to send before the next responses.
+	failing  int           // Writes to fail before working again.
+	requests []string      // All requests seen, in sequence.
+	writes   []string      // Everything written, unparsed.
+
+	terminator string // Line terminator of the firmware.
+}
+
+func NewFakeSerialPort() *FakeSerialPort {
+	reader, writer := io.Pipe()
+	return &FakeSerialPort{
+		fromTerminal: reader,
+		terminalOut:  writer,
+		name:         "fake",
+		terminator:   "\r\n",
+	}
+}
+
+func (p *FakeSerialPort) SetName(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.name = name
+}
+
+func (p *FakeSerialPort) SetFirmwareVersion(version string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.version = version
+}
+
+func (p *FakeSerialPort) SetLCDBatch(supported bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lcdBatch = supported
+}
+
+// Simulate firmware that only acknowledges a tone after the given time,
+// e.g. once the tone is done.
+func (p *FakeSerialPort) SetToneAckDelay(delay time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.toneAck = delay
+}
+
+// Simulate firmware that uses the given line terminator for reading and
+// writing.
+// Simulate noise on the line: the next responses are each preceded by
+// one stale line not matching the request, until count are sent.
+func (p *FakeSerialPort) SendJunkResponses(count int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.junk = count
+}
+
+func (p *FakeSerialPort) SetLineTerminator(terminator string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.terminator = terminator
+}
+
+func (p *FakeSerialPort) RawWrites() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.writes...)
+}
+
+// Simulate a glitch on the line: the next count writes fail.
+func (p *FakeSerialPort) FailWrites(count int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failing = count
+}
+
+// Simulate a terminal that hangs: requests are not answered anymore.
+func (p *FakeSerialPort) StopResponding() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.silent = true
+}
+
+// All requests the terminal received so far.
+func (p *FakeSerialPort) Requests() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.requests...)
+}
+
+// Wait until the terminal received the given request.
+func (p *FakeSerialPort) WaitForRequest(request string, timeout time.Duration) bool {
+	for end := time.Now().Add(timeout); time.Now().Before(end); {
+		for _, seen := range p.Requests() {
+			if seen == request {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (p *FakeSerialPort) Read(buf []byte) (int, error) {
+	return p.fromTerminal.Read(buf)
+}
+
+func (p *FakeSerialPort) Write(buf []byte) (int, error) {
+	p.lock.Lock()
+	if p.failing > 0 {
+		p.failing--
+		p.lock.Unlock()
+		return 0, errors.New("fake write failure")
+	}
+	p.writes = append(p.writes, string(buf))
+	terminator := p.terminator
+	p.lock.Unlock()
+	delimiter := terminator[len(terminator)-1:]
+	for _, request := range strings.Split(string(buf), delimiter) {
+		request = strings.Trim(request, "\r\n")
+		if request == "" {
+			continue
+		}
+		if response := p.respondTo(request); response != "" {
+			p.TerminalSends(response + terminator)
+		}
+	}
+	return len(buf), nil
+}
+
+func (p *FakeSerialPort) respondTo(request string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requests = append(p.requests, request)
+	if p.silent {
+		return ""
+	}
+	if p.junk > 0 {
+		p.junk--
+		return "x stale" + p.terminator + p.respondToLocked(request)
+	}
+	return p.respondToLocked(request)
+}
+
+func (p *FakeSerialPort) respondToLocked(request string) string {
+	switch request[0] {
+	case 'T':
+		if p.toneAck > 0 {
+			terminator := p.terminator
+			time.AfterFunc(p.toneAck, func() {
+				p.TerminalSends("T ok" + terminator)
+			})
+			return ""
+		}
+		return "T ok"
+	case 'n':
+		return "n" + p.name
+	case 'v':
+		if p.version != "" {
+			return "v" + p.version
+		}
+	case 'L', 'M':
+		return request[0:1] + " ok"
+	case 'W':
+		if p.lcdBatch {
+			return "W ok"
+		}
+	}
+	return "E Unknown command " + request[0:1]
+}
+
+func (p *FakeSerialPort) Close() error {
+	p.terminalOut.Close()
+	return p.fromTerminal.Close()
+}
+
+// Send data as if coming from the terminal.
+func (p *FakeSerialPort) TerminalSends(data string) {
+	p.terminalOut.Write([]byte(data))
+}
+
+func (p *FakeSerialPort) SendKeypress(key byte) {
+	p.TerminalSends(fmt.Sprintf("K%c%s", key, p.lineTerminator()))
+}
+
+func (p *FakeSerialPort) SendRFID(rfid string) {
+	p.TerminalSends(fmt.Sprintf("I%d %s%s", len(rfid)/2, rfid, p.lineTerminator()))
+}
+
+func (p *FakeSerialPort) lineTerminator() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.terminator
+}
+
+// Implements TerminalEventHandler, recording the events it sees.
+type RecordingHandler struct {
+	keys  chan byte
+	rfids chan string
+	power chan bool
+}
+
+func NewRecordingHandler() *RecordingHandler {
+	return &RecordingHandler{
+		keys:  make(chan byte, 100),
+		rfids: make(chan string, 100),
+		power: make(chan bool, 100),
+	}
+}
+
+func (h *RecordingHandler) Init(t Terminal)                {}
+func (h *RecordingHandler) HandleShutdown()                {}
+func (h *RecordingHandler) HandleKeypress(key byte)        { h.keys <- key }
+func (h *RecordingHandler) HandleRFID(rfid string)         { h.rfids <- rfid }
+func (h *RecordingHandler) HandleAppEvent(event *AppEvent) {}
+func (h *RecordingHandler) HandleTick()                    {}
+func (h *RecordingHandler) HandlePowerStatus(ok bool)      { h.power <- ok }
+
+func (h *RecordingHandler) expectKey(t *testing.T, expected byte) {
+	select {
+	case key := <-h.keys:
+		if key != expected {
+			t.Errorf("Expected key '%c', got '%c'", expected, key)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected key '%c', but got nothing", expected)
+	}
+}
+
+func (h *RecordingHandler) expectRFID(t *testing.T, expected string) {
+	select {
+	case rfid := <-h.rfids:
+		if rfid != expected {
+			t.Errorf("Expected RFID '%s', got '%s'", expected, rfid)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected RFID '%s', but got nothing", expected)
+	}
+}
+
+func (h *RecordingHandler) expectNoMoreKeys(t *testing.T) {
+	select {
+	case key := <-h.keys:
+		t.Errorf("Didn't expect key, got '%c'", key)
+	default:
+	}
+}
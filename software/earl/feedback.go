@@ -0,0 +1,124 @@
+// Feedback.
+//
+// The LED color and tone a terminal gives for the things that happen at an
+// entrance, such as granting or denying access. Collected in a
+// FeedbackProfile so that the UX can be changed in the config file, e.g.
+//
+//	"feedback": {
+//	  "denied": { "color": "R", "color-duration": "2s",
+//	              "tone": "L", "tone-duration": "1s" }
+//	}
+//
+// The control terminal has its own defaults (see DefaultFeedbackProfileFor()),
+// so that it can't be mistaken for a door on a bench full of terminals:
+// it is blue while idle and confirms with a short beep.
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type FeedbackEvent string
+
+const (
+	FeedbackGranted    = FeedbackEvent("granted")     // Access granted.
+	FeedbackDenied     = FeedbackEvent("denied")      // Known code, but no access.
+	FeedbackUnknown    = FeedbackEvent("unknown")     // Unknown code.
+	FeedbackLocked     = FeedbackEvent("locked")      // Outside hours or expired; rings the bell.
+	FeedbackDoorbell   = FeedbackEvent("doorbell")    // Doorbell button pressed.
+	FeedbackTimeout    = FeedbackEvent("timeout")     // User stopped typing.
+	FeedbackRemoteOpen = FeedbackEvent("remote-open") // Opened from elsewhere.
+	FeedbackPropped    = FeedbackEvent("propped")     // Reminder: door left open.
+	FeedbackIdle       = FeedbackEvent("idle")        // Color while nothing happens.
+)
+
+type Feedback struct {
+	// Combination of 'R', 'G', 'B' (see Terminal.ShowColor()), or empty
+	// to leave the LEDs alone.
+	Color         string   `json:"color"`
+	ColorDuration Duration `json:"color-duration"`
+
+	// 'H' or 'L' (see Terminal.BuzzSpeaker()), or empty for silence.
+	Tone         string   `json:"tone"`
+	ToneDuration Duration `json:"tone-duration"`
+}
+
+// Feedback for each event. Events not in the profile give no feedback.
+type FeedbackProfile map[FeedbackEvent]Feedback
+
+func DefaultFeedbackProfile() FeedbackProfile {
+	return FeedbackProfile{
+		// The green light is shown with the welcome message, so it
+		// stays on for the welcome-duration.
+		FeedbackGranted: {Color: ColorGreen,
+			Tone: "H", ToneDuration: Duration(500 * time.Millisecond)},
+		FeedbackDenied: {Color: ColorRed, ColorDuration: Duration(500 * time.Millisecond),
+			Tone: "L", ToneDuration: Duration(200 * time.Millisecond)},
+		FeedbackUnknown: {Color: ColorRed, ColorDuration: Duration(500 * time.Millisecond),
+			Tone: "L", ToneDuration: Duration(200 * time.Millisecond)},
+		// Blue (='nighttime') is less confusing than red for codes
+		// that are only failing as they are outside daytime.
+		FeedbackLocked: {Color: ColorBlue, ColorDuration: Duration(1000 * time.Millisecond),
+			Tone: "L", ToneDuration: Duration(200 * time.Millisecond)},
+		FeedbackTimeout: {
+			Tone: "L", ToneDuration: Duration(500 * time.Millisecond)},
+		FeedbackRemoteOpen: {Color: ColorGreen, ColorDuration: Duration(2000 * time.Millisecond)},
+		FeedbackPropped: {Color: ColorRed, ColorDuration: Duration(1000 * time.Millisecond),
+			Tone: "H", ToneDuration: Duration(1000 * time.Millisecond)},
+	}
+}
+
+// Feedback of the control terminal: it grants nothing, "granted" confirms
+// that what a member did on it worked.
+func ControlFeedbackProfile() FeedbackProfile {
+	return FeedbackProfile{
+		FeedbackIdle: {Color: ColorBlue},
+		FeedbackGranted: {Color: ColorGreen, ColorDuration: Duration(1000 * time.Millisecond),
+			Tone: "H", ToneDuration: Duration(100 * time.Millisecond)},
+		FeedbackDenied: {Color: ColorRed, ColorDuration: Duration(1000 * time.Millisecond),
+			Tone: "L", ToneDuration: Duration(500 * time.Millisecond)},
+		FeedbackUnknown: {Color: ColorRed, ColorDuration: Duration(1000 * time.Millisecond),
+			Tone: "L", ToneDuration: Duration(500 * time.Millisecond)},
+	}
+}
+
+// The default profile for the terminal with the given target.
+func DefaultFeedbackProfileFor(target Target) FeedbackProfile {
+	if target == TargetControlUI {
+		return ControlFeedbackProfile()
+	}
+	return DefaultFeedbackProfile()
+}
+
+// Return a new profile with the events in "overrides" replaced.
+func (p FeedbackProfile) WithOverrides(overrides FeedbackProfile) FeedbackProfile {
+	result := FeedbackProfile{}
+	for event, feedback := range p {
+		result[event] = feedback
+	}
+	for event, feedback := range overrides {
+		result[event] = feedback
+	}
+	return result
+}
+
+func (p FeedbackProfile) Validate() error {
+	for event, feedback := range p {
+		switch event {
+		case FeedbackGranted, FeedbackDenied, FeedbackUnknown,
+			FeedbackLocked, FeedbackDoorbell, FeedbackTimeout,
+			FeedbackRemoteOpen, FeedbackPropped, FeedbackIdle:
+		default:
+			return fmt.Errorf("unknown feedback event '%s'", event)
+		}
+		if _, err := NormalizeColor(feedback.Color); err != nil {
+			return fmt.Errorf("feedback '%s': %v", event, err)
+		}
+		if feedback.Tone != "" && feedback.Tone != "H" && feedback.Tone != "L" {
+			return fmt.Errorf("feedback '%s': tone needs to be H or L; got '%s'",
+				event, feedback.Tone)
+		}
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -21,85 +22,211 @@ const (
 
 	// Don't allow to ring more often than this.
 	defaultDoorbellRatelimit = 15 * time.Second
+
+	// Time window in which an enabled floor can be selected in the
+	// elevator.
+	defaultFloorEnableTime = 10 * time.Second
+
+	// Value of AppEnableFloorRequest to enable all floors.
+	AllFloors = -1
 )
 
+// Actions in the physical world, requested via the ApplicationBus.
+type PhysicalActions interface {
+	OpenDoor(which Target, openTime time.Duration)
+	CloseDoor(which Target) // Before the openTime is up.
+	RingBell(which Target)
+	HushBell(which Target, until time.Time) // Don't ring before then.
+	EnableFloor(floor int)                  // Floor number or AllFloors
+
+	// Whether the door is open, as far as a sensor tells; known is false
+	// for doors without one.
+	DoorState(which Target) (open bool, known bool)
+}
+
+// Act on a request from the ApplicationBus. Other events are ignored.
+// Doors of targets in maintenance are not opened, whoever asks.
+func DispatchPhysicalAction(event *AppEvent, actions PhysicalActions,
+	maintenance *Maintenance) {
+	switch event.Ev {
+	case AppOpenRequest:
+		if maintenance.Active(event.Target) {
+			log.Printf("%s in maintenance, not opening for %s",
+				event.Target, event.Source)
+			return
+		}
+		openTime := defaultDoorOpenTime
+		if !event.Timeout.IsZero() {
+			openTime = event.Timeout.Sub(time.Now())
+		}
+		actions.OpenDoor(event.Target, openTime)
+	case AppCloseRequest:
+		actions.CloseDoor(event.Target)
+	case AppEnableFloorRequest:
+		actions.EnableFloor(event.Value)
+	case AppDoorbellTriggerEvent:
+		actions.RingBell(event.Target)
+	case AppHushBellRequest:
+		actions.HushBell(event.Target, event.Timeout)
+	}
+}
+
+// GPIO pins of the door strikes, unless configured otherwise.
+var defaultDoorPins = map[Target]int{
+	TargetDownstairs: 7,
+	TargetUpstairs:   11,
+	TargetElevator:   9,
+}
+
 type GPIOActions struct {
 	doorbellDirectory   string
+	doorPins            map[Target]int
+	floorPins           map[int]int // Elevator floor to GPIO pin.
+	pins                []int       // All the pins we control.
 	nextAllowedOpenTime map[Target]time.Time
 	nextAllowedRingTime map[Target]time.Time
+	closeEarly          map[Target]chan struct{} // Of doors currently open.
+	sensorPins          map[Target]int           // Reed contacts; inputs.
 }
 
 // Create this, then call EventLoop() to hook into system.
-func NewGPIOActions(wavDir string) *GPIOActions {
+// The floorPins map elevator floors to the GPIO pin that enables them. If
+// empty, enabling a floor just opens the elevator.
+// The doorPins add to or override the defaultDoorPins. The sensorPins are
+// read for DoorState().
+func NewGPIOActions(wavDir string, floorPins map[int]int, doorPins map[Target]int,
+	sensorPins map[Target]int) *GPIOActions {
 	result := &GPIOActions{
 		doorbellDirectory:   wavDir,
+		doorPins:            make(map[Target]int),
+		floorPins:           floorPins,
+		pins:                []int{7, 8, 9, 11},
 		nextAllowedOpenTime: make(map[Target]time.Time),
 		nextAllowedRingTime: make(map[Target]time.Time),
+		closeEarly:          make(map[Target]chan struct{}),
+		sensorPins:          sensorPins,
+	}
+	for door, gpio_pin := range defaultDoorPins {
+		result.doorPins[door] = gpio_pin
+	}
+	for door, gpio_pin := range doorPins {
+		result.doorPins[door] = gpio_pin
+		result.pins = append(result.pins, gpio_pin)
+	}
+	for _, gpio_pin := range floorPins {
+		result.pins = append(result.pins, gpio_pin)
+	}
+	for _, gpio_pin := range result.pins {
+		result.initGPIO(gpio_pin)
+	}
+	for _, gpio_pin := range sensorPins {
+		result.initSensorGPIO(gpio_pin)
 	}
-	result.initGPIO(7)
-	result.initGPIO(8)
-	result.initGPIO(9)
-	result.initGPIO(11)
 	return result
 }
 
-// Receive events from the bus and act on it.
-// (later: if we read reed contacts, send AppDoorSensorEvents)
-func (g *GPIOActions) EventLoop(bus *ApplicationBus) {
+// Receive events from the bus and act on it. Door sensors are watched
+// separately, see door-sensor.go
+func (g *GPIOActions) EventLoop(bus *ApplicationBus, maintenance *Maintenance) {
 	appEvents := make(AppEventChannel, 2)
 	bus.Subscribe(appEvents)
 	for {
-		event := <-appEvents
-		switch event.Ev {
-		case AppOpenRequest:
-			g.openDoor(event.Target)
-		case AppDoorbellTriggerEvent:
-			g.ringBell(event.Target)
-		case AppHushBellRequest:
-			g.nextAllowedRingTime[event.Target] = event.Timeout
-		}
+		DispatchPhysicalAction(<-appEvents, g, maintenance)
+	}
+}
+
+// Switch off all relays, so that no door is left open when we exit.
+func (g *GPIOActions) Shutdown() {
+	for _, gpio_pin := range g.pins {
+		g.switchRelay(false, gpio_pin)
 	}
 }
 
-func (g *GPIOActions) openDoor(which Target) {
+func (g *GPIOActions) OpenDoor(which Target, openTime time.Duration) {
 	if time.Now().Before(g.nextAllowedOpenTime[which]) {
 		// We don't want to interfere with ourself currently opening.
 		return
 	}
-	g.nextAllowedOpenTime[which] = time.Now().Add(defaultDoorOpenTime + defaultDoorOpenRateLimit)
-
-	gpio_pin := -1
-	switch which {
-	case TargetDownstairs:
-		gpio_pin = 7
-
-	case TargetUpstairs:
-		gpio_pin = 11
-
-	case TargetElevator:
-		gpio_pin = 9
+	if openTime <= 0 {
+		return // Request that already timed out.
+	}
+	g.nextAllowedOpenTime[which] = time.Now().Add(openTime + defaultDoorOpenRateLimit)
 
-	default:
+	gpio_pin, ok := g.doorPins[which]
+	if !ok {
 		log.Printf("DoorAction: Don't know how to open '%s'", which)
 	}
 	// Maybe when we see a door-open event for this target, fall back
 	// to non-buzzing immediately after ?
-	if gpio_pin > 0 {
-		go func() {
-			g.switchRelay(true, gpio_pin)
-			time.Sleep(defaultDoorOpenTime)
-			g.switchRelay(false, gpio_pin)
-		}()
+	if ok && gpio_pin > 0 {
+		closeEarly := make(chan struct{})
+		g.closeEarly[which] = closeEarly
+		go g.holdRelay(gpio_pin, openTime, closeEarly)
 	}
 
 	// The door was opened, so allow the doorbell to ring again right away.
 	g.nextAllowedRingTime[which] = time.Now()
 }
 
-func (g *GPIOActions) ringBell(which Target) {
+// Enable the given floor in the elevator for a while, so that the
+// passenger can select it. With no floors configured, this just opens the
+// elevator.
+func (g *GPIOActions) EnableFloor(floor int) {
+	if len(g.floorPins) == 0 {
+		g.OpenDoor(TargetElevator, defaultFloorEnableTime)
+		return
+	}
+	if floor == AllFloors {
+		for _, gpio_pin := range g.floorPins {
+			go g.pulseRelay(gpio_pin, defaultFloorEnableTime)
+		}
+		return
+	}
+	gpio_pin, ok := g.floorPins[floor]
+	if !ok {
+		log.Printf("FloorAction: Don't know how to enable floor %d", floor)
+		return
+	}
+	go g.pulseRelay(gpio_pin, defaultFloorEnableTime)
+}
+
+func (g *GPIOActions) CloseDoor(which Target) {
+	if closeEarly, ok := g.closeEarly[which]; ok {
+		close(closeEarly)
+		delete(g.closeEarly, which)
+	}
+	g.nextAllowedOpenTime[which] = time.Now().Add(defaultDoorOpenRateLimit)
+}
+
+func (g *GPIOActions) pulseRelay(gpio_pin int, duration time.Duration) {
+	g.holdRelay(gpio_pin, duration, nil)
+}
+
+// Like pulseRelay(), but switched off early once closeEarly is closed.
+func (g *GPIOActions) holdRelay(gpio_pin int, duration time.Duration,
+	closeEarly <-chan struct{}) {
+	g.switchRelay(true, gpio_pin)
+	select {
+	case <-time.After(duration):
+	case <-closeEarly:
+	}
+	g.switchRelay(false, gpio_pin)
+}
+
+func (g *GPIOActions) RingBell(which Target) {
 	if time.Now().Before(g.nextAllowedRingTime[which]) {
 		return // Hushed.
 	}
+	g.playBell(which)
+	g.nextAllowedRingTime[which] = time.Now().Add(defaultDoorbellRatelimit)
+}
+
+func (g *GPIOActions) HushBell(which Target, until time.Time) {
+	g.nextAllowedRingTime[which] = until
+}
+
+// Ring right away, whether hushed or not.
+func (g *GPIOActions) playBell(which Target) {
 	filename := g.doorbellDirectory + "/" + string(which) + ".wav"
 	_, err := os.Stat(filename)
 	msg := ""
@@ -110,10 +237,31 @@ func (g *GPIOActions) ringBell(which Target) {
 		msg = ": [ugh, file not found!]"
 	}
 	log.Printf("Ringing doorbell for %s (%s%s)", which, filename, msg)
-	g.nextAllowedRingTime[which] = time.Now().Add(defaultDoorbellRatelimit)
+}
+
+func (g *GPIOActions) DoorState(which Target) (open bool, known bool) {
+	gpio_pin, ok := g.sensorPins[which]
+	if !ok {
+		return false, false
+	}
+	value, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/gpio/gpio%d/value", gpio_pin))
+	if err != nil || len(value) == 0 {
+		return false, false
+	}
+	// The contact is closed with the door, pulling the pin low.
+	return value[0] == '1', true
 }
 
 func (g *GPIOActions) initGPIO(gpio_pin int) {
+	g.exportGPIO(gpio_pin, "out")
+	g.switchRelay(false, gpio_pin) // initial state.
+}
+
+func (g *GPIOActions) initSensorGPIO(gpio_pin int) {
+	g.exportGPIO(gpio_pin, "in")
+}
+
+func (g *GPIOActions) exportGPIO(gpio_pin int, direction string) {
 	// Initialize the GPIO stuffs
 	// Create gpio_pin if it doesn't exist
 	f, err := os.OpenFile("/sys/class/gpio/export", os.O_WRONLY, 0444)
@@ -124,20 +272,22 @@ func (g *GPIOActions) initGPIO(gpio_pin int) {
 		f.Close()
 	}
 
-	// Put GPIO in Out mode
+	// Put GPIO in In or Out mode
 	f, err = os.OpenFile(fmt.Sprintf("/sys/class/gpio/gpio%d/direction", gpio_pin), os.O_WRONLY, 0444)
 	if err != nil {
 		log.Print("Error! Could not configure GPIO", err)
 	}
-	f.Write([]byte("out\n"))
+	f.Write([]byte(direction + "\n"))
 	f.Close()
-
-	g.switchRelay(false, gpio_pin) // initial state.
 }
 
 func (g *GPIOActions) switchRelay(switch_on bool, gpio_pin int) {
-	if gpio_pin != 7 && gpio_pin != 8 && gpio_pin != 9 && gpio_pin != 11 {
-		log.Print("GPIO needs to be one of 7,8,9,11!")
+	known := false
+	for _, pin := range g.pins {
+		known = known || pin == gpio_pin
+	}
+	if !known {
+		log.Printf("GPIO needs to be one of %v!", g.pins)
 	}
 
 	gpioFile := fmt.Sprintf("/sys/class/gpio/gpio%d/value", gpio_pin)
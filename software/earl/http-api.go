@@ -1,18 +1,55 @@
 // API to see events fly by.
+//
+// Also allows to set the lockdown mode with a POST to /api/lockdown with
+// parameter mode=<off|members-only|all>, to put a terminal in maintenance
+// with a POST to /api/maintenance with target=<target> and
+// active=<true|false>, to trace the decisions for one code at /api/trace
+// (see access-trace.go), and to change the log level while running with a
+// POST to /api/loglevel with level=<debug|info|...>. There is no
+// authentication, so the port should only be reachable from a trusted
+// network.
+//
+// The exceptions are what tells about codes. /api/users, which replicas
+// sync the users from (see replica.go), is only there with a
+// users-export-token configured, and only answers requests bearing it.
+// Likewise /api/check, to check if a code would be granted with a POST
+// with parameters code=<code> and target=<target> for diagnostics, needs
+// the check-token. Where a code was last let in is at /api/last-use, with
+// a POST with parameters code=<code> and member=<code of a member>: only
+// members get to follow where others went. Hosts trying too many wrong
+// tokens or codes there are refused for a while, so that codes can't be
+// guessed faster than at a keypad.
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type ApiServer struct {
-	bus    *ApplicationBus
-	server *http.Server
+	bus         *ApplicationBus
+	server      *http.Server
+	terminals   *TerminalRegistry
+	lockdown    *Lockdown
+	occupancy   *Occupancy
+	recent      *RecentAccess
+	tracer      *AccessTracer
+	maintenance *Maintenance
+	auth        Authenticator
+	replica     *ReplicaSync // If we are a replica.
+	exportToken string       // Needed for /api/users; none to disable.
+	checkToken  string       // Needed for /api/check; none to disable.
+	failures    apiFailures  // Of guessing hosts.
 
 	// Remember the last event for each type. Already JSON prepared
 	eventChannel   AppEventChannel
@@ -51,9 +88,18 @@ func JsonEventFromAppEvent(event *AppEvent) *JsonAppEvent {
 	return jev
 }
 
-func NewApiServer(bus *ApplicationBus, port int) *ApiServer {
+func NewApiServer(backends *Backends, port int) *ApiServer {
+	bus := backends.appEventBus
 	newObject := &ApiServer{
-		bus: bus,
+		bus:         bus,
+		terminals:   backends.terminals,
+		lockdown:    backends.lockdown,
+		occupancy:   backends.occupancy,
+		recent:      backends.recentAccess,
+		tracer:      backends.tracer,
+		maintenance: backends.maintenance,
+		auth:        backends.authenticator,
+		replica:     backends.replica,
 		server: &http.Server{
 			Addr: fmt.Sprintf(":%d", port),
 			// JSON events listeners should be kept open for a while
@@ -68,6 +114,16 @@ func NewApiServer(bus *ApplicationBus, port int) *ApiServer {
 	return newObject
 }
 
+// Let replicas fetch the users with the given token.
+func (a *ApiServer) ExportUsers(token string) {
+	a.exportToken = token
+}
+
+// Let /api/check be used with the given token.
+func (a *ApiServer) AllowChecks(token string) {
+	a.checkToken = token
+}
+
 func (a *ApiServer) Run() {
 	a.server.ListenAndServe()
 }
@@ -127,6 +183,38 @@ func (a *ApiServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 		out.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if req.URL.Path == "/api/status" {
+		a.serveStatus(out)
+		return
+	}
+	if req.URL.Path == "/api/lockdown" {
+		a.serveLockdown(out, req)
+		return
+	}
+	if req.URL.Path == "/api/maintenance" {
+		a.serveMaintenance(out, req)
+		return
+	}
+	if req.URL.Path == "/api/check" {
+		a.serveCheck(out, req)
+		return
+	}
+	if req.URL.Path == "/api/trace" {
+		a.serveTrace(out, req)
+		return
+	}
+	if req.URL.Path == "/api/loglevel" {
+		a.serveLogLevel(out, req)
+		return
+	}
+	if req.URL.Path == "/api/last-use" {
+		a.serveLastUse(out, req)
+		return
+	}
+	if req.URL.Path == "/api/users" {
+		a.serveUsers(out, req)
+		return
+	}
 	if req.URL.Path != "/api/events" {
 		out.WriteHeader(http.StatusNotFound)
 		out.Write([]byte("Nothing to see here. " +
@@ -169,3 +257,354 @@ func (a *ApiServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 	}
 	a.bus.Unsubscribe(appEvents)
 }
+
+// Status of the system as a single JSON object.
+type JsonStatus struct {
+	Terminals []TerminalStatus `json:"terminals"`
+	Lockdown  string           `json:"lockdown"`
+	UserFile  string           `json:"user-file"` // "ok" or problem.
+	Occupancy *JsonOccupancy   `json:"occupancy,omitempty"`
+	AuthCache *AuthCacheStats  `json:"auth-cache,omitempty"` // Remote auth only.
+	Replica   *ReplicaStatus   `json:"replica,omitempty"`
+
+	// Last access attempts at each terminal, oldest first.
+	RecentAccess map[Target][]AccessRecord `json:"recent-access,omitempty"`
+}
+
+// People who entered at each target within the window.
+type JsonOccupancy struct {
+	Window  string         `json:"window"`
+	Entered map[Target]int `json:"entered"`
+}
+
+func (a *ApiServer) serveStatus(out http.ResponseWriter) {
+	status := &JsonStatus{
+		Terminals: a.terminals.Snapshot(),
+		Lockdown:  a.lockdown.Mode().String(),
+		UserFile:  "ok",
+	}
+	if err := a.auth.StoreError(); err != nil {
+		status.UserFile = err.Error()
+	}
+	if remote, ok := a.auth.(*RemoteAuthenticator); ok {
+		stats := remote.CacheStats()
+		status.AuthCache = &stats
+	}
+	if a.replica != nil {
+		replica := a.replica.Status()
+		status.Replica = &replica
+	}
+	if a.occupancy != nil {
+		status.Occupancy = &JsonOccupancy{
+			Window:  a.occupancy.Window().String(),
+			Entered: a.occupancy.Counts(),
+		}
+	}
+	if a.recent != nil {
+		status.RecentAccess = a.recent.Snapshot()
+	}
+	writeJSONResponse(out, status)
+}
+
+type JsonLockdown struct {
+	Mode string `json:"mode"`
+}
+
+// GET: current lockdown mode. POST: set mode from form parameter "mode".
+func (a *ApiServer) serveLockdown(out http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		req.ParseForm()
+		mode, err := ParseLockdownMode(req.Form.Get("mode"))
+		if err != nil {
+			out.WriteHeader(http.StatusBadRequest)
+			out.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		if err = a.lockdown.SetMode(mode, "http-api "+remoteHost(req)); err != nil {
+			// Active anyway, but won't survive a restart.
+			log.Printf("Couldn't persist lockdown: %v", err)
+		}
+	}
+	writeJSONResponse(out, &JsonLockdown{Mode: a.lockdown.Mode().String()})
+}
+
+type JsonLogLevel struct {
+	Level string `json:"level"`
+}
+
+// GET: current log level. POST: set level from form parameter "level".
+func (a *ApiServer) serveLogLevel(out http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		req.ParseForm()
+		level, err := ParseLogLevel(req.Form.Get("level"))
+		if err != nil {
+			out.WriteHeader(http.StatusBadRequest)
+			out.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		if level != CurrentLogLevel() {
+			log.Printf("Log level %s -> %s (http-api %s)",
+				CurrentLogLevel(), level, remoteHost(req))
+			SetLogLevel(level)
+		}
+	}
+	writeJSONResponse(out, &JsonLogLevel{
+		Level: strings.ToLower(CurrentLogLevel().String()),
+	})
+}
+
+type JsonMaintenance struct {
+	Targets []Target `json:"targets"` // In maintenance.
+}
+
+func (a *ApiServer) serveMaintenance(out http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		req.ParseForm()
+		target, _ := TargetForTerminalName(req.Form.Get("target"))
+		active, err := strconv.ParseBool(req.Form.Get("active"))
+		if target == "" || err != nil {
+			out.WriteHeader(http.StatusBadRequest)
+			out.Write([]byte("Need target=<target> and active=<true|false>\n"))
+			return
+		}
+		a.maintenance.Set(target, active, "http-api "+remoteHost(req))
+	}
+	writeJSONResponse(out, &JsonMaintenance{Targets: a.maintenance.Targets()})
+}
+
+type JsonCheck struct {
+	Granted bool   `json:"granted"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Level   string `json:"level,omitempty"` // Empty for unknown codes.
+}
+
+// POST: the decision for form parameters "code" and "target", without
+// granting anything. Not GET, so that codes don't end up in access logs.
+// Needs the check token as bearer token.
+func (a *ApiServer) serveCheck(out http.ResponseWriter, req *http.Request) {
+	if a.checkToken == "" {
+		out.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != "POST" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	host := remoteHost(req)
+	if a.failures.Throttled(host) {
+		log.Printf("Refusing check to %s: too many failures", host)
+		out.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if !hasBearerToken(req, a.checkToken) {
+		a.failures.Add(host)
+		log.Printf("Refusing check to %s: wrong token", host)
+		out.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	req.ParseForm()
+	// PINs are not changed by normalization.
+	code := NormalizeRFID(req.Form.Get("code"))
+	decision := a.auth.CheckCode(code, Target(req.Form.Get("target")))
+	if decision.Reason == ReasonUnknownCode {
+		a.failures.Add(host)
+	}
+	result := &JsonCheck{
+		Granted: decision.Granted,
+		Reason:  decision.Reason.String(),
+		Message: decision.Reason.DisplayMessage(),
+	}
+	if decision.User != nil {
+		result.Level = string(decision.User.UserLevel)
+	}
+	writeJSONResponse(out, result)
+}
+
+type JsonTrace struct {
+	Tracing bool          `json:"tracing"`
+	Traces  []AccessTrace `json:"traces"`
+}
+
+// GET: the last traces of the traced code. POST: trace the code with form
+// parameter "code-hash" (or "code"); neither to stop. See access-trace.go
+func (a *ApiServer) serveTrace(out http.ResponseWriter, req *http.Request) {
+	if a.tracer == nil {
+		out.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method == "POST" {
+		req.ParseForm()
+		codeHash := req.Form.Get("code-hash")
+		if code := req.Form.Get("code"); code != "" {
+			codeHash = hashAuthCode(NormalizeRFID(code))
+		}
+		a.tracer.Trace(codeHash)
+		if codeHash != "" {
+			log.Printf("Tracing access decisions of a code (http-api %s)", remoteHost(req))
+		} else {
+			log.Printf("Stopped tracing access decisions (http-api %s)", remoteHost(req))
+		}
+	}
+	writeJSONResponse(out, &JsonTrace{
+		Tracing: a.tracer.CodeHash() != "",
+		Traces:  a.tracer.Traces(),
+	})
+}
+
+type JsonLastUse struct {
+	LastUse string `json:"last-use"` // Time, or "never".
+	Target  Target `json:"target,omitempty"`
+}
+
+// POST: where and when the code in form parameter "code" was last granted
+// access. Needs form parameter "member" to be the code of a member; if it
+// isn't, the answer is the same as for an unused code, so that it doesn't
+// tell which codes are members'.
+func (a *ApiServer) serveLastUse(out http.ResponseWriter, req *http.Request) {
+	if a.recent == nil {
+		out.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != "POST" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	host := remoteHost(req)
+	if a.failures.Throttled(host) {
+		log.Printf("Refusing last use lookup to %s: too many failures", host)
+		out.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	req.ParseForm()
+	code := NormalizeRFID(req.Form.Get("code"))
+	if code == "" {
+		out.WriteHeader(http.StatusBadRequest)
+		out.Write([]byte("Need code=<code>\n"))
+		return
+	}
+	result := &JsonLastUse{LastUse: "never"}
+	member := a.auth.FindUser(NormalizeRFID(req.Form.Get("member")))
+	if member == nil || member.UserLevel != LevelMember || member.Suspended {
+		a.failures.Add(host)
+		log.Printf("Refusing last use lookup to %s: not a member", host)
+		writeJSONResponse(out, result)
+		return
+	}
+	log.Printf("Member %s looked up the last use of a code (http-api %s)",
+		member.Name, host)
+	if use, ok := a.recent.LastUse(code); ok {
+		result.LastUse = use.Time.Format(time.RFC3339)
+		result.Target = use.Terminal
+	}
+	writeJSONResponse(out, result)
+}
+
+// GET: all users as CSV, for replicas. Needs the export token as bearer
+// token.
+func (a *ApiServer) serveUsers(out http.ResponseWriter, req *http.Request) {
+	fileAuth, ok := a.auth.(*FileBasedAuthenticator)
+	if !ok || a.exportToken == "" {
+		out.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != "GET" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasBearerToken(req, a.exportToken) {
+		log.Printf("Refusing to export users to %s: wrong token", remoteHost(req))
+		out.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// Rather have the replica keep what it has than pass on stale data.
+	if err := fileAuth.StoreError(); err != nil {
+		out.WriteHeader(http.StatusServiceUnavailable)
+		out.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	var buffer bytes.Buffer
+	if err := fileAuth.ExportCSV(&buffer); err != nil {
+		out.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	out.Header().Set("Content-Type", "text/csv")
+	out.Header().Set("Content-Length", strconv.Itoa(buffer.Len()))
+	out.Write(buffer.Bytes())
+}
+
+func hasBearerToken(req *http.Request, token string) bool {
+	given := []byte(req.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) == 1
+}
+
+const (
+	apiFailedAttempts       = 5 // Failures of a host within
+	apiFailedAttemptsWindow = 10 * time.Minute
+)
+
+// Recent failures of each host, e.g. wrong tokens or unknown codes. The
+// zero value is ready to use.
+type apiFailures struct {
+	lock  sync.Mutex
+	clock Clock // RealClock if nil.
+	hosts map[string][]time.Time
+}
+
+// Whether the host failed too often lately to be answered.
+func (f *apiFailures) Throttled(host string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.recentRequiresLock(host)) >= apiFailedAttempts
+}
+
+func (f *apiFailures) Add(host string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.hosts == nil {
+		f.hosts = make(map[string][]time.Time)
+	}
+	f.hosts[host] = append(f.recentRequiresLock(host), f.now())
+}
+
+func (f *apiFailures) recentRequiresLock(host string) []time.Time {
+	now := f.now()
+	recent := []time.Time{}
+	for _, t := range f.hosts[host] {
+		if now.Sub(t) < apiFailedAttemptsWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(f.hosts, host)
+	} else {
+		f.hosts[host] = recent
+	}
+	return recent
+}
+
+func (f *apiFailures) now() time.Time {
+	if f.clock == nil {
+		return time.Now()
+	}
+	return f.clock.Now()
+}
+
+// The requesting host, for the log.
+func remoteHost(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func writeJSONResponse(out http.ResponseWriter, value interface{}) {
+	json, err := json.Marshal(value)
+	if err != nil {
+		out.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	out.Header()["Content-Type"] = []string{"application/json"}
+	out.Write(json)
+	out.Write([]byte("\n"))
+}
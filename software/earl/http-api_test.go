@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckApi(t *testing.T) {
+	auth := NewMockAuthenticator()
+	auth.allow[ACKey{"123456", TargetUpstairs}] = ReasonOK
+	auth.users["123456"] = &User{Name: "Jon Doe", UserLevel: LevelUser}
+	clock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	api := &ApiServer{auth: auth}
+	api.failures.clock = clock
+	post := func(code string, token string) (int, JsonCheck) {
+		form := url.Values{"code": {code}, "target": {"upstairs"}}
+		req := httptest.NewRequest("POST", "/api/check",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, req)
+		var result JsonCheck
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+
+	status, _ := post("123456", "")
+	ExpectTrue(t, status == http.StatusNotFound, "Off without token")
+
+	api.AllowChecks("s3cret")
+	status, checked := post("123456", "s3cret")
+	ExpectTrue(t, status == http.StatusOK, "Checked with token")
+	ExpectTrue(t, checked.Granted && checked.Level == string(LevelUser), "Granted")
+	status, _ = post("123456", "guess")
+	ExpectTrue(t, status == http.StatusUnauthorized, "Wrong token")
+
+	// Guessing codes.
+	for i := 1; i < apiFailedAttempts; i++ {
+		status, checked = post("99999"+string(rune('0'+i)), "s3cret")
+		ExpectTrue(t, status == http.StatusOK && !checked.Granted, "Unknown code")
+	}
+	status, _ = post("123456", "s3cret")
+	ExpectTrue(t, status == http.StatusTooManyRequests, "Throttled")
+
+	clock.now = clock.now.Add(apiFailedAttemptsWindow)
+	status, checked = post("123456", "s3cret")
+	ExpectTrue(t, status == http.StatusOK && checked.Granted, "Answered again")
+}
@@ -0,0 +1,98 @@
+// Keys of the terminal keypads. The firmware reports each key as printed on
+// it: '0'..'9', '*' and '#'. What handlers care about is what the key
+// means: a digit, clearing the input or entering it. On most keypads that
+// is '*' and '#', but some have them the other way round.
+//
+// So the layout of each keypad is configured in one place (the "keypad"
+// of the terminal in the config file), and the SerialTerminal hands
+// handlers the meaning: a Key to handlers that implement KeyHandler, and
+// the byte of the standard layout to those that only HandleKeypress().
+package main
+
+import (
+	"fmt"
+)
+
+type KeyType int
+
+const (
+	KeyDigit KeyType = iota
+	KeyClear         // '*' on the standard keypad.
+	KeyEnter         // '#' on the standard keypad.
+)
+
+type Key struct {
+	Type  KeyType
+	Digit byte // '0'..'9' for KeyDigit.
+}
+
+// The key as typed on the standard keypad.
+func (k Key) Byte() byte {
+	switch k.Type {
+	case KeyClear:
+		return StandardKeypad.Clear
+	case KeyEnter:
+		return StandardKeypad.Enter
+	}
+	return k.Digit
+}
+
+// Handlers implementing this get the meaning of keys instead of the
+// HandleKeypress() of the TerminalEventHandler.
+type KeyHandler interface {
+	HandleKey(key Key)
+}
+
+// Which keys clear and enter on a keypad.
+type KeypadLayout struct {
+	Clear byte
+	Enter byte
+}
+
+var (
+	StandardKeypad = KeypadLayout{Clear: '*', Enter: '#'}
+	SwappedKeypad  = KeypadLayout{Clear: '#', Enter: '*'}
+)
+
+// The layout as named in the config: "standard" (or empty) or "swapped".
+func ParseKeypadLayout(name string) (KeypadLayout, error) {
+	switch name {
+	case "", "standard":
+		return StandardKeypad, nil
+	case "swapped":
+		return SwappedKeypad, nil
+	}
+	return StandardKeypad, fmt.Errorf("unknown keypad '%s'; one of 'standard', 'swapped'", name)
+}
+
+// The meaning of the byte typed on this keypad; false if it isn't a key
+// we know.
+func (l KeypadLayout) Key(typed byte) (Key, bool) {
+	switch {
+	case typed >= '0' && typed <= '9':
+		return Key{Type: KeyDigit, Digit: typed}, true
+	case typed == l.Clear:
+		return Key{Type: KeyClear}, true
+	case typed == l.Enter:
+		return Key{Type: KeyEnter}, true
+	}
+	return Key{}, false
+}
+
+// Give the key typed on a keypad with the layout to the handler. Keys we
+// don't know only go to handlers taking raw keypresses; returns false if
+// the handler didn't get it.
+func deliverKeypress(handler TerminalEventHandler, layout KeypadLayout, typed byte) bool {
+	key, known := layout.Key(typed)
+	if keyHandler, ok := handler.(KeyHandler); ok {
+		if known {
+			keyHandler.HandleKey(key)
+		}
+		return known
+	}
+	if known {
+		typed = key.Byte()
+	}
+	handler.HandleKeypress(typed)
+	return true
+}
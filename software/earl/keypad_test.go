@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeypadLayouts(t *testing.T) {
+	key, ok := StandardKeypad.Key('*')
+	ExpectTrue(t, ok && key.Type == KeyClear, "'*' clears")
+	key, ok = StandardKeypad.Key('#')
+	ExpectTrue(t, ok && key.Type == KeyEnter, "'#' enters")
+	key, ok = StandardKeypad.Key('7')
+	ExpectTrue(t, ok && key.Type == KeyDigit && key.Digit == '7', "Digit")
+	_, ok = StandardKeypad.Key('A')
+	ExpectFalse(t, ok, "Not a key")
+
+	key, ok = SwappedKeypad.Key('*')
+	ExpectTrue(t, ok && key.Type == KeyEnter, "Swapped: '*' enters")
+	key, ok = SwappedKeypad.Key('#')
+	ExpectTrue(t, ok && key.Type == KeyClear, "Swapped: '#' clears")
+	ExpectTrue(t, key.Byte() == '*', "As typed on the standard keypad")
+
+	layout, err := ParseKeypadLayout("")
+	ExpectTrue(t, err == nil && layout == StandardKeypad, "Default")
+	layout, err = ParseKeypadLayout("swapped")
+	ExpectTrue(t, err == nil && layout == SwappedKeypad, "Swapped")
+	_, err = ParseKeypadLayout("qwerty")
+	ExpectTrue(t, err != nil, "Unknown layout")
+}
+
+// Only takes raw keypresses.
+type rawKeypressHandler struct {
+	TerminalEventHandler
+	typed string
+}
+
+func (h *rawKeypressHandler) HandleKeypress(b byte) {
+	h.typed += string(b)
+}
+
+func TestRawHandlerGetsStandardKeys(t *testing.T) {
+	handler := &rawKeypressHandler{}
+	for _, b := range []byte("12*3#A") {
+		deliverKeypress(handler, SwappedKeypad, b)
+	}
+	ExpectTrue(t, handler.typed == "12#3*A", "Canonical keys: "+handler.typed)
+}
+
+func TestSwappedKeypadOpensDoor(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	handler := testFixture.handlerUnderTest
+	ExpectFalse(t, deliverKeypress(handler, SwappedKeypad, 'A'), "Not a key")
+	for _, b := range []byte("99#123456*") {
+		deliverKeypress(handler, SwappedKeypad, b)
+	}
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
@@ -0,0 +1,69 @@
+// Text for the LCD. The terminals have an HD44780 display with the
+// common A00 character ROM: ASCII, plus a few accented letters and symbols
+// in the upper half, where e.g. 'ä' is 0xE1. The firmware writes the bytes
+// it gets as they are, so names with other characters come out as garbage.
+//
+// So before sending, we translate what the ROM has to its bytes, other
+// accented letters to the plain letter and anything else to '?'. This
+// happens in SerialTerminal.writeLCD(), so handlers just write Unicode.
+//
+// Bytes below 0x20 are left alone: 1..7 are the glyphs the firmware
+// defines itself (e.g. DoorBellCharacter).
+package main
+
+import (
+	"unicode/utf8"
+)
+
+// Characters in the upper half of the A00 ROM. The ROM also has '¥', '→'
+// and '←' where ASCII has '\', '~' and DEL.
+var lcdROMCharacters = map[rune]byte{
+	'¥': 0x5C, '→': 0x7E, '←': 0x7F,
+	'°': 0xDF, 'α': 0xE0, 'ä': 0xE1, 'ß': 0xE2, 'β': 0xE2, 'ε': 0xE3,
+	'µ': 0xE4, 'μ': 0xE4, 'σ': 0xE5, 'ρ': 0xE6, '√': 0xE8, '¢': 0xEC,
+	'ñ': 0xEE, 'ö': 0xEF, 'θ': 0xF2, '∞': 0xF3, 'Ω': 0xF4, 'ü': 0xF5,
+	'Σ': 0xF6, 'π': 0xF7, '÷': 0xFD,
+}
+
+// Characters the ROM doesn't have, but which look enough like one it has.
+var lcdFallbacks = map[rune]byte{
+	'À': 'A', 'Á': 'A', 'Â': 'A', 'Ã': 'A', 'Ä': 'A', 'Å': 'A',
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'å': 'a', 'ą': 'a',
+	'Ç': 'C', 'Č': 'C', 'ç': 'c', 'č': 'c', 'ć': 'c',
+	'È': 'E', 'É': 'E', 'Ê': 'E', 'Ë': 'E',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ę': 'e', 'ě': 'e',
+	'Ì': 'I', 'Í': 'I', 'Î': 'I', 'Ï': 'I', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i',
+	'Ł': 'L', 'ł': 'l', 'Ñ': 'N', 'ń': 'n', 'ň': 'n',
+	'Ò': 'O', 'Ó': 'O', 'Ô': 'O', 'Õ': 'O', 'Ö': 'O', 'Ø': 'O',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ø': 'o',
+	'Š': 'S', 'š': 's', 'ś': 's', 'ř': 'r',
+	'Ù': 'U', 'Ú': 'U', 'Û': 'U', 'Ü': 'U', 'ù': 'u', 'ú': 'u', 'û': 'u', 'ů': 'u',
+	'Ý': 'Y', 'ý': 'y', 'ÿ': 'y', 'Ž': 'Z', 'ž': 'z', 'ź': 'z', 'ż': 'z',
+	'‘': '\'', '’': '\'', '“': '"', '”': '"', '–': '-', '—': '-',
+	'\u00a0': ' ', // No-break space.
+}
+
+// The bytes to send for text, one per column, cut to the width of the
+// LCD. Translating again leaves the result as it is, so what we remember
+// as shown can be written again.
+func lcdText(text string) string {
+	result := make([]byte, 0, len(text))
+	for len(text) > 0 && len(result) < maxLCDCols {
+		r, size := utf8.DecodeRuneInString(text)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			result = append(result, text[0]) // Translated already.
+		case r < 0x7F:
+			result = append(result, byte(r))
+		case lcdROMCharacters[r] != 0:
+			result = append(result, lcdROMCharacters[r])
+		case lcdFallbacks[r] != 0:
+			result = append(result, lcdFallbacks[r])
+		default:
+			result = append(result, '?')
+		}
+		text = text[size:]
+	}
+	// TODO: too long lines: scroll back and forth.
+	return string(result)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLCDText(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want string
+	}{
+		{"Welcome", "Welcome"},
+		{"Grüße", "Gr\xf5\xe2e"},
+		{"Björk Ångström", "Bj\xefrk Angstr\xefm"},
+		{"José Muñoz", "Jose Mu\xeeoz"},
+		{"20°C, 5µs", "20\xdfC, 5\xe4s"},
+		{"Zoë’s “café”", "Zoe's \"cafe\""},
+		{"東京 ☃", "?? ?"},
+		{"Ring " + DoorBellCharacter, "Ring \x01"},
+	} {
+		got := lcdText(c.text)
+		if got != c.want {
+			t.Errorf("%s: expected %q, got %q", c.text, c.want, got)
+		}
+		ExpectTrue(t, lcdText(got) == got, "Translating again keeps it: "+c.text)
+	}
+	long := lcdText(strings.Repeat("ü", 30))
+	ExpectTrue(t, long == strings.Repeat("\xf5", maxLCDCols),
+		"One byte per column")
+}
+
+func TestLCDTextSent(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	connectRequests := len(port.Requests())
+
+	terminal.WriteLCD(0, "Hallo Jürgen")
+	terminal.WriteLCD(0, "Hallo Jürgen")
+	terminal.WriteLCDLines([]string{"Hallo Jürgen", "Ça va?"})
+	requests := port.Requests()[connectRequests:]
+	ExpectTrue(t, fmt.Sprintf("%q", requests) ==
+		`["M0Hallo J\xf5rgen" "M1Ca va?"]`,
+		"Sent translated, once: "+fmt.Sprintf("%q", requests))
+}
@@ -0,0 +1,69 @@
+// Progress on the LCD, e.g. the countdown of a door held open: formatted to
+// fit a row, and meant to be written again on each tick. The terminal only
+// sends rows that changed (see SerialTerminal.writeLCD()), so writing more
+// often than the text changes costs nothing.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Remaining time as "m:ss", or "h:mm:ss" from an hour on. Rounded up, so
+// that "0:00" only shows once the time is over.
+func FormatRemaining(remaining time.Duration) string {
+	if remaining < 0 {
+		remaining = 0
+	}
+	seconds := int64((remaining + time.Second - 1) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// The label, then the remaining time at the end of the row:
+// "Door open           1:59". Long labels are cut to keep the time.
+func FormatLCDCountdown(label string, remaining time.Duration) string {
+	return fitWithSuffix(label, FormatRemaining(remaining))
+}
+
+// The label, then a bar filled to the fraction (0..1) up to the end of
+// the row: "Code [#######.......]". Long labels are cut to keep a bar.
+func FormatLCDProgress(label string, fraction float64) string {
+	if fraction < 0 {
+		fraction = 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	width := maxLCDCols - len(label) - 3 // Space and brackets.
+	if width < maxLCDCols/2 {
+		width = maxLCDCols / 2
+	}
+	filled := int(fraction*float64(width) + 0.5)
+	bar := "[" + strings.Repeat("#", filled) +
+		strings.Repeat(".", width-filled) + "]"
+	return fitWithSuffix(label, bar)
+}
+
+// Label and suffix in one row, with the suffix right-aligned.
+func fitWithSuffix(label string, suffix string) string {
+	room := maxLCDCols - len(suffix) - 1
+	if room <= 0 {
+		return suffix
+	}
+	if len(label) > room {
+		label = label[:room]
+	}
+	return fmt.Sprintf("%-*s %s", room, label, suffix)
+}
+
+func WriteLCDCountdown(t Terminal, row int, label string, remaining time.Duration) {
+	t.WriteLCD(row, FormatLCDCountdown(label, remaining))
+}
+
+func WriteLCDProgress(t Terminal, row int, label string, fraction float64) {
+	t.WriteLCD(row, FormatLCDProgress(label, fraction))
+}
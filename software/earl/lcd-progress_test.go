@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFormatLCDProgress(t *testing.T) {
+	for _, c := range []struct {
+		fraction float64
+		want     string
+	}{
+		{-1, "Code [.................]"},
+		{0, "Code [.................]"},
+		{0.5, "Code [#########........]"},
+		{0.51, "Code [#########........]"},
+		{1, "Code [#################]"},
+		{2, "Code [#################]"},
+	} {
+		got := FormatLCDProgress("Code", c.fraction)
+		if got != c.want {
+			t.Errorf("%v: expected '%s', got '%s'", c.fraction, c.want, got)
+		}
+	}
+	long := FormatLCDProgress("A label that is much too long", 0.5)
+	ExpectTrue(t, len(long) == maxLCDCols, "Long label fits: "+long)
+	ExpectTrue(t, long[len(long)-1] == ']', "Long label keeps the bar: "+long)
+}
+
+func TestFormatLCDCountdown(t *testing.T) {
+	for _, c := range []struct {
+		remaining time.Duration
+		want      string
+	}{
+		{2 * time.Minute, "Door open           2:00"},
+		{119*time.Second + time.Millisecond, "Door open           2:00"},
+		{119 * time.Second, "Door open           1:59"},
+		{-time.Second, "Door open           0:00"},
+		{90 * time.Minute, "Door open        1:30:00"},
+	} {
+		got := FormatLCDCountdown("Door open", c.remaining)
+		if got != c.want {
+			t.Errorf("%v: expected '%s', got '%s'", c.remaining, c.want, got)
+		}
+		ExpectTrue(t, len(got) <= maxLCDCols, "Fits: "+got)
+	}
+	long := FormatLCDCountdown("A label that is much too long", time.Minute)
+	ExpectTrue(t, len(long) == maxLCDCols && long[len(long)-4:] == "1:00",
+		"Long label keeps the time: "+long)
+}
+
+func TestLCDCountdownOnlySentOnChange(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	connectRequests := len(port.Requests())
+
+	// Ticks come every 500ms; the text only changes each second.
+	for remaining := 3 * time.Second; remaining > time.Second; remaining -= 500 * time.Millisecond {
+		WriteLCDCountdown(terminal, 1, "Door open", remaining)
+	}
+	sent := port.Requests()[connectRequests:]
+	ExpectTrue(t, fmt.Sprint(sent) == "[M1Door open           0:03 M1Door open           0:02]",
+		fmt.Sprint("Sent ", sent))
+}
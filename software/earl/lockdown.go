@@ -0,0 +1,136 @@
+// Lockdown.
+//
+// In an emergency, the space can be restricted to members only, or locked
+// for everyone, without editing the user file. The Authenticator consults
+// the Lockdown on each access request.
+//
+// The mode is toggled with the HTTP API or by a member on the control
+// terminal, and is kept in a small state file so that it survives a restart.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+type LockdownMode int
+
+const (
+	LockdownOff         = LockdownMode(iota)
+	LockdownMembersOnly // Only members get in.
+	LockdownAll         // Nobody gets in.
+)
+
+func (m LockdownMode) String() string {
+	switch m {
+	case LockdownOff:
+		return "off"
+	case LockdownMembersOnly:
+		return "members-only"
+	case LockdownAll:
+		return "all"
+	}
+	return fmt.Sprintf("lockdown-%d", int(m))
+}
+
+// Parse a mode as returned by String().
+func ParseLockdownMode(value string) (LockdownMode, error) {
+	for m := LockdownOff; m <= LockdownAll; m++ {
+		if value == m.String() {
+			return m, nil
+		}
+	}
+	return LockdownOff, fmt.Errorf("unknown lockdown mode '%s'", value)
+}
+
+type Lockdown struct {
+	stateFile string // Where to persist. Empty: don't.
+	bus       *ApplicationBus
+
+	lock sync.Mutex
+	mode LockdownMode
+}
+
+// Create a Lockdown, reading the mode from the stateFile if it exists.
+// Changes are announced on the bus as AppLockdownChanged.
+func NewLockdown(stateFile string, bus *ApplicationBus) *Lockdown {
+	l := &Lockdown{stateFile: stateFile, bus: bus}
+	if stateFile == "" {
+		return l
+	}
+	content, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't read lockdown state: %v", err)
+		}
+		return l
+	}
+	mode, err := ParseLockdownMode(strings.TrimSpace(string(content)))
+	if err != nil {
+		// Better safe than sorry.
+		log.Printf("%s: %v; assuming members-only", stateFile, err)
+		mode = LockdownMembersOnly
+	}
+	l.mode = mode
+	if mode != LockdownOff {
+		log.Printf("Lockdown active: %s", mode)
+	}
+	return l
+}
+
+// Current mode. A nil Lockdown is always off.
+func (l *Lockdown) Mode() LockdownMode {
+	if l == nil {
+		return LockdownOff
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.mode
+}
+
+// Set the new mode; "source" is for the log. Returns an error if the mode
+// could not be persisted, but the mode is in effect regardless.
+func (l *Lockdown) SetMode(mode LockdownMode, source string) error {
+	l.lock.Lock()
+	l.mode = mode
+	err := l.writeStateRequiresLock()
+	l.lock.Unlock()
+
+	log.Printf("Lockdown set to %s by %s", mode, source)
+	if l.bus != nil {
+		l.bus.Post(&AppEvent{
+			Ev:     AppLockdownChanged,
+			Source: source,
+			Msg:    mode.String(),
+			Value:  int(mode),
+		})
+	}
+	return err
+}
+
+// Returns true if the lockdown doesn't keep out users of the given level.
+func (l *Lockdown) Allows(level Level) bool {
+	switch l.Mode() {
+	case LockdownMembersOnly:
+		return level == LevelMember
+	case LockdownAll:
+		return false
+	}
+	return true
+}
+
+func (l *Lockdown) writeStateRequiresLock() error {
+	if l.stateFile == "" {
+		return nil
+	}
+	tmpFile := l.stateFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, []byte(l.mode.String()+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, l.stateFile)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLockdownDeniesBelowMember(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "lockdown-tests")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	registered, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = registered.Add(12 * time.Hour) // Daytime for users.
+
+	u := User{Name: "Some User", ContactInfo: "u@nb", UserLevel: LevelUser}
+	u.SetAuthCode("user123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	u = User{Name: "Phil", ContactInfo: "p@nb", UserLevel: LevelPhilanthropist}
+	u.SetAuthCode("phil123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding philanthropist")
+
+	mockClock.now = mockClock.now.Add(time.Minute)
+
+	lockdown := NewLockdown("", nil)
+	auth.(*FileBasedAuthenticator).lockdown = lockdown
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+
+	lockdown.SetMode(LockdownMembersOnly, "test")
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonLockdown)
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, ReasonLockdown)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonOK)
+
+	lockdown.SetMode(LockdownAll, "test")
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonLockdown)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, ReasonLockdown)
+
+	// Unknown codes are still just unknown.
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, ReasonUnknownCode)
+
+	lockdown.SetMode(LockdownOff, "test")
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonOK)
+}
+
+func TestLockdownSurvivesRestart(t *testing.T) {
+	stateFile, _ := ioutil.TempFile("", "lockdown-state")
+	stateFile.Close()
+	os.Remove(stateFile.Name())
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(stateFile.Name())
+	}
+
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	lockdown := NewLockdown(stateFile.Name(), bus)
+	ExpectTrue(t, lockdown.Mode() == LockdownOff, "Off without state file")
+	ExpectTrue(t, lockdown.SetMode(LockdownMembersOnly, "test") == nil,
+		"Writing state")
+	bus.Flush()
+	select {
+	case event := <-events:
+		ExpectTrue(t, event.Ev == AppLockdownChanged, "Lockdown event")
+		ExpectTrue(t, event.Msg == "members-only", "Mode in event")
+	default:
+		t.Error("Expected lockdown event")
+	}
+
+	restarted := NewLockdown(stateFile.Name(), nil)
+	ExpectTrue(t, restarted.Mode() == LockdownMembersOnly, "Mode restored")
+
+	// Garbage in the state file errs on the safe side.
+	ioutil.WriteFile(stateFile.Name(), []byte("party\n"), 0644)
+	ExpectTrue(t, NewLockdown(stateFile.Name(), nil).Mode() == LockdownMembersOnly,
+		"Unknown state is members-only")
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+func dialSyslog(tag string) (syslogWriter, error) {
+	return nil, errors.New("no syslog on this platform")
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+)
+
+// Connect to the local syslog daemon, logging as a daemon with the tag.
+func dialSyslog(tag string) (syslogWriter, error) {
+	return syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+}
@@ -0,0 +1,245 @@
+// Leveled logging.
+//
+// Writes through the standard log package, so the output goes wherever
+// that is set up to go (stdout or the -logfile, and/or the local syslog
+// with -syslog, where the level becomes the priority). Each line is prefixed with
+// its level and the context of the logger, e.g. the device and name of a
+// terminal, so that it is easy to grep for the lines of one terminal:
+//
+//	INFO device=/dev/ttyUSB0:9600 terminal=gate: connected
+//
+// Lines below the level set with -loglevel are dropped. The level can be
+// changed while running with a POST to /api/loglevel (see http-api.go), to
+// see debug lines during an incident without restarting.
+//
+// The log often goes to the SD card of a Raspberry Pi, so we keep it from
+// filling up with the same line, e.g. a flapping connection reporting
+// "reading input: EOF" over and over. A line repeated within
+// -log-dedup-window is only written once; at the end of the window, a
+// summary tells how often it was repeated:
+//
+//	WARN terminal=gate: reading input: EOF (repeated 42 times)
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+// Lines below this level are not logged. Changed at runtime, so only
+// accessed atomically, see SetLogLevel() and CurrentLogLevel().
+var logLevel = int32(LogInfo)
+
+// Identical lines within this window are collapsed into one, plus a
+// summary. 0 disables collapsing.
+var logDedupWindow = 10 * time.Second
+
+const (
+	// Lines we collapse at the same time; beyond that, lines are written
+	// as they come, so that a log flood doesn't grow our memory.
+	maxDedupLines = 64
+
+	// Summaries are spread out over this fraction of the window, so that
+	// the ones of lines that started together are not written together.
+	dedupJitter = 0.1
+)
+
+// A line that was written, and how often it came again since.
+type repeatedLogLine struct {
+	repeats int
+}
+
+var (
+	dedupLock  sync.Mutex
+	dedupLines = make(map[string]*repeatedLogLine)
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Parse a level such as "info" or "WARN".
+func ParseLogLevel(value string) (LogLevel, error) {
+	for l := LogDebug; l <= LogError; l++ {
+		if strings.EqualFold(value, l.String()) {
+			return l, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown log level '%s'", value)
+}
+
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func CurrentLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+// A Logger tags each line with its context. The zero value logs without
+// context. Loggers are immutable, With() returns a new one.
+type Logger struct {
+	context string
+}
+
+// Return a logger that additionally tags lines with key=value.
+func (l *Logger) With(key string, value string) *Logger {
+	tag := key + "=" + value
+	if l.context != "" {
+		tag = l.context + " " + tag
+	}
+	return &Logger{context: tag}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogError, format, args...)
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < CurrentLogLevel() {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if l.context != "" {
+		writeLogLine(fmt.Sprintf("%s %s: %s", level, l.context, msg))
+	} else {
+		writeLogLine(fmt.Sprintf("%s %s", level, msg))
+	}
+}
+
+// Write the line, unless it was just written.
+func writeLogLine(line string) {
+	window := logDedupWindow
+	if window <= 0 {
+		log.Print(line)
+		return
+	}
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+	if seen, ok := dedupLines[line]; ok {
+		seen.repeats++
+		return
+	}
+	log.Print(line)
+	if len(dedupLines) < maxDedupLines {
+		dedupLines[line] = &repeatedLogLine{}
+		scheduleLogSummary(line, window)
+	}
+}
+
+// Forget what was written, so that the next lines are written no matter
+// what.
+func resetLogDedup() {
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+	dedupLines = make(map[string]*repeatedLogLine)
+}
+
+// At the end of the window, tell how often the line was repeated. If it
+// was, keep collapsing for another window, so a continuous flood is one
+// line per window.
+func scheduleLogSummary(line string, window time.Duration) {
+	jitter := time.Duration(rand.Float64() * dedupJitter * float64(window))
+	time.AfterFunc(window+jitter, func() {
+		dedupLock.Lock()
+		defer dedupLock.Unlock()
+		seen := dedupLines[line]
+		if seen == nil {
+			return // Forgotten with resetLogDedup().
+		}
+		if seen.repeats == 0 {
+			delete(dedupLines, line)
+			return
+		}
+		log.Printf("%s (repeated %d times)", line, seen.repeats)
+		seen.repeats = 0
+		scheduleLogSummary(line, window)
+	})
+}
+
+// Where lines go with -syslog. Implemented by *syslog.Writer; the level
+// of the line becomes its priority.
+type syslogWriter interface {
+	Debug(msg string) error
+	Info(msg string) error
+	Warning(msg string) error
+	Err(msg string) error
+}
+
+// Hands each line written by the log package to syslog, with the
+// priority of its level. Syslog adds its own timestamp, so ours is
+// dropped. Lines not from a Logger (plain log.Printf()) are infos.
+type syslogOutput struct {
+	writer syslogWriter
+}
+
+func newSyslogOutput(writer syslogWriter) *syslogOutput {
+	return &syslogOutput{writer: writer}
+}
+
+func (s *syslogOutput) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	if len(line) > len(logTimestampLayout) && line[len(logTimestampLayout)] == ' ' {
+		if _, err := time.Parse(logTimestampLayout, line[:len(logTimestampLayout)]); err == nil {
+			line = line[len(logTimestampLayout)+1:]
+		}
+	}
+	level := LogInfo
+	if space := strings.IndexByte(line, ' '); space > 0 {
+		if parsed, err := ParseLogLevel(line[:space]); err == nil &&
+			parsed.String() == line[:space] {
+			level, line = parsed, line[space+1:]
+		}
+	}
+	var err error
+	switch level {
+	case LogDebug:
+		err = s.writer.Debug(line)
+	case LogWarn:
+		err = s.writer.Warning(line)
+	case LogError:
+		err = s.writer.Err(line)
+	default:
+		err = s.writer.Info(line)
+	}
+	return len(p), err
+}
+
+// Prefix of log.LstdFlags.
+const logTimestampLayout = "2006/01/02 15:04:05"
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("warn")
+	ExpectTrue(t, err == nil && level == LogWarn, "lowercase level")
+	level, err = ParseLogLevel("DEBUG")
+	ExpectTrue(t, err == nil && level == LogDebug, "uppercase level")
+	_, err = ParseLogLevel("chatty")
+	ExpectTrue(t, err != nil, "unknown level")
+}
+
+func TestLoggerLevelAndContext(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LogInfo)
+
+	logger := (&Logger{}).With("device", "/dev/ttyUSB0:9600").
+		With("terminal", "gate")
+	SetLogLevel(LogWarn)
+	logger.Infof("not shown")
+	logger.Warnf("shown %d", 42)
+
+	ExpectFalse(t, strings.Contains(out.String(), "not shown"),
+		"info filtered at warn level")
+	ExpectTrue(t, strings.Contains(out.String(),
+		"WARN device=/dev/ttyUSB0:9600 terminal=gate: shown 42"),
+		"warning with context: "+out.String())
+}
+
+func TestLogLevelChangedAtRuntime(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LogInfo)
+
+	api := &ApiServer{}
+	setLevel := func(level string) int {
+		req := httptest.NewRequest("POST", "/api/loglevel",
+			strings.NewReader(url.Values{"level": {level}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	logger := (&Logger{}).With("terminal", "gate")
+
+	logger.Debugf("quiet")
+	ExpectTrue(t, setLevel("debug") == http.StatusOK, "Level set")
+	logger.Debugf("chatty")
+	ExpectTrue(t, setLevel("INFO") == http.StatusOK, "Level set back")
+	logger.Debugf("quiet again")
+	ExpectTrue(t, setLevel("chatty") == http.StatusBadRequest, "Unknown level")
+	ExpectTrue(t, CurrentLogLevel() == LogInfo, "Level kept")
+
+	ExpectFalse(t, strings.Contains(out.String(), "quiet"), "Debug dropped at info")
+	ExpectTrue(t, strings.Contains(out.String(), "DEBUG terminal=gate: chatty"),
+		"Debug logged while set: "+out.String())
+}
+
+// Log output, written by timers while the test reads it.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestRepeatedLogLinesCollapsed(t *testing.T) {
+	var out syncBuffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	defer func(window time.Duration) { logDedupWindow = window }(logDedupWindow)
+	logDedupWindow = 200 * time.Millisecond
+	resetLogDedup()
+
+	logger := (&Logger{}).With("terminal", "flappy")
+	for i := 0; i < 100; i++ {
+		logger.Warnf("reading input: EOF")
+	}
+	logger.Warnf("something else")
+	ExpectTrue(t, strings.Count(out.String(), "\n") == 2,
+		"Repeats not written: "+out.String())
+
+	time.Sleep(logDedupWindow + logDedupWindow/2)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	ExpectTrue(t, len(lines) == 3 && strings.HasSuffix(lines[2],
+		"WARN terminal=flappy: reading input: EOF (repeated 99 times)"),
+		"Summary at the end of the window: "+out.String())
+
+	// Quiet for a window: forgotten.
+	time.Sleep(logDedupWindow + logDedupWindow/2)
+	logger.Warnf("reading input: EOF")
+	ExpectTrue(t, strings.Count(out.String(), "\n") == 4, "Written again")
+}
+
+// Records what would go to syslog, by priority.
+type mockSyslog struct {
+	lines []string
+}
+
+func (m *mockSyslog) record(priority string, msg string) error {
+	m.lines = append(m.lines, priority+": "+msg)
+	return nil
+}
+
+func (m *mockSyslog) Debug(msg string) error   { return m.record("debug", msg) }
+func (m *mockSyslog) Info(msg string) error    { return m.record("info", msg) }
+func (m *mockSyslog) Warning(msg string) error { return m.record("warning", msg) }
+func (m *mockSyslog) Err(msg string) error     { return m.record("err", msg) }
+
+func TestLoggingToSyslog(t *testing.T) {
+	syslog := &mockSyslog{}
+	log.SetOutput(newSyslogOutput(syslog))
+	defer log.SetOutput(os.Stderr)
+	resetLogDedup()
+
+	logger := (&Logger{}).With("terminal", "gate")
+	logger.Warnf("reading input: %s", "EOF")
+	logger.Errorf("gone")
+	log.Printf("Plain line")
+	log.Printf("INFORMATION is not a level")
+
+	expected := []string{
+		"warning: terminal=gate: reading input: EOF",
+		"err: terminal=gate: gone",
+		"info: Plain line",
+		"info: INFORMATION is not a level",
+	}
+	if strings.Join(syslog.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %q, got %q", expected, syslog.lines)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -25,6 +29,30 @@ const (
 	TargetControlUI  = Target("control") // UI to add new users.
 )
 
+// The target of each terminal name. Names are compared without
+// surrounding whitespace and case (see NormalizeTerminalName()): a
+// terminal named "Gate " in its firmware is just as good as "gate".
+var terminalNameTargets = map[string]Target{
+	"gate":     TargetDownstairs,
+	"upstairs": TargetUpstairs,
+	"elevator": TargetElevator,
+	"control":  TargetControlUI,
+}
+
+func NormalizeTerminalName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// The target of the terminal with the given name. If it is none of ours,
+// returns false and the normalized name as target.
+func TargetForTerminalName(name string) (Target, bool) {
+	name = NormalizeTerminalName(name)
+	if target, ok := terminalNameTargets[name]; ok {
+		return target, true
+	}
+	return Target(name), false
+}
+
 const (
 	maxLCDRows                  = 2
 	maxLCDCols                  = 24
@@ -32,24 +60,22 @@ const (
 	initialReconnectOnErrorTime = 2 * time.Second
 	maxReconnectOnErrorTime     = 60 * time.Second
 	idleTickTime                = 500 * time.Millisecond
+	maxShutdownWaitTime         = 5 * time.Second
+	lastAccessFlushInterval     = 15 * time.Minute
 )
 
-func parseArg(arg string) (devicepath string, baudrate int) {
-	split := strings.Split(arg, ":")
-	devicepath = split[0]
-	baudrate = defaultBaudrate
-	if len(split) > 1 {
-		var err error
-		if baudrate, err = strconv.Atoi(split[1]); err != nil {
-			panic(err)
-		}
-	}
-	return
-}
-
 type Backends struct {
 	authenticator Authenticator
 	appEventBus   *ApplicationBus
+	terminals     *TerminalRegistry
+	lockdown      *Lockdown
+	occupancy     *Occupancy
+	recentAccess  *RecentAccess
+	tracer        *AccessTracer
+	maintenance   *Maintenance
+	replica       *ReplicaSync   // Only on replicas.
+	location      *time.Location // Where days start and end. nil: Local.
+	config        *LiveConfig    // Reloaded on SIGHUP, see reload.go
 }
 
 func printVersionInfo() {
@@ -75,8 +101,8 @@ func printUserList(auth *FileBasedAuthenticator) {
 		timeFrom, timeTo := user.AccessHours()
 		fmt.Printf("\u231a %02d:00..%02d:00 ", timeFrom, timeTo)
 
-		exp := user.ExpiryDate(time.Now())
-		validityPeriod := user.InValidityPeriod(time.Now())
+		exp := user.ExpiryDate(auth.localNow())
+		validityPeriod := user.InValidityPeriod(auth.localNow())
 		if !exp.IsZero() {
 			if !validityPeriod {
 				fmt.Printf("\033[1;31mExpired ")
@@ -86,137 +112,499 @@ func printUserList(auth *FileBasedAuthenticator) {
 			fmt.Print(exp.Format("2006-01-02 15:04"))
 			fmt.Printf("\033[0m")
 		}
+		if user.Suspended {
+			fmt.Printf(" \033[1;31mSuspended\033[0m")
+		}
+		if !user.LastAccess.IsZero() {
+			fmt.Printf(" last in %s", user.LastAccess.Format("2006-01-02 15:04"))
+		}
+		if user.Comment != "" {
+			fmt.Printf(" # %s", user.Comment)
+		}
 		fmt.Println()
 	})
 }
 
-func handleSerialDevice(devicepath string, baud int, backends *Backends) {
+// Terminals are dispatched by name (or the target configured). There are
+// different handlers for the name e.g. handlers that deal with reading codes
+// and opening doors, but also the UI handler dealing with adding new users.
+// Returns nil if there is no handler for the target.
+func newHandlerForTarget(target Target, config TerminalConfig, backends *Backends) TerminalEventHandler {
+	switch target {
+	case TargetDownstairs, TargetUpstairs:
+		handler := NewAccessHandler(backends)
+		configureAccessHandler(handler, target, config)
+		return handler
+
+	case TargetElevator:
+		handler := NewElevatorHandler(backends)
+		configureAccessHandler(handler.AccessHandler, target, config)
+		return handler
+
+	case TargetControlUI:
+		handler := NewControlHandler(backends)
+		configureControlHandler(handler, config)
+		return handler
+	}
+	return nil
+}
+
+// Also applied again on reload (see reload.go), so whatever is not in the
+// config goes back to its default.
+func configureAccessHandler(handler *AccessHandler, target Target, config TerminalConfig) {
+	handler.target = target
+	handler.feedback = DefaultFeedbackProfileFor(target).WithOverrides(config.Feedback)
+	handler.doors = config.Doors
+	handler.keypadFallback = config.KeypadFallback
+	handler.confirmRFID = config.ConfirmRFID
+	handler.outsideHours = config.OutsideHours
+	handler.cardOverlap = config.CardOverlap
+	handler.strikeDuration = 0 // The GPIO actions' default.
+	if config.StrikeDuration > 0 {
+		handler.strikeDuration = time.Duration(config.StrikeDuration)
+	}
+	handler.keypadTimeout = kKeypadTimeout
+	if config.IdleTimeout > 0 {
+		handler.keypadTimeout = time.Duration(config.IdleTimeout)
+	}
+	handler.welcomeDuration = kWelcomeTime
+	if config.WelcomeDuration > 0 {
+		handler.welcomeDuration = time.Duration(config.WelcomeDuration)
+	}
+	handler.expiryWarning = kExpiryWarning
+	if config.ExpiryWarning != 0 {
+		handler.expiryWarning = time.Duration(config.ExpiryWarning)
+	}
+	handler.proppedReminder = 0
+	if config.ProppedReminder > 0 {
+		handler.proppedReminder = time.Duration(config.ProppedReminder)
+	}
+	rfidGap := kRFIDRemovedGap
+	if config.RFIDGap > 0 {
+		rfidGap = time.Duration(config.RFIDGap)
+	}
+	if handler.rfidDebouncer == nil || handler.rfidDebouncer.gap != rfidGap {
+		handler.rfidDebouncer = NewRFIDDebouncer(rfidGap)
+	}
+}
+
+// Like configureAccessHandler(), for the control terminal.
+func configureControlHandler(handler *UIControlHandler, config TerminalConfig) {
+	handler.feedback = DefaultFeedbackProfileFor(TargetControlUI).
+		WithOverrides(config.Feedback)
+	handler.holdOpenDoors = []Target{TargetDownstairs, TargetUpstairs}
+	if len(config.Doors) > 0 {
+		handler.holdOpenDoors = config.Doors
+	}
+	handler.holdOpenMax = defaultHoldOpenMax
+	if config.HoldOpenMax > 0 {
+		handler.holdOpenMax = time.Duration(config.HoldOpenMax)
+	}
+	handler.enrollTimeout = defaultEnrollTimeout
+	if config.EnrollTimeout > 0 {
+		handler.enrollTimeout = time.Duration(config.EnrollTimeout)
+	}
+}
+
+// Sits between a terminal and its handler: passes everything on, but also
+// posts the power status of the terminal to the bus, so that the admins
+// hear about power loss. On reload, hands the handler the new config of its
+// device first.
+type terminalHandlerAdapter struct {
+	TerminalEventHandler
+	target Target
+	bus    *ApplicationBus
+	device string
+	config *LiveConfig
+}
+
+func (h *terminalHandlerAdapter) HandlePowerStatus(ok bool) {
+	value := 0
+	if ok {
+		value = 1
+	}
+	h.bus.Post(&AppEvent{
+		Ev:     AppTerminalPower,
+		Target: h.target,
+		Value:  value,
+		Source: "serialdevice",
+	})
+	h.TerminalEventHandler.HandlePowerStatus(ok)
+}
+
+func (h *terminalHandlerAdapter) HandleAppEvent(event *AppEvent) {
+	if event.Ev == AppConfigReloaded {
+		if config, ok := h.config.Terminal(h.device); ok {
+			reconfigureHandler(h.TerminalEventHandler, h.target, config)
+		}
+	}
+	h.TerminalEventHandler.HandleAppEvent(event)
+}
+
+// The adapter as the terminal should see it: taking Keys only if the
+// handler does, so that handlers taking raw keypresses still get keys the
+// keypad layout doesn't know (see deliverKeypress()).
+func (h *terminalHandlerAdapter) forTerminal() TerminalEventHandler {
+	if _, ok := h.TerminalEventHandler.(KeyHandler); ok {
+		return &keyHandlerAdapter{h}
+	}
+	return h
+}
+
+type keyHandlerAdapter struct {
+	*terminalHandlerAdapter
+}
+
+func (h *keyHandlerAdapter) HandleKey(key Key) {
+	h.TerminalEventHandler.(KeyHandler).HandleKey(key)
+}
+
+// Connects to the terminal on the device of the config. That's
+// NewSerialTerminalContext() opening the serial port; tests connect to fake
+// ports instead (see connectSerialTerminal()).
+type terminalConnector func(ctx context.Context,
+	config TerminalConfig) (*SerialTerminal, error)
+
+// Keep a terminal on the given device connected and dispatch it to the
+// handler matching its name. Runs until the context is cancelled.
+// Failed connects are retried after waiting as given by reconnect.
+func handleSerialDevice(ctx context.Context, config TerminalConfig,
+	reconnect BackoffConfig, backends *Backends) {
+	handleSerialDeviceWith(ctx, config, reconnect, backends,
+		NewSerialTerminalContext)
+}
+
+// Like handleSerialDevice(), connecting with the given function.
+func handleSerialDeviceWith(ctx context.Context, config TerminalConfig,
+	reconnect BackoffConfig, backends *Backends, connect terminalConnector) {
 	var t *SerialTerminal
+	device := config.DeviceString()
+	deviceLogger := (&Logger{}).With("device", device)
 	connect_successful := true
-	retry_time := initialReconnectOnErrorTime
-	for {
+	backoff := NewBackoff(reconnect)
+	var totals TerminalStats // Of earlier connections.
+	connects := 0
+	// Handlers are kept across reconnects, so that they can restore
+	// what the terminal showed and pick up where they left off.
+	handlers := make(map[Target]TerminalEventHandler)
+	for ctx.Err() == nil {
 		if !connect_successful {
-			time.Sleep(retry_time)
-			retry_time *= 2 // exponential backoff.
-			if retry_time > maxReconnectOnErrorTime {
-				retry_time = maxReconnectOnErrorTime
+			select {
+			case <-time.After(backoff.Next()):
+			case <-ctx.Done():
+				return
 			}
 		}
 
 		connect_successful = false
 
-		t, _ = NewSerialTerminal(devicepath, baud)
+		var err error
+		t, err = connect(ctx, config)
 		if t == nil {
+			deviceLogger.Debugf("Can't connect: %v", err)
 			continue
 		}
 
-		// Terminals are dispatched by name. There are different handlers
-		// for the name e.g. handlers that deal with reading codes
-		// and opening doors, but also the UI handler dealing with
-		// adding new users.
 		var handler TerminalEventHandler
-		switch Target(t.GetTerminalName()) {
-		case TargetDownstairs, TargetUpstairs, TargetElevator:
-			handler = NewAccessHandler(backends)
-
-		case TargetControlUI:
-			handler = NewControlHandler(backends)
+		target, _ := TargetForTerminalName(t.GetTerminalName())
+		if config.Target != "" {
+			target, _ = TargetForTerminalName(string(config.Target))
+		}
+		logger := deviceLogger.With("terminal", t.GetTerminalName()).
+			With("target", string(target))
+		live := backends.config.TerminalOr(config) // Maybe reloaded.
+		if config.Name != "" && NormalizeTerminalName(config.Name) !=
+			NormalizeTerminalName(t.GetTerminalName()) {
+			logger.Errorf("Terminal name is not the expected '%s'",
+				config.Name)
+		} else if handler = handlers[target]; handler == nil {
+			handler = newHandlerForTarget(target, live, backends)
+			if handler == nil {
+				logger.Warnf("Terminal with unrecognized name")
+			} else {
+				handlers[target] = handler
+			}
+		} else {
+			// A reload while we were disconnected went unseen.
+			reconfigureHandler(handler, target, live)
+		}
 
-		default:
-			log.Printf("%s:%d: Terminal with unrecognized name '%s'",
-				devicepath, baud, t.GetTerminalName())
+		if handler != nil {
+			current, reconnects := t, connects
+			ok, claimedBy := backends.terminals.Connected(TerminalStatus{
+				Device:          device,
+				Name:            t.GetTerminalName(),
+				Target:          target,
+				Doors:           live.Doors,
+				FirmwareVersion: t.GetFirmwareVersion(),
+				ConnectedSince:  time.Now(),
+				// Only called while registered, and totals only
+				// change after we unregistered.
+				StatsFunc: func() TerminalStats {
+					stats := totals.Add(current.Stats())
+					stats.Reconnects = reconnects
+					return stats
+				},
+			})
+			if !ok {
+				// Two terminals for the same door are confusing.
+				// Keep retrying: the other one might go away.
+				logger.Errorf("Target already claimed by terminal on %s; "+
+					"refusing. Set \"target\" in the config "+
+					"to assign a different one.", claimedBy)
+				handler = nil
+			}
 		}
 
 		if handler != nil {
 			connect_successful = true
-			retry_time = initialReconnectOnErrorTime
-			log.Printf("%s:%d: connected to '%s'",
-				devicepath, baud, t.GetTerminalName())
+			connects++
+			backoff.Reset()
+			logger.Infof("connected (firmware %s)",
+				t.GetFirmwareVersion())
 			backends.appEventBus.Post(&AppEvent{
 				Ev:     AppTerminalConnect,
-				Target: Target(t.GetTerminalName()),
-				Msg:    fmt.Sprintf("%s:%d", devicepath, baud),
+				Target: target,
+				Msg:    device,
 				Source: "serialdevice",
 			})
-			t.RunEventLoop(handler, backends.appEventBus)
+			adapter := &terminalHandlerAdapter{
+				TerminalEventHandler: handler,
+				target:               target,
+				bus:                  backends.appEventBus,
+				device:               config.Device,
+				config:               backends.config,
+			}
+			t.RunEventLoop(ctx, adapter.forTerminal(), backends.appEventBus)
+			logger.Infof("disconnected")
+			backends.terminals.Disconnected(device)
 			backends.appEventBus.Post(&AppEvent{
 				Ev:     AppTerminalDisconnect,
-				Target: Target(t.GetTerminalName()),
-				Msg:    fmt.Sprintf("%s:%d", devicepath, baud),
+				Target: target,
+				Msg:    device,
 				Source: "serialdevice",
 			})
 		}
 		t.shutdown()
+		totals = totals.Add(t.Stats())
 		t = nil
 	}
 }
 
 func main() {
-	userFileName := flag.String("users", "", "User Authentication file.")
+	configFileName := flag.String("config", "", "JSON config file describing terminals.")
+	userFileName := flag.String("users", "", "User Authentication file. Default: $"+EnvUsers)
 	logFileName := flag.String("logfile", "", "The log file, default = stdout")
+	useSyslog := flag.Bool("syslog", false, "Log to the local syslog as daemon 'earl'; also to -logfile if given, otherwise only there.")
+	logLevelName := flag.String("loglevel", "info", "Minimum level to log: debug, info, warn or error")
+	logDedupWindowFlag := flag.Duration("log-dedup-window", logDedupWindow, "Log identical lines within this time only once, then how often they were repeated. 0: log all.")
 	doorbellDir := flag.String("belldir", "", "Directory that contains upstairs.wav, gate.wav etc. Wav needs to be named like")
 	httpPort := flag.Int("httpport", -1, "Port to listen HTTP requests on")
 	tcpPort := flag.Int("tcpport", -1, "Port to listen for TCP requests on")
 	list_users := flag.Bool("list-users", false, "List users and exit")
 	show_version := flag.Bool("version", false, "Print version info")
+	lockdownFile := flag.String("lockdown-state", "", "File to keep lockdown state in. Default: <users-file>.lockdown")
+	facilities := flag.String("facilities", "", "Comma separated Wiegand facility codes of our cards. These are enrolled by card number only.")
+	timezone := flag.String("timezone", "Local", "Timezone of the daytime hours of users and of the days their validity is counted in, e.g. America/Los_Angeles.")
+	selftest := flag.Bool("selftest", false, "At startup, briefly pulse the outputs given in the config's self-test section, one after the other.")
+	anonValidity := flag.Duration("anon-validity", DefaultValidityPeriodAnonymousCards, "How long users without contact info are valid after registration.")
+	provisionToken := flag.Bool("provision-token", true, "While there are no members, require a one-time token from the log to add the first one on the control terminal.")
 
 	flag.Parse()
+	*userFileName = FlagOrEnv(*userFileName, EnvUsers, os.Getenv)
+	ValidityPeriodAnonymousCards = *anonValidity
+	if parsed, err := ParseFacilities(*facilities); err == nil {
+		SiteFacilities = parsed
+	} else {
+		log.Fatal(err)
+	}
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatal("Invalid -timezone: ", err)
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) == "check" {
+		os.Exit(checkUserFileCommand(flag.Args()[1:], location))
+	}
 
 	if *show_version {
 		printVersionInfo()
 		return
 	}
 
+	if level, err := ParseLogLevel(*logLevelName); err == nil {
+		SetLogLevel(level)
+	} else {
+		log.Fatal(err)
+	}
+	logDedupWindow = *logDedupWindowFlag
+
+	var logfile *os.File
+	var logOutputs []io.Writer
 	if *logFileName != "" {
-		logfile, err := os.OpenFile(*logFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		var err error
+		logfile, err = os.OpenFile(*logFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
 			log.Fatal("Error opening log file", err)
 		}
 		defer logfile.Close()
-		log.SetOutput(logfile)
+		logOutputs = append(logOutputs, logfile)
+	}
+	if *useSyslog {
+		// Without syslog, we still want a log somewhere.
+		if writer, err := dialSyslog("earl"); err != nil {
+			log.Printf("Can't log to syslog, logging here: %v", err)
+		} else {
+			logOutputs = append(logOutputs, newSyslogOutput(writer))
+		}
+	}
+	if len(logOutputs) > 0 {
+		log.SetOutput(io.MultiWriter(logOutputs...))
 	}
 
 	log.Printf("Starting... version: %s\n", VERSION)
 
-	if len(flag.Args()) < 1 && !*list_users {
+	config := &Config{}
+	if *configFileName != "" {
+		var err error
+		if config, err = ReadConfigFile(*configFileName); err != nil {
+			log.Fatal("Error reading config: ", err)
+		}
+	}
+	// Terminals given on the commandline are a shortcut for terminals with
+	// default configuration.
+	if err := AddTerminalArgs(config, flag.Args(), os.Getenv); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(config.Terminals) < 1 && !*list_users {
 		fmt.Fprintf(os.Stderr,
 			"Expected list of serial ports."+
-				"usage: %s [options] <serial-device>[:baudrate] [<serial-device>[:baudrate]...]\nOptions\n",
-			os.Args[0])
+				"usage: %s [options] <serial-device>[:baudrate] [<serial-device>[:baudrate]...]\n"+
+				"(Terminals can also be given in $%s)\n"+
+				"   or: %s check <users-file>\nOptions\n",
+			os.Args[0], EnvTerminals, os.Args[0])
 		flag.PrintDefaults()
 		return
 	}
 
 	appEventBus := NewApplicationBus()
-	authenticator := NewFileBasedAuthenticator(*userFileName,
-		appEventBus)
+	if *lockdownFile == "" {
+		*lockdownFile = *userFileName + ".lockdown"
+	}
+	lockdown := NewLockdown(*lockdownFile, appEventBus)
+	tracer := NewAccessTracer()
+	var authenticator Authenticator
+	var fileAuthenticator *FileBasedAuthenticator // nil with remote-auth
+	var replica *ReplicaSync
+	if config.Replica != nil {
+		// Start out with fresh users if we can; with the users we
+		// have if not.
+		replica = NewReplicaSync(*config.Replica, *userFileName)
+		replica.Sync()
+	}
+	if config.RemoteAuth != nil {
+		if *list_users {
+			log.Fatal("Users are managed in the remote system, not listing.")
+		}
+		remote := NewRemoteAuthenticator(*config.RemoteAuth)
+		remote.lockdown = lockdown
+		authenticator = remote
+	} else {
+		if replica != nil {
+			fileAuthenticator = NewReadOnlyFileBasedAuthenticator(*userFileName,
+				appEventBus)
+		} else {
+			createFirstBootUserFile(*userFileName)
+			fileAuthenticator = NewFileBasedAuthenticator(*userFileName,
+				appEventBus)
+		}
+		if fileAuthenticator == nil {
+			log.Fatal("Can't continue without authenticator.")
+		}
+		setUpProvisioning(fileAuthenticator, *provisionToken)
+		fileAuthenticator.lockdown = lockdown
+		fileAuthenticator.location = location
+		fileAuthenticator.schedules = config.Schedules
+		fileAuthenticator.renewalGrace = time.Duration(config.RenewalGrace)
+		fileAuthenticator.tracer = tracer
+		authenticator = fileAuthenticator
+	}
 	backends := &Backends{
 		authenticator: authenticator,
 		appEventBus:   appEventBus,
+		terminals:     NewTerminalRegistry(),
+		lockdown:      lockdown,
+		occupancy:     NewOccupancy(time.Duration(config.OccupancyWindow)),
+		recentAccess:  NewRecentAccess(config.RecentAccess),
+		tracer:        tracer,
+		maintenance:   NewMaintenance(appEventBus),
+		replica:       replica,
+		location:      location,
+		config:        NewLiveConfig(config),
 	}
-
-	if authenticator == nil {
-		log.Fatal("Can't continue without authenticator.")
+	for _, terminal := range config.Terminals {
+		if terminal.Maintenance {
+			backends.maintenance.Set(terminal.ConfiguredTarget(), true, "config")
+		}
 	}
 
 	// If we just requested to list users, do this and exit.
 	if *list_users {
-		printUserList(authenticator)
+		printUserList(fileAuthenticator)
 		return
 	}
 
-	actions := NewGPIOActions(*doorbellDir)
-	go actions.EventLoop(appEventBus)
+	if replica != nil {
+		go replica.Run()
+	}
+
+	// Access times are kept in memory and written every now and then.
+	if fileAuthenticator != nil {
+		go func() {
+			for range time.Tick(lastAccessFlushInterval) {
+				if ok, msg := fileAuthenticator.FlushLastAccess(); !ok {
+					log.Printf("Couldn't write last access times: %s", msg)
+				}
+			}
+		}()
+	}
+
+	sensorPins := make(map[Target]int)
+	for target, sensor := range config.DoorSensors {
+		sensorPins[target] = sensor.Pin
+	}
+	actions := NewGPIOActions(*doorbellDir, config.ElevatorFloorPins,
+		config.DoorPins, sensorPins)
+	go actions.EventLoop(appEventBus, backends.maintenance)
+	if len(config.DoorSensors) > 0 {
+		go NewDoorWatcher(actions, appEventBus, config.DoorSensors).EventLoop()
+	}
+
+	watcher := NewAdminEventWatcher(NewNotifier(config.Notifications),
+		config.Notifications)
+	go watcher.EventLoop(appEventBus)
 
 	// For each serial interface, we run an indepenent loop
 	// making sure we are constantly connected.
-	for _, arg := range flag.Args() {
-		devicepath, baudrate := parseArg(arg)
-		go handleSerialDevice(devicepath, baudrate, backends)
+	ctx, stopTerminals := context.WithCancel(context.Background())
+	var terminalsRunning sync.WaitGroup
+	for _, terminal := range config.Terminals {
+		terminalsRunning.Add(1)
+		go func(terminal TerminalConfig) {
+			defer terminalsRunning.Done()
+			handleSerialDevice(ctx, terminal, config.Reconnect, backends)
+		}(terminal)
 	}
 
 	if *httpPort > 0 && *httpPort <= 65535 {
-		apiServer := NewApiServer(appEventBus, *httpPort)
+		apiServer := NewApiServer(backends, *httpPort)
+		if config.UsersExportToken != "" {
+			apiServer.ExportUsers(config.UsersExportToken)
+		}
+		if config.CheckToken != "" {
+			apiServer.AllowChecks(config.CheckToken)
+		}
 		go apiServer.Run()
 	}
 
@@ -225,6 +613,10 @@ func main() {
 		go tcpServer.Run()
 	}
 
+	if *selftest {
+		go actions.SelfTest(config.SelfTest, appEventBus)
+	}
+
 	log.Println("Ready.")
 	backends.appEventBus.Post(&AppEvent{
 		Ev:     AppEarlStarted,
@@ -232,6 +624,52 @@ func main() {
 		Source: "main",
 	})
 
-	var block_forever chan bool
-	<-block_forever
+	// Run until someone asks us to stop; reload when asked to.
+	reloader := &Reloader{
+		configFile:   *configFileName,
+		terminalArgs: flag.Args(),
+		auth:         fileAuthenticator,
+		backends:     backends,
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %s. Shutting down.", sig)
+			break
+		}
+		log.Printf("Received %s. Reloading config and users.", sig)
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Couldn't reload, keeping the config we have: %v", err)
+		}
+	}
+
+	// Stop all terminals, which runs their handlers' HandleShutdown()
+	// and closes the serial ports. Some might be stuck in a
+	// request, so don't wait forever.
+	stopTerminals()
+	terminalsDone := make(chan bool)
+	go func() {
+		terminalsRunning.Wait()
+		close(terminalsDone)
+	}()
+	select {
+	case <-terminalsDone:
+	case <-time.After(maxShutdownWaitTime):
+		log.Println("Timeout waiting for terminals to shut down.")
+	}
+
+	// Make sure we don't leave any door strike energized.
+	actions.Shutdown()
+
+	if fileAuthenticator != nil {
+		if ok, msg := fileAuthenticator.FlushLastAccess(); !ok {
+			log.Printf("Couldn't write last access times: %s", msg)
+		}
+	}
+
+	log.Println("Bye.")
+	if logfile != nil {
+		logfile.Sync()
+	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTargetForTerminalName(t *testing.T) {
+	for name, expected := range map[string]Target{
+		"gate":       TargetDownstairs,
+		"  GATE\n":   TargetDownstairs,
+		"Upstairs ":  TargetUpstairs,
+		"elevator":   TargetElevator,
+		"\tControl":  TargetControlUI,
+		"Basement  ": Target("basement"),
+	} {
+		target, known := TargetForTerminalName(name)
+		if target != expected {
+			t.Errorf("'%s': expected target '%s', got '%s'", name, expected, target)
+		}
+		ExpectTrue(t, known == (expected != Target("basement")), "Known "+name)
+	}
+}
+
+func TestSerialDeviceReconnects(t *testing.T) {
+	backends := &Backends{
+		authenticator: NewMockAuthenticator(),
+		appEventBus:   NewApplicationBus(),
+		terminals:     NewTerminalRegistry(),
+		maintenance:   NewMaintenance(NewApplicationBus()),
+	}
+	ports := make(chan *FakeSerialPort, 3)
+	var attempts int32
+	connect := func(ctx context.Context, config TerminalConfig) (*SerialTerminal, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("no such device")
+		}
+		port := NewFakeSerialPort()
+		port.SetName("upstairs")
+		ports <- port
+		return connectSerialTerminal(ctx, port, config)
+	}
+	connected := func() *TerminalStatus {
+		for end := time.Now().Add(2 * time.Second); time.Now().Before(end); {
+			if snapshot := backends.terminals.Snapshot(); len(snapshot) == 1 {
+				return &snapshot[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		handleSerialDeviceWith(ctx, TerminalConfig{Device: "fake"},
+			BackoffConfig{Initial: Duration(time.Millisecond)}, backends, connect)
+		close(done)
+	}()
+
+	status := connected()
+	ExpectTrue(t, status != nil && status.Target == TargetUpstairs,
+		"Connected after failed attempt")
+	ExpectTrue(t, status != nil && status.Stats.Reconnects == 0, "First connection")
+
+	// The terminal goes away and comes back.
+	first := <-ports
+	first.Close()
+	<-ports
+	status = connected()
+	ExpectTrue(t, status != nil && status.Stats.Reconnects == 1, "Reconnected")
+	ExpectTrue(t, atomic.LoadInt32(&attempts) == 3, "Connected right away again")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Not stopped by cancelling")
+	}
+	ExpectTrue(t, len(backends.terminals.Snapshot()) == 0, "Unregistered")
+}
+
+func TestReconnectAppliesMissedReload(t *testing.T) {
+	auth := NewMockAuthenticator()
+	bus := NewApplicationBus()
+	backends := &Backends{
+		authenticator: auth,
+		appEventBus:   bus,
+		terminals:     NewTerminalRegistry(),
+		config:        NewLiveConfig(&Config{}),
+	}
+	sideDoor := Target("side-door")
+	auth.allow[ACKey{"123456", sideDoor}] = ReasonOK
+	events := make(AppEventChannel, 100)
+	bus.Subscribe(events)
+	ports := make(chan *FakeSerialPort, 2)
+	connect := func(ctx context.Context, config TerminalConfig) (*SerialTerminal, error) {
+		port := NewFakeSerialPort()
+		port.SetName("upstairs")
+		ports <- port
+		return connectSerialTerminal(ctx, port, config)
+	}
+	connects := func(count int) bool {
+		for end := time.Now().Add(2 * time.Second); time.Now().Before(end); {
+			snapshot := backends.terminals.Snapshot()
+			if len(snapshot) == 1 && snapshot[0].Stats.Reconnects == count-1 {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSerialDeviceWith(ctx, TerminalConfig{Device: "fake"},
+		BackoffConfig{Initial: Duration(time.Millisecond)}, backends, connect)
+
+	// Reloaded while the terminal is away: the handler never sees it.
+	first := <-ports
+	ExpectTrue(t, connects(1), "Connected")
+	backends.config.Set(&Config{Terminals: []TerminalConfig{{
+		Device: "fake",
+		Doors:  []Target{sideDoor},
+	}}})
+	first.Close()
+	second := <-ports
+	ExpectTrue(t, connects(2), "Reconnected")
+	for _, key := range []byte("123456#") {
+		second.SendKeypress(key)
+	}
+	for end := time.After(2 * time.Second); ; {
+		select {
+		case event := <-events:
+			if event.Ev == AppOpenRequest {
+				ExpectTrue(t, event.Target == sideDoor, "Door of the new config")
+				return
+			}
+		case <-end:
+			t.Fatal("Door not opened")
+		}
+	}
+}
+
+func TestAdapterPassesUnknownKeysToRawHandler(t *testing.T) {
+	raw := NewRecordingHandler()
+	adapter := (&terminalHandlerAdapter{TerminalEventHandler: raw,
+		bus: NewApplicationBus()}).forTerminal()
+	_, isKeyHandler := adapter.(KeyHandler)
+	ExpectFalse(t, isKeyHandler, "Raw handler stays raw")
+	ExpectTrue(t, deliverKeypress(adapter, SwappedKeypad, 'A'), "Delivered")
+	raw.expectKey(t, 'A')
+	deliverKeypress(adapter, SwappedKeypad, '#') // Clear on this keypad.
+	raw.expectKey(t, '*')
+
+	access := NewAccessHandler(&Backends{appEventBus: NewApplicationBus()})
+	adapter = (&terminalHandlerAdapter{TerminalEventHandler: access}).forTerminal()
+	_, isKeyHandler = adapter.(KeyHandler)
+	ExpectTrue(t, isKeyHandler, "Keys for handlers taking them")
+}
@@ -0,0 +1,82 @@
+// Maintenance mode.
+//
+// While a terminal is being serviced, it should not let anyone in, but stay
+// connected: techs shouldn't fight reconnect loops or open doors by
+// accident. A terminal in maintenance ignores RFID and keypad, shows a
+// maintenance screen and opens no doors; ticks and heartbeats go on as
+// usual.
+//
+// Toggled per target with the HTTP API, or with "maintenance" in the
+// terminal's config to start in maintenance. Not kept across restarts.
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+type Maintenance struct {
+	bus *ApplicationBus
+
+	lock    sync.Mutex
+	targets map[Target]bool
+}
+
+// Changes are announced on the bus as AppMaintenanceChanged.
+func NewMaintenance(bus *ApplicationBus) *Maintenance {
+	return &Maintenance{bus: bus, targets: make(map[Target]bool)}
+}
+
+// Whether the terminal of the target is in maintenance. A nil Maintenance
+// never is.
+func (m *Maintenance) Active(target Target) bool {
+	if m == nil {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.targets[target]
+}
+
+// The targets in maintenance, sorted.
+func (m *Maintenance) Targets() []Target {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	result := make([]Target, 0, len(m.targets))
+	for target := range m.targets {
+		result = append(result, target)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// Put the terminal of the target in maintenance or back in service;
+// "source" is for the log.
+func (m *Maintenance) Set(target Target, active bool, source string) {
+	m.lock.Lock()
+	changed := m.targets[target] != active
+	if active {
+		m.targets[target] = true
+	} else {
+		delete(m.targets, target)
+	}
+	m.lock.Unlock()
+	if !changed {
+		return
+	}
+
+	log.Printf("Maintenance of %s set to %t by %s", target, active, source)
+	value := 0
+	if active {
+		value = 1
+	}
+	if m.bus != nil {
+		m.bus.Post(&AppEvent{
+			Ev:     AppMaintenanceChanged,
+			Target: target,
+			Source: source,
+			Value:  value,
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceSuppressesAccess(t *testing.T) {
+	f := NewTestFixture(t)
+	maintenance := NewMaintenance(f.mockbackends.appEventBus)
+	f.mockbackends.maintenance = maintenance
+	f.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	f.mockauth.allow[ACKey{"abcd1234", Target("mock")}] = ReasonOK
+
+	PressKeys(f.handlerUnderTest, "123") // Interrupted by maintenance.
+	maintenance.Set(Target("mock"), true, "test")
+	f.ExpectEvent(AppMaintenanceChanged, Target("mock"))
+	f.mockterm.expectLCD(0, "Out of service")
+	f.mockterm.expectLCD(1, "Maintenance")
+
+	PressKeys(f.handlerUnderTest, "456#")
+	f.handlerUnderTest.HandleRFID("abcd1234")
+	PressKeys(f.handlerUnderTest, "#") // Nor ringing the bell.
+	f.handlerUnderTest.HandleTick()
+	f.ExpectNoMoreEvents()
+	f.mockterm.expectLCD(0, "Out of service")
+
+	// Other terminals are not affected.
+	maintenance.Set(Target("upstairs"), true, "test")
+	f.ExpectEvent(AppMaintenanceChanged, Target("upstairs"))
+	f.mockterm.expectLCD(0, "Out of service")
+
+	maintenance.Set(Target("mock"), false, "test")
+	f.ExpectEvent(AppMaintenanceChanged, Target("mock"))
+	f.mockterm.expectLCD(0, "")
+	PressKeys(f.handlerUnderTest, "123456#")
+	f.ExpectEvent(AppOpenRequest, Target("mock"))
+	ExpectTrue(t, len(maintenance.Targets()) == 1, "Upstairs still in maintenance")
+}
+
+func TestMaintenanceKeepsConnection(t *testing.T) {
+	port := NewFakeSerialPort()
+	auth := NewMockAuthenticator()
+	auth.allow[ACKey{"abcd1234", Target("fake")}] = ReasonOK
+	bus := NewApplicationBus()
+	openRequests := make(AppEventChannel, 10)
+	bus.Subscribe(openRequests)
+	maintenance := NewMaintenance(nil)
+	maintenance.Set(Target("fake"), true, "test")
+	handler := NewAccessHandler(&Backends{authenticator: auth, appEventBus: bus,
+		maintenance: maintenance})
+
+	terminal, err := connectSerialTerminal(context.Background(), port, TerminalConfig{
+		Device:            "fake",
+		HeartbeatInterval: Duration(100 * time.Millisecond),
+		PingTimeout:       Duration(100 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	done := make(chan bool)
+	go func() {
+		terminal.RunEventLoop(context.Background(), handler, bus)
+		close(done)
+	}()
+
+	ExpectTrue(t, port.WaitForRequest("M0Out of service", time.Second),
+		"Maintenance screen")
+	port.SendRFID("abcd1234")
+	select {
+	case <-done:
+		t.Fatal("Disconnected while in maintenance")
+	case event := <-openRequests:
+		if event.Ev == AppOpenRequest {
+			t.Error("Opened door while in maintenance")
+		}
+	case <-time.After(time.Second):
+	}
+	pings := 0
+	for _, request := range port.Requests() {
+		if request == "n" {
+			pings++
+		}
+	}
+	ExpectTrue(t, pings > 3, "Still answering pings") // 2 on connect.
+	ExpectFalse(t, port.WaitForRequest("LG", 10*time.Millisecond), "No green light")
+}
+
+func TestMaintenanceBlocksAnyOpenRequest(t *testing.T) {
+	bus := NewApplicationBus()
+	maintenance := NewMaintenance(nil)
+	maintenance.Set(TargetUpstairs, true, "test")
+	actions := NewRecordingActions()
+	actions.Listen(bus, maintenance)
+
+	// E.g. held open from the control terminal.
+	bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs,
+		Source: "control"})
+	bus.Post(&AppEvent{Ev: AppOpenRequest, Target: TargetDownstairs,
+		Source: "control"})
+	ExpectTrue(t, actions.WaitForCall("open", TargetDownstairs, time.Second) != nil,
+		"Door in service opens")
+	ExpectTrue(t, actions.WaitForCall("open", TargetUpstairs, 100*time.Millisecond) == nil,
+		"Door in maintenance stays closed")
+}
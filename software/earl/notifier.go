@@ -0,0 +1,406 @@
+// Notifications.
+//
+// Notable events, such as a new user, a lockdown, repeated failed attempts
+// at an entrance, a terminal that stays offline or loses power, a door
+// forced or propped open (see door-sensor.go), are sent to the admins
+// so that nobody has to watch the logs. The AdminEventWatcher picks these
+// from the ApplicationBus and hands them to a Notifier, configured in the
+// config file, e.g.
+//
+//	"notifications": {
+//	  "transport": "slack",
+//	  "slack-webhook": "https://hooks.slack.com/services/...",
+//	  "failed-attempts": 5, "failed-attempts-window": "2m",
+//	  "terminal-offline": "10m"
+//	}
+//
+// Delivery happens in the background with retries, so a slow or
+// unreachable transport never holds up opening a door.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultFailedAttempts       = 5
+	defaultFailedAttemptsWindow = 2 * time.Minute
+	defaultTerminalOffline      = 10 * time.Minute
+	renewalReminderInterval     = 24 * time.Hour
+
+	notifyQueueSize     = 32
+	notifyRetries       = 3
+	notifyRetryDelay    = 5 * time.Second
+	offlineCheckTime    = 10 * time.Second
+	slackRequestTimeout = 10 * time.Second
+)
+
+type AdminEventType string
+
+const (
+	AdminUserAdded       = AdminEventType("user-added")
+	AdminLockdownChanged = AdminEventType("lockdown")
+	AdminFailedAttempts  = AdminEventType("failed-attempts")
+	AdminTerminalOffline = AdminEventType("terminal-offline")
+	AdminUserFileAlert   = AdminEventType("user-file-alert")
+	AdminDuress          = AdminEventType("duress")
+	AdminTerminalPower   = AdminEventType("terminal-power")
+	AdminDoorAlert       = AdminEventType("door-alert")
+	AdminRenewalDue      = AdminEventType("renewal-due")
+)
+
+type AdminEvent struct {
+	Timestamp time.Time
+	Type      AdminEventType
+	Target    Target // Empty if not about a particular entrance.
+	Msg       string // Human readable.
+
+	// Needs someone's attention right now, e.g. a member under duress.
+	Urgent bool
+}
+
+func (e AdminEvent) String() string {
+	prefix := ""
+	if e.Urgent {
+		prefix = "URGENT "
+	}
+	if e.Target != "" {
+		return fmt.Sprintf("%s[%s] %s: %s", prefix, e.Type, e.Target, e.Msg)
+	}
+	return fmt.Sprintf("%s[%s] %s", prefix, e.Type, e.Msg)
+}
+
+// Something that tells the admins. Returns an error if delivery failed and
+// might succeed if tried again.
+type Notifier interface {
+	Notify(event AdminEvent) error
+}
+
+type NotificationConfig struct {
+	// "log" (the default) or "slack".
+	Transport string `json:"transport"`
+
+	// Incoming webhook URL for the "slack" transport.
+	SlackWebhook string `json:"slack-webhook"`
+
+	// Notify if there are FailedAttempts denied codes at one target
+	// within FailedAttemptsWindow. 0 for defaults.
+	FailedAttempts       int      `json:"failed-attempts"`
+	FailedAttemptsWindow Duration `json:"failed-attempts-window"`
+
+	// Notify if a terminal stays disconnected this long. 0 for default.
+	TerminalOffline Duration `json:"terminal-offline"`
+}
+
+func (c *NotificationConfig) Validate() error {
+	switch c.Transport {
+	case "", "log":
+	case "slack":
+		if c.SlackWebhook == "" {
+			return fmt.Errorf("slack transport needs a slack-webhook")
+		}
+	default:
+		return fmt.Errorf("unknown notification transport '%s'", c.Transport)
+	}
+	if c.FailedAttempts < 0 {
+		return fmt.Errorf("failed-attempts can't be negative")
+	}
+	return nil
+}
+
+// Create the notifier chosen in the config. Delivery is asynchronous.
+func NewNotifier(config NotificationConfig) Notifier {
+	var transport Notifier = NewLogNotifier()
+	if config.Transport == "slack" {
+		transport = NewSlackNotifier(config.SlackWebhook)
+	}
+	return NewAsyncNotifier(transport, notifyRetries, notifyRetryDelay)
+}
+
+// Notifies by writing to the log. Always available.
+type LogNotifier struct {
+	logger *Logger
+}
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{logger: (&Logger{}).With("notify", "log")}
+}
+
+func (n *LogNotifier) Notify(event AdminEvent) error {
+	if event.Urgent {
+		n.logger.Errorf("%s", event)
+	} else {
+		n.logger.Warnf("%s", event)
+	}
+	return nil
+}
+
+// Posts to a Slack incoming webhook.
+type SlackNotifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func NewSlackNotifier(webhookURL string) *SlackNotifier {
+	return &SlackNotifier{
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: slackRequestTimeout},
+	}
+}
+
+func (n *SlackNotifier) Notify(event AdminEvent) error {
+	text := event.Timestamp.Format("2006-01-02 15:04:05 ") + event.String()
+	if event.Urgent {
+		text = "<!channel> " + text // Alert everyone in the channel.
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	response, err := n.client.Post(n.webhookURL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook: %s", response.Status)
+	}
+	return nil
+}
+
+// Wraps a Notifier to deliver in the background, retrying failed
+// deliveries. Notify() never blocks; if the queue is full, the event is
+// dropped (and logged).
+type AsyncNotifier struct {
+	notifier   Notifier
+	retries    int
+	retryDelay time.Duration
+	queue      chan AdminEvent
+	logger     *Logger
+}
+
+func NewAsyncNotifier(notifier Notifier, retries int, retryDelay time.Duration) *AsyncNotifier {
+	n := &AsyncNotifier{
+		notifier:   notifier,
+		retries:    retries,
+		retryDelay: retryDelay,
+		queue:      make(chan AdminEvent, notifyQueueSize),
+		logger:     (&Logger{}).With("notify", "async"),
+	}
+	go n.run()
+	return n
+}
+
+func (n *AsyncNotifier) Notify(event AdminEvent) error {
+	select {
+	case n.queue <- event:
+		return nil
+	default:
+		n.logger.Errorf("Queue full, dropping %s", event)
+		return fmt.Errorf("notification queue full")
+	}
+}
+
+func (n *AsyncNotifier) run() {
+	for event := range n.queue {
+		n.deliver(event)
+	}
+}
+
+func (n *AsyncNotifier) deliver(event AdminEvent) {
+	delay := n.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := n.notifier.Notify(event)
+		if err == nil {
+			return
+		}
+		if attempt >= n.retries {
+			n.logger.Errorf("Giving up on %s: %v", event, err)
+			return
+		}
+		n.logger.Warnf("Failed to deliver, retrying in %s: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Watches the ApplicationBus for notable events and sends them to the
+// Notifier.
+type AdminEventWatcher struct {
+	notifier Notifier
+	clock    Clock
+
+	failedAttempts       int
+	failedAttemptsWindow time.Duration
+	terminalOffline      time.Duration
+
+	denials      map[Target][]time.Time // Recent failed attempts.
+	offlineSince map[Target]time.Time
+	offlineTold  map[Target]bool // Already notified.
+	onBattery    map[Target]bool // Power failed, notified.
+
+	// When we last reminded about each user let in on grace, by name.
+	renewalTold map[string]time.Time
+}
+
+func NewAdminEventWatcher(notifier Notifier, config NotificationConfig) *AdminEventWatcher {
+	w := &AdminEventWatcher{
+		notifier:             notifier,
+		clock:                RealClock{},
+		failedAttempts:       defaultFailedAttempts,
+		failedAttemptsWindow: defaultFailedAttemptsWindow,
+		terminalOffline:      defaultTerminalOffline,
+		denials:              make(map[Target][]time.Time),
+		offlineSince:         make(map[Target]time.Time),
+		offlineTold:          make(map[Target]bool),
+		onBattery:            make(map[Target]bool),
+		renewalTold:          make(map[string]time.Time),
+	}
+	if config.FailedAttempts > 0 {
+		w.failedAttempts = config.FailedAttempts
+	}
+	if config.FailedAttemptsWindow > 0 {
+		w.failedAttemptsWindow = time.Duration(config.FailedAttemptsWindow)
+	}
+	if config.TerminalOffline > 0 {
+		w.terminalOffline = time.Duration(config.TerminalOffline)
+	}
+	return w
+}
+
+// Receive events from the bus and notify about the notable ones.
+func (w *AdminEventWatcher) EventLoop(bus *ApplicationBus) {
+	appEvents := make(AppEventChannel, 10)
+	bus.Subscribe(appEvents)
+	ticker := time.NewTicker(offlineCheckTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-appEvents:
+			w.HandleAppEvent(event)
+		case <-ticker.C:
+			w.CheckOffline()
+		}
+	}
+}
+
+func (w *AdminEventWatcher) HandleAppEvent(event *AppEvent) {
+	switch event.Ev {
+	case AppUserAdded:
+		w.notify(AdminUserAdded, "", "New "+event.Msg)
+
+	case AppLockdownChanged:
+		w.notify(AdminLockdownChanged, "",
+			fmt.Sprintf("Lockdown set to %s by %s", event.Msg, event.Source))
+
+	case AppUserFileAlert:
+		msg := event.Msg
+		if msg == "" {
+			msg = "resolved"
+		}
+		w.notify(AdminUserFileAlert, "", msg)
+
+	case AppAccessDenied:
+		w.recordDenial(event.Target)
+
+	case AppDuress:
+		w.notifyUrgent(AdminDuress, event.Target,
+			fmt.Sprintf("Duress code of %s used", event.Msg))
+
+	case AppTerminalPower:
+		// Terminals might repeat their status; only tell about changes.
+		failed := event.Value == 0
+		if failed == w.onBattery[event.Target] {
+			break
+		}
+		if failed {
+			w.onBattery[event.Target] = true
+			w.notify(AdminTerminalPower, event.Target,
+				"Power failed, running on battery")
+		} else {
+			delete(w.onBattery, event.Target)
+			w.notify(AdminTerminalPower, event.Target, "Power is back")
+		}
+
+	case AppDoorForced, AppDoorPropped:
+		w.notify(AdminDoorAlert, event.Target, event.Msg)
+
+	case AppRenewalDue:
+		// They come every day; once a day is enough to remind them.
+		now := w.clock.Now()
+		if told, ok := w.renewalTold[event.Msg]; ok &&
+			now.Sub(told) < renewalReminderInterval {
+			break
+		}
+		w.renewalTold[event.Msg] = now
+		w.notify(AdminRenewalDue, event.Target,
+			fmt.Sprintf("%s is let in on grace; needs to renew", event.Msg))
+
+	case AppTerminalDisconnect:
+		if _, known := w.offlineSince[event.Target]; !known {
+			w.offlineSince[event.Target] = w.clock.Now()
+		}
+
+	case AppTerminalConnect:
+		if w.offlineTold[event.Target] {
+			w.notify(AdminTerminalOffline, event.Target, "Back online")
+		}
+		delete(w.offlineSince, event.Target)
+		delete(w.offlineTold, event.Target)
+	}
+}
+
+// Notify about terminals that are disconnected for too long.
+func (w *AdminEventWatcher) CheckOffline() {
+	now := w.clock.Now()
+	for target, since := range w.offlineSince {
+		if w.offlineTold[target] || now.Sub(since) < w.terminalOffline {
+			continue
+		}
+		w.offlineTold[target] = true
+		w.notify(AdminTerminalOffline, target,
+			fmt.Sprintf("Offline since %s", since.Format("15:04")))
+	}
+}
+
+func (w *AdminEventWatcher) recordDenial(target Target) {
+	now := w.clock.Now()
+	recent := []time.Time{}
+	for _, t := range w.denials[target] {
+		if now.Sub(t) < w.failedAttemptsWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) >= w.failedAttempts {
+		w.notify(AdminFailedAttempts, target,
+			fmt.Sprintf("%d failed attempts within %s",
+				len(recent), w.failedAttemptsWindow))
+		recent = nil // Start counting anew.
+	}
+	w.denials[target] = recent
+}
+
+func (w *AdminEventWatcher) notify(ev AdminEventType, target Target, msg string) {
+	w.notifier.Notify(AdminEvent{
+		Timestamp: w.clock.Now(),
+		Type:      ev,
+		Target:    target,
+		Msg:       msg,
+	})
+}
+
+func (w *AdminEventWatcher) notifyUrgent(ev AdminEventType, target Target, msg string) {
+	w.notifier.Notify(AdminEvent{
+		Timestamp: w.clock.Now(),
+		Type:      ev,
+		Target:    target,
+		Msg:       msg,
+		Urgent:    true,
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type RecordingNotifier struct {
+	events []AdminEvent
+}
+
+func (n *RecordingNotifier) Notify(event AdminEvent) error {
+	n.events = append(n.events, event)
+	return nil
+}
+
+func (n *RecordingNotifier) expect(t *testing.T, ev AdminEventType, target Target) {
+	if len(n.events) == 0 {
+		t.Errorf("Expected notification %s:%s, got none", ev, target)
+		return
+	}
+	got := n.events[0]
+	n.events = n.events[1:]
+	if got.Type != ev || got.Target != target {
+		t.Errorf("Expected notification %s:%s, got %s", ev, target, got)
+	}
+}
+
+func (n *RecordingNotifier) expectNone(t *testing.T) {
+	for _, event := range n.events {
+		t.Errorf("Didn't expect notification, got %s", event)
+	}
+	n.events = nil
+}
+
+func NewTestWatcher() (*AdminEventWatcher, *RecordingNotifier, *MockClock) {
+	recorder := &RecordingNotifier{}
+	clock := &MockClock{}
+	watcher := NewAdminEventWatcher(recorder, NotificationConfig{
+		FailedAttempts:       3,
+		FailedAttemptsWindow: Duration(time.Minute),
+		TerminalOffline:      Duration(5 * time.Minute),
+	})
+	watcher.clock = clock
+	return watcher, recorder, clock
+}
+
+func TestNotifyAdminEvents(t *testing.T) {
+	watcher, recorder, _ := NewTestWatcher()
+	watcher.HandleAppEvent(&AppEvent{Ev: AppUserAdded, Msg: "user:Jon Doe"})
+	recorder.expect(t, AdminUserAdded, "")
+	watcher.HandleAppEvent(&AppEvent{Ev: AppLockdownChanged,
+		Msg: "all", Source: "http"})
+	recorder.expect(t, AdminLockdownChanged, "")
+	watcher.HandleAppEvent(&AppEvent{Ev: AppOpenRequest, Target: TargetUpstairs})
+	recorder.expectNone(t)
+}
+
+func TestNotifyDuress(t *testing.T) {
+	watcher, recorder, _ := NewTestWatcher()
+	watcher.HandleAppEvent(&AppEvent{Ev: AppDuress, Target: TargetUpstairs,
+		Msg: "Jon Doe"})
+	ExpectTrue(t, len(recorder.events) == 1 && recorder.events[0].Urgent,
+		"Duress is urgent")
+	ExpectTrue(t, strings.Contains(recorder.events[0].String(), "Jon Doe"),
+		"Duress names the user")
+	recorder.expect(t, AdminDuress, TargetUpstairs)
+}
+
+func TestNotifyRenewalDueOncePerDay(t *testing.T) {
+	watcher, recorder, clock := NewTestWatcher()
+	renewal := func(name string) {
+		watcher.HandleAppEvent(&AppEvent{Ev: AppRenewalDue,
+			Target: TargetUpstairs, Msg: name})
+	}
+	renewal("Jon Doe")
+	ExpectTrue(t, len(recorder.events) == 1 &&
+		strings.Contains(recorder.events[0].Msg, "Jon Doe"), "Names the user")
+	recorder.expect(t, AdminRenewalDue, TargetUpstairs)
+
+	clock.now = clock.now.Add(3 * time.Hour)
+	renewal("Jon Doe")
+	recorder.expectNone(t)
+	renewal("Jane Roe") // Others are counted separately.
+	recorder.expect(t, AdminRenewalDue, TargetUpstairs)
+
+	clock.now = clock.now.Add(21 * time.Hour)
+	renewal("Jon Doe")
+	recorder.expect(t, AdminRenewalDue, TargetUpstairs)
+}
+
+func TestNotifyPowerLoss(t *testing.T) {
+	watcher, recorder, _ := NewTestWatcher()
+	power := func(value int) {
+		watcher.HandleAppEvent(&AppEvent{Ev: AppTerminalPower,
+			Target: TargetDownstairs, Value: value})
+	}
+	power(1)
+	recorder.expectNone(t)
+
+	power(0)
+	power(0) // Repeated status.
+	recorder.expect(t, AdminTerminalPower, TargetDownstairs)
+	recorder.expectNone(t)
+
+	power(1)
+	recorder.expect(t, AdminTerminalPower, TargetDownstairs)
+	recorder.expectNone(t)
+}
+
+func TestNotifyRepeatedFailedAttempts(t *testing.T) {
+	watcher, recorder, clock := NewTestWatcher()
+	denied := &AppEvent{Ev: AppAccessDenied, Target: TargetDownstairs}
+
+	// Spread out, these are just people mistyping.
+	for i := 0; i < 5; i++ {
+		watcher.HandleAppEvent(denied)
+		clock.now = clock.now.Add(40 * time.Second)
+	}
+	recorder.expectNone(t)
+
+	clock.now = clock.now.Add(time.Minute)
+	watcher.HandleAppEvent(denied)
+	watcher.HandleAppEvent(&AppEvent{Ev: AppAccessDenied, Target: TargetUpstairs})
+	watcher.HandleAppEvent(denied)
+	recorder.expectNone(t)
+	watcher.HandleAppEvent(denied)
+	recorder.expect(t, AdminFailedAttempts, TargetDownstairs)
+
+	// Counting starts anew.
+	watcher.HandleAppEvent(denied)
+	recorder.expectNone(t)
+}
+
+func TestNotifyTerminalOffline(t *testing.T) {
+	watcher, recorder, clock := NewTestWatcher()
+	watcher.HandleAppEvent(&AppEvent{Ev: AppTerminalDisconnect, Target: TargetUpstairs})
+	clock.now = clock.now.Add(time.Minute)
+	watcher.HandleAppEvent(&AppEvent{Ev: AppTerminalConnect, Target: TargetUpstairs})
+	clock.now = clock.now.Add(10 * time.Minute)
+	watcher.CheckOffline()
+	recorder.expectNone(t) // Quick reconnect is not news.
+
+	watcher.HandleAppEvent(&AppEvent{Ev: AppTerminalDisconnect, Target: TargetUpstairs})
+	clock.now = clock.now.Add(4 * time.Minute)
+	watcher.CheckOffline()
+	recorder.expectNone(t)
+	clock.now = clock.now.Add(2 * time.Minute)
+	watcher.CheckOffline()
+	recorder.expect(t, AdminTerminalOffline, TargetUpstairs)
+	watcher.CheckOffline()
+	recorder.expectNone(t) // Only once.
+
+	watcher.HandleAppEvent(&AppEvent{Ev: AppTerminalConnect, Target: TargetUpstairs})
+	recorder.expect(t, AdminTerminalOffline, TargetUpstairs) // Back online.
+}
+
+type FlakyNotifier struct {
+	failures  int
+	delivered chan AdminEvent
+}
+
+func (n *FlakyNotifier) Notify(event AdminEvent) error {
+	if n.failures > 0 {
+		n.failures--
+		return errors.New("flaky")
+	}
+	n.delivered <- event
+	return nil
+}
+
+func TestAsyncNotifierRetries(t *testing.T) {
+	flaky := &FlakyNotifier{failures: 2, delivered: make(chan AdminEvent, 1)}
+	notifier := NewAsyncNotifier(flaky, 3, time.Millisecond)
+	ExpectTrue(t, notifier.Notify(AdminEvent{Type: AdminUserAdded}) == nil,
+		"Queued")
+	select {
+	case event := <-flaky.delivered:
+		ExpectTrue(t, event.Type == AdminUserAdded, "Delivered event")
+	case <-time.After(time.Second):
+		t.Error("Expected delivery after retries")
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&received)
+		}))
+	defer server.Close()
+
+	notifier := NewSlackNotifier(server.URL)
+	err := notifier.Notify(AdminEvent{Type: AdminTerminalOffline,
+		Target: TargetDownstairs, Msg: "Offline since 12:00"})
+	ExpectTrue(t, err == nil, "Posted")
+	ExpectTrue(t, strings.Contains(received["text"],
+		"[terminal-offline] gate: Offline since 12:00"), "Message text")
+
+	notifier.Notify(AdminEvent{Type: AdminDuress, Urgent: true})
+	ExpectTrue(t, strings.HasPrefix(received["text"], "<!channel> "),
+		"Urgent alerts the channel")
+
+	server.Config.Handler = http.NotFoundHandler()
+	ExpectTrue(t, notifier.Notify(AdminEvent{}) != nil, "Error status")
+}
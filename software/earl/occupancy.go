@@ -0,0 +1,107 @@
+// Rough occupancy: who entered where recently.
+//
+// We only see people coming in, not leaving, so this can't tell who is
+// in the space. But "3 people entered upstairs in the last hour" is a good
+// hint for safety checks, e.g. before locking up. Fed by the AccessHandler
+// with every grant; entries older than the window are forgotten.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultOccupancyWindow = time.Hour
+
+type occupancyEntry struct {
+	who  string // Name of the user; empty if we don't know.
+	when time.Time
+}
+
+type Occupancy struct {
+	clock  Clock
+	window time.Duration
+
+	lock    sync.Mutex
+	entries map[Target][]occupancyEntry // Oldest first.
+}
+
+// Track entries within the given window; 0 for the default.
+func NewOccupancy(window time.Duration) *Occupancy {
+	if window <= 0 {
+		window = defaultOccupancyWindow
+	}
+	return &Occupancy{
+		clock:   RealClock{},
+		window:  window,
+		entries: make(map[Target][]occupancyEntry),
+	}
+}
+
+func (o *Occupancy) Window() time.Duration {
+	return o.window
+}
+
+// Record that the user was let in at target. Fine to call on a nil
+// Occupancy, which doesn't track anything.
+func (o *Occupancy) RecordEntry(target Target, user *User) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := o.clock.Now()
+	entries := o.expire(target, now)
+	who := ""
+	if user != nil {
+		who = user.Name
+	}
+	if who != "" {
+		// Coming in again only moves them to the end.
+		for i, entry := range entries {
+			if entry.who == who {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+	}
+	o.entries[target] = append(entries, occupancyEntry{who: who, when: now})
+}
+
+// Number of people who entered at target within the window. People
+// without a name are counted each time they enter.
+func (o *Occupancy) Count(target Target) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.expire(target, o.clock.Now()))
+}
+
+// Count() for all targets with any recent entries.
+func (o *Occupancy) Counts() map[Target]int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := o.clock.Now()
+	result := make(map[Target]int)
+	for target := range o.entries {
+		if count := len(o.expire(target, now)); count > 0 {
+			result[target] = count
+		}
+	}
+	return result
+}
+
+// Drop entries that are too old. Needs to be called with the lock held.
+func (o *Occupancy) expire(target Target, now time.Time) []occupancyEntry {
+	entries := o.entries[target]
+	keep := 0
+	for keep < len(entries) && now.Sub(entries[keep].when) >= o.window {
+		keep++
+	}
+	entries = entries[keep:]
+	if len(entries) == 0 {
+		delete(o.entries, target)
+		return nil
+	}
+	o.entries[target] = entries
+	return entries
+}
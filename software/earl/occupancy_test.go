@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOccupancyWindow(t *testing.T) {
+	clock := &MockClock{}
+	occupancy := NewOccupancy(time.Hour)
+	occupancy.clock = clock
+
+	occupancy.RecordEntry(TargetUpstairs, &User{Name: "Alice"})
+	clock.now = clock.now.Add(20 * time.Minute)
+	occupancy.RecordEntry(TargetUpstairs, &User{Name: "Bob"})
+	occupancy.RecordEntry(TargetDownstairs, &User{Name: "Bob"})
+	ExpectTrue(t, occupancy.Count(TargetUpstairs) == 2, "Two upstairs")
+	ExpectTrue(t, occupancy.Count(TargetDownstairs) == 1, "One downstairs")
+
+	// Coming in again counts once, but refreshes the time.
+	clock.now = clock.now.Add(20 * time.Minute)
+	occupancy.RecordEntry(TargetUpstairs, &User{Name: "Alice"})
+	ExpectTrue(t, occupancy.Count(TargetUpstairs) == 2, "Alice counted once")
+
+	// Without name, we can't tell people apart.
+	occupancy.RecordEntry(TargetUpstairs, &User{})
+	occupancy.RecordEntry(TargetUpstairs, &User{})
+	ExpectTrue(t, occupancy.Count(TargetUpstairs) == 4, "Anonymous entries")
+
+	// Bob entered 61 minutes ago and is forgotten; the rest still counts.
+	clock.now = clock.now.Add(41 * time.Minute)
+	counts := occupancy.Counts()
+	ExpectTrue(t, counts[TargetUpstairs] == 3, "Bob forgotten upstairs")
+	_, hasDownstairs := counts[TargetDownstairs]
+	ExpectFalse(t, hasDownstairs, "Nobody recently downstairs")
+
+	clock.now = clock.now.Add(time.Hour)
+	ExpectTrue(t, len(occupancy.Counts()) == 0, "Everyone forgotten")
+}
+
+func TestAccessHandlerRecordsOccupancy(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockbackends.occupancy = NewOccupancy(0)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	PressKeys(testFixture.handlerUnderTest, "654321#") // Denied.
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.FlushAllAppEvents()
+	ExpectTrue(t, testFixture.mockbackends.occupancy.Count(Target("mock")) == 1,
+		"Granted entry counted")
+}
@@ -0,0 +1,116 @@
+// First boot.
+//
+// Adding users takes a member, so a new installation without any would be
+// stuck. As long as there is no member, the first one can be added on the
+// control terminal: an unknown card shown there is offered to become the
+// first member (see uicontrolhandler.go). By default, this needs a
+// one-time token that is printed to the log, so that only whoever runs earl
+// can claim the space.
+//
+// Once there is a member, users are added as always. Should there be none
+// again later (the last one suspended, deleted, or edited out of the file),
+// a new token is made and logged the next time it is needed.
+package main
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+const provisionTokenDigits = 8 // Typed on the keypad.
+
+// Whether there is no member to add users. If a token is required and
+// there is none yet, makes one and logs it.
+func (a *FileBasedAuthenticator) NeedsProvisioning() bool {
+	if a.readOnly {
+		return false // The primary is to take care of it.
+	}
+	a.reloadIfStale()
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	if a.hasMemberRequiresLock() {
+		return false
+	}
+	if !a.provisionWithoutToken && a.provisionToken == "" {
+		token, err := randomDigits(provisionTokenDigits)
+		if err != nil {
+			// ProvisionMember() refuses without a token.
+			log.Printf("Couldn't create provisioning token: %v", err)
+			return true
+		}
+		a.provisionToken = token
+		log.Printf("No members. To add the first one, show their card on "+
+			"the control terminal and type %s#", token)
+	}
+	return true
+}
+
+func (a *FileBasedAuthenticator) ProvisionMember(token string, user User) (bool, string) {
+	if a.readOnly {
+		return false, errReplicaReadOnly.Error()
+	}
+	a.reloadIfChanged() // Someone might have added one by hand.
+	user.UserLevel = LevelMember
+	user.ValidFrom = a.clock.Now()
+	user.RegisteredAt = a.clock.Now()
+	user.ContactInfo = NormalizeContactInfo(user.ContactInfo)
+
+	a.userLock.Lock()
+	if a.hasMemberRequiresLock() {
+		a.userLock.Unlock()
+		return false, "There is a member already."
+	}
+	if !a.provisionWithoutToken && (a.provisionToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(a.provisionToken)) != 1) {
+		a.userLock.Unlock()
+		return false, "Wrong provisioning token."
+	}
+	a.revision++
+	if !a.addUserAtPosRequiresLock(&user, -1) {
+		a.userLock.Unlock()
+		return false, "Duplicate codes while adding user"
+	}
+	a.provisionToken = "" // One-time.
+	a.userLock.Unlock()
+
+	log.Printf("Provisioned first member '%s'", user.Name)
+	a.postUserEvent(AppUserAdded, &user)
+	return a.appendDatabaseSingleEntry(&user)
+}
+
+// Only members can add users; suspended ones can't.
+func (a *FileBasedAuthenticator) hasMemberRequiresLock() bool {
+	for _, user := range a.userList {
+		if user != nil && user.UserLevel == LevelMember && !user.Suspended {
+			return true
+		}
+	}
+	return false
+}
+
+// On first boot, there is no users file yet.
+func createFirstBootUserFile(filename string) {
+	if filename == "" {
+		return
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return
+	}
+	log.Printf("No users file %s; starting without users.", filename)
+	if err := ioutil.WriteFile(filename, nil, 0644); err != nil {
+		log.Printf("Couldn't create %s: %v", filename, err)
+	}
+}
+
+// Set whether the first member needs a token; at startup. If there is no
+// member yet, tells how to add one.
+func setUpProvisioning(auth *FileBasedAuthenticator, withToken bool) {
+	auth.provisionWithoutToken = !withToken
+	if !auth.NeedsProvisioning() || withToken {
+		return // NeedsProvisioning() logged the token.
+	}
+	log.Printf("No members yet. Anyone can make their card the first " +
+		"member on the control terminal.")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// The token NeedsProvisioning() logged.
+func loggedProvisioningToken(auth *FileBasedAuthenticator) string {
+	auth.userLock.Lock()
+	defer auth.userLock.Unlock()
+	return auth.provisionToken
+}
+
+func TestProvisionFirstMember(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "provisioning-tests")
+	defer os.RemoveAll(dir)
+	filename := dir + "/users.csv"
+	createFirstBootUserFile(filename)
+	auth := NewFileBasedAuthenticator(filename, NewApplicationBus())
+	if auth == nil {
+		t.Fatal("Empty users file not read")
+	}
+	setUpProvisioning(auth, true)
+	ExpectTrue(t, auth.NeedsProvisioning(), "Empty store needs provisioning")
+	token := loggedProvisioningToken(auth)
+	ExpectTrue(t, len(token) == provisionTokenDigits, "Token created")
+
+	u := User{Name: "First"}
+	u.SetAuthCode("first123")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("", u)), "Can't add without member")
+	ok, msg := auth.ProvisionMember("", u)
+	ExpectFalse(t, ok, "Token needed")
+	ExpectTrue(t, msg == "Wrong provisioning token.", "Told why: "+msg)
+	ExpectFalse(t, eatmsg(auth.ProvisionMember("1"+token, u)), "Wrong token")
+
+	ExpectTrue(t, eatmsg(auth.ProvisionMember(token, u)), "Provisioning")
+	ExpectFalse(t, auth.NeedsProvisioning(), "Done")
+	first := auth.FindUser("first123")
+	ExpectTrue(t, first != nil && first.UserLevel == LevelMember, "First is a member")
+
+	// From now on, as always.
+	u = User{Name: "Second"}
+	u.SetAuthCode("second123")
+	ExpectFalse(t, eatmsg(auth.ProvisionMember(token, u)), "Token used up")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("first123", u)), "Member adds user")
+
+	reloaded := NewFileBasedAuthenticator(filename, NewApplicationBus())
+	ExpectTrue(t, reloaded.FindUser("first123").UserLevel == LevelMember,
+		"Member written to file")
+	ExpectFalse(t, reloaded.NeedsProvisioning(), "Not after restart either")
+}
+
+func TestProvisioningRefusedWithMember(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "provisioning-member-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	ExpectFalse(t, auth.NeedsProvisioning(), "There is root")
+	u := User{Name: "Intruder"}
+	u.SetAuthCode("intruder123")
+	ok, msg := auth.ProvisionMember("", u)
+	ExpectFalse(t, ok, "Refused with a member")
+	ExpectTrue(t, msg == "There is a member already.", "Told why: "+msg)
+	ExpectTrue(t, auth.FindUser("intruder123") == nil, "Not added")
+
+	// Suspended members can't add users, so that doesn't count.
+	ExpectTrue(t, eatmsg(auth.SetSuspended("root123", "root123", true)), "Suspending")
+	ExpectTrue(t, auth.NeedsProvisioning(), "Only a suspended member")
+
+	// Still not without the token, made now that it is needed.
+	ok, msg = auth.ProvisionMember("", u)
+	ExpectFalse(t, ok, "Token needed once members are gone")
+	ExpectTrue(t, msg == "Wrong provisioning token.", "Told why: "+msg)
+	token := loggedProvisioningToken(auth)
+	ExpectTrue(t, len(token) == provisionTokenDigits, "Token made when needed")
+	ExpectTrue(t, eatmsg(auth.ProvisionMember(token, u)), "With the token")
+}
+
+func TestProvisionWithoutToken(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "provisioning-open-tests")
+	defer os.RemoveAll(dir)
+	filename := dir + "/users.csv"
+	createFirstBootUserFile(filename)
+	auth := NewFileBasedAuthenticator(filename, NewApplicationBus())
+	setUpProvisioning(auth, false)
+
+	u := User{Name: "First"}
+	u.SetAuthCode("first123")
+	ExpectTrue(t, eatmsg(auth.ProvisionMember("", u)), "Anyone, as configured")
+}
+
+func TestProvisionOnControlTerminal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "provisioning-ui-tests")
+	defer os.RemoveAll(dir)
+	filename := dir + "/users.csv"
+	createFirstBootUserFile(filename)
+	auth := NewFileBasedAuthenticator(filename, NewApplicationBus())
+	setUpProvisioning(auth, true)
+	token := loggedProvisioningToken(auth)
+	term := NewMockTerminal(t)
+	handler := NewControlHandler(&Backends{
+		authenticator: auth,
+		appEventBus:   NewApplicationBus(),
+		lockdown:      NewLockdown("", nil),
+	})
+	handler.Init(term)
+
+	handler.HandleRFID("first-card")
+	term.expectLCD(0, "No members: first one?")
+	PressKeys(handler, "42#")
+	term.expectLCD(0, "Trouble:Wrong provisioning token.")
+	ExpectTrue(t, handler.state == StateProvisionToken, "Can try again")
+	PressKeys(handler, token+"#")
+	term.expectLCD(0, "Welcome, first member!")
+	member := auth.FindUser("first-card")
+	ExpectTrue(t, member != nil && member.UserLevel == LevelMember, "Card is a member")
+
+	// Now it's like always.
+	handler.backToIdle()
+	handler.HandleRFID("other-card")
+	term.expectLCD(0, "      Unknown RFID")
+	handler.HandleRFID("first-card")
+	term.expectLCD(1, "[1]Add [2]Renew [3]Guest")
+}
@@ -0,0 +1,116 @@
+// The last access attempts at each terminal, for when someone says "it
+// didn't let me in": the status (see http-api.go) shows when they tried,
+// if it was granted and why not, without digging through the logs.
+//
+// Codes are kept scrubbed like in the log (see scrubLogValue()), so the
+// same code can be recognized and found in the log, but not recovered.
+// Only the last few attempts per terminal are kept, in memory.
+//
+// Also, for each code that got in, where and when it did last: "was this
+// card used at the gate or upstairs last night?". These are kept by the
+// hash of the code (see hashAuthCode()), in memory until restart.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultRecentAccessSize = 20
+
+type AccessRecord struct {
+	Time    time.Time `json:"time"`
+	Code    string    `json:"code"`   // Scrubbed.
+	Origin  string    `json:"origin"` // rfid, keypad, ...
+	Granted bool      `json:"granted"`
+	Reason  string    `json:"reason"` // ReasonCode.String()
+}
+
+// Where and when a code was last granted access.
+type LastUse struct {
+	Time     time.Time
+	Terminal Target
+}
+
+// Ring buffer of the records of one terminal.
+type accessRing struct {
+	records []AccessRecord // Up to size; wraps around.
+	next    int            // Where the next record goes, once full.
+}
+
+type RecentAccess struct {
+	clock Clock
+	size  int
+
+	lock     sync.Mutex
+	rings    map[Target]*accessRing
+	lastUses map[string]LastUse // By hashAuthCode() of the code.
+}
+
+// Keep the last size attempts per terminal; 0 for the default.
+func NewRecentAccess(size int) *RecentAccess {
+	if size <= 0 {
+		size = defaultRecentAccessSize
+	}
+	return &RecentAccess{
+		clock:    RealClock{},
+		size:     size,
+		rings:    make(map[Target]*accessRing),
+		lastUses: make(map[string]LastUse),
+	}
+}
+
+// Record an attempt with the code at the terminal. Fine to call on a nil
+// RecentAccess, which doesn't keep anything.
+func (r *RecentAccess) Record(terminal Target, code string, origin string,
+	decision AuthDecision) {
+	if r == nil {
+		return
+	}
+	record := AccessRecord{
+		Time:    r.clock.Now(),
+		Code:    scrubLogValue(code),
+		Origin:  origin,
+		Granted: decision.Granted,
+		Reason:  decision.Reason.String(),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if decision.Granted {
+		r.lastUses[hashAuthCode(code)] = LastUse{Time: record.Time, Terminal: terminal}
+	}
+	ring := r.rings[terminal]
+	if ring == nil {
+		ring = &accessRing{records: make([]AccessRecord, 0, r.size)}
+		r.rings[terminal] = ring
+	}
+	if len(ring.records) < r.size {
+		ring.records = append(ring.records, record)
+		return
+	}
+	ring.records[ring.next] = record
+	ring.next = (ring.next + 1) % r.size
+}
+
+// The records of each terminal, oldest first.
+func (r *RecentAccess) Snapshot() map[Target][]AccessRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make(map[Target][]AccessRecord)
+	for terminal, ring := range r.rings {
+		records := make([]AccessRecord, 0, len(ring.records))
+		records = append(records, ring.records[ring.next:]...)
+		records = append(records, ring.records[:ring.next]...)
+		result[terminal] = records
+	}
+	return result
+}
+
+// Where the code was last granted access since startup. Returns false if
+// it never was.
+func (r *RecentAccess) LastUse(code string) (LastUse, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	use, ok := r.lastUses[hashAuthCode(code)]
+	return use, ok
+}
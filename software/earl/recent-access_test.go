@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecentAccessKeepsLastN(t *testing.T) {
+	clock := &MockClock{}
+	recent := NewRecentAccess(3)
+	recent.clock = clock
+	for i := 1; i <= 5; i++ {
+		clock.now = clock.now.Add(time.Minute)
+		recent.Record(TargetUpstairs, fmt.Sprintf("code%d", i), "rfid",
+			AuthDecision{Granted: i%2 == 0, Reason: ReasonCode(i % 2)})
+	}
+	recent.Record(TargetDownstairs, "code1", "keypad", authGranted())
+
+	upstairs := recent.Snapshot()[TargetUpstairs]
+	ExpectTrue(t, len(upstairs) == 3, "Exactly the last 3")
+	for i, record := range upstairs {
+		ExpectTrue(t, record.Code == scrubLogValue(fmt.Sprintf("code%d", i+3)),
+			fmt.Sprintf("Oldest first, older evicted: %v", upstairs))
+	}
+	ExpectTrue(t, upstairs[2].Time.Equal(clock.now), "Time recorded")
+	ExpectFalse(t, upstairs[2].Granted, "Decision recorded")
+	ExpectTrue(t, upstairs[2].Reason == ReasonUnknownCode.String(), "Reason recorded")
+
+	downstairs := recent.Snapshot()[TargetDownstairs]
+	ExpectTrue(t, len(downstairs) == 1 && downstairs[0].Granted &&
+		downstairs[0].Origin == "keypad", "Each terminal by itself")
+	ExpectTrue(t, downstairs[0].Code != "code1", "Code scrubbed")
+}
+
+func TestRecentAccessConcurrent(t *testing.T) {
+	recent := NewRecentAccess(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				recent.Record(TargetUpstairs, "code", "rfid", authGranted())
+				recent.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	ExpectTrue(t, len(recent.Snapshot()[TargetUpstairs]) == 10, "Bounded")
+}
+
+func TestAccessHandlerRecordsAttempts(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockbackends.recentAccess = NewRecentAccess(0)
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	PressKeys(testFixture.handlerUnderTest, "654321#")
+
+	records := testFixture.mockbackends.recentAccess.Snapshot()[Target("mock")]
+	ExpectTrue(t, len(records) == 2, "Both attempts recorded")
+	ExpectTrue(t, records[0].Granted && records[0].Origin == "keypad", "Granted")
+	ExpectTrue(t, !records[1].Granted &&
+		records[1].Reason == ReasonUnknownCode.String(), "Denied")
+}
+
+func TestLastUseApi(t *testing.T) {
+	clock := &MockClock{now: time.Date(2024, 5, 1, 23, 15, 0, 0, time.UTC)}
+	recent := NewRecentAccess(0)
+	recent.clock = clock
+	recent.Record(TargetDownstairs, "abcd1234", "rfid", authGranted())
+	clock.now = clock.now.Add(time.Minute)
+	recent.Record(TargetUpstairs, "abcd1234", "rfid", authGranted())
+	recent.Record(TargetUpstairs, "unused12", "rfid", AuthDecision{Reason: ReasonUnknownCode})
+
+	auth := NewMockAuthenticator()
+	auth.users["member-rfid"] = &User{Name: "Root", UserLevel: LevelMember}
+	auth.users["user-rfid"] = &User{Name: "Jon Doe", UserLevel: LevelUser}
+	api := &ApiServer{auth: auth, recent: recent}
+	post := func(form url.Values) (int, JsonLastUse) {
+		req := httptest.NewRequest("POST", "/api/last-use",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, req)
+		var result JsonLastUse
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		return recorder.Code, result
+	}
+
+	status, used := post(url.Values{"code": {"ABCD1234"}, "member": {"member-rfid"}})
+	ExpectTrue(t, status == http.StatusOK, "Member may look up")
+	ExpectTrue(t, used.Target == TargetUpstairs, "Last terminal")
+	ExpectTrue(t, used.LastUse == "2024-05-01T23:16:00Z", "Last time: "+used.LastUse)
+
+	// Denied attempts don't count as use.
+	status, never := post(url.Values{"code": {"unused12"}, "member": {"member-rfid"}})
+	ExpectTrue(t, status == http.StatusOK, "Lookup of unused code")
+	ExpectTrue(t, never.LastUse == "never" && never.Target == "", "Never used")
+
+	// Others get what an unused code gets, so they can't tell whether
+	// they guessed a member's code.
+	status, refused := post(url.Values{"code": {"abcd1234"}, "member": {"user-rfid"}})
+	ExpectTrue(t, status == http.StatusOK && refused.LastUse == "never" &&
+		refused.Target == "", "Users may not")
+	status, refused = post(url.Values{"code": {"abcd1234"}})
+	ExpectTrue(t, status == http.StatusOK && refused.LastUse == "never",
+		"Nor anyone without code")
+
+	// Guessing member codes.
+	for i := 2; i < apiFailedAttempts; i++ {
+		post(url.Values{"code": {"abcd1234"}, "member": {"guess"}})
+	}
+	status, _ = post(url.Values{"code": {"abcd1234"}, "member": {"member-rfid"}})
+	ExpectTrue(t, status == http.StatusTooManyRequests, "Throttled")
+}
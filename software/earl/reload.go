@@ -0,0 +1,117 @@
+// Reloading on SIGHUP, as operators expect from a daemon: the config file
+// is read again and so is the users file, without dropping the terminal
+// connections.
+//
+// What changes is what the backends decide with: the schedules and renewal
+// grace of the authenticator, and the settings of each terminal's handler
+// (doors, feedback, durations, policies; see configureAccessHandler()).
+// A decision under way finishes with what it started with; the next one
+// sees the new config and users together (see
+// FileBasedAuthenticator.Reload()). The handlers pick up their new
+// settings in their own event loop when they see AppConfigReloaded, or when
+// their terminal reconnects, in case it was away during the reload.
+//
+// Everything else still needs a restart, e.g. which terminals there are,
+// their name, target and serial connection settings (keypad, rfid-format,
+// timeouts), the pins and door sensors, and services such as remote auth,
+// notifications or the replica.
+//
+// A config file that doesn't read or validate is reported, and we keep
+// running with what we have.
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// The config in effect; replaced as a whole on reload.
+type LiveConfig struct {
+	lock   sync.Mutex
+	config *Config
+}
+
+func NewLiveConfig(config *Config) *LiveConfig {
+	return &LiveConfig{config: config}
+}
+
+func (c *LiveConfig) Set(config *Config) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config = config
+}
+
+// The config of the terminal on the device, as now in effect. Returns
+// false if there is none (anymore). Fine to call on a nil LiveConfig.
+func (c *LiveConfig) Terminal(device string) (TerminalConfig, bool) {
+	if c == nil {
+		return TerminalConfig{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, terminal := range c.config.Terminals {
+		if terminal.Device == device {
+			return terminal, true
+		}
+	}
+	return TerminalConfig{}, false
+}
+
+type Reloader struct {
+	configFile   string                  // Empty: only terminalArgs.
+	terminalArgs []string                // From the commandline, see AddTerminalArgs().
+	auth         *FileBasedAuthenticator // nil with remote-auth.
+	backends     *Backends
+}
+
+// Read the config and users again and hand them to the backends.
+func (r *Reloader) Reload() error {
+	config := &Config{}
+	if r.configFile != "" {
+		var err error
+		if config, err = ReadConfigFile(r.configFile); err != nil {
+			return err
+		}
+	}
+	if err := AddTerminalArgs(config, r.terminalArgs, os.Getenv); err != nil {
+		return err
+	}
+	if r.auth != nil {
+		r.auth.Reload(config.Schedules, time.Duration(config.RenewalGrace))
+	}
+	r.backends.config.Set(config)
+	r.backends.appEventBus.Post(&AppEvent{
+		Ev:     AppConfigReloaded,
+		Source: "reload",
+		Msg:    "Reloaded config and users",
+	})
+	return nil
+}
+
+// Like Terminal(), but falls back to the given config, e.g. the one we
+// started with, if there is none.
+func (c *LiveConfig) TerminalOr(fallback TerminalConfig) TerminalConfig {
+	if config, ok := c.Terminal(fallback.Device); ok {
+		return config
+	}
+	return fallback
+}
+
+// Apply the config of its terminal to a handler again, after a reload or
+// on reconnect. Only call from the handler's event loop, or while it isn't
+// running.
+func reconfigureHandler(handler TerminalEventHandler, target Target,
+	config TerminalConfig) {
+	switch h := handler.(type) {
+	case *AccessHandler:
+		configureAccessHandler(h, target, config)
+	case *ElevatorHandler:
+		configureAccessHandler(h.AccessHandler, target, config)
+	case *UIControlHandler:
+		configureControlHandler(h, config)
+		if h.colorOffTime.IsZero() {
+			h.showIdleColor() // Might be another color now.
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, filename string, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Writing config: %v", err)
+	}
+}
+
+func TestReloadTakesEffectForNextAuth(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "reload-users")
+	configFile, _ := ioutil.TempFile("", "reload-config")
+	configFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(configFile.Name())
+	}
+	mockClock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	u := User{Name: "Lapsed Member", ContactInfo: "l@nb", UserLevel: LevelMember,
+		ValidFrom: mockClock.now.Add(-365 * 24 * time.Hour),
+		ValidTo:   mockClock.now.Add(-time.Hour)}
+	u.SetAuthCode("lapsed123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding member")
+	ExpectFalse(t, auth.AuthUser("lapsed123", TargetUpstairs).Granted, "Expired")
+
+	writeTestConfig(t, configFile.Name(), `{
+  "renewal-grace": "168h",
+  "terminals": [
+    { "device": "/dev/ttyAMA0", "feedback": { "granted": { "color": "B" } } }
+  ]
+}`)
+	// Someone added a user by hand, too quick for the file to look changed.
+	added := User{Name: "Added By Hand", ContactInfo: "h@nb", UserLevel: LevelMember}
+	added.SetAuthCode("byhand123")
+	file, _ := os.OpenFile(authFile.Name(), os.O_APPEND|os.O_WRONLY, 0644)
+	writer := csv.NewWriter(file)
+	added.WriteCSV(writer)
+	writer.Flush()
+	file.Close()
+
+	backends := &Backends{
+		authenticator: auth,
+		appEventBus:   NewApplicationBus(),
+		config:        NewLiveConfig(&Config{}),
+	}
+	reloader := &Reloader{
+		configFile: configFile.Name(),
+		auth:       auth,
+		backends:   backends,
+	}
+	events := make(AppEventChannel, 10)
+	backends.appEventBus.Subscribe(events)
+	ExpectTrue(t, reloader.Reload() == nil, "Reloaded")
+
+	decision := auth.AuthUser("lapsed123", TargetUpstairs)
+	ExpectTrue(t, decision.Granted && decision.RenewalDue, "New renewal grace")
+	ExpectTrue(t, auth.FindUser("byhand123") != nil, "Users file re-read")
+	terminal, ok := backends.config.Terminal("/dev/ttyAMA0")
+	ExpectTrue(t, ok && terminal.Feedback[FeedbackGranted].Color == "B",
+		"New terminal config")
+	backends.appEventBus.Flush()
+	select {
+	case event := <-events:
+		ExpectTrue(t, event.Ev == AppConfigReloaded, "Reload announced")
+	default:
+		t.Errorf("Expected reload event")
+	}
+
+	// A broken config is not taken.
+	writeTestConfig(t, configFile.Name(), `{"renewal-grace": "-1h"}`)
+	ExpectTrue(t, reloader.Reload() != nil, "Invalid config reported")
+	ExpectTrue(t, auth.AuthUser("lapsed123", TargetUpstairs).Granted, "Kept grace")
+}
+
+func TestReloadUpdatesHandlerFeedback(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	config := NewLiveConfig(&Config{})
+	wrapped := &terminalHandlerAdapter{
+		TerminalEventHandler: testFixture.handlerUnderTest,
+		target:               Target("mock"),
+		bus:                  testFixture.mockbackends.appEventBus,
+		device:               "/dev/ttyAMA0",
+		config:               config,
+	}
+	config.Set(&Config{Terminals: []TerminalConfig{{
+		Device: "/dev/ttyAMA0",
+		Feedback: FeedbackProfile{
+			FeedbackGranted: {Color: ColorBlue, ColorDuration: Duration(time.Second)},
+		},
+	}}})
+	wrapped.HandleAppEvent(&AppEvent{Ev: AppConfigReloaded})
+
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = ReasonOK
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	ExpectTrue(t, testFixture.mockterm.currentColor == ColorBlue, "New granted color")
+}
@@ -0,0 +1,409 @@
+// Delegating access decisions to an external system, e.g. the web app or
+// payment provider that keeps track of memberships. Configured in the
+// config file instead of using the users file:
+//
+//	"remote-auth": {
+//	  "url": "https://members.example.org/earl/auth",
+//	  "timeout": "2s", "cache-time": "168h",
+//	  "cache-file": "/var/lib/earl/remote-auth-cache.json",
+//	  "when-unreachable": "closed"
+//	}
+//
+// For each decision, we POST
+//
+//	{"code": "<hashed code>", "target": "gate", "check": true}
+//
+// The code is hashed like in the users file (see hashAuthCode()), so the
+// backend never sees PINs or card IDs. "check" is true as long as this is
+// no access attempt: the terminals decide first, and once the door opened,
+// report the access with the same request and "check": false. The answer
+// to that report is not used. The backend answers with 200 and
+//
+//	{"granted": true, "reason": "ok", "duress": false,
+//	 "user": {"name": "Jane", "level": "member",
+//	          "valid-to": "2024-06-01T00:00:00Z"}}
+//
+// where reason is one of the ReasonCode strings, e.g. "expired" or
+// "unknown-code", and valid-to is optional.
+//
+// An internet outage shouldn't lock everyone out, so answers are cached.
+// When the backend is unreachable or answers with an error, we decide as
+// it did last time for the same code and target, if that was within
+// cache-time and the user is still valid. Otherwise, "closed" (default)
+// denies and "open" lets in anyone with a code that looks valid - only for
+// places that are staffed anyway. The lockdown applies on top of either.
+//
+// With a cache-file, the cache is written through to it, so it survives a
+// restart during an outage. To spare the SD card, an answer that didn't
+// change is only written again after cacheRewriteInterval, so after a
+// restart, entries can seem up to that much older than they are. How often
+// the cache helped is in the status of the HTTP API.
+//
+// Users are managed in the external system, so adding, changing and
+// deleting users on the control terminal doesn't work.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRemoteAuthTimeout   = 2 * time.Second
+	defaultRemoteAuthCacheTime = 7 * 24 * time.Hour
+	cacheRewriteInterval       = time.Hour
+
+	RemoteAuthFailClosed = "closed"
+	RemoteAuthFailOpen   = "open"
+
+	// We only expect a small JSON object.
+	maxRemoteAuthResponse = 64 << 10
+)
+
+var errRemoteManaged = errors.New("Users are managed in the remote system.")
+
+type RemoteAuthConfig struct {
+	URL string `json:"url"`
+
+	// Waiting for the backend before it counts as unreachable; someone
+	// is standing at the door. 0 for default.
+	Timeout Duration `json:"timeout"`
+
+	// How long a decision of the backend is used while it is
+	// unreachable. 0 for default.
+	CacheTime Duration `json:"cache-time"`
+
+	// Where to keep the cache across restarts. Optional.
+	CacheFile string `json:"cache-file"`
+
+	// Without a cached decision: "closed" (default) or "open".
+	WhenUnreachable string `json:"when-unreachable"`
+}
+
+func (c *RemoteAuthConfig) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("remote-auth: missing url")
+	}
+	if c.Timeout < 0 || c.CacheTime < 0 {
+		return fmt.Errorf("remote-auth: durations can't be negative")
+	}
+	switch c.WhenUnreachable {
+	case "", RemoteAuthFailClosed, RemoteAuthFailOpen:
+		return nil
+	}
+	return fmt.Errorf("remote-auth: when-unreachable needs to be '%s' or '%s', got '%s'",
+		RemoteAuthFailClosed, RemoteAuthFailOpen, c.WhenUnreachable)
+}
+
+type remoteAuthRequest struct {
+	Code   string `json:"code"`
+	Target Target `json:"target"`
+	Check  bool   `json:"check"`
+}
+
+type remoteAuthResponse struct {
+	Granted bool            `json:"granted"`
+	Reason  string          `json:"reason"`
+	Duress  bool            `json:"duress"`
+	User    *remoteAuthUser `json:"user,omitempty"`
+}
+
+type remoteAuthUser struct {
+	Name    string    `json:"name"`
+	Level   Level     `json:"level"`
+	ValidTo time.Time `json:"valid-to"` // Zero if not given.
+}
+
+// An answer of the backend, and when it was given. As written to the
+// cache file.
+type cachedAnswer struct {
+	Answer remoteAuthResponse `json:"answer"`
+	At     time.Time          `json:"at"`
+}
+
+// How the cache did while the backend was unreachable.
+type AuthCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`   // Decided as the backend did before.
+	Misses  uint64 `json:"misses"` // Code not in the cache.
+	Stale   uint64 `json:"stale"`  // Too old, or the user expired since.
+}
+
+type RemoteAuthenticator struct {
+	url       string
+	cacheTime time.Duration
+	failOpen  bool
+	client    *http.Client
+	clock     Clock
+	lockdown  *Lockdown // Optional. If set, consulted in AuthUser()
+
+	lock      sync.Mutex
+	cache     map[string]cachedAnswer // By target and hashed code.
+	cacheFile string                  // Optional.
+	stats     AuthCacheStats
+	lastError error // Of the last request; nil if ok.
+}
+
+func NewRemoteAuthenticator(config RemoteAuthConfig) *RemoteAuthenticator {
+	a := &RemoteAuthenticator{
+		url:       config.URL,
+		cacheTime: time.Duration(config.CacheTime),
+		failOpen:  config.WhenUnreachable == RemoteAuthFailOpen,
+		client:    &http.Client{Timeout: time.Duration(config.Timeout)},
+		clock:     RealClock{},
+		cache:     make(map[string]cachedAnswer),
+		cacheFile: config.CacheFile,
+	}
+	if a.client.Timeout <= 0 {
+		a.client.Timeout = defaultRemoteAuthTimeout
+	}
+	if a.cacheTime <= 0 {
+		a.cacheTime = defaultRemoteAuthCacheTime
+	}
+	a.readCache()
+	return a
+}
+
+func (a *RemoteAuthenticator) readCache() {
+	if a.cacheFile == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(a.cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't read remote auth cache: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(content, &a.cache); err != nil {
+		log.Printf("%s: %v; starting with empty cache", a.cacheFile, err)
+		a.cache = make(map[string]cachedAnswer)
+	}
+}
+
+func (a *RemoteAuthenticator) writeCacheRequiresLock() error {
+	if a.cacheFile == "" {
+		return nil
+	}
+	content, err := json.Marshal(a.cache)
+	if err != nil {
+		return err
+	}
+	tmpFile := a.cacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, a.cacheFile)
+}
+
+func (a *RemoteAuthenticator) CacheStats() AuthCacheStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	stats := a.stats
+	stats.Entries = len(a.cache)
+	return stats
+}
+
+func (a *RemoteAuthenticator) AuthUser(code string, target Target) AuthDecision {
+	return a.decide(code, target, false)
+}
+
+func (a *RemoteAuthenticator) CheckCode(code string, target Target) AuthDecision {
+	return a.decide(code, target, true)
+}
+
+// Report the access to the backend; it already decided with CheckCode().
+func (a *RemoteAuthenticator) RecordAccess(user *User, target Target) {
+	if len(user.Codes) == 0 {
+		return
+	}
+	request := remoteAuthRequest{Code: user.Codes[0], Target: target, Check: false}
+	if _, err := a.ask(request); err != nil {
+		log.Printf("Remote auth: can't report access: %v", err)
+	}
+}
+
+// What the backend knows about the user, whatever the target.
+func (a *RemoteAuthenticator) FindUser(code string) *User {
+	return a.decide(code, "", true).User
+}
+
+func (a *RemoteAuthenticator) decide(code string, target Target, check bool) AuthDecision {
+	if !hasMinimalCodeRequirements(code) {
+		return authDenied(ReasonUnknownCode, "Auth failed: too short code.")
+	}
+	hashed := hashAuthCode(rfidEnrollmentCode(code))
+	key := string(target) + ":" + hashed
+	answer, err := a.ask(remoteAuthRequest{Code: hashed, Target: target, Check: check})
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lastError = err
+	var decision AuthDecision
+	if err != nil {
+		log.Printf("Remote auth: %v", err)
+		decision = a.offlineDecisionRequiresLock(key, hashed)
+	} else {
+		decision = answer.decision(hashed)
+		a.rememberRequiresLock(key, answer)
+	}
+	if decision.Granted && a.lockdown != nil {
+		level := Level("")
+		if decision.User != nil {
+			level = decision.User.UserLevel
+		}
+		if !a.lockdown.Allows(level) {
+			user := decision.User
+			decision = authDenied(ReasonLockdown,
+				fmt.Sprintf("Lockdown (%s)", a.lockdown.Mode()))
+			decision.User = user
+		}
+	}
+	return decision
+}
+
+// Write-through: the cache file is updated right away, unless the answer
+// is the same as before and was written recently.
+func (a *RemoteAuthenticator) rememberRequiresLock(key string, answer remoteAuthResponse) {
+	now := a.clock.Now()
+	previous, known := a.cache[key]
+	a.cache[key] = cachedAnswer{Answer: answer, At: now}
+	if known && reflect.DeepEqual(previous.Answer, answer) &&
+		now.Sub(previous.At) < cacheRewriteInterval {
+		a.cache[key] = previous // What's in the file.
+		return
+	}
+	if err := a.writeCacheRequiresLock(); err != nil {
+		log.Printf("Can't write remote auth cache: %v", err)
+	}
+}
+
+func (a *RemoteAuthenticator) offlineDecisionRequiresLock(key string, hashed string) AuthDecision {
+	now := a.clock.Now()
+	cached, ok := a.cache[key]
+	switch {
+	case !ok:
+		a.stats.Misses++
+	case now.Sub(cached.At) >= a.cacheTime:
+		a.stats.Stale++
+	case cached.Answer.Granted && cached.Answer.User != nil &&
+		!cached.Answer.User.ValidTo.IsZero() && !cached.Answer.User.ValidTo.After(now):
+		a.stats.Stale++
+		decision := authDenied(ReasonExpired,
+			"Backend unreachable, user expired since last asked")
+		decision.User = cached.Answer.User.asUser(hashed)
+		return decision
+	default:
+		a.stats.Hits++
+		decision := cached.Answer.decision(hashed)
+		decision.Detail = "Backend unreachable, as decided before: " + decision.Detail
+		return decision
+	}
+	if a.failOpen {
+		decision := authGranted()
+		decision.Detail = "Backend unreachable, failing open"
+		decision.User = unnamedRemoteUser("<offline>", hashed)
+		return decision
+	}
+	return authDenied(ReasonBackendDown, "Backend unreachable")
+}
+
+func (a *RemoteAuthenticator) ask(request remoteAuthRequest) (remoteAuthResponse, error) {
+	var answer remoteAuthResponse
+	body, err := json.Marshal(request)
+	if err != nil {
+		return answer, err
+	}
+	response, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return answer, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return answer, fmt.Errorf("backend answered %s", response.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, maxRemoteAuthResponse)).Decode(&answer)
+	if err != nil {
+		return answer, fmt.Errorf("invalid answer from backend: %v", err)
+	}
+	return answer, nil
+}
+
+// The decision for the (hashed) code the backend answered for.
+func (answer *remoteAuthResponse) decision(hashed string) AuthDecision {
+	decision := authGranted()
+	if !answer.Granted {
+		reason, ok := ParseReasonCode(answer.Reason)
+		if !ok || reason == ReasonOK {
+			reason = ReasonUnknownCode
+		}
+		decision = authDenied(reason, "Denied by backend: "+answer.Reason)
+	}
+	decision.Duress = answer.Duress
+	if answer.User != nil {
+		decision.User = answer.User.asUser(hashed)
+	} else if decision.Granted {
+		decision.User = unnamedRemoteUser("<remote>", hashed)
+	}
+	return decision
+}
+
+// Whoever is granted without the backend telling who: the handlers need a
+// user to welcome. Names in <> are not shown, and the level is the least
+// one let in.
+func unnamedRemoteUser(name string, hashed string) *User {
+	return &User{Name: name, UserLevel: LevelUser, Codes: []string{hashed}}
+}
+
+func (u *remoteAuthUser) asUser(hashed string) *User {
+	return &User{
+		Name:      u.Name,
+		UserLevel: u.Level,
+		ValidTo:   u.ValidTo,
+		Codes:     []string{hashed},
+	}
+}
+
+func (a *RemoteAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
+	return false, errRemoteManaged.Error()
+}
+
+func (a *RemoteAuthenticator) UpdateUser(authentication_code string, user_code string, updater_fun ModifyFun) (bool, string) {
+	return false, errRemoteManaged.Error()
+}
+
+func (a *RemoteAuthenticator) DeleteUser(authentication_code string, user_code string) (bool, string) {
+	return false, errRemoteManaged.Error()
+}
+
+func (a *RemoteAuthenticator) SetSuspended(authentication_code string, user_code string, suspended bool) (bool, string) {
+	return false, errRemoteManaged.Error()
+}
+
+func (a *RemoteAuthenticator) CreateGuestCode(authentication_code string, duration time.Duration, target Target) (string, error) {
+	return "", errRemoteManaged
+}
+
+func (a *RemoteAuthenticator) NeedsProvisioning() bool {
+	return false
+}
+
+func (a *RemoteAuthenticator) ProvisionMember(token string, user User) (bool, string) {
+	return false, errRemoteManaged.Error()
+}
+
+// The backend being unreachable, if it was on the last request.
+func (a *RemoteAuthenticator) StoreError() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.lastError
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A membership system that knows a member, a guest and an expired user.
+type fakeAuthBackend struct {
+	lock     sync.Mutex
+	down     bool
+	requests []remoteAuthRequest
+}
+
+func (b *fakeAuthBackend) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.down {
+		http.Error(out, "maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	var request remoteAuthRequest
+	json.NewDecoder(req.Body).Decode(&request)
+	b.requests = append(b.requests, request)
+	switch request.Code {
+	case hashAuthCode("member123"):
+		out.Write([]byte(`{"granted": true, "reason": "ok",
+			"user": {"name": "Jane", "level": "member"}}`))
+	case hashAuthCode("guest123"):
+		out.Write([]byte(`{"granted": true, "reason": "ok",
+			"user": {"name": "Guest", "level": "guest",
+				"valid-to": "2024-05-01T18:00:00Z"}}`))
+	case hashAuthCode("13572468"):
+		out.Write([]byte(`{"granted": true, "reason": "ok"}`))
+	case hashAuthCode("user123"):
+		out.Write([]byte(`{"granted": false, "reason": "expired",
+			"user": {"name": "Joe", "level": "user"}}`))
+	default:
+		out.Write([]byte(`{"granted": false, "reason": "unknown-code"}`))
+	}
+}
+
+func (b *fakeAuthBackend) setDown(down bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.down = down
+}
+
+func newRemoteAuthFixture(config RemoteAuthConfig) (*RemoteAuthenticator,
+	*fakeAuthBackend, *MockClock, func()) {
+	backend := &fakeAuthBackend{}
+	server := httptest.NewServer(backend)
+	config.URL = server.URL
+	auth := NewRemoteAuthenticator(config)
+	clock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	auth.clock = clock
+	return auth, backend, clock, server.Close
+}
+
+func TestRemoteAuthGrantAndDeny(t *testing.T) {
+	auth, backend, _, stop := newRemoteAuthFixture(RemoteAuthConfig{})
+	defer stop()
+
+	decision := auth.AuthUser("member123", TargetDownstairs)
+	ExpectTrue(t, decision.Granted && decision.Reason == ReasonOK, "Granted")
+	ExpectTrue(t, decision.User != nil && decision.User.Name == "Jane" &&
+		decision.User.UserLevel == LevelMember, "User")
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonExpired)
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, ReasonUnknownCode)
+	ExpectTrue(t, auth.FindUser("member123").Name == "Jane", "FindUser")
+	ExpectTrue(t, auth.FindUser("nobody123") == nil, "FindUser unknown")
+	ExpectTrue(t, auth.StoreError() == nil, "No error")
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	first := backend.requests[0]
+	ExpectTrue(t, first.Code == hashAuthCode("member123"), "Code is hashed")
+	ExpectTrue(t, first.Target == TargetDownstairs && !first.Check, "Request")
+	ExpectTrue(t, backend.requests[len(backend.requests)-1].Check,
+		"FindUser is no access attempt")
+	backend.lock.Unlock()
+
+	decision = auth.CheckCode("13572468", TargetUpstairs)
+	auth.RecordAccess(decision.User, TargetUpstairs)
+	backend.lock.Lock()
+	reported := backend.requests[len(backend.requests)-1]
+	ExpectTrue(t, reported.Code == hashAuthCode("13572468") &&
+		reported.Target == TargetUpstairs && !reported.Check,
+		"Access reported, also without user")
+
+	ok, _ := auth.AddNewUser("member123", User{Name: "New"})
+	ExpectFalse(t, ok, "Users are managed remotely")
+}
+
+func TestRemoteAuthBackendDown(t *testing.T) {
+	auth, backend, clock, stop := newRemoteAuthFixture(RemoteAuthConfig{
+		CacheTime: Duration(time.Hour)})
+	defer stop()
+
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonExpired)
+	backend.setDown(true)
+
+	// Decided as before, as long as it's in the cache.
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonExpired)
+	ExpectTrue(t, auth.StoreError() != nil, "Error reported")
+	ExpectAuthResult(t, auth, "member123", TargetUpstairs, ReasonBackendDown)
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, ReasonBackendDown)
+	clock.now = clock.now.Add(time.Hour)
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, ReasonBackendDown)
+
+	backend.setDown(false)
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, ReasonOK)
+	ExpectTrue(t, auth.StoreError() == nil, "Back up")
+}
+
+func TestRemoteAuthFailOpen(t *testing.T) {
+	auth, backend, _, stop := newRemoteAuthFixture(RemoteAuthConfig{
+		WhenUnreachable: RemoteAuthFailOpen})
+	defer stop()
+	auth.lockdown = NewLockdown("", nil)
+
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonExpired)
+	backend.setDown(true)
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonExpired)
+	ExpectAuthResult(t, auth, "abc", TargetDownstairs, ReasonUnknownCode)
+
+	// Not in a lockdown, though.
+	auth.lockdown.SetMode(LockdownMembersOnly, "test")
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, ReasonLockdown)
+}
+
+func TestRemoteAuthCacheSurvivesRestart(t *testing.T) {
+	cacheFile, _ := ioutil.TempFile("", "remote-auth-cache")
+	cacheFile.Close()
+	os.Remove(cacheFile.Name()) // Not there on first start.
+	defer os.Remove(cacheFile.Name())
+	config := RemoteAuthConfig{CacheFile: cacheFile.Name()}
+	auth, backend, clock, stop := newRemoteAuthFixture(config)
+	defer stop()
+
+	// Populated while online.
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "guest123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, ReasonExpired)
+	ExpectTrue(t, auth.CacheStats() == AuthCacheStats{Entries: 3},
+		"Nothing served from the cache while online")
+
+	// Restarted during an outage.
+	backend.setDown(true)
+	config.URL = auth.url
+	restarted := NewRemoteAuthenticator(config)
+	restarted.clock = clock
+	clock.now = clock.now.Add(7 * time.Hour)
+	ExpectAuthResult(t, restarted, "member123", TargetDownstairs, ReasonOK)
+	ExpectAuthResult(t, restarted, "user123", TargetDownstairs, ReasonExpired)
+	ExpectAuthResult(t, restarted, "guest123", TargetDownstairs, ReasonExpired)
+	ExpectAuthResult(t, restarted, "member123", TargetUpstairs, ReasonBackendDown)
+	clock.now = clock.now.Add(defaultRemoteAuthCacheTime)
+	ExpectAuthResult(t, restarted, "member123", TargetDownstairs, ReasonBackendDown)
+	stats := restarted.CacheStats()
+	if stats != (AuthCacheStats{Entries: 3, Hits: 2, Misses: 1, Stale: 2}) {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+}
+
+func TestRemoteGrantWithoutUserAtTerminal(t *testing.T) {
+	auth, backend, _, stop := newRemoteAuthFixture(RemoteAuthConfig{
+		WhenUnreachable: RemoteAuthFailOpen})
+	defer stop()
+	testFixture := NewTestFixture(t)
+	testFixture.mockbackends.authenticator = auth
+
+	// The backend doesn't say who it is.
+	PressKeys(testFixture.handlerUnderTest, "13572468#")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.mockterm.expectLCD(0, "Welcome")
+	testFixture.mockterm.expectLCD(1, "")
+
+	// Failing open while the backend is down.
+	backend.setDown(true)
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
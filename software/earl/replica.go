@@ -0,0 +1,201 @@
+// Read-only replica of the users of another Earl.
+//
+// With more than one site (or a standby), the users are managed on one
+// Earl, the primary, and the others just follow. A replica periodically
+// pulls the users from the primary's /api/users (see http-api.go), which
+// needs the token the primary has as "users-export-token":
+//
+//	"replica": {
+//	  "primary": "http://earl-main.noise:8080",
+//	  "token": "<users-export-token of the primary>",
+//	  "interval": "5m"
+//	}
+//
+// The users are written to the local users file, from which the
+// authenticator reads them as usual; it refuses all changes, as they would
+// be overwritten with the next sync anyway.
+//
+// If a sync fails, e.g. the primary is down or the data arrived
+// incomplete, the users file is left alone, so people keep getting in with
+// the last good data.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicaInterval = 5 * time.Minute
+	replicaSyncTimeout     = 30 * time.Second
+)
+
+var errReplicaReadOnly = errors.New("Users are managed on the primary.")
+
+type ReplicaConfig struct {
+	// Base URL of the primary's HTTP API.
+	Primary string `json:"primary"`
+
+	// The users-export-token of the primary.
+	Token string `json:"token"`
+
+	// Time between syncs. 0 for default.
+	Interval Duration `json:"interval"`
+}
+
+func (c *ReplicaConfig) Validate() error {
+	if c.Primary == "" {
+		return fmt.Errorf("replica: missing primary")
+	}
+	if u, err := url.Parse(c.Primary); err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("replica: primary needs to be an http(s) URL, got '%s'", c.Primary)
+	}
+	if c.Token == "" {
+		return fmt.Errorf("replica: missing token")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("replica: interval can't be negative")
+	}
+	return nil
+}
+
+// How the syncing goes, for the status.
+type ReplicaStatus struct {
+	Primary   string     `json:"primary"`
+	LastSync  *time.Time `json:"last-sync,omitempty"` // Last successful.
+	LastError string     `json:"last-error,omitempty"`
+}
+
+type ReplicaSync struct {
+	config   ReplicaConfig
+	filename string // The users file we keep up to date.
+	client   *http.Client
+	clock    Clock
+
+	lock      sync.Mutex // Protects the following.
+	lastSync  time.Time
+	lastError error
+}
+
+func NewReplicaSync(config ReplicaConfig, userFilename string) *ReplicaSync {
+	if config.Interval == 0 {
+		config.Interval = Duration(defaultReplicaInterval)
+	}
+	return &ReplicaSync{
+		config:   config,
+		filename: userFilename,
+		client:   &http.Client{Timeout: replicaSyncTimeout},
+		clock:    RealClock{},
+	}
+}
+
+// Sync every interval. Call after the initial Sync().
+func (r *ReplicaSync) Run() {
+	for range time.Tick(time.Duration(r.config.Interval)) {
+		r.Sync()
+	}
+}
+
+// Fetch the users from the primary and, if they look complete, replace
+// the users file with them.
+func (r *ReplicaSync) Sync() error {
+	err := r.fetchAndStore()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		log.Printf("Replica: couldn't sync users from %s: %v (keeping what we have)",
+			r.config.Primary, err)
+	} else {
+		r.lastSync = r.clock.Now()
+	}
+	r.lastError = err
+	return err
+}
+
+func (r *ReplicaSync) Status() ReplicaStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	status := ReplicaStatus{Primary: r.config.Primary}
+	if !r.lastSync.IsZero() {
+		lastSync := r.lastSync
+		status.LastSync = &lastSync
+	}
+	if r.lastError != nil {
+		status.LastError = r.lastError.Error()
+	}
+	return status
+}
+
+func (r *ReplicaSync) fetchAndStore() error {
+	req, err := http.NewRequest("GET", strings.TrimRight(r.config.Primary, "/")+"/api/users", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.config.Token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded %s", resp.Status)
+	}
+	// Fails if the connection drops before the announced length.
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := validateReplicaUsers(data); err != nil {
+		return err
+	}
+	if current, err := ioutil.ReadFile(r.filename); err == nil && bytes.Equal(current, data) {
+		return nil // Unchanged; don't make the authenticator reload.
+	}
+	tmpFilename := r.filename + ".replica-tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, r.filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	log.Printf("Replica: updated %s from %s", r.filename, r.config.Primary)
+	return nil
+}
+
+// The primary writes complete lines only, so any line we can't read means
+// the data is damaged. No users at all is more likely a problem on the
+// primary than everyone leaving.
+func validateReplicaUsers(data []byte) error {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return fmt.Errorf("incomplete users data")
+	}
+	reader := NewUserCSVReader(bytes.NewReader(data))
+	users := 0
+	for {
+		user, done := reader.Next()
+		if reader.Err() != nil {
+			return fmt.Errorf("users data line %d: %v", reader.Line(), reader.Err())
+		}
+		if done {
+			break
+		}
+		if user != nil {
+			users++
+		}
+	}
+	if users == 0 {
+		return fmt.Errorf("no users in data")
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const testExportToken = "s3cret"
+
+// A primary with root123 and doe123, serving its users.
+func newTestPrimary(t *testing.T) (*FileBasedAuthenticator, *ApiServer, func()) {
+	authFile, _ := ioutil.TempFile("", "test-primary")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	u := User{Name: "Jon Doe", UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	ok, msg := auth.AddNewUser("root123", u)
+	ExpectTrue(t, ok, "Adding user on primary: "+msg)
+	api := &ApiServer{auth: auth}
+	api.ExportUsers(testExportToken)
+	return auth, api, func() {
+		if !keepGeneratedFiles {
+			syscall.Unlink(authFile.Name())
+		}
+	}
+}
+
+func newReplicaFile() string {
+	replicaFile, _ := ioutil.TempFile("", "test-replica")
+	replicaFile.Close()
+	return replicaFile.Name()
+}
+
+func TestReplicaSync(t *testing.T) {
+	primary, api, cleanup := newTestPrimary(t)
+	defer cleanup()
+	server := httptest.NewServer(api)
+	defer server.Close()
+	replicaFile := newReplicaFile()
+	defer os.Remove(replicaFile)
+
+	sync := NewReplicaSync(ReplicaConfig{Primary: server.URL, Token: testExportToken},
+		replicaFile)
+	ExpectTrue(t, sync.Sync() == nil, "Initial sync")
+	ExpectTrue(t, sync.Status().LastSync != nil, "Sync time in status")
+	replica := NewReadOnlyFileBasedAuthenticator(replicaFile, NewApplicationBus())
+	ExpectTrue(t, replica != nil, "Reading synced users")
+	replica.fileCheckInterval = 0 // See each sync right away.
+	ExpectTrue(t, replica.FindUser("root123") != nil, "Member synced")
+	ExpectTrue(t, replica.FindUser("doe123") != nil, "User synced")
+
+	// Changes are for the primary.
+	u := User{Name: "Jane Doe", UserLevel: LevelUser}
+	u.SetAuthCode("jane123")
+	ok, msg := replica.AddNewUser("root123", u)
+	ExpectFalse(t, ok, "Adding user on replica")
+	ExpectTrue(t, msg == errReplicaReadOnly.Error(), "Told why: "+msg)
+	ok, _ = replica.DeleteUser("root123", "doe123")
+	ExpectFalse(t, ok, "Deleting user on replica")
+	ok, _ = replica.SetSuspended("root123", "doe123", true)
+	ExpectFalse(t, ok, "Suspending user on replica")
+	_, err := replica.CreateGuestCode("root123", 0, TargetUpstairs)
+	ExpectTrue(t, err == errReplicaReadOnly, "Guest code on replica")
+
+	// ... from where they make it to the replica.
+	ok, msg = primary.DeleteUser("root123", "doe123")
+	ExpectTrue(t, ok, "Deleting on primary: "+msg)
+	ExpectTrue(t, sync.Sync() == nil, "Second sync")
+	ExpectTrue(t, replica.FindUser("doe123") == nil, "Deletion synced")
+	ExpectTrue(t, replica.FindUser("root123") != nil, "Member still there")
+}
+
+func TestReplicaFailedSyncKeepsData(t *testing.T) {
+	_, api, cleanup := newTestPrimary(t)
+	defer cleanup()
+	failure := ""
+	server := httptest.NewServer(http.HandlerFunc(
+		func(out http.ResponseWriter, req *http.Request) {
+			switch failure {
+			case "down":
+				out.WriteHeader(http.StatusInternalServerError)
+			case "truncated":
+				recorder := httptest.NewRecorder()
+				api.ServeHTTP(recorder, req)
+				body := recorder.Body.String()
+				out.Header().Set("Content-Length", recorder.Header().Get("Content-Length"))
+				out.Write([]byte(body[:len(body)/2]))
+			case "damaged":
+				recorder := httptest.NewRecorder()
+				api.ServeHTTP(recorder, req)
+				out.Write([]byte(strings.Replace(recorder.Body.String(),
+					",user,", ",wizard,", 1)))
+			case "empty":
+				out.Write([]byte("# earl-users schema 2\n"))
+			default:
+				api.ServeHTTP(out, req)
+			}
+		}))
+	defer server.Close()
+	replicaFile := newReplicaFile()
+	defer os.Remove(replicaFile)
+
+	sync := NewReplicaSync(ReplicaConfig{Primary: server.URL, Token: testExportToken},
+		replicaFile)
+	ExpectTrue(t, sync.Sync() == nil, "Initial sync")
+	lastSync := *sync.Status().LastSync
+	good, _ := ioutil.ReadFile(replicaFile)
+	replica := NewReadOnlyFileBasedAuthenticator(replicaFile, NewApplicationBus())
+
+	wrongToken := NewReplicaSync(ReplicaConfig{Primary: server.URL, Token: "guess"},
+		replicaFile)
+	ExpectTrue(t, wrongToken.Sync() != nil, "Wrong token refused")
+
+	for _, failure = range []string{"down", "truncated", "damaged", "empty"} {
+		ExpectTrue(t, sync.Sync() != nil, "Failing sync: "+failure)
+		current, _ := ioutil.ReadFile(replicaFile)
+		ExpectTrue(t, string(current) == string(good), "File kept: "+failure)
+		ExpectTrue(t, replica.FindUser("doe123") != nil, "User kept: "+failure)
+		status := sync.Status()
+		ExpectTrue(t, status.LastError != "", "Error in status: "+failure)
+		ExpectTrue(t, status.LastSync.Equal(lastSync), "Last good sync: "+failure)
+	}
+
+	failure = ""
+	ExpectTrue(t, sync.Sync() == nil, "Recovered")
+	ExpectTrue(t, sync.Status().LastError == "", "Error cleared")
+}
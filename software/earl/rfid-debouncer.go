@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+)
+
+// RFID readers report a card over and over again while it is held in front
+// of them. The RFIDDebouncer lets us act on a card only once: a card is
+// considered removed once it has not been reported for a while, only then
+// it is acted on again.
+//
+// Two cards held to the reader at about the same time are reported
+// interleaved. Once a card is held with Hold(), other cards are ignored
+// until it is removed, so a passerby's card can't cut into someone's swipe.
+type RFIDDebouncer struct {
+	gap      time.Duration // Absence after which a card counts as removed.
+	lastRFID string
+	lastSeen time.Time
+
+	held     string // Card we're locked onto; empty if none.
+	heldSeen time.Time
+}
+
+func NewRFIDDebouncer(gap time.Duration) *RFIDDebouncer {
+	return &RFIDDebouncer{gap: gap}
+}
+
+// Report a card seen at the given time. Returns true if it should be acted
+// on, i.e. it is a different card or the same card after it was removed.
+func (d *RFIDDebouncer) ShouldHandle(rfid string, now time.Time) bool {
+	if d.held != "" && now.Sub(d.heldSeen) >= d.gap {
+		d.held = "" // Removed.
+	}
+	if d.held != "" && rfid != d.held {
+		return false // Someone else's card while the first is still there.
+	}
+	if rfid == d.held {
+		d.heldSeen = now
+	}
+	isRepeat := rfid == d.lastRFID && now.Sub(d.lastSeen) < d.gap
+	d.lastRFID = rfid
+	d.lastSeen = now
+	return !isRepeat
+}
+
+// Lock onto the card just handled: ignore other cards until it is removed.
+func (d *RFIDDebouncer) Hold(rfid string, now time.Time) {
+	d.held = rfid
+	d.heldSeen = now
+}
@@ -0,0 +1,73 @@
+// Schedules.
+//
+// Each target can have its own open hours, on top of the hours of each
+// user's level (see User.AccessHours()). Outside these, only those with
+// all-hour access get in, or nobody at all. Configured per target in the
+// config file, e.g.
+//
+//	"schedules": {
+//	  "upstairs": { "from": 9, "to": 22 },
+//	  "elevator": { "from": 7, "to": 24, "after-hours": "nobody" }
+//	}
+//
+// Targets without a schedule are open all day; the level alone decides.
+package main
+
+import (
+	"fmt"
+)
+
+// Who may come in outside the open hours of a target.
+const (
+	// Members and philanthropists, who have all-hour access. Default.
+	AfterHoursMembers = "members"
+
+	// Nobody; the target is closed.
+	AfterHoursNobody = "nobody"
+)
+
+type TargetSchedule struct {
+	// Open hours [From, To), e.g. 9 and 22 for 9:00..21:59. Both 0 means
+	// all day.
+	From int `json:"from"`
+	To   int `json:"to"`
+
+	// "members" (default) or "nobody".
+	AfterHours string `json:"after-hours"`
+}
+
+func (s TargetSchedule) Validate() error {
+	if s.From < 0 || s.From > 24 || s.To < 0 || s.To > 24 || s.From > s.To {
+		return fmt.Errorf("open hours need to be 0 <= from <= to <= 24; got %d..%d",
+			s.From, s.To)
+	}
+	switch s.AfterHours {
+	case "", AfterHoursMembers, AfterHoursNobody:
+	default:
+		return fmt.Errorf("unknown after-hours policy '%s'; one of '%s', '%s'",
+			s.AfterHours, AfterHoursMembers, AfterHoursNobody)
+	}
+	return nil
+}
+
+func (s TargetSchedule) IsOpen(hour int) bool {
+	if s.From == 0 && s.To == 0 {
+		return true
+	}
+	return hour >= s.From && hour < s.To
+}
+
+// Check the schedule for a user that their level already lets in at this
+// hour.
+func (s TargetSchedule) Check(user *User, hour int) AuthDecision {
+	if s.IsOpen(hour) {
+		return authGranted()
+	}
+	allHours := user.UserLevel == LevelMember ||
+		user.UserLevel == LevelPhilanthropist
+	if allHours && s.AfterHours != AfterHoursNobody {
+		return authGranted()
+	}
+	return authDenied(ReasonOutsideDaytime,
+		fmt.Sprintf("Outside open hours %d:00..%d:00", s.From, s.To))
+}
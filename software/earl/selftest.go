@@ -0,0 +1,165 @@
+// Self-test of the outputs, run at startup with -selftest.
+//
+// A strike wired backwards or to the wrong pin goes unnoticed until someone
+// is locked out. The self-test pulses each output briefly, one after the
+// other, and logs it, so the person installing can watch (or listen) and
+// see that the right thing happens. Configured in the "self-test" section
+// of the config file, e.g.
+//
+//	"self-test": { "pulse": "300ms", "doors": ["gate"], "bells": ["gate"],
+//	               "confirm": true }
+//
+// With confirm, each step is shown on the control terminal, where the
+// operator answers if it worked; the answers end up in the log.
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	defaultSelfTestPulse = 300 * time.Millisecond
+
+	// Long enough to see a strike click, too short to walk in.
+	maxSelfTestPulse = 1 * time.Second
+
+	selfTestStepGap        = 1 * time.Second  // Between outputs.
+	selfTestConfirmTimeout = 60 * time.Second // Per step.
+	selfTestRepostTime     = 5 * time.Second  // For late control terminals.
+)
+
+type SelfTestConfig struct {
+	Pulse  Duration `json:"pulse"`  // How long to switch on each output. 0: default.
+	Doors  []Target `json:"doors"`  // Strikes to test. Empty: all.
+	Floors []int    `json:"floors"` // Elevator floors to test. Empty: all.
+	Bells  []Target `json:"bells"`  // Doorbells to ring. Empty: none.
+
+	// Ask the operator on the control terminal if each step worked.
+	Confirm bool `json:"confirm"`
+}
+
+func (c *SelfTestConfig) Validate() error {
+	if c.Pulse < 0 || time.Duration(c.Pulse) > maxSelfTestPulse {
+		return fmt.Errorf("self-test pulse needs to be at most %s",
+			maxSelfTestPulse)
+	}
+	return nil
+}
+
+// Values of AppSelfTestConfirm.
+const (
+	SelfTestFailed = 0
+	SelfTestWorked = 1
+)
+
+// The outcome of one step of the self-test.
+type SelfTestResult struct {
+	Output string // e.g. "strike gate (pin 7)"
+	Result string // "ok", "FAILED", "unconfirmed" or "done" without confirm.
+}
+
+// Pulse the outputs given in config one after the other, and log the
+// results. With config.Confirm, waits for the operator's answer for each
+// step on the bus.
+func (g *GPIOActions) SelfTest(config SelfTestConfig, bus *ApplicationBus) []SelfTestResult {
+	pulse := time.Duration(config.Pulse)
+	if pulse <= 0 {
+		pulse = defaultSelfTestPulse
+	}
+	var answers AppEventChannel
+	if config.Confirm {
+		answers = make(AppEventChannel, 10)
+		bus.Subscribe(answers)
+		defer bus.Unsubscribe(answers)
+	}
+
+	var results []SelfTestResult
+	step := func(output string, action func()) {
+		log.Printf("Self-test: %s", output)
+		action()
+		result := "done"
+		if config.Confirm {
+			result = g.awaitSelfTestConfirm(bus, answers, output)
+		} else {
+			time.Sleep(selfTestStepGap)
+		}
+		log.Printf("Self-test: %s: %s", output, result)
+		results = append(results, SelfTestResult{Output: output, Result: result})
+	}
+
+	doors := config.Doors
+	if len(doors) == 0 {
+		for door := range g.doorPins {
+			doors = append(doors, door)
+		}
+		sort.Slice(doors, func(i, j int) bool { return doors[i] < doors[j] })
+	}
+	for _, door := range doors {
+		gpio_pin, ok := g.doorPins[door]
+		if !ok || gpio_pin <= 0 {
+			log.Printf("Self-test: no strike for '%s'", door)
+			continue
+		}
+		step(fmt.Sprintf("strike %s (pin %d)", door, gpio_pin),
+			func() { g.pulseRelay(gpio_pin, pulse) })
+	}
+
+	floors := config.Floors
+	if len(floors) == 0 {
+		for floor := range g.floorPins {
+			floors = append(floors, floor)
+		}
+		sort.Ints(floors)
+	}
+	for _, floor := range floors {
+		gpio_pin, ok := g.floorPins[floor]
+		if !ok {
+			log.Printf("Self-test: no pin for floor %d", floor)
+			continue
+		}
+		step(fmt.Sprintf("floor %d (pin %d)", floor, gpio_pin),
+			func() { g.pulseRelay(gpio_pin, pulse) })
+	}
+
+	for _, bell := range config.Bells {
+		step(fmt.Sprintf("bell %s", bell), func() { g.playBell(bell) })
+	}
+	return results
+}
+
+// Ask the operator on the control terminal if the step worked. The
+// question is repeated every now and then, in case the control terminal
+// connects only after we started.
+func (g *GPIOActions) awaitSelfTestConfirm(bus *ApplicationBus,
+	answers AppEventChannel, output string) string {
+	ask := func() {
+		bus.Post(&AppEvent{
+			Ev:     AppSelfTestStep,
+			Source: "selftest",
+			Msg:    output,
+		})
+	}
+	ask()
+	repost := time.NewTicker(selfTestRepostTime)
+	defer repost.Stop()
+	timeout := time.After(selfTestConfirmTimeout)
+	for {
+		select {
+		case event := <-answers:
+			if event.Ev != AppSelfTestConfirm || event.Msg != output {
+				continue
+			}
+			if event.Value == SelfTestWorked {
+				return "ok"
+			}
+			return "FAILED"
+		case <-repost.C:
+			ask()
+		case <-timeout:
+			return "unconfirmed"
+		}
+	}
+}
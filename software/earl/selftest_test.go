@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelfTestWithConfirmation(t *testing.T) {
+	bus := NewApplicationBus()
+	gpio := &GPIOActions{
+		doorPins:  map[Target]int{TargetUpstairs: 11, TargetDownstairs: 7},
+		floorPins: map[int]int{2: 23},
+	}
+	// The operator at the control terminal: the gate works, the floor
+	// doesn't.
+	control := NewControlHandler(&Backends{
+		authenticator: NewMockAuthenticator(),
+		appEventBus:   bus,
+	})
+	term := NewMockTerminal(t)
+	control.Init(term)
+	steps := make(AppEventChannel, 10)
+	bus.Subscribe(steps)
+	prompts := make(chan string, 10) // What the operator saw.
+	go func() {
+		for event := range steps {
+			if event.Ev != AppSelfTestStep {
+				continue
+			}
+			control.HandleAppEvent(event)
+			prompts <- term.lcd[0]
+			if event.Msg == "floor 2 (pin 23)" {
+				PressKeys(control, "0")
+			} else {
+				PressKeys(control, "#")
+			}
+		}
+	}()
+
+	results := gpio.SelfTest(SelfTestConfig{
+		Pulse:   Duration(time.Millisecond),
+		Doors:   []Target{TargetDownstairs},
+		Confirm: true,
+	}, bus)
+	expected := []SelfTestResult{
+		{"strike gate (pin 7)", "ok"},
+		{"floor 2 (pin 23)", "FAILED"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected results %v, got %v", expected, results)
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], results[i])
+		}
+	}
+	for _, prompt := range []string{"Test: strike gate (pin 7)",
+		"Test: floor 2 (pin 23)"} {
+		if seen := <-prompts; seen != prompt {
+			t.Errorf("Expected prompt '%s', got '%s'", prompt, seen)
+		}
+	}
+}
+
+func TestSelfTestPulseIsShort(t *testing.T) {
+	ExpectTrue(t, (&SelfTestConfig{}).Validate() == nil, "Default pulse")
+	ExpectFalse(t, (&SelfTestConfig{Pulse: Duration(5 * time.Second)}).Validate() == nil,
+		"Pulse long enough to walk in")
+}
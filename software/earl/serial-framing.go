@@ -0,0 +1,56 @@
+// Line framing on the serial line.
+//
+// The terminal protocol is line based: each request, response and event is
+// one line, starting with the command letter. The firmware we started with
+// reads '\n' terminated lines and sends '\r\n', but other firmware variants
+// differ. The LineCodec is the only place that knows about that, so a new
+// firmware is a matter of the "line-terminator" in the config.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Line terminator names as used in the config.
+const (
+	LineTerminatorLF   = "lf"   // '\n', the default.
+	LineTerminatorCRLF = "crlf" // '\r\n'
+	LineTerminatorCR   = "cr"   // '\r'
+)
+
+type LineCodec struct {
+	terminator string // Appended to lines we send.
+}
+
+// Codec for the terminator with the given name; empty for the default.
+func NewLineCodec(name string) (*LineCodec, error) {
+	switch name {
+	case "", LineTerminatorLF:
+		return &LineCodec{terminator: "\n"}, nil
+	case LineTerminatorCRLF:
+		return &LineCodec{terminator: "\r\n"}, nil
+	case LineTerminatorCR:
+		return &LineCodec{terminator: "\r"}, nil
+	}
+	return nil, fmt.Errorf("unknown line-terminator '%s' (%s, %s or %s)",
+		name, LineTerminatorLF, LineTerminatorCRLF, LineTerminatorCR)
+}
+
+// The byte that ends a line when reading.
+func (c *LineCodec) Delimiter() byte {
+	return c.terminator[len(c.terminator)-1]
+}
+
+// The bytes to send for a line.
+func (c *LineCodec) Encode(line string) []byte {
+	return []byte(line + c.terminator)
+}
+
+// The line contained in raw bytes read up to and including Delimiter().
+// Line ending characters are removed on both ends, so that a terminal that
+// sends a different terminator than we expect still results in clean
+// lines, just possibly an additional empty one.
+func (c *LineCodec) Decode(raw []byte) string {
+	return strings.Trim(string(raw), "\r\n")
+}
@@ -2,69 +2,292 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/tarm/goserial"
 	"io"
-	"log"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	unknownFirmwareVersion = "unknown"
+
+	// Lines from the terminal are short (the firmware has a 64 byte
+	// line buffer). Anything much longer is garbage from a confused line.
+	maxSerialLineLength = 128
+
+	// Number of events and responses we queue up for the consumer.
+	defaultEventBufferSize = 10
+
+	// If we haven't heard from the terminal in this time, ping it. If it
+	// doesn't answer a ping within the timeout maxFailedPings times in a
+	// row, we consider it gone.
+	defaultHeartbeatInterval = 2 * time.Second
+	defaultPingTimeout       = 1 * time.Second
+	maxFailedPings           = 2
+
+	// Responses not matching the request we skip before giving up on
+	// the terminal.
+	defaultSkipUnexpectedResponses = 3
+
+	// Longest tone we ask for, so that a bug or a typo in the config
+	// can't leave the buzzer blaring.
+	defaultMaxToneDuration = 3 * time.Second
+
+	// On connect, we discard whatever the terminal sends until it has
+	// been quiet for discardQuietTime, but not longer than maxDiscardTime.
+	discardQuietTime = 200 * time.Millisecond
+	maxDiscardTime   = 3 * time.Second
+	discardPollTime  = 20 * time.Millisecond
+)
+
+// Whether the firmware can write both LCD rows with one 'W' command. We
+// only find out on first use.
+type lcdBatchSupport int
+
+const (
+	lcdBatchUnknown = lcdBatchSupport(iota)
+	lcdBatchSupported
+	lcdBatchUnsupported
+)
+
+// What a terminal tells about itself in its answer to the 'n'ame request:
+//
+//	n<name> [<key>=<value> ...]
+//
+// Known keys are lcd=<columns>x<rows> (or lcd=none), led=none, buzzer=none
+// and features=<list>, a comma separated list of flags such as lcd-batch.
+// Unknown keys are kept
+// in Fields, so that newer firmware doesn't confuse us. Older firmware
+// only sends the name; then the whole rest of the line is the name.
+type TerminalInfo struct {
+	Name       string
+	LCDColumns int // 0 if not reported.
+	LCDRows    int
+	NoLCD      bool // Reported lcd=none.
+	Features   map[string]bool
+	Fields     map[string]string // All key=value pairs, as reported.
+}
+
+// Feature flags in TerminalInfo.
+const (
+	terminalFeatureLCDBatch = "lcd-batch" // Knows 'W'.
+)
+
+// The hardware the terminal told us about.
+func (info TerminalInfo) Capabilities() TerminalCapabilities {
+	result := FullTerminalCapabilities()
+	result.LED = info.Fields["led"] != "none"
+	result.Buzzer = info.Fields["buzzer"] != "none"
+	result.LCD = !info.NoLCD
+	if !result.LCD {
+		result.LCDColumns, result.LCDRows = 0, 0
+	} else if info.LCDColumns > 0 {
+		result.LCDColumns, result.LCDRows = info.LCDColumns, info.LCDRows
+	}
+	return result
+}
+
+// Parse the answer to 'n', without the leading 'n'.
+func ParseTerminalInfo(response string) TerminalInfo {
+	response = strings.TrimSpace(response)
+	info := TerminalInfo{Name: response}
+	tokens := strings.Fields(response)
+	if len(tokens) < 2 {
+		return info
+	}
+	fields := make(map[string]string)
+	for _, token := range tokens[1:] {
+		equals := strings.Index(token, "=")
+		if equals <= 0 {
+			return info // Not structured; a name with spaces.
+		}
+		fields[token[:equals]] = token[equals+1:]
+	}
+	info.Name = tokens[0]
+	info.Fields = fields
+	if lcd, ok := fields["lcd"]; ok {
+		if lcd == "none" {
+			info.NoLCD = true
+		} else {
+			fmt.Sscanf(lcd, "%dx%d", &info.LCDColumns, &info.LCDRows)
+		}
+	}
+	if features := fields["features"]; features != "" {
+		info.Features = make(map[string]bool)
+		for _, feature := range strings.Split(features, ",") {
+			info.Features[feature] = true
+		}
+	}
+	return info
+}
+
+// A row showing a WriteLCDTemporary() text.
+type temporaryLCDLine struct {
+	restore string    // What was shown before.
+	until   time.Time // Zero if nothing temporary is shown.
+}
+
 type SerialTerminal struct {
+	// For Stats(). Atomic, so first: only the start of a struct is
+	// 64-bit aligned on 32-bit platforms such as the Raspberry Pi.
+	commandsSent   uint64
+	commandErrors  uint64
+	eventsReceived uint64
+
 	serialFile      io.ReadWriteCloser
-	responseChannel chan string // Strings coming as response to requests
-	eventChannel    chan string // Strings representing input events.
-	errorState      bool
+	responseChannel chan string        // Strings coming as response to requests
+	eventChannel    chan string        // Strings representing input events.
+	errorState      int32              // Set once the connection failed. Atomic.
 	name            string             // The name of the terminal e.g. 'upstairs'
+	info            TerminalInfo       // As reported on connect.
+	firmwareVersion string             // As reported by the terminal.
 	lastLCDContent  [maxLCDRows]string // last content sent to lcd
-	logPrefix       string
+	lcdUnsupported  bool               // Firmware built without LCD.
+	lcdBatch        lcdBatchSupport    // Firmware knows 'W'?
+	pendingToneAcks int                // 'T' sent, but not acknowledged.
+	temporaryLCD    [maxLCDRows]temporaryLCDLine
+	logger          *Logger
+	ctx             context.Context // Cancels blocking requests.
+	codec           *LineCodec
+	keypad          KeypadLayout
+	rfidFormat      *WiegandFormat // Raw frames to check; nil: IDs.
+	clock           Clock
+
+	lastActivity      int64 // UnixNano of last line received. Atomic.
+	lastInput         int64 // UnixNano of last bytes, even garbage. Atomic.
+	heartbeatInterval time.Duration
+	pingTimeout       time.Duration
+	failedPings       int // Consecutive pings without answer.
+	skipResponses     int // Unexpected responses to skip per request.
+
+	// Old firmware drops commands that come too quickly after another;
+	// we wait at least commandGap after the last one.
+	commandGap  time.Duration
+	lastCommand time.Time
+	sleep       func(time.Duration)
+
+	maxToneDuration time.Duration // Longer tones are cut to this.
 }
 
-func NewSerialTerminal(port string, baudrate int) (*SerialTerminal, error) {
-	t := &SerialTerminal{
-		errorState:      false,
-		eventChannel:    make(chan string, 10),
-		responseChannel: make(chan string, 10),
-		logPrefix:       fmt.Sprintf("%s:%d", port, baudrate),
-	}
-	c := &serial.Config{Name: port, Baud: baudrate}
-	var err error
-	t.serialFile, err = serial.OpenPort(c)
+func NewSerialTerminal(config TerminalConfig) (*SerialTerminal, error) {
+	return NewSerialTerminalContext(context.Background(), config)
+}
+
+// Like NewSerialTerminal(), but cancelling the context aborts the
+// connect and any later request to the terminal, e.g. on shutdown.
+func NewSerialTerminalContext(ctx context.Context,
+	config TerminalConfig) (*SerialTerminal, error) {
+	c := &serial.Config{Name: config.Device, Baud: config.Baud}
+	serialFile, err := serial.OpenPort(c)
 	if err != nil {
 		return nil, err
 	}
-	go t.inputScanLoop()
+	return connectSerialTerminal(ctx, serialFile, config)
+}
+
+// Talk to the terminal on the given port, and ask for its name and firmware
+// version. On failure, the port is closed.
+func connectSerialTerminal(ctx context.Context, serialFile io.ReadWriteCloser,
+	config TerminalConfig) (*SerialTerminal, error) {
+	t, err := newSerialTerminalOnPort(serialFile, config)
+	if err != nil {
+		serialFile.Close()
+		return nil, err
+	}
+	t.ctx = ctx
 	t.discardInitialInput()
-	t.name = t.requestName()
-	if t.errorState {
+	t.info = t.requestInfo()
+	t.name = t.info.Name
+	if t.inErrorState() {
 		t.shutdown()
 		return nil, errors.New("Couldn't get name of terminal.")
 	}
+	t.logger = t.logger.With("terminal", t.name)
+	t.applyTerminalInfo()
+	t.firmwareVersion = t.RequestFirmwareVersion()
+	return t, nil
+}
+
+// Create terminal talking to the given port and start reading from it.
+func newSerialTerminalOnPort(serialFile io.ReadWriteCloser,
+	config TerminalConfig) (*SerialTerminal, error) {
+	codec, err := NewLineCodec(config.LineTerminator)
+	if err != nil {
+		return nil, err
+	}
+	keypad, err := ParseKeypadLayout(config.Keypad)
+	if err != nil {
+		return nil, err
+	}
+	rfidFormat, err := ParseRFIDFormat(config.RFIDFormat)
+	if err != nil {
+		return nil, err
+	}
+	bufferSize := config.EventBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultEventBufferSize
+	}
+	t := &SerialTerminal{
+		serialFile:        serialFile,
+		eventChannel:      make(chan string, bufferSize),
+		responseChannel:   make(chan string, bufferSize),
+		logger:            (&Logger{}).With("device", config.DeviceString()),
+		ctx:               context.Background(),
+		codec:             codec,
+		keypad:            keypad,
+		rfidFormat:        rfidFormat,
+		clock:             RealClock{},
+		heartbeatInterval: time.Duration(config.HeartbeatInterval),
+		pingTimeout:       time.Duration(config.PingTimeout),
+		commandGap:        time.Duration(config.CommandGap),
+		sleep:             time.Sleep,
+		maxToneDuration:   time.Duration(config.MaxToneDuration),
+	}
+	if t.heartbeatInterval <= 0 {
+		t.heartbeatInterval = defaultHeartbeatInterval
+	}
+	if t.pingTimeout <= 0 {
+		t.pingTimeout = defaultPingTimeout
+	}
+	if t.maxToneDuration <= 0 {
+		t.maxToneDuration = defaultMaxToneDuration
+	}
+	switch {
+	case config.SkipUnexpectedResponses == 0:
+		t.skipResponses = defaultSkipUnexpectedResponses
+	case config.SkipUnexpectedResponses > 0:
+		t.skipResponses = config.SkipUnexpectedResponses
+	}
+	t.markActivity()
+	// The reader keeps its own logger: ours changes once we know the name.
+	go t.inputScanLoop(t.logger)
 	return t, nil
 }
 
 // Deliver events received from the hardware to the TerminalEventHandler.
-// Run until we encounter an IO problem or we can't verify to be
-// connected anymore. So the only reason for this loop exiting would be
-// an error condition.
-func (t *SerialTerminal) RunEventLoop(handler TerminalEventHandler,
-	appEventBus *ApplicationBus) {
-	var tick_count uint32
-	lastTickTime := time.Now()
+// Run until we encounter an IO problem or the terminal stops answering our
+// heartbeat pings. So the only reason for this loop exiting would be
+// an error condition or the context being cancelled.
+func (t *SerialTerminal) RunEventLoop(ctx context.Context,
+	handler TerminalEventHandler, appEventBus *ApplicationBus) {
+	t.ctx = ctx // Requests by the handler are cancelled with the loop.
 	handler.Init(t)
 	defer handler.HandleShutdown()
 	appEvents := make(AppEventChannel, 2)
 	appEventBus.Subscribe(appEvents)
 	defer appEventBus.Unsubscribe(appEvents)
-	for !t.errorState {
-		// If the events come in very quickly, the idle tick might
-		// be starved. So make sure to inject some.
-		if time.Now().Sub(lastTickTime) > 4*idleTickTime {
-			handler.HandleTick()
-			lastTickTime = time.Now()
-		}
+	// Ticks come on a steady cadence, independent of how busy we are with
+	// events: timeouts and rate limiting in the handler depend on it.
+	// (If both are ready, select picks randomly, so a flood of events
+	// can't starve the ticker.)
+	ticker := time.NewTicker(idleTickTime)
+	defer ticker.Stop()
+	for !t.inErrorState() {
 		select {
 		case line := <-t.eventChannel:
 			switch {
@@ -73,167 +296,609 @@ func (t *SerialTerminal) RunEventLoop(handler TerminalEventHandler,
 					handler.HandleRFID(rfid)
 				}
 			case line[0] == 'K':
-				handler.HandleKeypress(line[1])
+				if len(line) < 2 || line[1] <= ' ' {
+					t.logger.Warnf("Malformed keypress '%s'", line)
+					continue
+				}
+				if !deliverKeypress(handler, t.keypad, line[1]) {
+					t.logger.Warnf("Unknown key '%c'", line[1])
+				}
+			case line[0] == 'P':
+				if len(line) < 2 || (line[1] != '0' && line[1] != '1') {
+					t.logger.Warnf("Malformed power status '%s'", line)
+					continue
+				}
+				handler.HandlePowerStatus(line[1] == '1')
 			default:
-				log.Printf("%s: Unexpected input '%s'", t.logPrefix, line)
+				t.logger.Warnf("Unexpected input '%s'", line)
 			}
 
 		case event := <-appEvents:
 			handler.HandleAppEvent(event)
 
-		case <-time.After(idleTickTime):
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			t.revertTemporaryLCD()
 			handler.HandleTick()
-			lastTickTime = time.Now()
-			tick_count++
-			if tick_count%10 == 0 && !t.verifyConnected() {
+			// Only ping if the terminal has been quiet for a while;
+			// everything we receive tells us that it is alive.
+			if t.clock.Now().Sub(t.LastActivity()) > t.heartbeatInterval &&
+				!t.heartbeat() {
 				return
 			}
 		}
 	}
 }
 
+// The last time we received anything from the terminal.
+func (t *SerialTerminal) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActivity))
+}
+
+func (t *SerialTerminal) markActivity() {
+	atomic.StoreInt64(&t.lastActivity, t.clock.Now().UnixNano())
+}
+
+func (t *SerialTerminal) inErrorState() bool {
+	return atomic.LoadInt32(&t.errorState) != 0
+}
+
+func (t *SerialTerminal) setErrorState() {
+	atomic.StoreInt32(&t.errorState, 1)
+}
+
+// The last time we received any bytes, including garbage.
+func (t *SerialTerminal) lastInputTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastInput))
+}
+
 // Public 'Terminal' interface
 func (t *SerialTerminal) GetTerminalName() string {
 	return t.name
 }
 
+// What the terminal reported about itself on connect.
+func (t *SerialTerminal) GetTerminalInfo() TerminalInfo {
+	return t.info
+}
+
+func (t *SerialTerminal) Capabilities() TerminalCapabilities {
+	result := t.info.Capabilities()
+	if t.lcdUnsupported { // Maybe only found out when writing.
+		result.LCD, result.LCDColumns, result.LCDRows = false, 0, 0
+	}
+	return result
+}
+
+// The firmware version the terminal reported on connect; "unknown" for
+// firmware that does not support the version query.
+func (t *SerialTerminal) GetFirmwareVersion() string {
+	return t.firmwareVersion
+}
+
 func (t *SerialTerminal) WriteLCD(line int, text string) {
-	if line < 0 || line >= maxLCDRows {
+	if line >= 0 && line < maxLCDRows {
+		t.temporaryLCD[line].until = time.Time{} // Replaced.
+	}
+	t.writeLCD(line, text)
+}
+
+// Another temporary text while one is shown only replaces the text; we
+// still go back to what was there before the first.
+func (t *SerialTerminal) WriteLCDTemporary(row int, text string, duration time.Duration) {
+	if row < 0 || row >= maxLCDRows || t.lcdUnsupported {
 		return
 	}
-	if len(text) > maxLCDCols {
-		// TODO: too long lines: scroll back and forth.
-		text = text[:maxLCDCols]
+	temporary := &t.temporaryLCD[row]
+	if temporary.until.IsZero() {
+		temporary.restore = strings.TrimPrefix(t.lastLCDContent[row],
+			lcdContent(row, ""))
+	}
+	temporary.until = t.clock.Now().Add(duration)
+	t.writeLCD(row, text)
+}
+
+// Go back to what was shown before temporary texts that are due. Called
+// with each tick, so reverts are up to idleTickTime late.
+func (t *SerialTerminal) revertTemporaryLCD() {
+	now := t.clock.Now()
+	for row := range t.temporaryLCD {
+		temporary := &t.temporaryLCD[row]
+		if temporary.until.IsZero() || now.Before(temporary.until) {
+			continue
+		}
+		temporary.until = time.Time{}
+		t.writeLCD(row, temporary.restore)
+	}
+}
+
+func (t *SerialTerminal) writeLCD(line int, text string) {
+	// Once the line is broken, we're about to reconnect, which shows
+	// what should be there (see DisplayState).
+	if line < 0 || line >= maxLCDRows || t.lcdUnsupported || t.inErrorState() {
+		return
 	}
 	// Only send line if it is different from what is shown already.
-	newContent := fmt.Sprintf("M%d%s", line, text)
+	newContent := lcdContent(line, text)
 	if t.lastLCDContent[line] == newContent {
 		return
 	}
-	t.sendAndAwaitResponse(newContent)
+	// Terminals with LEDs instead of an LCD don't know the 'M' command.
+	// Handlers don't need to care; we just stop sending to these.
+	result, unsupported := t.sendAndAwaitOptionalResponse(newContent)
+	if unsupported {
+		t.lcdUnsupported = true
+		return
+	}
+	if result == "" {
+		t.forgetLCDContent() // Broken line or no answer, not missing LCD.
+		return
+	}
 	t.lastLCDContent[line] = newContent
 }
 
+// After a failed write, we don't know what the LCD shows: maybe the old
+// text, maybe part of the new one. Send every row again next time.
+func (t *SerialTerminal) forgetLCDContent() {
+	for row := range t.lastLCDContent {
+		t.lastLCDContent[row] = ""
+	}
+}
+
+func (t *SerialTerminal) WriteLCDLines(lines []string) {
+	if t.lcdUnsupported || t.inErrorState() {
+		return
+	}
+	if len(lines) > maxLCDRows {
+		lines = lines[:maxLCDRows]
+	}
+	rows := make([]string, len(lines))
+	changed := 0
+	for row, text := range lines {
+		t.temporaryLCD[row].until = time.Time{} // Replaced.
+		// Tab separates the rows in the 'W' command.
+		rows[row] = lcdText(strings.Replace(text, "\t", " ", -1))
+		if t.lastLCDContent[row] != lcdContent(row, rows[row]) {
+			changed++
+		}
+	}
+	if changed < maxLCDRows || !t.lcdBatchAvailable() {
+		if changed == maxLCDRows && t.lcdBatch == lcdBatchUnknown {
+			return // Probe not answered; all rows are sent next time.
+		}
+		for row, text := range rows {
+			t.WriteLCD(row, text) // Skips unchanged rows.
+		}
+		return
+	}
+	result, unsupported := t.sendAndAwaitOptionalResponse("W" + strings.Join(rows, "\t"))
+	if unsupported {
+		t.lcdBatch = lcdBatchUnsupported
+		for row, text := range rows {
+			t.WriteLCD(row, text)
+		}
+		return
+	}
+	if result == "" {
+		t.forgetLCDContent()
+		return
+	}
+	for row, text := range rows {
+		t.lastLCDContent[row] = lcdContent(row, text)
+	}
+}
+
+// Firmware that doesn't know 'W' has a shorter line buffer, so a full 'W'
+// command would overflow it and leave us with garbage responses. So the
+// first time, we probe with a short one, which just clears the LCD.
+func (t *SerialTerminal) lcdBatchAvailable() bool {
+	if t.lcdBatch == lcdBatchUnknown {
+		result, unsupported := t.sendAndAwaitOptionalResponse("W")
+		switch {
+		case result != "":
+			t.lcdBatch = lcdBatchSupported
+			for row := range t.lastLCDContent {
+				t.lastLCDContent[row] = lcdContent(row, "")
+			}
+		case unsupported:
+			t.lcdBatch = lcdBatchUnsupported
+		default:
+			t.forgetLCDContent() // Ask again next time.
+		}
+	}
+	return t.lcdBatch == lcdBatchSupported
+}
+
+// The 'M' command writing text to row, which is also what we remember as
+// shown. The text is translated for the LCD (see lcdText()).
+func lcdContent(row int, text string) string {
+	return fmt.Sprintf("M%d%s", row, lcdText(text))
+}
+
 // Tell the buzzer to buzz. If toneCode should be 'H' or 'L'
+//
+// The firmware acknowledges the command as soon as the tone is started and
+// plays it in the background. We don't even wait for that: the handler
+// should go on with its business right away, and a firmware that only acks
+// once the tone is done would otherwise stall the event loop for the whole
+// duration. The ack is skipped whenever it shows up. Nothing is sent to
+// terminals without a buzzer.
 func (t *SerialTerminal) BuzzSpeaker(toneCode string, duration time.Duration) {
-	t.sendAndAwaitResponse(fmt.Sprintf("T%s%d", toneCode, int64(duration/time.Millisecond)))
+	if !t.Capabilities().Buzzer {
+		return
+	}
+	if duration > t.maxToneDuration {
+		t.logger.Warnf("Tone of %v cut to %v", duration, t.maxToneDuration)
+		duration = t.maxToneDuration
+	}
+	t.logger.Debugf("Sending 'T' request")
+	err := t.writeLine(fmt.Sprintf("T%s%d", toneCode, int64(duration/time.Millisecond)))
+	if err != nil {
+		t.setErrorState()
+		return
+	}
+	t.pendingToneAcks++
+}
+
+// Whether the response is the ack of an earlier BuzzSpeaker(), which
+// nobody is waiting for.
+func (t *SerialTerminal) isToneAck(response string) bool {
+	if t.pendingToneAcks == 0 || len(response) == 0 || response[0] != 'T' {
+		return false
+	}
+	t.pendingToneAcks--
+	return true
 }
 
+// Invalid colors are dropped; sent verbatim they might confuse the
+// firmware. Nothing is sent to terminals without LEDs.
 func (t *SerialTerminal) ShowColor(colors string) {
-	t.sendAndAwaitResponse(fmt.Sprintf("L%s", colors))
+	if !t.Capabilities().LED {
+		return
+	}
+	normalized, err := NormalizeColor(colors)
+	if err != nil {
+		t.logger.Errorf("ShowColor: %v", err)
+	}
+	t.sendAndAwaitResponse(fmt.Sprintf("L%s", normalized))
 }
 
 // Read data coming from the terminal and stuff it into the right
 // channels (we distinguish responses of commands from event notifications)
-func (t *SerialTerminal) inputScanLoop() {
-	reader := bufio.NewReader(t.serialFile)
-	for !t.errorState {
-		line, err := reader.ReadString('\n')
+func (t *SerialTerminal) inputScanLoop(logger *Logger) {
+	reader := bufio.NewReaderSize(t.serialFile, maxSerialLineLength)
+	discardingOverlongLine := false
+	for !t.inErrorState() {
+		lineBytes, err := reader.ReadSlice(t.codec.Delimiter())
+		if len(lineBytes) > 0 {
+			atomic.StoreInt64(&t.lastInput, t.clock.Now().UnixNano())
+		}
+		if err == bufio.ErrBufferFull {
+			// Garbage on the line. Drop everything up to the next
+			// newline, then continue reading regularly.
+			if !discardingOverlongLine {
+				logger.Warnf("Dropping overlong input line")
+			}
+			discardingOverlongLine = true
+			continue
+		}
 		if err != nil {
-			if !t.errorState {
-				log.Printf("%s: reading input: %v", t.logPrefix, err)
+			if !t.inErrorState() {
+				logger.Errorf("reading input: %v", err)
 			}
-			t.errorState = true
+			t.setErrorState()
 			return
 		}
+		if discardingOverlongLine {
+			discardingOverlongLine = false
+			continue // The remainder of the overlong line.
+		}
+		t.markActivity()
+		line := t.codec.Decode(lineBytes)
+		if line == "" {
+			continue
+		}
 		switch line[0] {
 		case '#', 0:
 			// ignore comment lines and obvious garbage.
-		case 'I', 'K':
+		case 'I', 'K', 'P':
 			// These are events sent asynchronously from the
 			// terminal to signify incoming key-presses or RFID
-			// reads
-			t.eventChannel <- line
+			// reads. Terminals on battery backup also report
+			// their power: 'P1' on mains, 'P0' once it failed.
+			atomic.AddUint64(&t.eventsReceived, 1)
+			enqueueDroppingOldest(t.eventChannel, line, logger)
 		default:
 			// Everything else coming from the terminal is in
 			// response to something we requested.
-			t.responseChannel <- line
+			enqueueDroppingOldest(t.responseChannel, line, logger)
+		}
+	}
+}
+
+// Queue a line for the consumer. If the consumer can't keep up (e.g. a
+// handler is stuck in a slow operation) and the channel is full, we drop the
+// oldest line instead of blocking: blocking here would mean to stop reading
+// the serial line altogether which wedges the terminal. Old events are the
+// least interesting anyway (an RFID is repeated while held in front of the
+// reader) and a response nobody picked up is stale.
+func enqueueDroppingOldest(channel chan string, line string, logger *Logger) {
+	for {
+		select {
+		case channel <- line:
+			return
+		default:
+		}
+		select {
+		case dropped := <-channel:
+			logger.Warnf("Consumer too slow. Dropping '%s'", dropped)
+		default:
+		}
+	}
+}
+
+func (t *SerialTerminal) writeLine(line string) error {
+	if t.commandGap > 0 {
+		if wait := t.lastCommand.Add(t.commandGap).Sub(t.clock.Now()); wait > 0 {
+			t.sleep(wait)
 		}
+		defer func() { t.lastCommand = t.clock.Now() }()
+	}
+	atomic.AddUint64(&t.commandsSent, 1)
+	_, err := t.serialFile.Write(t.codec.Encode(line))
+	if err != nil {
+		atomic.AddUint64(&t.commandErrors, 1)
+	}
+	return err
+}
+
+// Counters of this connection. Reconnects and Uptime are up to the caller,
+// who knows about earlier connections.
+func (t *SerialTerminal) Stats() TerminalStats {
+	return TerminalStats{
+		Commands:      atomic.LoadUint64(&t.commandsSent),
+		CommandErrors: atomic.LoadUint64(&t.commandErrors),
+		Events:        atomic.LoadUint64(&t.eventsReceived),
 	}
 }
 
 // Line-level interaction with the terminal. The protocol encodes
 // the command as the first character, and the reply of the terminal
 // (which arrives in the responseChannel) echos that character as first char.
-// If that is not the case, we're in some error condition.
+// If that is not the case, it is usually a stale line from earlier noise,
+// so we discard a few of those and keep waiting for the right one. More
+// than that, and we're in some error condition.
 // This function sends the request and verifies that the response
 // is as expected.
 func (t *SerialTerminal) sendAndAwaitResponse(toSend string) string {
-	_, err := t.serialFile.Write([]byte(toSend + "\n"))
+	return t.sendAndAwaitResponseContext(t.ctx, toSend)
+}
+
+// Like sendAndAwaitResponse(), but gives up waiting once ctx is cancelled.
+func (t *SerialTerminal) sendAndAwaitResponseContext(ctx context.Context,
+	toSend string) string {
+	t.logger.Debugf("Sending '%c' request", toSend[0])
+	err := t.writeLine(toSend)
 	if err != nil {
-		t.errorState = true
+		t.setErrorState()
 		return ""
 	}
 
-	select {
-	case result := <-t.responseChannel:
-		if result[0] == toSend[0] {
-			return result
-		} else {
-			log.Printf("%s: Unexpected result. Expected '%c', got '%s'",
-				t.logPrefix, toSend[0], result)
-			t.errorState = true
+	timeout := time.After(2 * time.Second)
+	skipped := 0
+	for {
+		select {
+		case result := <-t.responseChannel:
+			if t.isToneAck(result) {
+				continue
+			}
+			if len(result) > 0 && result[0] == toSend[0] {
+				return result
+			}
+			if skipped < t.skipResponses {
+				skipped++
+				t.logger.Warnf("Discarding unexpected result. Expected '%c', got '%s'",
+					toSend[0], result)
+				continue
+			}
+			t.logger.Errorf("Unexpected result. Expected '%c', got '%s'",
+				toSend[0], result)
+			atomic.AddUint64(&t.commandErrors, 1)
+			t.setErrorState()
+			return ""
+		case <-timeout:
+			// Terminal should've returned immediately. Timeout: bad.
+			t.logger.Errorf("Timeout waiting for '%c' response", toSend[0])
+			atomic.AddUint64(&t.commandErrors, 1)
+			t.setErrorState()
+			return ""
+		case <-ctx.Done():
+			t.logger.Debugf("Cancelled waiting for '%c' response", toSend[0])
+			t.setErrorState()
 			return ""
 		}
-	case <-time.After(2 * time.Second):
-		// Terminal should've returned immediately. Timeout: bad.
-		t.errorState = true
-		return ""
 	}
-	return "" // make old compiler happy
+}
+
+// Like sendAndAwaitResponse(), but for requests that older firmware might
+// not know about. These are answered with an 'E'rror line, which is no
+// reason to consider the terminal broken: then the result is empty and
+// unsupported is true. Without any answer (timeout, broken line), the result
+// is empty as well, but we don't know whether the firmware supports it.
+func (t *SerialTerminal) sendAndAwaitOptionalResponse(toSend string) (result string, unsupported bool) {
+	return t.sendAndAwaitOptionalResponseContext(t.ctx, toSend)
+}
+
+func (t *SerialTerminal) sendAndAwaitOptionalResponseContext(ctx context.Context,
+	toSend string) (result string, unsupported bool) {
+	t.logger.Debugf("Sending optional '%c' request", toSend[0])
+	err := t.writeLine(toSend)
+	if err != nil {
+		t.setErrorState()
+		return "", false
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case result := <-t.responseChannel:
+			if t.isToneAck(result) {
+				continue
+			}
+			if len(result) > 0 && result[0] == toSend[0] {
+				return result, false
+			}
+			if len(result) > 0 && result[0] == 'E' {
+				t.logger.Infof("'%c' not supported by firmware: '%s'",
+					toSend[0], result)
+				return "", true
+			}
+			t.logger.Debugf("Skipping unexpected response '%s'", result)
+		case <-timeout:
+			t.logger.Infof("No response to optional '%c' request", toSend[0])
+			return "", false
+		case <-ctx.Done():
+			return "", false
+		}
+	}
 }
 
 // Blow out the tubes.
 func (t *SerialTerminal) discardInitialInput() {
+	t.discardInitialInputContext(t.ctx)
+}
+
+func (t *SerialTerminal) discardInitialInputContext(ctx context.Context) {
 	// The first connect with the terminal might catch the line in some
-	// strange state with undiscarded input, so just discard that here
-	// until we see a couple of 100ms of silence.
+	// strange state with undiscarded input (or a terminal still booting
+	// and chatty), so just discard that here until we see a couple of
+	// 100ms of silence.
 	// Also send one dummy request to properly blow out the TX-line
 	// (whose response is discarded as well)
-	t.serialFile.Write([]byte("n\n")) // dummy request for name
-	select {
-	case <-t.eventChannel: // discard
-	case <-t.responseChannel: // discard
-	case <-time.After(1000 * time.Millisecond):
-		break
+	t.writeLine("n") // dummy request for name
+	start := t.clock.Now()
+	for {
+		t.discardQueuedInput()
+		now := t.clock.Now()
+		if now.Sub(start) >= discardQuietTime &&
+			now.Sub(t.lastInputTime()) >= discardQuietTime {
+			return
+		}
+		if now.Sub(start) >= maxDiscardTime {
+			t.logger.Warnf("Terminal didn't become quiet within %s",
+				maxDiscardTime)
+			return
+		}
+		select {
+		case <-time.After(discardPollTime):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *SerialTerminal) discardQueuedInput() {
+	for {
+		select {
+		case <-t.eventChannel:
+		case <-t.responseChannel:
+		default:
+			return
+		}
 	}
 }
 
 func (t *SerialTerminal) parseRFIDResponse(from_terminal string) (string, bool) {
+	// The line is framed already, but whatever else the firmware puts
+	// around the ID would make it never match.
+	payload := strings.TrimSpace(from_terminal[1:])
+	// Raw frames; a corrupt one would just be looked up as the wrong
+	// card. Common on a noisy line, so not worth a warning.
+	if t.rfidFormat != nil {
+		rfid, err := t.rfidFormat.Decode(payload)
+		if err != nil {
+			t.logger.Debugf("Discarding RFID read: %v", err)
+			return "", false
+		}
+		return rfid, true
+	}
+	// Wiegand readers send "<facility>:<card>".
+	if strings.Contains(payload, ":") {
+		if _, _, ok := ParseWiegand(payload); ok {
+			return payload, true
+		}
+		return "", false
+	}
 	// The ID comes as "<length> <code>". Get the code.
-	rfid_elements := strings.Split(from_terminal[1:], " ")
+	rfid_elements := strings.Split(payload, " ")
 	if len(rfid_elements) != 2 {
 		return "", false
 	}
 	got_len, _ := strconv.Atoi(rfid_elements[0]) // number of bytes
-	rfid := strings.TrimSpace(rfid_elements[1])  // bytes as hex
+	rfid := rfid_elements[1]                     // bytes as hex
 	if len(rfid) > 0 && len(rfid) == 2*got_len {
 		return rfid, true
 	}
 	return "", false
 }
 
-// Regularly confirm that we are still connected to same terminal
-// i.e. if connectors are disconnected or plugged around.
-func (t *SerialTerminal) verifyConnected() bool {
-	new_name := t.requestName()
-	if t.errorState {
-		log.Printf("%s: Error pinging terminal '%s'",
-			t.logPrefix, t.name)
-		return false
+// Confirm that we are still connected to the same terminal, i.e. that it
+// is alive and connectors haven't been plugged around. A single unanswered
+// ping can happen on a noisy line, so we only give up after maxFailedPings
+// in a row. Returns false if the terminal should be considered gone.
+func (t *SerialTerminal) heartbeat() bool {
+	name, ok := t.ping()
+	if !ok {
+		atomic.AddUint64(&t.commandErrors, 1)
+		t.failedPings++
+		t.logger.Warnf("Ping unanswered (%d of %d)",
+			t.failedPings, maxFailedPings)
+		return t.failedPings < maxFailedPings
 	}
-	if new_name != t.name {
-		log.Printf("%s: Name change ('%s', was '%s')",
-			t.logPrefix, new_name, t.name)
+	t.failedPings = 0
+	if name != t.name {
+		t.logger.Infof("Name change ('%s', was '%s')", name, t.name)
 		return false
 	}
 	return true
 }
 
+// Ask the terminal for its name. Unlike requestName(), an unanswered
+// request is not an error; returns false in that case.
+func (t *SerialTerminal) ping() (string, bool) {
+	// Discard answers to earlier pings that came in too late.
+	for len(t.responseChannel) > 0 {
+		t.isToneAck(<-t.responseChannel)
+	}
+	if err := t.writeLine("n"); err != nil {
+		t.setErrorState()
+		return "", false
+	}
+	timeout := time.After(t.pingTimeout)
+	for {
+		select {
+		case result := <-t.responseChannel:
+			if t.isToneAck(result) {
+				continue
+			}
+			if len(result) > 0 && result[0] == 'n' {
+				return ParseTerminalInfo(result[1:]).Name, true
+			}
+			return "", false
+		case <-timeout:
+			return "", false
+		case <-t.ctx.Done():
+			return "", false
+		}
+	}
+}
+
 func (t *SerialTerminal) shutdown() {
 	// Not logging to not trash SD card.
-	//log.Printf("%s: Shutdown '%s'", t.logPrefix, t.GetTerminalName())
-	t.errorState = true
+	//t.logger.Infof("Shutdown")
+	t.setErrorState()
 
 	// TODO: ideally, we want a clean shutdown of the reader
 	// in inputScanLoop() which is blocking at this moment.
@@ -250,11 +915,42 @@ func (t *SerialTerminal) shutdown() {
 	t.serialFile.Close()
 }
 
-// Ask the terminal about its name. Returns true if we ran into a timeout.
-func (t *SerialTerminal) requestName() string {
+// Ask the terminal about its firmware version. Firmware that does not
+// support the 'v' command is reported as "unknown".
+func (t *SerialTerminal) RequestFirmwareVersion() string {
+	result, _ := t.sendAndAwaitOptionalResponse("v")
+	if result == "" {
+		return unknownFirmwareVersion
+	}
+	version := strings.TrimSpace(result[1:])
+	if version == "" {
+		return unknownFirmwareVersion
+	}
+	return version
+}
+
+// Ask the terminal about its name and what it can do. The name is empty if
+// we ran into a timeout.
+func (t *SerialTerminal) requestInfo() TerminalInfo {
 	result := t.sendAndAwaitResponse("n")
 	if result == "" {
-		return ""
+		return TerminalInfo{}
+	}
+	return ParseTerminalInfo(result[1:])
+}
+
+// Use what the terminal told us, so that we don't have to find out
+// by trying.
+func (t *SerialTerminal) applyTerminalInfo() {
+	if t.info.NoLCD {
+		t.lcdUnsupported = true
+	}
+	if t.info.Features[terminalFeatureLCDBatch] {
+		t.lcdBatch = lcdBatchSupported
+	}
+	if t.info.LCDColumns > 0 && (t.info.LCDColumns != maxLCDCols ||
+		t.info.LCDRows != maxLCDRows) {
+		t.logger.Warnf("LCD is %dx%d, but we format for %dx%d",
+			t.info.LCDColumns, t.info.LCDRows, maxLCDCols, maxLCDRows)
 	}
-	return strings.TrimSpace(result[1:])
 }
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run a terminal event loop on a fake port, returning a function to stop it.
+func runFakeTerminal(port *FakeSerialPort, handler TerminalEventHandler) func() {
+	return runFakeTerminalWithConfig(port, handler, TerminalConfig{Device: "fake"})
+}
+
+func runFakeTerminalWithConfig(port *FakeSerialPort, handler TerminalEventHandler,
+	config TerminalConfig) func() {
+	terminal, _ := newSerialTerminalOnPort(port, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		terminal.RunEventLoop(ctx, handler, NewApplicationBus())
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+		port.Close()
+	}
+}
+
+func TestPowerStatus(t *testing.T) {
+	port := NewFakeSerialPort()
+	handler := NewRecordingHandler()
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	port.TerminalSends("P\n")  // Malformed.
+	port.TerminalSends("Px\n") // Malformed.
+	port.TerminalSends("P0\n")
+	port.TerminalSends("P1\n")
+	for _, expected := range []bool{false, true} {
+		select {
+		case ok := <-handler.power:
+			ExpectTrue(t, ok == expected, "Power status")
+		case <-time.After(time.Second):
+			t.Fatalf("Expected power status %v, but got nothing", expected)
+		}
+	}
+	select {
+	case ok := <-handler.power:
+		t.Errorf("Didn't expect power status, got %v", ok)
+	default:
+	}
+}
+
+func TestMalformedSerialLines(t *testing.T) {
+	port := NewFakeSerialPort()
+	handler := NewRecordingHandler()
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	port.TerminalSends("\n")
+	port.TerminalSends("K\n")
+	port.TerminalSends("K\r\n")
+	port.TerminalSends("")
+	port.TerminalSends("\r\n")
+	port.TerminalSends("I\n")
+	port.TerminalSends("K1\n") // The only valid one.
+	handler.expectKey(t, '1')
+	handler.expectNoMoreKeys(t)
+}
+
+// Terminals ending lines with '\r\n' on the default '\n' framing must not
+// leave a '\r' in what the handler gets.
+func TestEventPayloadsTrimmed(t *testing.T) {
+	port := NewFakeSerialPort()
+	handler := NewRecordingHandler()
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	port.TerminalSends("I12:345\r\n")
+	handler.expectRFID(t, "12:345")
+	port.TerminalSends("I4 abcd1234\r\n")
+	handler.expectRFID(t, "abcd1234")
+	port.TerminalSends("I4 abcd1234 \r\n")
+	handler.expectRFID(t, "abcd1234")
+	port.TerminalSends("K1\r\n")
+	handler.expectKey(t, '1')
+}
+
+func TestOverlongSerialLine(t *testing.T) {
+	port := NewFakeSerialPort()
+	handler := NewRecordingHandler()
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	garbage := make([]byte, 3*maxSerialLineLength)
+	for i := range garbage {
+		garbage[i] = 'K'
+	}
+	port.TerminalSends(string(garbage) + "\n")
+	port.TerminalSends("K2\n")
+	handler.expectKey(t, '2')
+	handler.expectNoMoreKeys(t)
+}
+
+// A handler that blocks in HandleKeypress() until released.
+type StallingHandler struct {
+	*RecordingHandler
+	release chan bool
+}
+
+func (h *StallingHandler) HandleKeypress(key byte) {
+	<-h.release
+	h.RecordingHandler.HandleKeypress(key)
+}
+
+func TestSlowHandlerDoesNotBlockReader(t *testing.T) {
+	port := NewFakeSerialPort()
+	handler := &StallingHandler{NewRecordingHandler(), make(chan bool)}
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	// While the handler is stuck, the terminal keeps sending a lot more
+	// than fits into the buffer. The reader must keep reading.
+	sendingDone := make(chan bool)
+	go func() {
+		for i := 0; i < 5*defaultEventBufferSize; i++ {
+			port.TerminalSends("K1\n")
+		}
+		port.TerminalSends("K9\n")
+		close(sendingDone)
+	}()
+	select {
+	case <-sendingDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Reader blocked by slow handler")
+	}
+
+	// Once the handler continues, it sees the most recent events; the
+	// oldest have been dropped.
+	close(handler.release)
+	var last byte
+	count := 0
+	for last != '9' {
+		select {
+		case last = <-handler.keys:
+			count++
+		case <-time.After(time.Second):
+			t.Fatal("Didn't see most recent key")
+		}
+	}
+	if count > defaultEventBufferSize+2 {
+		t.Errorf("Expected old events to be dropped, but got %d", count)
+	}
+}
+
+func TestSerialTerminalHandshake(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetName("gate")
+	port.SetFirmwareVersion("abc123")
+	terminal, err := connectSerialTerminal(context.Background(), port, TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	ExpectTrue(t, terminal.GetTerminalName() == "gate", "terminal name")
+	ExpectTrue(t, terminal.GetFirmwareVersion() == "abc123", "firmware version")
+
+	// Old firmware does not know about versions.
+	oldPort := NewFakeSerialPort()
+	oldTerminal, err := connectSerialTerminal(context.Background(), oldPort, TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer oldTerminal.shutdown()
+	ExpectTrue(t, oldTerminal.GetFirmwareVersion() == unknownFirmwareVersion,
+		"unknown firmware version")
+}
+
+func TestParseTerminalInfo(t *testing.T) {
+	// Firmware so far only sends the name.
+	info := ParseTerminalInfo(" upstairs \r")
+	ExpectTrue(t, info.Name == "upstairs" && info.Fields == nil, "Plain name")
+	info = ParseTerminalInfo("back door")
+	ExpectTrue(t, info.Name == "back door", "Name with space, no fields")
+	info = ParseTerminalInfo("back door lcd=16x2")
+	ExpectTrue(t, info.Name == "back door lcd=16x2", "Not all fields: a name")
+
+	info = ParseTerminalInfo("gate lcd=16x2 features=lcd-batch,tone new=42")
+	ExpectTrue(t, info.Name == "gate", "Name is first token")
+	ExpectTrue(t, info.LCDColumns == 16 && info.LCDRows == 2, "LCD geometry")
+	ExpectTrue(t, info.Features[terminalFeatureLCDBatch] &&
+		info.Features["tone"] && !info.Features["x"], "Features")
+	ExpectTrue(t, info.Fields["new"] == "42", "Unknown fields kept")
+	ExpectFalse(t, info.NoLCD, "Has LCD")
+	ExpectTrue(t, ParseTerminalInfo("gate lcd=none").NoLCD, "No LCD")
+}
+
+func TestTerminalInfoOnConnect(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetName("gate lcd=24x2 features=lcd-batch")
+	port.SetLCDBatch(true)
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	ExpectTrue(t, terminal.GetTerminalName() == "gate", "terminal name")
+	ExpectTrue(t, terminal.GetTerminalInfo().LCDColumns == 24, "LCD geometry")
+	connectRequests := len(port.Requests())
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, fmt.Sprint(port.Requests()[connectRequests:]) ==
+		"[WHello\tWorld]", "No need to probe")
+
+	// Pings compare the name only.
+	ExpectTrue(t, terminal.heartbeat(), "Same terminal")
+}
+
+func TestMissingHardwareNotAddressed(t *testing.T) {
+	ExpectTrue(t, ParseTerminalInfo("gate").Capabilities() ==
+		FullTerminalCapabilities(), "Old firmware has everything")
+
+	port := NewFakeSerialPort()
+	port.SetName("gate buzzer=none led=none lcd=16x2")
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	capabilities := terminal.Capabilities()
+	ExpectFalse(t, capabilities.Buzzer || capabilities.LED, "Reported missing")
+	ExpectTrue(t, capabilities.LCD && capabilities.LCDColumns == 16, "LCD")
+
+	connectRequests := len(port.Requests())
+	terminal.BuzzSpeaker("H", time.Second)
+	terminal.ShowColor(ColorGreen)
+	terminal.WriteLCD(0, "Hi")
+	ExpectTrue(t, fmt.Sprint(port.Requests()[connectRequests:]) == "[M0Hi]",
+		"Only the LCD is written")
+}
+
+func TestEventLoopDrivesAccessHandler(t *testing.T) {
+	port := NewFakeSerialPort()
+	auth := NewMockAuthenticator()
+	auth.allow[ACKey{"abcd1234", Target("fake")}] = ReasonOK
+	bus := NewApplicationBus()
+	openRequests := make(AppEventChannel, 10)
+	bus.Subscribe(openRequests)
+	handler := NewAccessHandler(&Backends{authenticator: auth, appEventBus: bus})
+
+	terminal, err := connectSerialTerminal(context.Background(), port, TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go terminal.RunEventLoop(ctx, handler, bus)
+
+	port.SendRFID("abcd1234")
+	ExpectTrue(t, port.WaitForRequest("LG", time.Second), "Green light")
+	ExpectTrue(t, port.WaitForRequest("TH500", time.Second), "Happy tone")
+	select {
+	case event := <-openRequests:
+		ExpectTrue(t, event.Ev == AppOpenRequest, "Open request")
+	case <-time.After(time.Second):
+		t.Error("Expected open request")
+	}
+}
+
+func TestSilentTerminalIsDisconnected(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port, TerminalConfig{
+		Device:            "fake",
+		HeartbeatInterval: Duration(100 * time.Millisecond),
+		PingTimeout:       Duration(100 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	done := make(chan bool)
+	go func() {
+		terminal.RunEventLoop(context.Background(), NewRecordingHandler(),
+			NewApplicationBus())
+		close(done)
+	}()
+
+	// While the terminal answers pings, we stay connected.
+	select {
+	case <-done:
+		t.Fatal("Disconnected from healthy terminal")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// The terminal hangs. After failing pings, we give up.
+	port.StopResponding()
+	pingsBefore := len(port.Requests())
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Didn't notice silent terminal")
+	}
+	ExpectTrue(t, len(port.Requests())-pingsBefore >= maxFailedPings,
+		"Expected multiple pings before giving up")
+}
+
+func TestTerminalStats(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port, TerminalConfig{
+		Device:      "fake",
+		PingTimeout: Duration(50 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	stats := terminal.Stats()
+	// Dummy request to clear the line, name and version.
+	ExpectTrue(t, stats.Commands == 3 && stats.CommandErrors == 0,
+		"Name and version requested")
+
+	terminal.ShowColor(ColorGreen)
+	port.SendKeypress('1')
+	port.SendRFID("abcd1234")
+	for end := time.Now().Add(time.Second); time.Now().Before(end); {
+		if terminal.Stats().Events == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats = terminal.Stats()
+	ExpectTrue(t, stats.Commands == 4, "Color command counted")
+	ExpectTrue(t, stats.Events == 2, "Keypress and RFID counted")
+
+	port.StopResponding()
+	terminal.heartbeat()
+	stats = terminal.Stats()
+	ExpectTrue(t, stats.Commands == 5 && stats.CommandErrors == 1,
+		"Unanswered ping is an error")
+}
+
+// Buzzes on '1', shows a color on '2'.
+type BuzzingHandler struct {
+	*RecordingHandler
+	terminal Terminal
+}
+
+func (h *BuzzingHandler) Init(t Terminal) { h.terminal = t }
+func (h *BuzzingHandler) HandleKeypress(key byte) {
+	switch key {
+	case '1':
+		h.terminal.BuzzSpeaker("L", 5*time.Second)
+	case '2':
+		h.terminal.ShowColor(ColorGreen)
+	}
+	h.RecordingHandler.HandleKeypress(key)
+}
+
+func TestLongToneDoesNotStallEventLoop(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetToneAckDelay(1500 * time.Millisecond)
+	handler := &BuzzingHandler{RecordingHandler: NewRecordingHandler()}
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	start := time.Now()
+	port.SendKeypress('1')
+	handler.expectKey(t, '1')
+	port.SendKeypress('3')
+	handler.expectKey(t, '3')
+	ExpectTrue(t, time.Since(start) < time.Second,
+		"Keys handled while tone not acknowledged")
+
+	// The late ack is not mistaken as response to the next request.
+	time.Sleep(time.Until(start.Add(1600 * time.Millisecond)))
+	port.SendKeypress('2')
+	handler.expectKey(t, '2')
+	ExpectTrue(t, port.WaitForRequest("LG", time.Second), "Color sent")
+	port.SendKeypress('4')
+	handler.expectKey(t, '4') // Still running.
+}
+
+func TestLongToneClamped(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	terminal.BuzzSpeaker("H", 10*time.Minute)
+	ExpectTrue(t, port.WaitForRequest("TH3000", time.Second), "Cut to the default")
+	terminal.BuzzSpeaker("L", 200*time.Millisecond)
+	ExpectTrue(t, port.WaitForRequest("TL200", time.Second), "Short tones as they are")
+
+	terminal.maxToneDuration = time.Second
+	terminal.BuzzSpeaker("L", 10*time.Minute)
+	ExpectTrue(t, port.WaitForRequest("TL1000", time.Second), "Cut to configured")
+}
+
+func TestConnectAfterChattyBoot(t *testing.T) {
+	port := NewFakeSerialPort()
+	// A terminal still booting spews garbage for a while.
+	go func() {
+		for end := time.Now().Add(1500 * time.Millisecond); time.Now().Before(end); {
+			port.TerminalSends("xboot\r\nxnoise\r\nxmore noise\r\n")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond) // Let the noise start.
+
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	ExpectTrue(t, terminal.GetTerminalName() == "fake", "terminal name")
+}
+
+func TestCancelledConnectReturnsPromptly(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.StopResponding()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	terminal, err := connectSerialTerminal(ctx, port, TerminalConfig{Device: "fake"})
+	ExpectTrue(t, terminal == nil && err != nil, "Connect failed")
+	// Without cancel, this takes the discard and request timeouts.
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Cancelled connect took %v", elapsed)
+	}
+}
+
+func TestCancelledRequestReturnsPromptly(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	port.StopResponding()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	ExpectTrue(t, terminal.sendAndAwaitResponseContext(ctx, "LG") == "",
+		"No response")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Cancelled request took %v", elapsed)
+	}
+}
+
+func TestUnexpectedResponseSkipped(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+
+	port.SendJunkResponses(1)
+	ExpectTrue(t, terminal.sendAndAwaitResponse("LG") == "L ok", "Response")
+	ExpectFalse(t, terminal.inErrorState(), "Junk response skipped")
+	ExpectTrue(t, terminal.Stats().CommandErrors == 0, "No command error")
+
+	// Not skipping anything, we give up right away.
+	strictPort := NewFakeSerialPort()
+	strict, err := connectSerialTerminal(context.Background(), strictPort,
+		TerminalConfig{Device: "fake", SkipUnexpectedResponses: -1})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer strict.shutdown()
+	strictPort.SendJunkResponses(1)
+	ExpectTrue(t, strict.sendAndAwaitResponse("LG") == "", "No response")
+	ExpectTrue(t, strict.inErrorState(), "Junk response is an error")
+}
+
+func TestPromptRestoredAfterReconnect(t *testing.T) {
+	handler := NewControlHandler(&Backends{
+		authenticator: NewMockAuthenticator(),
+		appEventBus:   NewApplicationBus(),
+	})
+	port := NewFakeSerialPort()
+	stop := runFakeTerminal(port, handler)
+	for _, key := range adminCommandPrefix {
+		port.SendKeypress(byte(key))
+	}
+	ExpectTrue(t, port.WaitForRequest("M0Admin: show member RFID", time.Second),
+		"Prompt shown")
+	ExpectTrue(t, port.WaitForRequest("M1[*] Cancel", time.Second),
+		"Prompt shown")
+	stop() // Terminal goes away mid-prompt.
+
+	// The same handler gets the new connection and shows the prompt again.
+	reconnectedPort := NewFakeSerialPort()
+	stop = runFakeTerminal(reconnectedPort, handler)
+	defer stop()
+	ExpectTrue(t, reconnectedPort.WaitForRequest("M0Admin: show member RFID",
+		time.Second), "Prompt restored on reconnect")
+	ExpectTrue(t, reconnectedPort.WaitForRequest("M1[*] Cancel", time.Second),
+		"Prompt restored on reconnect")
+}
+
+func TestCRLFFraming(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetLineTerminator("\r\n")
+	port.SetName("gate")
+	port.SetFirmwareVersion("abc123")
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake", LineTerminator: LineTerminatorCRLF})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	ExpectTrue(t, terminal.GetTerminalName() == "gate", "No '\\r' in name")
+	ExpectTrue(t, terminal.GetFirmwareVersion() == "abc123", "No '\\r' in version")
+	ExpectTrue(t, port.RawWrites()[0] == "n\r\n", "Requests end in CRLF")
+
+	rfid, ok := terminal.parseRFIDResponse(terminal.codec.Decode([]byte("I4 abcd1234\r\n")))
+	ExpectTrue(t, ok && rfid == "abcd1234", "No '\\r' in RFID")
+}
+
+func TestCRFraming(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetLineTerminator("\r")
+	handler := NewRecordingHandler()
+	stop := runFakeTerminalWithConfig(port, handler,
+		TerminalConfig{Device: "fake", LineTerminator: LineTerminatorCR})
+	defer stop()
+
+	port.SendKeypress('1')
+	port.SendRFID("abcd1234")
+	handler.expectKey(t, '1')
+	handler.expectRFID(t, "abcd1234")
+}
+
+func TestNormalizeColor(t *testing.T) {
+	for _, valid := range []struct{ in, want string }{
+		{"", ColorOff}, {"G", ColorGreen}, {"GR", ColorYellow},
+		{"RRG", ColorYellow}, {"BGR", ColorWhite}, {"BR", ColorMagenta},
+	} {
+		got, err := NormalizeColor(valid.in)
+		ExpectTrue(t, err == nil && got == valid.want, "Valid color "+valid.in)
+	}
+	for _, garbage := range []string{"X", "r", "R G", "RGBX", "LG\nT"} {
+		_, err := NormalizeColor(garbage)
+		ExpectTrue(t, err != nil, "Invalid color "+garbage)
+	}
+}
+
+func TestInvalidColorNotSent(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	terminal.ShowColor("GRG")
+	ExpectTrue(t, port.WaitForRequest("LRG", time.Second), "Normalized")
+	terminal.ShowColor("XBlue")
+	ExpectTrue(t, port.WaitForRequest("LB", time.Second), "Garbage dropped")
+}
+
+func TestCommandGapRespected(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	clock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	var waits []time.Duration
+	terminal.clock = clock
+	terminal.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		clock.now = clock.now.Add(d)
+	}
+	terminal.commandGap = 50 * time.Millisecond
+
+	terminal.ShowColor("G")
+	ExpectTrue(t, len(waits) == 0, "First command right away")
+	clock.now = clock.now.Add(20 * time.Millisecond)
+	terminal.ShowColor("R")
+	ExpectTrue(t, len(waits) == 1 && waits[0] == 30*time.Millisecond,
+		fmt.Sprintf("Waited the rest of the gap: %v", waits))
+	clock.now = clock.now.Add(time.Second)
+	terminal.ShowColor("B")
+	ExpectTrue(t, len(waits) == 1, "No wait after a pause")
+	ExpectTrue(t, port.WaitForRequest("LB", time.Second), "All sent")
+}
+
+func TestBatchedLCDUpdate(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetLCDBatch(true)
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	connectRequests := len(port.Requests())
+	sent := func() []string {
+		requests := port.Requests()[connectRequests:]
+		connectRequests += len(requests)
+		return requests
+	}
+
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[W WHello\tWorld]",
+		"Probe, then both rows in one go")
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, len(sent()) == 0, "Unchanged rows skipped")
+	terminal.WriteLCDLines([]string{"Hello", "there"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M1there]", "Only changed row")
+	terminal.WriteLCD(0, "Hi")
+	terminal.WriteLCDLines([]string{"Hi", "there"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0Hi]", "Tracks single rows")
+	terminal.WriteLCDLines([]string{"", ""})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[W\t]", "No more probing")
+}
+
+func TestBatchedLCDFallback(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	connectRequests := len(port.Requests())
+	sent := func() []string {
+		requests := port.Requests()[connectRequests:]
+		connectRequests += len(requests)
+		return requests
+	}
+
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[W M0Hello M1World]",
+		"Old firmware: rows one by one")
+	terminal.WriteLCDLines([]string{"Hello", "there"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M1there]", "Unchanged row skipped")
+	terminal.WriteLCDLines([]string{"Good", "bye"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0Good M1bye]", "No more probing")
+}
+
+func TestFailedLCDWriteNotCached(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	display := &DisplayState{}
+	display.Attach(terminal)
+	connectRequests := len(port.Requests())
+	sent := func() []string {
+		requests := port.Requests()[connectRequests:]
+		connectRequests += len(requests)
+		return requests
+	}
+
+	display.WriteLCD(0, "Hello")
+	display.WriteLCD(1, "World")
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0Hello M1World]", "Shown")
+	port.FailWrites(1)
+	display.WriteLCD(0, "Glitch")
+	ExpectTrue(t, len(sent()) == 0, "Write failed")
+	ExpectTrue(t, terminal.inErrorState(), "Failure noticed")
+	ExpectFalse(t, terminal.lcdUnsupported, "Still has an LCD")
+	ExpectTrue(t, terminal.lastLCDContent == [maxLCDRows]string{},
+		"Nothing taken for shown")
+
+	// The way out is a reconnect, which shows what should be there.
+	reconnectedPort := NewFakeSerialPort()
+	reconnected, err := connectSerialTerminal(context.Background(),
+		reconnectedPort, TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer reconnected.shutdown()
+	connectRequests = len(reconnectedPort.Requests())
+	display.Attach(reconnected)
+	display.WriteLCD(0, "Glitch")
+	requests := reconnectedPort.Requests()[connectRequests:]
+	ExpectTrue(t, fmt.Sprint(requests) == "[M0Glitch M1World]",
+		"Restored once after reconnect: "+fmt.Sprint(requests))
+}
+
+func TestFailedBatchWriteNotCached(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetLCDBatch(true)
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	connectRequests := len(port.Requests())
+	sent := func() []string {
+		requests := port.Requests()[connectRequests:]
+		connectRequests += len(requests)
+		return requests
+	}
+
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, fmt.Sprint(sent()) == "[W WHello\tWorld]", "Batch sent")
+	port.FailWrites(1)
+	terminal.WriteLCDLines([]string{"Good", "bye"})
+	ExpectTrue(t, len(sent()) == 0, "Write failed")
+	ExpectTrue(t, terminal.lcdBatch == lcdBatchSupported, "Batch still known")
+	ExpectTrue(t, terminal.lastLCDContent == [maxLCDRows]string{},
+		"Nothing taken for shown")
+}
+
+func TestFailedBatchProbeNotOldFirmware(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetLCDBatch(true)
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	port.FailWrites(1)
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, terminal.lcdBatch == lcdBatchUnknown, "Ask again next time")
+	ExpectFalse(t, terminal.lcdUnsupported, "Still has an LCD")
+}
+
+func TestTemporaryLCDReverts(t *testing.T) {
+	port := NewFakeSerialPort()
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	clock := &MockClock{}
+	terminal.clock = clock
+	terminal.WriteLCD(0, "Prompt")
+	connectRequests := len(port.Requests())
+	sent := func() []string {
+		requests := port.Requests()[connectRequests:]
+		connectRequests += len(requests)
+		return requests
+	}
+	tick := func(d time.Duration) {
+		clock.now = clock.now.Add(d)
+		terminal.revertTemporaryLCD()
+	}
+
+	terminal.WriteLCDTemporary(0, "Granted", 2*time.Second)
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0Granted]", "Temporary shown")
+	tick(1999 * time.Millisecond)
+	ExpectTrue(t, len(sent()) == 0, "Still shown")
+	tick(time.Millisecond)
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0Prompt]", "Reverted")
+	tick(10 * time.Second)
+	ExpectTrue(t, len(sent()) == 0, "Reverted only once")
+
+	// A second temporary text extends, but we still go back to the prompt.
+	terminal.WriteLCDTemporary(0, "One", 2*time.Second)
+	tick(time.Second)
+	terminal.WriteLCDTemporary(0, "Two", 2*time.Second)
+	tick(1500 * time.Millisecond)
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0One M0Two]", "No revert yet")
+	tick(500 * time.Millisecond)
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M0Prompt]", "Back to the prompt")
+
+	// Regular writes in the meantime win.
+	terminal.WriteLCDTemporary(1, "Busy", 2*time.Second)
+	terminal.WriteLCD(1, "New")
+	terminal.WriteLCDTemporary(0, "Busy", 2*time.Second)
+	terminal.WriteLCDLines([]string{"Newer", "New"})
+	tick(3 * time.Second)
+	ExpectTrue(t, fmt.Sprint(sent()) == "[M1Busy M1New M0Busy M0Newer]",
+		"Not reverted")
+}
+
+func TestLineCodec(t *testing.T) {
+	lf, _ := NewLineCodec("")
+	ExpectTrue(t, string(lf.Encode("n")) == "n\n", "LF is default")
+	ExpectTrue(t, lf.Delimiter() == '\n', "LF delimiter")
+	// Tolerant to terminals sending other line endings.
+	ExpectTrue(t, lf.Decode([]byte("K1\r\n")) == "K1", "Stray CR removed")
+	cr, _ := NewLineCodec(LineTerminatorCR)
+	ExpectTrue(t, cr.Decode([]byte("\nK1\r")) == "K1", "Stray LF removed")
+	_, err := NewLineCodec("semicolon")
+	ExpectTrue(t, err != nil, "Unknown terminator")
+}
+
+// Counts what it sees, without ever blocking the event loop.
+type countingHandler struct {
+	keys  int32
+	ticks int32
+}
+
+func (h *countingHandler) Init(t Terminal)                {}
+func (h *countingHandler) HandleShutdown()                {}
+func (h *countingHandler) HandlePowerStatus(ok bool)      {}
+func (h *countingHandler) HandleKeypress(key byte)        { atomic.AddInt32(&h.keys, 1) }
+func (h *countingHandler) HandleRFID(rfid string)         {}
+func (h *countingHandler) HandleAppEvent(event *AppEvent) {}
+func (h *countingHandler) HandleTick()                    { atomic.AddInt32(&h.ticks, 1) }
+
+func TestTicksUnderEventFlood(t *testing.T) {
+	port := NewFakeSerialPort()
+	handler := &countingHandler{}
+	stop := runFakeTerminal(port, handler)
+	defer stop()
+
+	flood := 4 * idleTickTime
+	for end := time.Now().Add(flood); time.Now().Before(end); {
+		port.SendKeypress('1')
+	}
+	keys := atomic.LoadInt32(&handler.keys)
+	ticks := atomic.LoadInt32(&handler.ticks)
+	ExpectTrue(t, keys > 100, "Expected events to be processed promptly")
+	// Allow some slack for slow test machines.
+	if ticks < 3 {
+		t.Errorf("Expected about %d ticks during flood, got %d",
+			flood/idleTickTime, ticks)
+	}
+}
+
+func TestUnansweredLCDWriteKeepsLCD(t *testing.T) {
+	port := NewFakeSerialPort()
+	port.SetLCDBatch(true)
+	terminal, err := connectSerialTerminal(context.Background(), port,
+		TerminalConfig{Device: "fake"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer terminal.shutdown()
+	port.StopResponding()
+	terminal.WriteLCDLines([]string{"Hello", "World"})
+	ExpectTrue(t, terminal.lcdBatch == lcdBatchUnknown, "Ask again next time")
+	terminal.WriteLCD(0, "Hi")
+	ExpectFalse(t, terminal.lcdUnsupported, "Timeout is no missing LCD")
+	ExpectFalse(t, terminal.inErrorState(), "Nor a broken line")
+	ExpectTrue(t, terminal.lastLCDContent == [maxLCDRows]string{},
+		"Nothing taken for shown")
+}
@@ -1,28 +1,35 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
 // Callback interface to be implemented to receive events generated
 // by terminals, the little boxes mounted next to doors :)
 // This is the interface that code should implement to interact with
-// such a terminal - the Init() function will be called once and pass
+// such a terminal - the Init() function will be called on connect and pass
 // you a way to talk back to that terminal.
 //
 // Each method call should return quickly; if you need to do something
 // dependent on time, implement HandleTick()
 type TerminalEventHandler interface {
-	// Initialize. This is called once in the beginning and gets passed the
+	// Initialize. This is called in the beginning and gets passed the
 	// TerminalStub connected to the terminal. This provides the interface
 	// to trigger actions, e.g. activating LEDs or emitting a tone.
+	// If the terminal reconnects, the handler is kept and Init() is
+	// called again with the new connection, which starts out blank (see
+	// DisplayState to restore what was shown).
 	Init(my_terminal Terminal)
 
 	// Called when the connection to this EventHandler is shut down.
 	HandleShutdown()
 
 	// HandleKeypress receives each character typed on the keypad.
-	// These are ASCII encoded bytes in the range '0'..'9' and '*' and '#'.
+	// These are ASCII encoded bytes in the range '0'..'9' and '*' and '#',
+	// as on the standard keypad. Handlers implementing KeyHandler get
+	// HandleKey() instead (see keypad.go).
 	HandleKeypress(byte)
 
 	// HandleRFID receives the ID of an RFID card presented to the
@@ -36,6 +43,12 @@ type TerminalEventHandler interface {
 
 	// HandleTick is called roughly every 500ms when idle.
 	HandleTick()
+
+	// HandlePowerStatus is called when a terminal on battery backup
+	// reports its power: false if mains power failed and the battery is
+	// running down, true once it is back. Terminals that can't tell
+	// never call this.
+	HandlePowerStatus(ok bool)
 }
 
 // The API to interact with the terminal. If you implement a
@@ -45,9 +58,14 @@ type Terminal interface {
 	// Get the name of the terminal.
 	GetTerminalName() string
 
+	// What the terminal has. Calls for things it doesn't have do nothing,
+	// but handlers might want to adapt what they show.
+	Capabilities() TerminalCapabilities
+
 	// Show the LED color. String contains a string with a combination of
 	// characters 'R', 'G', 'B'. So ShowColor("RG") would show yellow for
-	// instance. Empty string: LEDs off.
+	// instance. Empty string: LEDs off. Best use one of the Color*
+	// constants below.
 	ShowColor(colors string)
 
 	// Buzz the speaker. Tone code can be 'H' or 'L' for high or low
@@ -58,4 +76,58 @@ type Terminal interface {
 	// Write to the LCD. The "row" is the row to write to (starting with
 	// 0). The "text" is the line to be written.
 	WriteLCD(row int, text string)
+
+	// Write several rows at once, starting with row 0. Prefer this when
+	// changing both rows: where the firmware supports it, that is a single
+	// command instead of one per row.
+	WriteLCDLines(lines []string)
+
+	// Show the text on the row for the given duration, then go back to
+	// what was shown before, e.g. for a short "Access granted". Writing
+	// the row in the meantime cancels the revert.
+	WriteLCDTemporary(row int, text string, duration time.Duration)
+}
+
+// Hardware of a terminal. Firmware that doesn't tell has everything, with
+// the LCD size we format for.
+type TerminalCapabilities struct {
+	LED        bool // RGB LEDs for ShowColor().
+	Buzzer     bool // For BuzzSpeaker().
+	LCD        bool
+	LCDColumns int
+	LCDRows    int
+}
+
+func FullTerminalCapabilities() TerminalCapabilities {
+	return TerminalCapabilities{LED: true, Buzzer: true, LCD: true,
+		LCDColumns: maxLCDCols, LCDRows: maxLCDRows}
+}
+
+// Colors for Terminal.ShowColor(), in the form NormalizeColor() returns.
+const (
+	ColorOff     = ""
+	ColorRed     = "R"
+	ColorGreen   = "G"
+	ColorBlue    = "B"
+	ColorYellow  = "RG"
+	ColorMagenta = "RB"
+	ColorCyan    = "GB"
+	ColorWhite   = "RGB"
+)
+
+// Bring a color string in the canonical form the firmware understands:
+// each of 'R', 'G', 'B' at most once, in that order. So "GR" and "RRG"
+// become "RG". Anything else is dropped, and reported in the error.
+func NormalizeColor(colors string) (string, error) {
+	var result strings.Builder
+	for _, c := range "RGB" {
+		if strings.ContainsRune(colors, c) {
+			result.WriteRune(c)
+		}
+	}
+	if strings.Trim(colors, "RGB") != "" {
+		return result.String(), fmt.Errorf(
+			"color needs to be made of R, G, B; got '%s'", colors)
+	}
+	return result.String(), nil
 }
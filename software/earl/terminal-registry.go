@@ -0,0 +1,116 @@
+// Keeps track of the terminals currently connected, so that status
+// information can be reported, e.g. via the http-api.
+//
+// Each target (and each door of a terminal controlling several) can only be
+// claimed by one connected terminal: if two terminals report the same name,
+// the second is refused instead of both opening the same door.
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Snapshot of what we know about a connected terminal.
+type TerminalStatus struct {
+	Device          string    `json:"device"` // Serial device and baudrate
+	Name            string    `json:"name"`
+	Target          Target    `json:"target"` // Usually same as name.
+	Doors           []Target  `json:"doors,omitempty"`
+	FirmwareVersion string    `json:"firmware"`
+	ConnectedSince  time.Time `json:"connected-since"`
+
+	// Filled in by Snapshot() from Stats.
+	Stats TerminalStats `json:"stats"`
+
+	// Returns the current counters. Called with the registry lock held,
+	// so needs to be quick. Optional.
+	StatsFunc func() TerminalStats `json:"-"`
+}
+
+// Counters to tell a flaky cable (many reconnects, errors) from flaky
+// firmware (unexpected responses) or an unused terminal (no events).
+// Totals over all connections on the device.
+type TerminalStats struct {
+	Reconnects    int    `json:"reconnects"`
+	Commands      uint64 `json:"commands"`       // Sent to the terminal.
+	CommandErrors uint64 `json:"command-errors"` // Timeouts, bad answers.
+	Events        uint64 `json:"events"`         // Keypresses and RFIDs.
+	Uptime        string `json:"uptime"`         // Of this connection.
+}
+
+// Sum of both; Reconnects and Uptime are taken from other.
+func (s TerminalStats) Add(other TerminalStats) TerminalStats {
+	other.Commands += s.Commands
+	other.CommandErrors += s.CommandErrors
+	other.Events += s.Events
+	return other
+}
+
+type TerminalRegistry struct {
+	lock      sync.Mutex
+	terminals map[string]*TerminalStatus // By device.
+	targets   map[Target]string          // Device that claimed target.
+}
+
+func NewTerminalRegistry() *TerminalRegistry {
+	return &TerminalRegistry{
+		terminals: make(map[string]*TerminalStatus),
+		targets:   make(map[Target]string),
+	}
+}
+
+// Register a connected terminal, claiming its target and doors. If any of
+// these is already claimed by a terminal on another device, the terminal is
+// not registered; returns false and that device.
+func (r *TerminalRegistry) Connected(status TerminalStatus) (bool, string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, target := range status.claims() {
+		if device, claimed := r.targets[target]; claimed && device != status.Device {
+			return false, device
+		}
+	}
+	r.terminals[status.Device] = &status
+	for _, target := range status.claims() {
+		r.targets[target] = status.Device
+	}
+	return true, ""
+}
+
+// Unregister terminal, releasing its target and doors.
+func (r *TerminalRegistry) Disconnected(device string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if status, ok := r.terminals[device]; ok {
+		for _, target := range status.claims() {
+			delete(r.targets, target)
+		}
+		delete(r.terminals, device)
+	}
+}
+
+func (s *TerminalStatus) claims() []Target {
+	return append([]Target{s.Target}, s.Doors...)
+}
+
+// Returns a copy of the status of all connected terminals, sorted by name.
+func (r *TerminalRegistry) Snapshot() []TerminalStatus {
+	r.lock.Lock()
+	result := make([]TerminalStatus, 0, len(r.terminals))
+	for _, status := range r.terminals {
+		snapshot := *status
+		if status.StatsFunc != nil {
+			snapshot.Stats = status.StatsFunc()
+		}
+		snapshot.Stats.Uptime = time.Since(status.ConnectedSince).
+			Truncate(time.Second).String()
+		result = append(result, snapshot)
+	}
+	r.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistryRefusesDuplicateTarget(t *testing.T) {
+	registry := NewTerminalRegistry()
+	ok, _ := registry.Connected(TerminalStatus{Device: "/dev/ttyUSB0:9600",
+		Name: "upstairs", Target: TargetUpstairs})
+	ExpectTrue(t, ok, "First terminal claims upstairs")
+
+	ok, claimedBy := registry.Connected(TerminalStatus{Device: "/dev/ttyUSB1:9600",
+		Name: "upstairs", Target: TargetUpstairs})
+	ExpectFalse(t, ok, "Second terminal with same target refused")
+	ExpectTrue(t, claimedBy == "/dev/ttyUSB0:9600", "Refusal names device")
+	ExpectTrue(t, len(registry.Snapshot()) == 1, "Only first registered")
+
+	// Reconnect on the same device is fine.
+	ok, _ = registry.Connected(TerminalStatus{Device: "/dev/ttyUSB0:9600",
+		Name: "upstairs", Target: TargetUpstairs})
+	ExpectTrue(t, ok, "Same device can reclaim")
+
+	// Once the first is gone, the target is free again.
+	registry.Disconnected("/dev/ttyUSB0:9600")
+	ok, _ = registry.Connected(TerminalStatus{Device: "/dev/ttyUSB1:9600",
+		Name: "upstairs", Target: TargetUpstairs})
+	ExpectTrue(t, ok, "Target released on disconnect")
+
+	// A refused terminal disconnecting doesn't release anything.
+	registry.Disconnected("/dev/ttyUSB0:9600")
+	ok, _ = registry.Connected(TerminalStatus{Device: "/dev/ttyUSB2:9600",
+		Name: "upstairs", Target: TargetUpstairs})
+	ExpectFalse(t, ok, "Still claimed by second terminal")
+}
+
+func TestRegistrySnapshotHasStats(t *testing.T) {
+	registry := NewTerminalRegistry()
+	registry.Connected(TerminalStatus{Device: "/dev/ttyUSB0:9600",
+		Name: "gate", Target: TargetDownstairs,
+		ConnectedSince: time.Now().Add(-90 * time.Second),
+		StatsFunc: func() TerminalStats {
+			return TerminalStats{Reconnects: 2, Commands: 42}
+		}})
+	stats := registry.Snapshot()[0].Stats
+	ExpectTrue(t, stats.Reconnects == 2 && stats.Commands == 42,
+		"Current stats")
+	ExpectTrue(t, stats.Uptime == "1m30s", "Uptime "+stats.Uptime)
+
+	// Totals of earlier connections are added.
+	total := TerminalStats{Commands: 10, Events: 3}.Add(
+		TerminalStats{Reconnects: 1, Commands: 5, CommandErrors: 1})
+	ExpectTrue(t, total == TerminalStats{Reconnects: 1, Commands: 15,
+		CommandErrors: 1, Events: 3}, "Added")
+}
+
+func TestRegistryClaimsAllDoors(t *testing.T) {
+	registry := NewTerminalRegistry()
+	ok, _ := registry.Connected(TerminalStatus{Device: "/dev/ttyUSB0:9600",
+		Name: "gate", Target: TargetDownstairs,
+		Doors: []Target{"inner-gate", "outer-gate"}})
+	ExpectTrue(t, ok, "Two-door terminal")
+
+	ok, _ = registry.Connected(TerminalStatus{Device: "/dev/ttyUSB1:9600",
+		Name: "outer-gate", Target: "outer-gate"})
+	ExpectFalse(t, ok, "Door already claimed")
+
+	registry.Disconnected("/dev/ttyUSB0:9600")
+	ok, _ = registry.Connected(TerminalStatus{Device: "/dev/ttyUSB1:9600",
+		Name: "outer-gate", Target: "outer-gate"})
+	ExpectTrue(t, ok, "Doors released on disconnect")
+}
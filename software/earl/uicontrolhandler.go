@@ -7,6 +7,24 @@
 //
 // It is a regular terminal (same serial protocol), but has a LCD attached as
 // output and a Keypad and RFID reader as input.
+//
+// Admin commands. Typing *0# on the idle terminal enters the command mode.
+// After a member shows their RFID, the menu offers
+//
+//	[1] Look up code: show an RFID or type a PIN followed by [#];
+//	    shows name and level of the user.
+//	[2] Check expiry: same, shows when the code expires.
+//	[3] Lockdown: [0] cycles through the lockdown modes, [#] activates
+//	    the one shown.
+//	[4] Hold open: [0] cycles through the doors, [#] picks the one shown.
+//	    Then type the minutes followed by [#] (just [#] for the maximum).
+//	    Shows the time left; [*] closes the door early.
+//
+// After a result is shown, the menu is offered again. [*] cancels at any
+// time, and the terminal goes back to idle after adminTimeout without input.
+//
+// During a -selftest with confirmation, each tested output is shown, and
+// the operator answers with [#] if it worked or [0] if not.
 package main
 
 // TODO
@@ -15,6 +33,9 @@ package main
 //  - make this state-machine more readable.
 import (
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,9 +45,20 @@ const (
 	StateIdle               = iota // When there is nothing to do; idle screen.
 	StateDisplayInfoMessage        // Interrupt idle screen and show info message
 	StateWaitMenuChoice            // Member/Philanthropist showed RFID; awaiting instruction
-	StateAddAwaitNewRFID           // Member adds new user: wait for new user RFID
+	StateAddAwaitValidity          // Member adds new user: days valid, optional
+	StateAddAwaitNewRFID           // Member adds new user: wait for new card swiped
 	StateUpdateAwaitRFID           // Member/Philanthropist updates user: wait for new user RFID
 	StateDoorbellRequest           // Someone just rang
+	StateLockdownChoice            // Member selects lockdown mode
+	StateAdminAwaitMember          // Admin command mode: wait for member RFID
+	StateAdminMenu                 // Admin command mode: awaiting command
+	StateAdminLookupCode           // Admin command: wait for code to look up
+	StateAdminExpiryCode           // Admin command: wait for code to check expiry
+	StateSelfTestConfirm           // Operator confirms a self-test step
+	StateHoldOpenChoice            // Admin command: pick door to hold open
+	StateHoldOpenMinutes           // Admin command: how long to hold it open
+	StateHoldOpen                  // Door held open; counting down
+	StateProvisionToken            // No members yet: token for the first
 )
 
 const (
@@ -37,6 +69,28 @@ const (
 	offerSilenceWhenRepeatedRingsUnder = 2 * time.Second
 	silenceDoorbellIncrement           = 60 * time.Second
 	maxSilenceDoorbell                 = 5 * 60 * time.Second
+
+	// Guest codes created on the control terminal are valid this long.
+	guestCodeValidity = 4 * time.Hour
+
+	// Users added on this terminal can be valid for at most this many
+	// days; more digits are ignored.
+	maxValidityDigits = 3
+
+	// Keys to type on the idle terminal to enter admin command mode.
+	adminCommandPrefix = "*0#"
+	adminTimeout       = 30 * time.Second
+
+	// Longest a door can be held open, unless configured otherwise.
+	defaultHoldOpenMax = 15 * time.Minute
+
+	// Minutes typed to hold a door open; anything above holdOpenMax is
+	// cut to it anyway, so this only needs to fit a configured day.
+	maxHoldOpenDigits = 4
+
+	// How long adding or renewing a user waits for the next key or card,
+	// unless configured otherwise.
+	defaultEnrollTimeout = 30 * time.Second
 )
 
 const (
@@ -47,10 +101,28 @@ const (
 type UIControlHandler struct {
 	backends *Backends
 	auth     Authenticator // shortcut, copy of the pointer in backends
+	clock    Clock
 
-	t Terminal
+	t       Terminal
+	display DisplayState // Restored on reconnect.
 
-	authUserCode string // current active member code
+	feedback     FeedbackProfile
+	colorOffTime time.Time // Back to the idle color; zero if showing it.
+
+	authUserCode  string // current active member code
+	keyInput      string // Keys typed: command prefix or code to query.
+	provisionRFID string // Card to become the first member.
+
+	proposedLockdown LockdownMode // Mode to set in StateLockdownChoice
+	newUserValidDays int          // For the user to add. 0: no expiry.
+	selfTestOutput   string       // Output to confirm in StateSelfTestConfirm
+
+	holdOpenDoors  []Target      // Doors that can be held open.
+	holdOpenMax    time.Duration // Longest to hold one open.
+	holdOpenTarget Target        // Door chosen or held open.
+	holdOpenUntil  time.Time
+
+	enrollTimeout time.Duration // Idle time to give up adding a user.
 
 	state        UIState   // state of our state machine
 	stateTimeout time.Time // timeout of current state
@@ -74,8 +146,13 @@ func NewControlHandler(backends *Backends) *UIControlHandler {
 	return &UIControlHandler{
 		backends:               backends,
 		auth:                   backends.authenticator,
+		clock:                  RealClock{},
 		userCounter:            time.Now().Second() % 100, // semi-random start
 		observedDoorOpenStatus: make(map[Target]int),
+		holdOpenDoors:          []Target{TargetDownstairs, TargetUpstairs},
+		holdOpenMax:            defaultHoldOpenMax,
+		enrollTimeout:          defaultEnrollTimeout,
+		feedback:               DefaultFeedbackProfileFor(TargetControlUI),
 	}
 }
 
@@ -83,21 +160,53 @@ func NewControlHandler(backends *Backends) *UIControlHandler {
 // the timeout is reached and we fall back to the idleScreen
 func (u *UIControlHandler) setStateWithTimeout(state UIState, timeout_in time.Duration) {
 	u.state = state
-	u.stateTimeout = time.Now().Add(timeout_in)
+	u.stateTimeout = u.clock.Now().Add(timeout_in)
 }
 
+// Forgets the member and anything half-entered, e.g. a user being added.
 func (u *UIControlHandler) backToIdle() {
 	u.state = StateIdle
 	u.authUserCode = ""
+	u.keyInput = ""
+	u.provisionRFID = ""
+	u.newUserValidDays = 0
 	u.displayIdleScreen()
 }
 
 func (u *UIControlHandler) Init(t Terminal) {
-	u.t = t
+	u.display.Attach(t)
+	u.t = &u.display
+	u.showIdleColor()
+}
+
+// LED and tone for the event. A color with a duration goes back to the
+// idle color after it.
+func (u *UIControlHandler) giveFeedback(event FeedbackEvent) {
+	feedback := u.feedback[event]
+	if feedback.Tone != "" {
+		u.t.BuzzSpeaker(feedback.Tone, time.Duration(feedback.ToneDuration))
+	}
+	if feedback.Color == "" {
+		return
+	}
+	u.t.ShowColor(feedback.Color)
+	u.colorOffTime = time.Time{}
+	if feedback.ColorDuration > 0 {
+		u.colorOffTime = u.clock.Now().Add(time.Duration(feedback.ColorDuration))
+	}
+}
+
+func (u *UIControlHandler) showIdleColor() {
+	u.colorOffTime = time.Time{}
+	if idle := u.feedback[FeedbackIdle]; idle.Color != "" {
+		u.t.ShowColor(idle.Color)
+	}
 }
 
 func (u *UIControlHandler) HandleShutdown() {}
 
+func (u *UIControlHandler) HandlePowerStatus(ok bool) {}
+
 func (u *UIControlHandler) CurrentAuthLevel() Level {
 	user := u.auth.FindUser(u.authUserCode)
 	if user == nil {
@@ -108,22 +217,143 @@ func (u *UIControlHandler) CurrentAuthLevel() Level {
 
 func (u *UIControlHandler) HandleKeypress(key byte) {
 	if key == '*' { // The '*' key is always 'Esc'-equivalent
+		if u.state == StateHoldOpen {
+			u.closeHeldDoor()
+		}
 		u.backToIdle()
+		u.keyInput = "*" // ... but also starts the admin command.
 		return
 	}
 
 	switch u.state {
+	case StateIdle:
+		u.keyInput += string(key)
+		if u.keyInput == adminCommandPrefix {
+			u.keyInput = ""
+			u.t.WriteLCDLines([]string{"Admin: show member RFID", "[*] Cancel"})
+			u.setStateWithTimeout(StateAdminAwaitMember, adminTimeout)
+		} else if !strings.HasPrefix(adminCommandPrefix, u.keyInput) {
+			u.keyInput = ""
+		}
+
+	case StateAdminMenu:
+		switch key {
+		case '1':
+			u.awaitAdminQueryCode(StateAdminLookupCode, "Look up code")
+		case '2':
+			u.awaitAdminQueryCode(StateAdminExpiryCode, "Check expiry of code")
+		case '3':
+			if u.backends.lockdown != nil {
+				u.proposedLockdown = u.backends.lockdown.Mode()
+				u.proposeNextLockdownMode()
+			}
+		case '4':
+			if len(u.holdOpenDoors) > 0 {
+				u.holdOpenTarget = ""
+				u.proposeNextHoldOpenDoor()
+			}
+		}
+
+	case StateHoldOpenChoice:
+		switch key {
+		case '0':
+			u.proposeNextHoldOpenDoor()
+		case '#':
+			u.keyInput = ""
+			u.t.WriteLCDLines([]string{"Minutes to hold open?",
+				fmt.Sprintf("[#] for %d max", u.holdOpenMaxMinutes())})
+			u.setStateWithTimeout(StateHoldOpenMinutes, adminTimeout)
+		}
+
+	case StateHoldOpenMinutes:
+		switch {
+		case key == '#':
+			minutes, _ := strconv.Atoi(u.keyInput)
+			u.keyInput = ""
+			u.holdDoorOpen(time.Duration(minutes) * time.Minute)
+		case key >= '0' && key <= '9' && len(u.keyInput) < maxHoldOpenDigits:
+			u.keyInput += string(key)
+			u.t.WriteLCD(1, u.keyInput+" min [#]")
+			u.setStateWithTimeout(u.state, adminTimeout)
+		}
+
+	case StateSelfTestConfirm:
+		switch key {
+		case '#':
+			u.confirmSelfTest(SelfTestWorked)
+		case '0':
+			u.confirmSelfTest(SelfTestFailed)
+		}
+
+	case StateAdminLookupCode, StateAdminExpiryCode:
+		if key == '#' {
+			u.runAdminQuery(u.keyInput)
+		} else {
+			u.keyInput += string(key)
+			u.t.WriteLCD(1, strings.Repeat("*", len(u.keyInput))+"#")
+			u.setStateWithTimeout(u.state, adminTimeout)
+		}
+
+	case StateProvisionToken:
+		if key == '#' {
+			u.provisionMember()
+		} else {
+			u.keyInput += string(key)
+			u.t.WriteLCD(1, strings.Repeat("*", len(u.keyInput))+"#")
+		}
+
 	case StateWaitMenuChoice:
 		level := u.CurrentAuthLevel()
 		if key == '1' && CanLevelAddDelete(level) {
-			u.t.WriteLCD(0, "Read new user RFID")
-			u.t.WriteLCD(1, "[*] Cancel")
-			u.setStateWithTimeout(StateAddAwaitNewRFID, 30*time.Second)
+			u.keyInput = ""
+			u.t.WriteLCDLines([]string{"Days valid? [#] No limit",
+				"...or swipe new card"})
+			u.setStateWithTimeout(StateAddAwaitValidity, u.enrollTimeout)
 		}
 		if key == '2' && CanLevelModify(level) {
-			u.t.WriteLCD(0, "Read user RFID to renew")
-			u.t.WriteLCD(1, "[*] Cancel")
-			u.setStateWithTimeout(StateUpdateAwaitRFID, 30*time.Second)
+			u.t.WriteLCDLines([]string{"Read user RFID to renew", "[*] Cancel"})
+			u.setStateWithTimeout(StateUpdateAwaitRFID, u.enrollTimeout)
+		}
+		if key == '3' && CanLevelAddDelete(level) {
+			u.createGuestCode()
+		}
+
+	case StateAddAwaitValidity:
+		switch {
+		case key == '#':
+			u.newUserValidDays, _ = strconv.Atoi(u.keyInput)
+			u.keyInput = ""
+			u.t.WriteLCD(0, "Swipe new user's card")
+			if u.newUserValidDays > 0 {
+				u.t.WriteLCD(1, "Valid until "+u.newUserValidTo().Format("Jan 02"))
+			} else {
+				u.t.WriteLCD(1, "[*] Cancel")
+			}
+			u.setStateWithTimeout(StateAddAwaitNewRFID, u.enrollTimeout)
+		case key >= '0' && key <= '9' && len(u.keyInput) < maxValidityDigits:
+			u.keyInput += string(key)
+			u.t.WriteLCD(1, u.keyInput+" days [#]")
+			u.setStateWithTimeout(u.state, u.enrollTimeout)
+		}
+
+	case StateLockdownChoice:
+		switch key {
+		case '0':
+			u.proposeNextLockdownMode()
+		case '#':
+			member := u.actingMember()
+			if member == nil {
+				return
+			}
+			err := u.backends.lockdown.SetMode(u.proposedLockdown,
+				member.Name+" on "+u.t.GetTerminalName())
+			if err != nil {
+				u.t.WriteLCD(0, "Not saved: "+err.Error())
+			} else {
+				u.t.WriteLCD(0, "Lockdown: "+u.proposedLockdown.String())
+			}
+			u.t.WriteLCD(1, "[*] Done")
+			u.setStateWithTimeout(StateDisplayInfoMessage, 5*time.Second)
 		}
 
 	case StateDoorbellRequest:
@@ -147,12 +377,16 @@ func (u *UIControlHandler) HandleKeypress(key byte) {
 }
 
 func (u *UIControlHandler) HandleRFID(rfid string) {
+	rfid = NormalizeRFID(rfid)
 	switch u.state {
 	case StateIdle:
 		user := u.auth.FindUser(rfid)
-		if user == nil {
-			u.t.WriteLCD(0, "      Unknown RFID")
-			u.t.WriteLCD(1, "Ask a member to register")
+		if user == nil && u.auth.NeedsProvisioning() {
+			u.startProvisioning(rfid)
+		} else if user == nil {
+			u.giveFeedback(FeedbackUnknown)
+			u.t.WriteLCDLines([]string{"      Unknown RFID",
+				"Ask a member to register"})
 		} else {
 			switch user.UserLevel {
 			case LevelMember:
@@ -168,41 +402,44 @@ func (u *UIControlHandler) HandleRFID(rfid string) {
 			}
 		}
 
+	case StateAdminAwaitMember:
+		u.authUserCode = rfid
+		if u.actingMember() != nil {
+			u.presentAdminMenu()
+		}
+
+	case StateAdminLookupCode, StateAdminExpiryCode:
+		u.runAdminQuery(rfid)
+
+	case StateAddAwaitValidity:
+		// Showing the card right away: no expiry.
+		u.newUserValidDays = 0
+		u.keyInput = ""
+		if !u.rejectNewCard(rfid) {
+			u.addNewUser(rfid)
+		}
+
 	case StateAddAwaitNewRFID:
-		// Let's create some name that is somewhat unique to be
-		// easy to find in the file later to edit.
-		userPrefix := time.Now().Format("0102-15")
-		u.userCounter++
-		userName := fmt.Sprintf("<u%s%02d>",
-			userPrefix, u.userCounter%100)
-		newUser := User{
-			Name:      userName,
-			UserLevel: LevelUser}
-		newUser.SetAuthCode(rfid)
-		if ok, msg := u.auth.AddNewUser(u.authUserCode, newUser); ok {
-			u.t.WriteLCD(0,
-				fmt.Sprintf("Success! += %s", userName))
-		} else {
-			u.t.WriteLCD(0, "Trouble:"+msg)
+		if !u.rejectNewCard(rfid) {
+			u.addNewUser(rfid)
 		}
-		u.t.WriteLCD(1, "[*] Done    [1] Add More")
-		u.setStateWithTimeout(StateWaitMenuChoice, 5*time.Second)
 
 	case StateUpdateAwaitRFID:
 		updateUser := u.auth.FindUser(rfid)
 		if updateUser == nil {
 			u.t.WriteLCD(0, "Unknown RFID")
-		} else if updateUser.ExpiryDate(time.Now()).IsZero() {
+		} else if updateUser.ExpiryDate(u.localNow()).IsZero() {
 			u.t.WriteLCD(0, fmt.Sprintf("%s does not expire", updateUser.Name))
 		} else {
 			// TODO: maybe ask for confirmation ?
 			u.auth.UpdateUser(u.authUserCode, rfid,
 				func(user *User) bool {
-					user.ValidFrom = time.Now()
+					// Renewing is like registering again.
+					user.RegisteredAt = u.clock.Now()
 					return true
 				})
 			updateUser = u.auth.FindUser(rfid)
-			newExp := updateUser.ExpiryDate(time.Now()).Format("Jan 02")
+			newExp := updateUser.ExpiryDate(u.localNow()).Format("Jan 02")
 			u.t.WriteLCD(0, fmt.Sprintf("Extended to %s", newExp))
 		}
 		u.t.WriteLCD(1, "[*] Done [2] Renew More")
@@ -219,11 +456,119 @@ func (u *UIControlHandler) HandleRFID(rfid string) {
 	}
 }
 
+// Let's create some name that is somewhat unique to be
+// easy to find in the file later to edit.
+func (u *UIControlHandler) newUserName() string {
+	userPrefix := u.clock.Now().Format("0102-15")
+	u.userCounter++
+	return fmt.Sprintf("<u%s%02d>", userPrefix, u.userCounter%100)
+}
+
+// Add a user with the given RFID, valid for newUserValidDays if set.
+func (u *UIControlHandler) addNewUser(rfid string) {
+	userName := u.newUserName()
+	newUser := User{
+		Name:      userName,
+		UserLevel: LevelUser,
+		Comment:   u.addedByComment()}
+	if u.newUserValidDays > 0 {
+		newUser.ValidTo = u.newUserValidTo()
+	}
+	newUser.SetRFIDCode(rfid)
+	if ok, msg := u.auth.AddNewUser(u.authUserCode, newUser); ok {
+		u.giveFeedback(FeedbackGranted)
+		u.t.WriteLCD(0,
+			fmt.Sprintf("Success! += %s", userName))
+	} else {
+		u.giveFeedback(FeedbackDenied)
+		u.t.WriteLCD(0, "Trouble:"+msg)
+	}
+	u.t.WriteLCD(1, "[*] Done    [1] Add More")
+	u.setStateWithTimeout(StateWaitMenuChoice, 5*time.Second)
+}
+
+// Nobody could add users without a member: offer the card shown to
+// become the first one. See provisioning.go
+func (u *UIControlHandler) startProvisioning(rfid string) {
+	u.provisionRFID = rfid
+	u.keyInput = ""
+	u.t.WriteLCDLines([]string{"No members: first one?", "Token then # [*] ESC"})
+	u.setStateWithTimeout(StateProvisionToken, 60*time.Second)
+}
+
+func (u *UIControlHandler) provisionMember() {
+	member := User{
+		Name:    u.newUserName(),
+		Comment: "first member, provisioned on " + u.t.GetTerminalName()}
+	member.SetRFIDCode(u.provisionRFID)
+	ok, msg := u.auth.ProvisionMember(u.keyInput, member)
+	u.keyInput = ""
+	if ok {
+		u.provisionRFID = ""
+		u.giveFeedback(FeedbackGranted)
+		u.t.WriteLCDLines([]string{"Welcome, first member!", member.Name})
+		u.setStateWithTimeout(StateDisplayInfoMessage, 5*time.Second)
+		return
+	}
+	u.giveFeedback(FeedbackDenied)
+	u.t.WriteLCD(0, "Trouble:"+msg)
+	if !u.auth.NeedsProvisioning() {
+		u.t.WriteLCD(1, "")
+		u.setStateWithTimeout(StateDisplayInfoMessage, 5*time.Second)
+		return
+	}
+	u.t.WriteLCD(1, "Token then # [*] ESC") // Try again.
+	u.setStateWithTimeout(StateProvisionToken, 60*time.Second)
+}
+
+// Guard against enrolling the wrong card: the member showing their own
+// card again, or a card that already belongs to someone. Keeps waiting for
+// the right card if so.
+func (u *UIControlHandler) rejectNewCard(rfid string) bool {
+	problem := ""
+	if rfid == u.authUserCode {
+		problem = "That's your own card"
+	} else if existing := u.auth.FindUser(rfid); existing != nil {
+		problem = "Already has " + existing.Name
+	} else {
+		return false
+	}
+	u.keyInput = ""
+	u.t.WriteLCDLines([]string{problem, "Swipe other card [*] ESC"})
+	u.setStateWithTimeout(StateAddAwaitNewRFID, u.enrollTimeout)
+	return true
+}
+
+// When a user added now with newUserValidDays expires: at local midnight
+// starting the day shown as "Valid until".
+func (u *UIControlHandler) newUserValidTo() time.Time {
+	return startOfDayAfter(u.localNow(), u.newUserValidDays)
+}
+
+// The current time where our days start and end.
+func (u *UIControlHandler) localNow() time.Time {
+	now := u.clock.Now()
+	if u.backends.location != nil {
+		now = now.In(u.backends.location)
+	}
+	return now
+}
+
 // We switch back to idle after some time, handled in this tick. Also, if we
 // pick up request from other sub-systems and we are done with whatever we are
 // doing
 func (u *UIControlHandler) HandleTick() {
-	if u.state != StateIdle && time.Now().After(u.stateTimeout) {
+	if !u.colorOffTime.IsZero() && !u.clock.Now().Before(u.colorOffTime) {
+		u.showIdleColor()
+	}
+	if u.state == StateHoldOpen {
+		if u.clock.Now().Before(u.holdOpenUntil) {
+			u.showHoldOpenCountdown()
+			return
+		}
+		u.backToIdle() // The door closed by itself.
+	}
+	if u.state != StateIdle && u.clock.Now().After(u.stateTimeout) {
 		u.backToIdle()
 	}
 
@@ -238,13 +583,20 @@ func (u *UIControlHandler) HandleAppEvent(event *AppEvent) {
 	switch event.Ev {
 	case AppDoorbellTriggerEvent:
 		// We interrupt whatever we are doing now, as this is
-		// more important:
-		u.startDoorOpenUI(event.Target, event.Msg)
+		// more important. Except holding a door open: we'd lose
+		// the way to close it.
+		if u.state != StateHoldOpen {
+			u.startDoorOpenUI(event.Target, doorbellMessage(event))
+		}
 	case AppOpenRequest:
 		u.actionMessage = "Opening " + string(event.Target)
 		u.actionMessageTimeout = time.Now().Add(2 * time.Second)
 	case AppHushBellRequest:
 		u.hushedDoorbellTimeout = event.Timeout
+	case AppSelfTestStep:
+		u.selfTestOutput = event.Msg
+		u.t.WriteLCDLines([]string{"Test: " + event.Msg, "[#] Worked [0] Failed"})
+		u.setStateWithTimeout(StateSelfTestConfirm, selfTestConfirmTimeout)
 	case AppDoorSensorEvent:
 		u.observedDoorOpenStatus[event.Target] = event.Value
 		if event.Value == 1 {
@@ -278,7 +630,9 @@ func (u *UIControlHandler) displayIdleScreen() {
 	// -- Status message line
 	// Let's see if there is anything interesting to display in
 	// the status screen, otherwise fall back to 'Noisebridge'
-	if u.hushedDoorbellTimeout.After(now) {
+	if mode := u.backends.lockdown.Mode(); mode != LockdownOff {
+		u.t.WriteLCD(0, "LOCKDOWN: "+mode.String())
+	} else if u.hushedDoorbellTimeout.After(now) {
 		u.t.WriteLCD(0, fmt.Sprintf("Bell silenced %dsec",
 			u.hushedDoorbellTimeout.Sub(now)/time.Second))
 	} else if doorStatus := u.getDoorStatusString(); doorStatus != "" {
@@ -298,11 +652,187 @@ func (u *UIControlHandler) displayIdleScreen() {
 
 func (u *UIControlHandler) presentMemberActions(member *User) {
 	u.t.WriteLCD(0, fmt.Sprintf("Howdy %s", member.Name))
-	u.t.WriteLCD(1, "[*]ESC [1]Add [2]Renew")
+	u.t.WriteLCD(1, "[1]Add [2]Renew [3]Guest")
 
 	u.setStateWithTimeout(StateWaitMenuChoice, 5*time.Second)
 }
 
+// Note for users added on this terminal, so that it is possible to find
+// out later whom to ask about a card.
+func (u *UIControlHandler) addedByComment() string {
+	comment := "added on " + u.t.GetTerminalName()
+	if member := u.auth.FindUser(u.authUserCode); member != nil {
+		comment += " by " + member.Name
+	}
+	return comment
+}
+
+// Create a guest PIN and show it, so that the member can pass it on.
+func (u *UIControlHandler) createGuestCode() {
+	code, err := u.auth.CreateGuestCode(u.authUserCode, guestCodeValidity, "")
+	if err != nil {
+		u.giveFeedback(FeedbackDenied)
+		u.t.WriteLCD(0, "Trouble:"+err.Error())
+		u.t.WriteLCD(1, "[*] Done")
+		u.setStateWithTimeout(StateWaitMenuChoice, 5*time.Second)
+		return
+	}
+	u.giveFeedback(FeedbackGranted)
+	u.t.WriteLCD(0, "Guest PIN: "+code+"#")
+	u.t.WriteLCD(1, "Valid until "+
+		time.Now().Add(guestCodeValidity).Format("15:04"))
+	u.setStateWithTimeout(StateDisplayInfoMessage, 30*time.Second)
+}
+
+func (u *UIControlHandler) confirmSelfTest(result int) {
+	u.backends.appEventBus.Post(&AppEvent{
+		Ev:     AppSelfTestConfirm,
+		Source: u.t.GetTerminalName(),
+		Msg:    u.selfTestOutput,
+		Value:  result,
+	})
+	u.backToIdle()
+}
+
+func (u *UIControlHandler) presentAdminMenu() {
+	u.t.WriteLCD(1, "1Code 2Exp 3Lock 4Hold")
+	u.setStateWithTimeout(StateAdminMenu, adminTimeout)
+}
+
+func (u *UIControlHandler) awaitAdminQueryCode(state UIState, prompt string) {
+	u.keyInput = ""
+	u.t.WriteLCD(0, prompt)
+	u.t.WriteLCD(1, "RFID or PIN#")
+	u.setStateWithTimeout(state, adminTimeout)
+}
+
+// Answer the query of the current state for the given code, then show
+// the admin menu again.
+func (u *UIControlHandler) runAdminQuery(code string) {
+	u.keyInput = ""
+	// Codes are mostly used at the gate, so that is what we check.
+	decision := u.auth.CheckCode(code, TargetDownstairs)
+	user := decision.User
+	switch {
+	case user == nil:
+		u.t.WriteLCD(0, "Unknown code")
+	case u.state == StateAdminLookupCode && !decision.Granted:
+		u.t.WriteLCD(0, fmt.Sprintf("%s: %s", user.Name,
+			decision.Reason.DisplayMessage()))
+	case u.state == StateAdminLookupCode:
+		u.t.WriteLCD(0, fmt.Sprintf("%s (%s)", user.Name, user.UserLevel))
+	default:
+		now := u.localNow()
+		expiry := user.ExpiryDate(now)
+		if expiry.IsZero() {
+			u.t.WriteLCD(0, "Does not expire")
+		} else if user.InValidityPeriod(now) {
+			u.t.WriteLCD(0, "Expires "+expiry.Format("2006-01-02"))
+		} else {
+			u.t.WriteLCD(0, "Expired "+expiry.Format("2006-01-02"))
+		}
+	}
+	u.presentAdminMenu()
+}
+
+// Show the lockdown mode following the currently proposed one.
+func (u *UIControlHandler) proposeNextLockdownMode() {
+	u.proposedLockdown = (u.proposedLockdown + 1) % (LockdownAll + 1)
+	u.t.WriteLCD(0, "Lockdown: "+u.proposedLockdown.String()+"?")
+	u.t.WriteLCD(1, "[0] Next [#] Set [*] ESC")
+	u.setStateWithTimeout(StateLockdownChoice, 30*time.Second)
+}
+
+// Show the door following the currently proposed one to hold open.
+func (u *UIControlHandler) proposeNextHoldOpenDoor() {
+	next := 0
+	for i, door := range u.holdOpenDoors {
+		if door == u.holdOpenTarget {
+			next = (i + 1) % len(u.holdOpenDoors)
+		}
+	}
+	u.holdOpenTarget = u.holdOpenDoors[next]
+	u.t.WriteLCDLines([]string{"Hold open: " + string(u.holdOpenTarget) + "?",
+		"[0] Next [#] Pick [*] ESC"})
+	u.setStateWithTimeout(StateHoldOpenChoice, adminTimeout)
+}
+
+func (u *UIControlHandler) holdOpenMaxMinutes() int {
+	return int(u.holdOpenMax / time.Minute)
+}
+
+// Open the chosen door for the given time, at most holdOpenMax; 0 for the
+// maximum. Unlike a regular grant, this is a staff action, so it goes to
+// the log with the name of the member.
+func (u *UIControlHandler) holdDoorOpen(duration time.Duration) {
+	if u.actingMember() == nil {
+		return
+	}
+	if u.backends.maintenance.Active(u.holdOpenTarget) {
+		u.giveFeedback(FeedbackDenied)
+		u.t.WriteLCDLines([]string{string(u.holdOpenTarget) + ":", "In maintenance"})
+		u.setStateWithTimeout(StateDisplayInfoMessage, 3*time.Second)
+		return
+	}
+	if duration <= 0 || duration > u.holdOpenMax {
+		duration = u.holdOpenMax
+	}
+	u.holdOpenUntil = u.clock.Now().Add(duration)
+	log.Printf("%s: STAFF %s holds %s open for %s", u.t.GetTerminalName(),
+		u.memberName(), u.holdOpenTarget, duration)
+	u.backends.appEventBus.Post(&AppEvent{
+		Ev:      AppOpenRequest,
+		Target:  u.holdOpenTarget,
+		Source:  u.t.GetTerminalName(),
+		Msg:     "Held open by " + u.memberName(),
+		Timeout: u.holdOpenUntil,
+	})
+	// The countdown ends the state; the timeout is just a safety net.
+	u.setStateWithTimeout(StateHoldOpen, duration+time.Minute)
+	u.showHoldOpenCountdown()
+}
+
+func (u *UIControlHandler) showHoldOpenCountdown() {
+	left := u.holdOpenUntil.Sub(u.clock.Now())
+	u.t.WriteLCDLines([]string{"Holding " + string(u.holdOpenTarget) + " open",
+		FormatRemaining(left) + " left [*] Close"})
+}
+
+func (u *UIControlHandler) closeHeldDoor() {
+	log.Printf("%s: STAFF %s closes %s early", u.t.GetTerminalName(),
+		u.memberName(), u.holdOpenTarget)
+	u.backends.appEventBus.Post(&AppEvent{
+		Ev:     AppCloseRequest,
+		Target: u.holdOpenTarget,
+		Source: u.t.GetTerminalName(),
+		Msg:    "Closed by " + u.memberName(),
+	})
+}
+
+// The member in admin mode, if they still may act as one: they might have
+// been suspended, expired or removed since showing their card. If not,
+// says so and returns nil.
+func (u *UIControlHandler) actingMember() *User {
+	member := u.auth.FindUser(u.authUserCode)
+	if member == nil || member.UserLevel != LevelMember || member.Suspended ||
+		!member.InValidityPeriod(u.localNow()) {
+		u.authUserCode = ""
+		u.giveFeedback(FeedbackDenied)
+		u.t.WriteLCDLines([]string{"Admin: members only", ""})
+		u.setStateWithTimeout(StateDisplayInfoMessage, 3*time.Second)
+		return nil
+	}
+	return member
+}
+
+// Name of the member who authorized the current action.
+func (u *UIControlHandler) memberName() string {
+	if member := u.auth.FindUser(u.authUserCode); member != nil {
+		return member.Name
+	}
+	return "unknown member"
+}
+
 func (u *UIControlHandler) presentPhilanthropistActions(member *User) {
 	// Meeting 2018-10-23: Philanthropists can do same as members.
 	u.presentMemberActions(member)
@@ -315,8 +845,9 @@ func (u *UIControlHandler) displayUserInfo(user *User) {
 	} else {
 		// No contact info; this is a temporary ID that
 		// expires after some time.
-		exp := user.ExpiryDate(time.Now())
-		days_left := exp.Sub(time.Now()) / (24 * time.Hour)
+		now := u.localNow()
+		exp := user.ExpiryDate(now)
+		days_left := exp.Sub(now) / (24 * time.Hour)
 		if days_left <= 0 {
 			// Already expired; show when that happend.
 			u.t.WriteLCD(0, fmt.Sprintf("Exp %s",
@@ -332,7 +863,7 @@ func (u *UIControlHandler) displayUserInfo(user *User) {
 	}
 
 	// Second line
-	if user.InValidityPeriod(time.Now()) {
+	if user.InValidityPeriod(u.localNow()) {
 		from, to := user.AccessHours()
 		u.t.WriteLCD(1, fmt.Sprintf("Open doors [%d:00-%d:00)",
 			from, to))
@@ -343,6 +874,24 @@ func (u *UIControlHandler) displayUserInfo(user *User) {
 	u.setStateWithTimeout(StateDisplayInfoMessage, 2*time.Second)
 }
 
+// Who is ringing. Known users are shown by name, so that people inside know
+// who is waiting.
+func doorbellMessage(event *AppEvent) string {
+	switch event.Value {
+	case DoorbellOutsideHours:
+		if event.Msg == "" {
+			return "(user)" // Anonymous code.
+		}
+		return event.Msg
+	case DoorbellExpired:
+		if event.Msg == "" {
+			return "(expired)"
+		}
+		return event.Msg + " (expired)"
+	}
+	return event.Msg
+}
+
 func (u *UIControlHandler) startDoorOpenUI(target Target, message string) {
 	now := time.Now()
 
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type UIControlFixture struct {
+	mockauth *MockAuthenticator
+	mockterm *MockTerminal
+	lockdown *Lockdown
+	handler  *UIControlHandler
+}
+
+func NewUIControlFixture(t *testing.T) *UIControlFixture {
+	f := &UIControlFixture{
+		mockauth: NewMockAuthenticator(),
+		mockterm: NewMockTerminal(t),
+		lockdown: NewLockdown("", nil),
+	}
+	f.mockauth.users["member-rfid"] = &User{Name: "Root", UserLevel: LevelMember,
+		ContactInfo: "root@nb"}
+	f.mockauth.users["user-rfid"] = &User{Name: "Jon Doe", UserLevel: LevelUser}
+	f.handler = NewControlHandler(&Backends{
+		authenticator: f.mockauth,
+		appEventBus:   NewApplicationBus(),
+		lockdown:      f.lockdown,
+	})
+	f.handler.Init(f.mockterm)
+	return f
+}
+
+func (f *UIControlFixture) expectState(t *testing.T, state UIState) {
+	if f.handler.state != state {
+		t.Errorf("Expected state %d, got %d", state, f.handler.state)
+	}
+}
+
+func (f *UIControlFixture) enterAdminMenu(t *testing.T) {
+	PressKeys(f.handler, adminCommandPrefix)
+	f.expectState(t, StateAdminAwaitMember)
+	f.mockterm.expectLCD(0, "Admin: show member RFID")
+	f.handler.HandleRFID("member-rfid")
+	f.expectState(t, StateAdminMenu)
+}
+
+func TestControlTerminalFeedbackProfile(t *testing.T) {
+	f := NewUIControlFixture(t)
+	ExpectTrue(t, f.mockterm.currentColor == ColorBlue, "Blue while idle on init")
+	clock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	f.handler.clock = clock
+
+	f.handler.HandleRFID("unknown-rfid")
+	f.mockterm.expectBuzz(Buzz{"L", 500 * time.Millisecond})
+	ExpectTrue(t, f.mockterm.currentColor == ColorRed, "Red for unknown card")
+	f.handler.HandleTick()
+	ExpectTrue(t, f.mockterm.currentColor == ColorRed, "Still red")
+	clock.now = clock.now.Add(time.Second)
+	f.handler.HandleTick()
+	ExpectTrue(t, f.mockterm.currentColor == ColorBlue, "Back to idle color")
+
+	// Doors keep theirs.
+	ExpectTrue(t, DefaultFeedbackProfileFor(TargetDownstairs)[FeedbackIdle].Color == "",
+		"Doors have no idle color")
+	ExpectTrue(t, DefaultFeedbackProfileFor(TargetDownstairs)[FeedbackGranted] !=
+		f.handler.feedback[FeedbackGranted], "Control confirms differently")
+}
+
+func TestAdminCommandNeedsPrefixAndMember(t *testing.T) {
+	f := NewUIControlFixture(t)
+	PressKeys(f.handler, "*1#")
+	f.expectState(t, StateIdle)
+	PressKeys(f.handler, "0#")
+	f.expectState(t, StateIdle)
+
+	PressKeys(f.handler, "*0#")
+	f.expectState(t, StateAdminAwaitMember)
+	f.handler.HandleRFID("user-rfid")
+	f.mockterm.expectLCD(0, "Admin: members only")
+	f.expectState(t, StateDisplayInfoMessage)
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "*")
+	f.expectState(t, StateIdle)
+}
+
+func TestAdminLookupAndExpiry(t *testing.T) {
+	f := NewUIControlFixture(t)
+	expiry := time.Now().Add(48 * time.Hour)
+	f.mockauth.users["123456"] = &User{Name: "Some Guest",
+		UserLevel: LevelGuest, ValidFrom: time.Now().Add(-time.Hour),
+		ValidTo: expiry}
+	f.mockauth.allow[ACKey{"user-rfid", TargetDownstairs}] = ReasonOK
+	f.mockauth.allow[ACKey{"123456", TargetDownstairs}] = ReasonOK
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "1")
+	f.expectState(t, StateAdminLookupCode)
+	f.handler.HandleRFID("USER-RFID") // Normalized
+	f.mockterm.expectLCD(0, "Jon Doe (user)")
+	f.expectState(t, StateAdminMenu)
+
+	// Known, but no access: tell why.
+	f.mockauth.allow[ACKey{"user-rfid", TargetDownstairs}] = ReasonOutsideDaytime
+	PressKeys(f.handler, "1")
+	f.handler.HandleRFID("user-rfid")
+	f.mockterm.expectLCD(0, "Jon Doe: Outside daytime")
+
+	PressKeys(f.handler, "1")
+	f.handler.HandleRFID("nobody")
+	f.mockterm.expectLCD(0, "Unknown code")
+
+	PressKeys(f.handler, "2")
+	f.expectState(t, StateAdminExpiryCode)
+	PressKeys(f.handler, "123456")
+	f.mockterm.expectLCD(1, "******#")
+	PressKeys(f.handler, "#")
+	f.mockterm.expectLCD(0, "Expires "+expiry.Format("2006-01-02"))
+	f.expectState(t, StateAdminMenu)
+}
+
+func TestAdminLockdown(t *testing.T) {
+	f := NewUIControlFixture(t)
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "3")
+	f.expectState(t, StateLockdownChoice)
+	f.mockterm.expectLCD(0, "Lockdown: members-only?")
+	PressKeys(f.handler, "0")
+	f.mockterm.expectLCD(0, "Lockdown: all?")
+	PressKeys(f.handler, "0#")
+	ExpectTrue(t, f.lockdown.Mode() == LockdownOff, "Cycled back to off")
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "3#")
+	ExpectTrue(t, f.lockdown.Mode() == LockdownMembersOnly, "Lockdown set")
+	f.mockterm.expectLCD(0, "Lockdown: members-only")
+}
+
+func TestAdminModeTimesOut(t *testing.T) {
+	f := NewUIControlFixture(t)
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "2")
+	f.expectState(t, StateAdminExpiryCode)
+
+	f.handler.stateTimeout = time.Now().Add(-time.Second)
+	f.handler.HandleTick()
+	f.expectState(t, StateIdle)
+	ExpectTrue(t, f.handler.authUserCode == "", "Member forgotten")
+	ExpectTrue(t, f.handler.keyInput == "", "Input discarded")
+}
+
+func TestEnrollmentTimesOut(t *testing.T) {
+	f := NewUIControlFixture(t)
+	clock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	f.handler.clock = clock
+
+	f.handler.HandleRFID("member-rfid")
+	PressKeys(f.handler, "17#")
+	f.expectState(t, StateAddAwaitNewRFID)
+
+	// Still waiting just before the timeout.
+	clock.now = clock.now.Add(defaultEnrollTimeout - time.Second)
+	f.handler.HandleTick()
+	f.expectState(t, StateAddAwaitNewRFID)
+
+	clock.now = clock.now.Add(2 * time.Second)
+	f.handler.HandleTick()
+	f.expectState(t, StateIdle)
+	ExpectTrue(t, f.handler.authUserCode == "", "Member forgotten")
+	ExpectTrue(t, f.handler.newUserValidDays == 0, "Validity discarded")
+	ExpectFalse(t, f.mockterm.lcd[0] == "Swipe new user's card", "Prompt cleared")
+}
+
+func TestDisplayStateRestoredOnInit(t *testing.T) {
+	f := NewUIControlFixture(t)
+	PressKeys(f.handler, adminCommandPrefix)
+
+	reconnected := NewMockTerminal(t)
+	f.handler.Init(reconnected)
+	reconnected.expectLCD(0, "Admin: show member RFID")
+	reconnected.expectLCD(1, "[*] Cancel")
+	f.expectState(t, StateAdminAwaitMember)
+}
+
+func TestAddUserWithValidity(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "ui-validity-tests")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	handler := NewControlHandler(&Backends{
+		authenticator: auth,
+		appEventBus:   NewApplicationBus(),
+	})
+	handler.clock = mockClock
+	term := NewMockTerminal(t)
+	handler.Init(term)
+
+	handler.HandleRFID("root123")
+	PressKeys(handler, "17#")
+	term.expectLCD(1, "Valid until May 08")
+	handler.HandleRFID("abcdef12")
+	ExpectTrue(t, strings.HasPrefix(term.lcd[0], "Success! += <u0501-12"),
+		"User added")
+
+	// Without days given, there is no explicit limit.
+	PressKeys(handler, "1")
+	handler.HandleRFID("12abcdef")
+	ExpectTrue(t, auth.FindUser("12abcdef").ValidTo.IsZero(), "No expiry")
+
+	mockClock.now = mockClock.now.Add(time.Minute)
+	ExpectAuthResult(t, auth, "abcdef12", TargetUpstairs, ReasonOK)
+	mockClock.now = mockClock.now.Add(8 * 24 * time.Hour)
+	ExpectAuthResult(t, auth, "abcdef12", TargetUpstairs, ReasonExpired)
+}
+
+func TestSwipeToEnroll(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "ui-enroll-tests")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	handler := NewControlHandler(&Backends{
+		authenticator: auth,
+		appEventBus:   NewApplicationBus(),
+	})
+	handler.clock = mockClock
+	term := NewMockTerminal(t)
+	handler.Init(term)
+
+	handler.HandleRFID("root123")
+	PressKeys(handler, "130#")
+	term.expectLCD(0, "Swipe new user's card")
+
+	// The member's own card is the one in their hand.
+	handler.HandleRFID("ROOT123")
+	term.expectLCD(0, "That's your own card")
+	ExpectTrue(t, handler.state == StateAddAwaitNewRFID, "Still waiting")
+
+	handler.HandleRFID("abcdef12")
+	ExpectTrue(t, strings.HasPrefix(term.lcd[0], "Success! += <u0501-12"),
+		"User added")
+	added := auth.FindUser("abcdef12")
+	ExpectTrue(t, added != nil &&
+		added.ValidTo.Equal(time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)),
+		"Valid as typed, until midnight")
+
+	// Swiped again, right away while asked for the days.
+	PressKeys(handler, "1")
+	handler.HandleRFID("abcdef12")
+	term.expectLCD(0, "Already has "+added.Name)
+	ExpectTrue(t, handler.state == StateAddAwaitNewRFID, "Still waiting")
+	handler.HandleRFID("12abcdef")
+	ExpectTrue(t, strings.HasPrefix(term.lcd[0], "Success!"), "Other card added")
+}
+
+// Next event on the bus.
+func nextDoorEvent(t *testing.T, events AppEventChannel) *AppEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("Expected door event, got nothing")
+	}
+	return nil
+}
+
+func TestHoldDoorOpen(t *testing.T) {
+	f := NewUIControlFixture(t)
+	clock := &MockClock{now: time.Now()}
+	f.handler.clock = clock
+	f.handler.holdOpenMax = 10 * time.Minute
+	events := make(AppEventChannel, 10)
+	f.handler.backends.appEventBus.Subscribe(events)
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "4")
+	f.expectState(t, StateHoldOpenChoice)
+	f.mockterm.expectLCD(0, "Hold open: gate?")
+	PressKeys(f.handler, "0")
+	f.mockterm.expectLCD(0, "Hold open: upstairs?")
+	PressKeys(f.handler, "#")
+	f.mockterm.expectLCD(1, "[#] for 10 max")
+	PressKeys(f.handler, "45#") // More than allowed.
+	f.expectState(t, StateHoldOpen)
+
+	open := nextDoorEvent(t, events)
+	ExpectTrue(t, open.Ev == AppOpenRequest && open.Target == TargetUpstairs,
+		"Open request")
+	ExpectTrue(t, open.Timeout.Equal(clock.now.Add(10*time.Minute)),
+		"Held open for the maximum")
+	ExpectTrue(t, open.Msg == "Held open by Root", "Staff action")
+	f.mockterm.expectLCD(0, "Holding upstairs open")
+	f.mockterm.expectLCD(1, "10:00 left [*] Close")
+
+	clock.now = clock.now.Add(9*time.Minute + 30*time.Second)
+	f.handler.HandleTick()
+	f.mockterm.expectLCD(1, "0:30 left [*] Close")
+
+	// A doorbell doesn't take away the countdown.
+	f.handler.HandleAppEvent(&AppEvent{Ev: AppDoorbellTriggerEvent,
+		Target: TargetDownstairs})
+	f.expectState(t, StateHoldOpen)
+
+	clock.now = clock.now.Add(30 * time.Second)
+	f.handler.HandleTick()
+	f.expectState(t, StateIdle)
+	f.handler.backends.appEventBus.Flush()
+	select {
+	case event := <-events:
+		t.Errorf("Door closes by itself, but got %s", event.Ev)
+	default:
+	}
+}
+
+func TestHoldDoorOpenForHours(t *testing.T) {
+	f := NewUIControlFixture(t)
+	clock := &MockClock{now: time.Now()}
+	f.handler.clock = clock
+	f.handler.holdOpenMax = 24 * time.Hour
+	events := make(AppEventChannel, 10)
+	f.handler.backends.appEventBus.Subscribe(events)
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "4#")
+	f.mockterm.expectLCD(1, "[#] for 1440 max")
+	PressKeys(f.handler, "1200#") // More digits than for validity days.
+	open := nextDoorEvent(t, events)
+	ExpectTrue(t, open.Timeout.Equal(clock.now.Add(20*time.Hour)),
+		"Held open for the minutes typed")
+}
+
+func TestHoldDoorOpenCancelled(t *testing.T) {
+	f := NewUIControlFixture(t)
+	f.handler.clock = &MockClock{now: time.Now()}
+	events := make(AppEventChannel, 10)
+	f.handler.backends.appEventBus.Subscribe(events)
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "4#2#")
+	open := nextDoorEvent(t, events)
+	ExpectTrue(t, open.Ev == AppOpenRequest && open.Target == TargetDownstairs,
+		"Open request")
+	f.mockterm.expectLCD(1, "2:00 left [*] Close")
+
+	PressKeys(f.handler, "*")
+	closed := nextDoorEvent(t, events)
+	ExpectTrue(t, closed.Ev == AppCloseRequest && closed.Target == TargetDownstairs,
+		"Close request")
+	f.expectState(t, StateIdle)
+}
+
+func TestStaffActionsRecheckMember(t *testing.T) {
+	f := NewUIControlFixture(t)
+	f.handler.clock = &MockClock{now: time.Now()}
+	events := make(AppEventChannel, 10)
+	f.handler.backends.appEventBus.Subscribe(events)
+
+	// Suspended while in the admin menu: no door held open.
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "4#2")
+	f.mockauth.users["member-rfid"].Suspended = true
+	PressKeys(f.handler, "#")
+	f.mockterm.expectLCD(0, "Admin: members only")
+	f.expectState(t, StateDisplayInfoMessage)
+	f.handler.backends.appEventBus.Flush()
+	select {
+	case event := <-events:
+		t.Errorf("Expected no door event, got %s", event.Ev)
+	default:
+	}
+
+	// Removed while in the admin menu: lockdown unchanged.
+	f.mockauth.users["member-rfid"].Suspended = false
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "3")
+	f.expectState(t, StateLockdownChoice)
+	delete(f.mockauth.users, "member-rfid")
+	before := f.lockdown.Mode()
+	PressKeys(f.handler, "0#")
+	f.mockterm.expectLCD(0, "Admin: members only")
+	ExpectTrue(t, f.lockdown.Mode() == before, "Lockdown unchanged")
+}
+
+func TestHoldDoorOpenInMaintenance(t *testing.T) {
+	f := NewUIControlFixture(t)
+	f.handler.clock = &MockClock{now: time.Now()}
+	maintenance := NewMaintenance(nil)
+	maintenance.Set(TargetDownstairs, true, "test")
+	f.handler.backends.maintenance = maintenance
+	events := make(AppEventChannel, 10)
+	f.handler.backends.appEventBus.Subscribe(events)
+
+	f.enterAdminMenu(t)
+	PressKeys(f.handler, "4#2#")
+	f.mockterm.expectLCD(1, "In maintenance")
+	f.expectState(t, StateDisplayInfoMessage)
+	f.handler.backends.appEventBus.Flush()
+	select {
+	case event := <-events:
+		t.Errorf("Expected no door event, got %s", event.Ev)
+	default:
+	}
+}
@@ -4,14 +4,24 @@
 // can be not set, which means no expiry limit).
 //
 // This has one exception: if there is no contact info associated (yet), it will expire
-// after 30 days.
+// ValidityPeriodAnonymousCards (default: 30 days) after registration.
+//
+// Periods in days are reckoned in local days: they end at local midnight,
+// not at the time of day they started, and not at midnight UTC. Times in
+// the file are UTC though, so that they read back the same whatever the
+// timezone.
 package main
 
 import (
+	"bufio"
 	"encoding/csv"
+	"fmt"
+	"io"
 	"log"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 type Level string
@@ -40,20 +50,27 @@ const (
 
 	// A user with 24/7 access to the space, but who cannot add users.
 	LevelPhilanthropist = Level("philanthropist")
-)
 
-const (
-	// Cards that don't have a name or contact info assigned to them are
-	// only valid for a limited period, as it otherwise is hard to find
-	// the right code if it is stolen/lost or needs revocation.
-	// Thus, these will expire automatically.
-	//
-	// Cards, that have been registered via the LCD ui will not have contact info
-	// so they need to be renewed regularly or someone has to simply add contact
-	// info to make them valid permanently.
-	ValidityPeriodAnonymousCards = 30 * 24 * time.Hour
+	// A guest with a temporary code created by a member. Only valid
+	// until ValidTo, and removed from the file after that.
+	LevelGuest = Level("guest")
 )
 
+// Cards that don't have a name or contact info assigned to them are
+// only valid for a limited period, as it otherwise is hard to find
+// the right code if it is stolen/lost or needs revocation.
+// Thus, these will expire automatically; the period is measured from
+// RegisteredAt.
+//
+// Cards, that have been registered via the LCD ui will not have contact info
+// so they need to be renewed regularly or someone has to simply add contact
+// info to make them valid permanently.
+//
+// Configurable with the -anon-validity flag.
+var ValidityPeriodAnonymousCards = DefaultValidityPeriodAnonymousCards
+
+const DefaultValidityPeriodAnonymousCards = 30 * 24 * time.Hour
+
 // Note: all Codes are stores as hashAuthCode() defined in authenticator.go
 type User struct {
 	// Name of user.
@@ -69,46 +86,342 @@ type User struct {
 	ValidFrom   time.Time // E.g. for temporary classes pin
 	ValidTo     time.Time // for anonymous tokens, day visitors or temp PIN
 	Codes       []string  // List of (hashed) codes associated with user
+
+	// Optional restrictions. Empty means: no restriction.
+	AllowedTargets []Target // Entrances this user may open
+	AllowedFloors  []int    // Floors this user may select in the elevator
+
+	// When the user was registered or last renewed. Anonymous users
+	// expire some time after this.
+	RegisteredAt time.Time
+
+	// Free-form note, e.g. who a guest or extra card is for.
+	Comment string
+
+	// When the user was last granted access. Updated in memory on each
+	// access and only written to the file from time to time.
+	LastAccess time.Time
+
+	// Access suspended, e.g. for unpaid dues, independent of the level.
+	Suspended bool
+
+	// (Hashed) codes to use when forced to open the door. They work
+	// exactly like the user's Codes, but silently alert the admins.
+	DuressCodes []string
+
+	// Optional daily caps, e.g. for trial memberships: entries per day
+	// and time after the first entry of the day. 0 means no cap. See
+	// daily-limit.go
+	DailyEntries int
+	DailyBudget  time.Duration
 }
 
 // User CSV
 // Fields are stored in the sequence as they appear in the struct, with arrays
-// being represented as semicolon separated lists.
-// Create a new user read from a CSV reader
-func NewUserFromCSV(reader *csv.Reader) (user *User, done bool) {
-	line, err := reader.Read()
+// being represented as semicolon separated lists. The fields after Codes
+// are optional, so older files with 7 fields are still valid.
+//
+// Files we write start with a schema marker and a header naming the
+// columns, both looking like comments to older versions:
+//
+//	# earl-users schema 2
+//	#name,contact-info,level,sponsors,valid-from,valid-to,codes,...
+//
+// The header is recognized by naming the level and codes columns. With a
+// header, columns are found by name, so they can come in any order,
+// optional ones can be missing and unknown ones are ignored. Files without
+// header (schema 1) are read by position.
+//
+// Other lines starting with '#' are comments and can contain anything,
+// commas and quotes included. They're kept in place when the file is
+// rewritten, as are the lines of users that didn't change (if the columns
+// are in the order we write them).
+const UserCSVSchema = 2
+
+const userCSVSchemaMarker = "# earl-users schema"
+
+// Column names in the sequence we write them; also the positions in
+// files without header.
+var userCSVColumns = []string{
+	"name", "contact-info", "level", "sponsors", "valid-from", "valid-to",
+	"codes", "allowed-targets", "allowed-floors", "registered-at",
+	"comment", "last-access", "suspended", "duress-codes",
+	"daily-entries", "daily-budget",
+}
+
+// Reads users from a CSV file, with or without header.
+type UserCSVReader struct {
+	reader   *csv.Reader
+	filter   *csvCommentFilter
+	schema   int            // As given in the file; 1 if not.
+	columns  map[string]int // Position of each column in a line.
+	err      error          // Why the last line gave no user.
+	line     int            // Where the last record started.
+	comments []string       // Before the last record.
+	raw      string         // The last record as in the file.
+}
+
+func NewUserCSVReader(in io.Reader) *UserCSVReader {
+	filter := &csvCommentFilter{in: bufio.NewReader(in)}
+	reader := csv.NewReader(filter)
+	reader.FieldsPerRecord = -1 //variable length fields
+	r := &UserCSVReader{
+		reader:  reader,
+		filter:  filter,
+		schema:  1,
+		columns: make(map[string]int),
+	}
+	for i, name := range userCSVColumns {
+		r.columns[name] = i
+	}
+	return r
+}
+
+// The schema version of the file read so far.
+func (r *UserCSVReader) Schema() int {
+	return r.schema
+}
+
+// True if all columns are where WriteCSV() puts them, so that lines
+// written by it can be appended.
+func (r *UserCSVReader) InWriteOrder() bool {
+	for i, name := range userCSVColumns {
+		if pos, ok := r.columns[name]; !ok || pos != i {
+			return false
+		}
+	}
+	return true
+}
+
+// Why the last Next() returned no user. Nil for the regular end of the
+// file.
+func (r *UserCSVReader) Err() error {
+	return r.err
+}
+
+// The line in the file the last Next() read from.
+func (r *UserCSVReader) Line() int {
+	return r.line
+}
+
+// The comment lines between the previous and the last Next(), as they
+// are in the file; at the end, those after the last user. Without the
+// schema marker and header, which are written anew anyway.
+func (r *UserCSVReader) Comments() []string {
+	return r.comments
+}
+
+// The last record read, exactly as in the file, including the line end.
+func (r *UserCSVReader) Raw() string {
+	return r.raw
+}
+
+// Read the next user. Returns nil for lines without user, such as
+// unparseable lines, and done at the end of the file. Comment lines are
+// skipped; see Comments().
+func (r *UserCSVReader) Next() (user *User, done bool) {
+	r.err = nil
+	first := len(r.filter.lines)
+	r.filter.record = r.filter.record[:0]
+	line, err := r.reader.Read()
+	if first < len(r.filter.lines) {
+		r.line = r.filter.lines[first]
+	}
+	r.raw = string(r.filter.record)
+	r.comments = nil
+	for _, comment := range r.filter.takeComments() {
+		if !r.parseSchemaOrHeader(comment) {
+			r.comments = append(r.comments, comment)
+		}
+	}
 	if err != nil {
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			// Tell the line in the file, not the one csv saw.
+			parseErr.StartLine = r.filter.fileLine(parseErr.StartLine)
+			parseErr.Line = r.filter.fileLine(parseErr.Line)
+		}
+		if err != io.EOF {
+			r.err = err
+		}
 		return nil, true
 	}
-	if len(line) != 7 {
+	if len(line) <= r.columns["codes"] || len(line) <= r.columns["level"] {
+		r.err = fmt.Errorf("too few fields (%d)", len(line))
 		return nil, false
 	}
-	// comment
-	firstElement := strings.TrimSpace(line[0])
-	if len(firstElement) > 0 && firstElement[0] == '#' {
-		return nil, false
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok && i < len(line) {
+			return line[i]
+		}
+		return ""
 	}
-	level := line[2]
-	ValidFrom, _ := time.Parse("2006-01-02 15:04", line[4])
-	ValidTo, _ := time.Parse("2006-01-02 15:04", line[5])
+	level := field("level")
+	ValidFrom := parseUserTime(field("valid-from"))
+	ValidTo := parseUserTime(field("valid-to"))
 	if !isValidLevel(level) {
 		log.Printf("Got invalid level '%s'", level)
+		r.err = fmt.Errorf("invalid level '%s'", level)
 		return nil, false
 	}
-	return &User{
-			Name:        line[0],
-			ContactInfo: line[1],
-			UserLevel:   Level(level),
-			Sponsors:    strings.Split(line[3], ";"),
-			ValidFrom:   ValidFrom, // field 4
-			ValidTo:     ValidTo,   // field 5
-			Codes:       strings.Split(line[6], ";")},
-		false
+	user = &User{
+		Name:        field("name"),
+		ContactInfo: field("contact-info"),
+		UserLevel:   Level(level),
+		Sponsors:    strings.Split(field("sponsors"), ";"),
+		ValidFrom:   ValidFrom,
+		ValidTo:     ValidTo,
+		Codes:       strings.Split(field("codes"), ";")}
+	if targets := field("allowed-targets"); targets != "" {
+		for _, target := range strings.Split(targets, ";") {
+			user.AllowedTargets = append(user.AllowedTargets, Target(target))
+		}
+	}
+	if floors := field("allowed-floors"); floors != "" {
+		for _, floor := range strings.Split(floors, ";") {
+			value, err := strconv.Atoi(floor)
+			if err != nil {
+				log.Printf("Got invalid floor '%s' for '%s'", floor, user.Name)
+				r.err = fmt.Errorf("invalid floor '%s'", floor)
+				return nil, false
+			}
+			user.AllowedFloors = append(user.AllowedFloors, value)
+		}
+	}
+	user.RegisteredAt = parseUserTime(field("registered-at"))
+	user.Comment = field("comment")
+	user.LastAccess = parseUserTime(field("last-access"))
+	user.Suspended = (field("suspended") == "suspended")
+	if duress := field("duress-codes"); duress != "" {
+		user.DuressCodes = strings.Split(duress, ";")
+	}
+	if entries := field("daily-entries"); entries != "" {
+		value, err := strconv.Atoi(entries)
+		if err != nil || value < 0 {
+			log.Printf("Got invalid daily entries '%s' for '%s'", entries, user.Name)
+			r.err = fmt.Errorf("invalid daily entries '%s'", entries)
+			return nil, false
+		}
+		user.DailyEntries = value
+	}
+	if budget := field("daily-budget"); budget != "" {
+		value, err := time.ParseDuration(budget)
+		if err != nil || value < 0 {
+			log.Printf("Got invalid daily budget '%s' for '%s'", budget, user.Name)
+			r.err = fmt.Errorf("invalid daily budget '%s'", budget)
+			return nil, false
+		}
+		user.DailyBudget = value
+	}
+	return user, false
+}
+
+// Comment lines can be the schema marker or the header. Returns false for
+// other comments.
+func (r *UserCSVReader) parseSchemaOrHeader(comment string) bool {
+	line, err := csv.NewReader(strings.NewReader(comment)).Read()
+	if err != nil {
+		return false // Just a comment, if one with stray quotes.
+	}
+	first := strings.TrimSpace(line[0])
+	if strings.HasPrefix(first, userCSVSchemaMarker) {
+		schema, err := strconv.Atoi(strings.TrimSpace(
+			strings.TrimPrefix(first, userCSVSchemaMarker)))
+		if err != nil {
+			log.Printf("Invalid schema marker '%s'", first)
+			return false
+		}
+		if schema > UserCSVSchema {
+			// Still try our best: we'd rather let people in with
+			// what we understand than lock everyone out.
+			log.Printf("User file has schema %d, newer than ours (%d). "+
+				"Unknown columns are ignored.", schema, UserCSVSchema)
+		}
+		r.schema = schema
+		return true
+	}
+	// It's the header if it names the columns we can't do without.
+	columns := make(map[string]int)
+	for i, name := range line {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			name = strings.TrimSpace(strings.TrimPrefix(name, "#"))
+		}
+		if _, known := columns[name]; !known {
+			columns[name] = i
+		}
+	}
+	for _, required := range []string{"level", "codes"} {
+		if _, ok := columns[required]; !ok {
+			return false // Just a comment.
+		}
+	}
+	r.columns = columns
+	return true
+}
+
+// Hands encoding/csv the file without the comment lines, which it would
+// otherwise try to make sense of: a quote in a comment would end the
+// file. They're collected for the UserCSVReader instead.
+// Only hands out a line per Read(), so that csv doesn't read ahead and we
+// know which comments came before which record.
+type csvCommentFilter struct {
+	in       *bufio.Reader
+	pending  []byte   // Rest of the line currently handed out.
+	lineNo   int      // Lines read from the file so far.
+	lines    []int    // Line in the file of each line handed out.
+	record   []byte   // Lines handed out since reset by the reader.
+	comments []string // Since the last takeComments().
+}
+
+func (f *csvCommentFilter) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		line, err := f.in.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		f.lineNo++
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if trimmed[0] == '#' {
+			f.comments = append(f.comments, strings.TrimRight(line, "\r\n"))
+			continue
+		}
+		f.lines = append(f.lines, f.lineNo)
+		f.record = append(f.record, line...)
+		f.pending = []byte(line)
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *csvCommentFilter) takeComments() []string {
+	result := f.comments
+	f.comments = nil
+	return result
+}
+
+// The line in the file of the given line handed out (counting from 1).
+func (f *csvCommentFilter) fileLine(line int) int {
+	if line < 1 || line > len(f.lines) {
+		return f.lineNo
+	}
+	return f.lines[line-1]
+}
+
+// Write the schema marker and the header. Goes first in the file.
+func WriteUserCSVHeader(writer *csv.Writer) {
+	writer.Write([]string{fmt.Sprintf("%s %d", userCSVSchemaMarker, UserCSVSchema)})
+	header := append([]string{}, userCSVColumns...)
+	header[0] = "#" + header[0]
+	writer.Write(header)
 }
 
 func isValidLevel(input string) bool {
 	switch input {
-	case "member", "user", "fulltimeuser", "hiatus", "philanthropist":
+	case "member", "user", "fulltimeuser", "hiatus", "philanthropist", "guest":
 		return true
 	default:
 		return false
@@ -116,6 +429,18 @@ func isValidLevel(input string) bool {
 	return false // Make old compilers happy.
 }
 
+const userTimeFormat = "2006-01-02 15:04"
+
+// Times in the file are UTC; zero if empty or unparseable.
+func parseUserTime(value string) time.Time {
+	t, _ := time.Parse(userTimeFormat, value)
+	return t
+}
+
+func formatUserTime(t time.Time) string {
+	return t.UTC().Format(userTimeFormat)
+}
+
 func (user *User) WriteCSV(writer *csv.Writer) {
 	var fields []string = make([]string, 7)
 	fields[0] = user.Name
@@ -123,12 +448,48 @@ func (user *User) WriteCSV(writer *csv.Writer) {
 	fields[2] = string(user.UserLevel)
 	fields[3] = strings.Join(user.Sponsors, ";")
 	if !user.ValidFrom.IsZero() {
-		fields[4] = user.ValidFrom.Format("2006-01-02 15:04")
+		fields[4] = formatUserTime(user.ValidFrom)
 	}
 	if !user.ValidTo.IsZero() {
-		fields[5] = user.ValidTo.Format("2006-01-02 15:04")
+		fields[5] = formatUserTime(user.ValidTo)
 	}
 	fields[6] = strings.Join(user.Codes, ";")
+	// Only write the optional fields if needed.
+	if len(user.AllowedTargets) > 0 || len(user.AllowedFloors) > 0 ||
+		!user.RegisteredAt.IsZero() || user.Comment != "" ||
+		!user.LastAccess.IsZero() || user.Suspended ||
+		len(user.DuressCodes) > 0 || user.HasDailyLimit() {
+		var targets, floors []string
+		for _, target := range user.AllowedTargets {
+			targets = append(targets, string(target))
+		}
+		for _, floor := range user.AllowedFloors {
+			floors = append(floors, strconv.Itoa(floor))
+		}
+		registered := ""
+		if !user.RegisteredAt.IsZero() {
+			registered = formatUserTime(user.RegisteredAt)
+		}
+		lastAccess := ""
+		if !user.LastAccess.IsZero() {
+			lastAccess = formatUserTime(user.LastAccess)
+		}
+		suspended := ""
+		if user.Suspended {
+			suspended = "suspended"
+		}
+		entries, budget := "", ""
+		if user.DailyEntries > 0 {
+			entries = strconv.Itoa(user.DailyEntries)
+		}
+		if user.DailyBudget > 0 {
+			budget = user.DailyBudget.String()
+		}
+		fields = append(fields,
+			strings.Join(targets, ";"), strings.Join(floors, ";"),
+			registered, user.Comment, lastAccess, suspended,
+			strings.Join(user.DuressCodes, ";"), entries, budget)
+	}
 	writer.Write(fields)
 }
 
@@ -138,7 +499,47 @@ func (user *User) HasContactInfo() bool {
 	// the LCD-frontend, so are _not_ considered 'has a name'
 	return user != nil &&
 		user.Name != "" && user.Name[0] != '<' &&
-		user.ContactInfo != ""
+		NormalizeContactInfo(user.ContactInfo) != ""
+}
+
+// Contact info without surrounding whitespace. Contact info without any
+// letter or digit, e.g. " " or "-" typed to get past a form, is no
+// contact info at all and returned as empty string.
+func NormalizeContactInfo(contact string) string {
+	contact = strings.TrimSpace(contact)
+	for _, r := range contact {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return contact
+		}
+	}
+	return ""
+}
+
+// Check that the contact info looks like an email address or a phone
+// number. Other contact info works, but is probably a typo.
+func ValidateContactInfo(contact string) error {
+	if at := strings.Index(contact, "@"); at > 0 {
+		domain := contact[at+1:]
+		if strings.Contains(domain, ".") && !strings.ContainsAny(domain, "@ ") &&
+			!strings.ContainsAny(contact[:at], " ") {
+			return nil
+		}
+		return fmt.Errorf("'%s' is not a valid email address", contact)
+	}
+	digits := 0
+	for _, r := range contact {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case strings.ContainsRune("+-() ./", r):
+		default:
+			return fmt.Errorf("'%s' is neither an email address nor a phone number", contact)
+		}
+	}
+	if digits < 7 {
+		return fmt.Errorf("'%s' is too short for a phone number", contact)
+	}
+	return nil
 }
 
 func (user *User) InValidityPeriod(now time.Time) bool {
@@ -147,17 +548,46 @@ func (user *User) InValidityPeriod(now time.Time) bool {
 		(expires.IsZero() || expires.After(now))
 }
 
+// The user's ValidTo passed less than grace ago, but they'd be let in
+// otherwise: members whose dues lapsed still get in for a while, with a
+// reminder to renew. Not for codes expiring for lack of contact info.
+func (user *User) InRenewalGrace(now time.Time, grace time.Duration) bool {
+	if grace <= 0 || user.ValidTo.IsZero() || user.InValidityPeriod(now) {
+		return false
+	}
+	if !user.ValidFrom.IsZero() && !user.ValidFrom.Before(now) {
+		return false // Not valid yet.
+	}
+	if !user.ExpiryDate(now).Equal(user.ValidTo) {
+		return false
+	}
+	return now.Before(user.ValidTo.Add(grace))
+}
+
 // Return when code expires. If the returned date IsZero(), there is no limit.
 // Even if there is no explicit user.ValidTo
-// limited when there is no contact info 30 days after creation
+// limited when there is no contact info ValidityPeriodAnonymousCards after
+// registration.
+// Days are counted in the location of now, so pass the local time.
 func (user *User) ExpiryDate(now time.Time) time.Time {
 	result := user.ValidTo
 	if !user.HasContactInfo() {
-		if user.ValidFrom.IsZero() {
+		registered := user.RegisteredAt
+		if registered.IsZero() {
+			// Before we had RegisteredAt, this was the creation time.
+			registered = user.ValidFrom
+		}
+		if registered.IsZero() {
 			log.Println("No start-date for temp code.")
 			return now.Add(-24 * time.Hour) // in the past
 		}
-		anonLimit := user.ValidFrom.Add(ValidityPeriodAnonymousCards)
+		var anonLimit time.Time
+		if period := ValidityPeriodAnonymousCards; period%(24*time.Hour) == 0 {
+			anonLimit = startOfDayAfter(registered.In(now.Location()),
+				int(period/(24*time.Hour)))
+		} else {
+			anonLimit = registered.Add(period)
+		}
 		if result.IsZero() || anonLimit.Before(result) {
 			result = anonLimit
 		}
@@ -165,6 +595,52 @@ func (user *User) ExpiryDate(now time.Time) time.Time {
 	return result
 }
 
+// Local midnight starting the day that is the given number of days after
+// t, in the location of t. With daylight saving changes, that day is not
+// always 24 hours away.
+func startOfDayAfter(t time.Time, days int) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day+days, 0, 0, 0, 0, t.Location())
+}
+
+// Time until the code expires (see ExpiryDate()); expires is false if it
+// doesn't.
+func (user *User) RemainingValidity(now time.Time) (remaining time.Duration, expires bool) {
+	expiry := user.ExpiryDate(now)
+	if expiry.IsZero() {
+		return 0, false
+	}
+	return expiry.Sub(now), true
+}
+
+// Returns true if the user may access the given target. Users without
+// AllowedTargets may access all.
+func (user *User) MayAccessTarget(target Target) bool {
+	if len(user.AllowedTargets) == 0 {
+		return true
+	}
+	for _, allowed := range user.AllowedTargets {
+		if allowed == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the user may select the given floor in the elevator.
+// Users without AllowedFloors may select all.
+func (user *User) MayAccessFloor(floor int) bool {
+	if len(user.AllowedFloors) == 0 {
+		return true
+	}
+	for _, allowed := range user.AllowedFloors {
+		if allowed == floor {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns the interval in hours this user may open doors. Includes from,
 // excludes to [from...to). So (7, 22) means >= 7:00 && < 22
 func (user *User) AccessHours() (from int, to int) {
@@ -175,6 +651,8 @@ func (user *User) AccessHours() (from int, to int) {
 		return 0, 24 // all access
 	case LevelFulltimeUser:
 		return 7, 24 // 7:00 .. 23:59
+	case LevelGuest:
+		return 0, 24 // limited by validity period instead
 	case LevelUser:
 		return 11, 22 // 11:00 .. 21:59
 	}
@@ -195,6 +673,23 @@ func (user *User) SetAuthCode(code string) bool {
 	return true
 }
 
+// Like SetAuthCode(), but for the ID of an RFID card, which is normalized
+// first (see NormalizeRFID()). Cards of our own Wiegand facilities are
+// enrolled by card number only (see wiegand.go).
+func (user *User) SetRFIDCode(rfid string) bool {
+	return user.SetAuthCode(rfidEnrollmentCode(NormalizeRFID(rfid)))
+}
+
+// Set the code to type when forced to open the door. Same criteria as
+// SetAuthCode().
+func (user *User) SetDuressCode(code string) bool {
+	if !hasMinimalCodeRequirements(code) {
+		return false
+	}
+	user.DuressCodes = []string{hashAuthCode(code)}
+	return true
+}
+
 func CanLevelModify(l Level) bool {
 	// Philanthropist are allowed to renew user tokens.
 	switch l {
@@ -204,6 +699,11 @@ func CanLevelModify(l Level) bool {
 	return false
 }
 
+// Only members can suspend and unsuspend users.
+func CanLevelSuspend(l Level) bool {
+	return l == LevelMember
+}
+
 func CanLevelAddDelete(l Level) bool {
 	switch l {
 	// Meeting 2018-10-23: Philanthropists also can add new
@@ -212,3 +712,18 @@ func CanLevelAddDelete(l Level) bool {
 	}
 	return false
 }
+
+// Whether a user of level "actor" can add a user of level "level". Nobody
+// can hand out more access than they have: philanthropists only add users
+// with less access than themselves. Members, and everyone else with 24/7
+// access, are only added by members.
+func CanLevelAddLevel(actor Level, level Level) bool {
+	if !CanLevelAddDelete(actor) {
+		return false
+	}
+	switch level {
+	case LevelUser, LevelFulltimeUser, LevelGuest, LevelHiatus:
+		return true
+	}
+	return actor == LevelMember
+}
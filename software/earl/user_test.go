@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAllUsers(t *testing.T, content string) (*UserCSVReader, []*User) {
+	reader := NewUserCSVReader(strings.NewReader(content))
+	var users []*User
+	for {
+		user, done := reader.Next()
+		if done {
+			break
+		}
+		if user != nil {
+			users = append(users, user)
+		}
+	}
+	return reader, users
+}
+
+func TestReadHeaderlessUserFile(t *testing.T) {
+	reader, users := readAllUsers(t, `# Comment,with,multi,comma,foo,bar,x
+old,old@nb,member,,,,abc
+new,new@nb,user,,2024-01-01 10:00,,def;ghi,upstairs,3,,a comment,,suspended
+`)
+	ExpectTrue(t, reader.Schema() == 1, "No schema marker")
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 users, got %d", len(users))
+	}
+	ExpectTrue(t, users[0].Name == "old" && users[0].Codes[0] == "abc",
+		"Seven field line")
+	ExpectTrue(t, users[1].UserLevel == LevelUser, "Level")
+	ExpectTrue(t, users[1].ValidFrom.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)),
+		"ValidFrom")
+	ExpectTrue(t, len(users[1].Codes) == 2, "Codes")
+	ExpectTrue(t, users[1].MayAccessTarget(TargetUpstairs) &&
+		!users[1].MayAccessTarget(TargetDownstairs), "AllowedTargets")
+	ExpectTrue(t, users[1].Comment == "a comment", "Comment")
+	ExpectTrue(t, users[1].Suspended, "Suspended")
+}
+
+func TestReadUserFileWithHeader(t *testing.T) {
+	// Columns reordered, optional ones missing, and one we don't know.
+	reader, users := readAllUsers(t, `# earl-users schema 2
+#codes,level,favorite-color,name,suspended
+abc,member,green,Jane
+def,user,blue,Joe,suspended
+`)
+	ExpectTrue(t, reader.Schema() == 2, "Schema marker")
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 users, got %d", len(users))
+	}
+	ExpectTrue(t, users[0].Name == "Jane" && users[0].UserLevel == LevelMember &&
+		users[0].Codes[0] == "abc", "Fields by name")
+	ExpectTrue(t, users[0].ContactInfo == "" && users[0].ValidTo.IsZero(),
+		"Missing columns are empty")
+	ExpectFalse(t, users[0].Suspended, "Short line")
+	ExpectTrue(t, users[1].Name == "Joe" && users[1].Suspended, "Second user")
+
+	// Without the essential columns, it's just a comment.
+	_, users = readAllUsers(t, "#name,contact-info\nroot,root@nb,member,,,,abc\n")
+	ExpectTrue(t, len(users) == 1 && users[0].Codes[0] == "abc",
+		"Still read by position")
+}
+
+func TestContactInfo(t *testing.T) {
+	now := time.Now()
+	user := User{Name: "Jon Doe", RegisteredAt: now}
+	for _, blank := range []string{"", "   ", "\t", " - ", "--", "."} {
+		user.ContactInfo = blank
+		ExpectFalse(t, user.HasContactInfo(), "Blank contact '"+blank+"'")
+		ExpectFalse(t, user.ExpiryDate(now).IsZero(), "Blank contact expires")
+	}
+	user.ContactInfo = " jon@example.org "
+	ExpectTrue(t, user.HasContactInfo(), "Has contact")
+	ExpectTrue(t, user.ExpiryDate(now).IsZero(), "Contact doesn't expire")
+	ExpectTrue(t, NormalizeContactInfo(user.ContactInfo) == "jon@example.org",
+		"Trimmed")
+
+	for _, valid := range []string{"jon@example.org", "+1 (415) 555-0100",
+		"415.555.0100"} {
+		ExpectTrue(t, ValidateContactInfo(valid) == nil, valid)
+	}
+	for _, invalid := range []string{"jon@example", "jon doe@example.org",
+		"jon@@example.org", "555-010", "ask at the front desk"} {
+		ExpectTrue(t, ValidateContactInfo(invalid) != nil, invalid)
+	}
+}
@@ -0,0 +1,149 @@
+// Wiegand readers report a facility code and a card number instead of a
+// single opaque ID. The terminal passes them on as "<facility>:<card>"
+// (decimal), and that is also how we match them: the same card number
+// under two different facilities is a different card.
+//
+// Cards of our own facilities (-facilities) are enrolled by card number
+// only, as ":<card>", and match that card number from any of these
+// facilities. This is useful if the facility is re-issued or readers are
+// configured differently.
+//
+// Some readers pass on the raw Wiegand frame instead, as a string of bits
+// ('0' and '1'), with the terminal configured for its format ("rfid-format",
+// e.g. "wiegand26"). On a noisy line, bits get flipped; the length and the
+// two parity bits of the frame tell, and corrupt frames are discarded
+// instead of being looked up as some other card.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Facility codes of the cards issued for our space.
+var SiteFacilities = map[int]bool{}
+
+// Layout of a raw Wiegand frame: a leading even parity bit over the first
+// half of the data bits, the facility code, the card number, and a trailing
+// odd parity bit over the second half.
+type WiegandFormat struct {
+	name         string
+	facilityBits int
+	cardBits     int
+}
+
+var (
+	Wiegand26 = &WiegandFormat{"wiegand26", 8, 16}
+	Wiegand34 = &WiegandFormat{"wiegand34", 16, 16}
+)
+
+// The format of raw frames with the given name; nil for "", where the
+// terminal reports decoded IDs.
+func ParseRFIDFormat(name string) (*WiegandFormat, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case Wiegand26.name:
+		return Wiegand26, nil
+	case Wiegand34.name:
+		return Wiegand34, nil
+	}
+	return nil, fmt.Errorf("unknown rfid-format '%s'; one of '%s', '%s'",
+		name, Wiegand26.name, Wiegand34.name)
+}
+
+// Check the parity of a frame of bits and return its "<facility>:<card>".
+func (f *WiegandFormat) Decode(frame string) (string, error) {
+	dataBits := f.facilityBits + f.cardBits
+	if len(frame) != dataBits+2 {
+		return "", fmt.Errorf("%s frame needs %d bits, got %d",
+			f.name, dataBits+2, len(frame))
+	}
+	ones := 0 // In the frame up to here.
+	var data uint64
+	for i := 0; i < len(frame); i++ {
+		switch frame[i] {
+		case '0':
+		case '1':
+			ones++
+		default:
+			return "", fmt.Errorf("%s frame has '%c' for a bit", f.name, frame[i])
+		}
+		if i > 0 && i <= dataBits {
+			data = data<<1 | uint64(frame[i]-'0')
+		}
+		if i == dataBits/2 && ones%2 != 0 {
+			return "", fmt.Errorf("%s frame fails even parity", f.name)
+		}
+		if i == dataBits/2 {
+			ones = 0 // The second half starts with the next bit.
+		}
+	}
+	if ones%2 != 1 {
+		return "", fmt.Errorf("%s frame fails odd parity", f.name)
+	}
+	card := int(data & (1<<uint(f.cardBits) - 1))
+	facility := int(data >> uint(f.cardBits))
+	return formatWiegand(facility, card), nil
+}
+
+// Parse a comma separated list of facility codes.
+func ParseFacilities(list string) (map[int]bool, error) {
+	result := make(map[int]bool)
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		facility, err := strconv.Atoi(value)
+		if err != nil || facility < 0 {
+			return nil, fmt.Errorf("invalid facility code '%s'", value)
+		}
+		result[facility] = true
+	}
+	return result, nil
+}
+
+// Parse a "<facility>:<card>" ID. Returns ok=false for other IDs.
+func ParseWiegand(rfid string) (facility int, card int, ok bool) {
+	// Not strings.Split(): this is on the path of every lookup.
+	sep := strings.IndexByte(rfid, ':')
+	if sep < 0 || strings.IndexByte(rfid[sep+1:], ':') >= 0 {
+		return 0, 0, false
+	}
+	facility, err := strconv.Atoi(rfid[:sep])
+	if err != nil || facility < 0 {
+		return 0, 0, false
+	}
+	card, err = strconv.Atoi(rfid[sep+1:])
+	if err != nil || card < 0 {
+		return 0, 0, false
+	}
+	return facility, card, true
+}
+
+func formatWiegand(facility int, card int) string {
+	return fmt.Sprintf("%d:%d", facility, card)
+}
+
+func facilityScopedCode(card int) string {
+	return fmt.Sprintf(":%d", card)
+}
+
+// The codes a user with the given (normalized) RFID might be enrolled
+// with, most specific first.
+func rfidLookupCodes(rfid string) []string {
+	facility, card, ok := ParseWiegand(rfid)
+	if !ok || !SiteFacilities[facility] {
+		return []string{rfid}
+	}
+	return []string{rfid, facilityScopedCode(card)}
+}
+
+// The code to store when enrolling the given (normalized) RFID.
+func rfidEnrollmentCode(rfid string) string {
+	if facility, card, ok := ParseWiegand(rfid); ok && SiteFacilities[facility] {
+		return facilityScopedCode(card)
+	}
+	return rfid
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func TestParseWiegand(t *testing.T) {
+	facility, card, ok := ParseWiegand("12:3456")
+	ExpectTrue(t, ok && facility == 12 && card == 3456, "Facility and card")
+	_, _, ok = ParseWiegand("abcd1234")
+	ExpectFalse(t, ok, "Plain ID is not Wiegand")
+	_, _, ok = ParseWiegand("12:34:56")
+	ExpectFalse(t, ok, "Too many parts")
+	_, _, ok = ParseWiegand("x:3456")
+	ExpectFalse(t, ok, "Facility not a number")
+	ExpectTrue(t, NormalizeRFID(" 012:03456 ") == "12:3456", "Canonical form")
+
+	terminal := &SerialTerminal{}
+	rfid, ok := terminal.parseRFIDResponse("I12:3456")
+	ExpectTrue(t, ok && rfid == "12:3456", "Wiegand from terminal")
+	rfid, ok = terminal.parseRFIDResponse("I4 abcd1234")
+	ExpectTrue(t, ok && rfid == "abcd1234", "Plain ID from terminal")
+	_, ok = terminal.parseRFIDResponse("I12:x")
+	ExpectFalse(t, ok, "Malformed Wiegand")
+}
+
+func TestRawWiegandFrames(t *testing.T) {
+	rfid, err := Wiegand26.Decode("00000110000001101100000001")
+	ExpectTrue(t, err == nil && rfid == "12:3456", "Valid 26 bit frame")
+	rfid, err = Wiegand34.Decode("0000000010010110011010100001100010")
+	ExpectTrue(t, err == nil && rfid == "300:54321", "Valid 34 bit frame")
+
+	_, err = Wiegand26.Decode("00000010000001101100000001")
+	ExpectTrue(t, err != nil, "Bit flipped in the first half")
+	_, err = Wiegand26.Decode("00000110000001101100000011")
+	ExpectTrue(t, err != nil, "Bit flipped in the second half")
+	_, err = Wiegand26.Decode("0000011000000110110000000")
+	ExpectTrue(t, err != nil, "Bit missing")
+	_, err = Wiegand26.Decode("0000011000000110110000000x")
+	ExpectTrue(t, err != nil, "Not a bit")
+
+	terminal := &SerialTerminal{rfidFormat: Wiegand26, logger: &Logger{}}
+	rfid, ok := terminal.parseRFIDResponse("I00000110000001101100000001")
+	ExpectTrue(t, ok && rfid == "12:3456", "Valid frame from terminal")
+	_, ok = terminal.parseRFIDResponse("I00000010000001101100000001")
+	ExpectFalse(t, ok, "Corrupt frame discarded")
+
+	_, err = ParseRFIDFormat("wiegand37")
+	ExpectTrue(t, err != nil, "Unknown format")
+	format, err := ParseRFIDFormat("")
+	ExpectTrue(t, err == nil && format == nil, "IDs by default")
+}
+
+func TestSameCardInDifferentFacilities(t *testing.T) {
+	defer func() { SiteFacilities = map[int]bool{} }()
+	authFile, _ := ioutil.TempFile("", "wiegand-tests")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	u := User{Name: "Facility 10", ContactInfo: "ten@nb", UserLevel: LevelMember}
+	ExpectTrue(t, u.SetRFIDCode("10:1234"), "Short Wiegand IDs are ok")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	u = User{Name: "Facility 20", ContactInfo: "twenty@nb", UserLevel: LevelMember}
+	u.SetRFIDCode("20:1234")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)),
+		"Same card number in other facility is a different card")
+
+	ExpectTrue(t, auth.FindUser("10:1234").Name == "Facility 10", "Facility 10")
+	ExpectTrue(t, auth.FindUser("20:1234").Name == "Facility 20", "Facility 20")
+	ExpectAuthResult(t, auth, "30:1234", TargetUpstairs, ReasonUnknownCode)
+	ExpectAuthResult(t, auth, "1234", TargetUpstairs, ReasonUnknownCode)
+
+	// Cards of our own facilities are enrolled by card number.
+	SiteFacilities, _ = ParseFacilities("40, 41")
+	u = User{Name: "Our card", ContactInfo: "our@nb", UserLevel: LevelMember}
+	u.SetRFIDCode("40:5678")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding scoped user")
+	ExpectAuthResult(t, auth, "40:5678", TargetUpstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "41:5678", TargetUpstairs, ReasonOK)
+	ExpectAuthResult(t, auth, "42:5678", TargetUpstairs, ReasonUnknownCode)
+	ExpectAuthResult(t, auth, "10:1234", TargetUpstairs, ReasonOK)
+
+	// Plain IDs keep working.
+	u = User{Name: "Mifare", ContactInfo: "m@nb", UserLevel: LevelMember}
+	u.SetRFIDCode("ABCD1234")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding plain ID")
+	ExpectAuthResult(t, auth, "abcd1234", TargetUpstairs, ReasonOK)
+}
@@ -189,9 +189,10 @@ public:
 
   // Returns current line, '\0' terminated, newline stripped.
   const char *line() const { return buffer_; }
+  char *mutable_line() { return buffer_; }
 
 private:
-  char buffer_[32 + 1];
+  char buffer_[64 + 1];  // Enough for both LCD rows in one 'W' command.
   char *pos_;
 };
 
@@ -213,6 +214,7 @@ static void SendHelp(SerialCom *out) {
            "# Lower case: read state\r\n"
            "#\t?\tThis help\r\n"
            "#\tn\tGet persistent name.\r\n"
+           "#\tv\tGet firmware version.\r\n"
 #if FEATURE_RFID_DEBUG
            "#\tr\tShow MFRC522 registers.\r\n"
 #endif
@@ -223,6 +225,7 @@ static void SendHelp(SerialCom *out) {
 #if FEATURE_LCD
            // We either support the LCD or the LED on that port
            "#\tM<n><msg> Write msg on LCD-line n=0,1.\r\n"
+           "#\tW<msg0>\\t<msg1> Write both LCD-lines at once.\r\n"
 #else
            "#\tL[<R|G|B>] Set (combination of) LED Red/Green/Blue.\r\n"
 #endif
@@ -288,6 +291,8 @@ static void PrintTerminalName(SerialCom *com) {
 #endif
 }
 
+// Acknowledges right away: the tone plays in the background, so the host
+// is never kept waiting for the duration of the tone.
 static void OutputTone(SerialCom *com, const char *line) {
   uint16_t duration = parseDec(line + 2);
   if (duration == 0) duration = 250;
@@ -437,6 +442,20 @@ int main() {
           println(&comm, _P("E row number must be 0 or 1"));
         }
         break;
+      case 'W': {
+        // Both rows in one go, separated by a tab: saves a round-trip.
+        char *const row0 = lineBuffer.mutable_line() + 1;
+        char *row1 = strchr(row0, '\t');
+        if (row1) {
+          *row1++ = '\0';
+        } else {
+          row1 = row0 + strlen(row0);  // Empty.
+        }
+        lcd.print(0, row0);
+        lcd.print(1, row1);
+        println(&comm, _P("W ok"));
+        break;
+      }
 #else
       case 'L':
         SetLED(&comm, lineBuffer.line());
@@ -474,6 +493,10 @@ int main() {
         comm.write('n');
         PrintTerminalName(&comm);
         break;
+      case 'v':
+        comm.write('v');
+        println(&comm, _P(GIT_VERSION));
+        break;
       case '\0': // TODO: the lineBuffer sometimes returns empty lines.
         break;
       default: